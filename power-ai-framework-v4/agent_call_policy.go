@@ -0,0 +1,221 @@
+package powerai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xbalance"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xbreaker"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xcache"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"strings"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	智能体调用策略：超时、重试、熔断
+//	配置存放在调用方的通用配置中，按目标智能体编号区分，default 为所有目标的默认策略
+//	fullKey: /agent/config/_general_config_/调用方智能体编号/企业ID/agent-call-policy
+//	value: {
+//	         "default": {"timeout_ms":600000,"max_retries":2,"retry_backoff_ms":200,"failure_threshold":5,"open_timeout_ms":30000,"half_open_max_calls":1},
+//	         "power-ai-triage": {"timeout_ms":30000}
+//	}
+//	未配置的字段使用上一级的值：目标智能体 -> default -> 框架默认值
+//	重试只针对建立连接失败的情况，请求已发出后不再重试，避免下游重复处理
+//
+// ***************************************************************************************************************
+
+// CallPolicy 调用目标智能体的策略
+type CallPolicy struct {
+	TimeoutMs        int `json:"timeout_ms"`          // 单次调用的总超时，流式调用包含整个流
+	MaxRetries       int `json:"max_retries"`         // 连接失败时的最大重试次数
+	RetryBackoffMs   int `json:"retry_backoff_ms"`    // 重试退避基数，第n次重试等待 base*2^(n-1)
+	FailureThreshold int `json:"failure_threshold"`   // 连续失败多少次后熔断，<=0 表示不熔断
+	OpenTimeoutMs    int `json:"open_timeout_ms"`     // 熔断持续时间，到期后进入半开
+	HalfOpenMaxCalls int `json:"half_open_max_calls"` // 半开状态允许的探测请求数
+}
+
+var defaultCallPolicy = CallPolicy{
+	TimeoutMs:        600000,
+	MaxRetries:       2,
+	RetryBackoffMs:   200,
+	FailureThreshold: 5,
+	OpenTimeoutMs:    30000,
+	HalfOpenMaxCalls: 1,
+}
+
+func (p CallPolicy) timeout() time.Duration {
+	return time.Duration(p.TimeoutMs) * time.Millisecond
+}
+
+func (p CallPolicy) backoff(retry int) time.Duration {
+	return time.Duration(p.RetryBackoffMs) * time.Millisecond << (retry - 1)
+}
+
+func (p CallPolicy) breakerSettings() xbreaker.Settings {
+	return xbreaker.Settings{
+		FailureThreshold: p.FailureThreshold,
+		OpenTimeout:      time.Duration(p.OpenTimeoutMs) * time.Millisecond,
+		HalfOpenMaxCalls: p.HalfOpenMaxCalls,
+	}
+}
+
+type agentCallGuard struct {
+	// key:企业ID，value:目标智能体编号 -> 原始策略配置，未配置时缓存空map，避免每次调用都查询etcd
+	policies *xcache.Cache[string, map[string]json.RawMessage]
+	// key:目标智能体编号/企业ID，策略按企业配置，熔断器也按企业区分
+	breakers *xcache.Cache[string, *xbreaker.Breaker]
+}
+
+func breakerKey(agentCode, enterpriseId string) string {
+	return agentCode + "/" + enterpriseId
+}
+
+func newAgentCallGuard() *agentCallGuard {
+	return &agentCallGuard{
+		policies: xcache.NewCache[string, map[string]json.RawMessage](),
+		breakers: xcache.NewCache[string, *xbreaker.Breaker](),
+	}
+}
+
+// onConfigChange 调用策略变更时清空缓存，下次调用重新加载
+func (g *agentCallGuard) onConfigChange(key string) {
+	if !strings.HasSuffix(key, "/"+AgentCallPolicyKey) {
+		return
+	}
+	for _, k := range g.policies.Keys() {
+		g.policies.Delete(k)
+	}
+}
+
+// GetAgentCallPolicy 获取调用目标智能体的策略
+func (a *AgentApp) GetAgentCallPolicy(agentCode, enterpriseId string) CallPolicy {
+	raw, ok := a.callGuard.policies.Get(enterpriseId)
+	if !ok {
+		raw = make(map[string]json.RawMessage)
+		if c := a.GetAgentConfig(AgentCallPolicyKey, enterpriseId); c != nil && c.Value != "" {
+			if err := json.Unmarshal([]byte(c.Value), &raw); err != nil {
+				xlog.LogErrorF("10000", "agent-call", "policy", fmt.Sprintf("解析[%s]配置失败", AgentCallPolicyKey), err)
+			}
+		}
+		a.callGuard.policies.Set(enterpriseId, raw)
+	}
+
+	p := defaultCallPolicy
+	for _, k := range []string{"default", agentCode} {
+		if v, ok := raw[k]; ok {
+			if err := json.Unmarshal(v, &p); err != nil {
+				xlog.LogErrorF("10000", "agent-call", "policy", fmt.Sprintf("解析[%s]中[%s]的策略失败", AgentCallPolicyKey, k), err)
+			}
+		}
+	}
+	return p
+}
+
+func (g *agentCallGuard) breaker(agentCode, enterpriseId string, p CallPolicy) *xbreaker.Breaker {
+	key := breakerKey(agentCode, enterpriseId)
+	b, ok := g.breakers.Get(key)
+	if !ok {
+		b = xbreaker.New(p.breakerSettings())
+		g.breakers.Set(key, b)
+		return b
+	}
+	b.Update(p.breakerSettings())
+	return b
+}
+
+// isConnectError 是否为建立连接失败，此时请求未发出，可以安全重试
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// callAgent 按调用策略调用目标智能体
+// fn 每次尝试时调用，in 为本次选中的实例，ctx 在 parent 基础上携带本次调用的超时
+// 只有 fn 返回连接错误时才会重新选择实例重试
+func (a *AgentApp) callAgent(parent context.Context, agentCode, enterpriseId string, fn func(ctx context.Context, in *xbalance.Instance) error) error {
+	policy := a.GetAgentCallPolicy(agentCode, enterpriseId)
+	breaker := a.callGuard.breaker(agentCode, enterpriseId, policy)
+	if err := breaker.Allow(); err != nil {
+		return fmt.Errorf("智能体[%s]已熔断,err: %w", agentCode, err)
+	}
+
+	ctx, cancel := context.WithTimeout(parent, policy.timeout())
+	defer cancel()
+
+	var err error
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			xlog.LogInfoF("10000", "agent-call", "retry", fmt.Sprintf("调用智能体[%s]连接失败,第%d次重试,原因：%v", agentCode, retry, err))
+			select {
+			case <-time.After(policy.backoff(retry)):
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		var in *xbalance.Instance
+		in, err = a.agentClient.pick(agentCode)
+		if err != nil {
+			err = fmt.Errorf("获取智能体[%s]实例信息失败,失败：%w", agentCode, err)
+			break
+		}
+		in.Acquire()
+		err = fn(ctx, in)
+		in.Release()
+		if err != nil && parent.Err() != nil {
+			// 调用方主动取消，不计入实例失败
+			break
+		}
+		a.agentClient.done(agentCode, in, err)
+
+		if err == nil || !isConnectError(err) || retry >= policy.MaxRetries {
+			break
+		}
+	}
+
+	if err != nil && parent.Err() != nil {
+		// 调用方主动取消（如客户端断开），不计入熔断统计
+		breaker.Release()
+		logCanceled(parent, "callAgent", err)
+		return err
+	}
+	breaker.Done(err == nil)
+	if breaker.State() == xbreaker.StateOpen && err != nil {
+		xlog.LogErrorF("10000", "agent-call", "breaker", fmt.Sprintf("调用智能体[%s]失败,熔断器已打开", agentCode), err)
+	}
+	return err
+}
+
+// circuitBreakers 查询调用其他智能体的熔断器状态，key 为 目标智能体编号/企业ID
+// 传入 enterprise_id 时只返回该企业的熔断器
+func (a *AgentApp) circuitBreakers(c *gin.Context) {
+	filter := c.Query("enterprise_id")
+	data := make(map[string]interface{})
+	for _, key := range a.callGuard.breakers.Keys() {
+		agentCode, enterpriseId, _ := strings.Cut(key, "/")
+		if filter != "" && enterpriseId != filter {
+			continue
+		}
+		b, ok := a.callGuard.breakers.Get(key)
+		if !ok {
+			continue
+		}
+		data[key] = map[string]interface{}{
+			"breaker": b.Snapshot(),
+			"policy":  a.GetAgentCallPolicy(agentCode, enterpriseId),
+		}
+	}
+	c.JSON(200, map[string]interface{}{
+		"code":    server.ResultSuccess.Code,
+		"message": server.ResultSuccess.Message,
+		"data":    data,
+	})
+}
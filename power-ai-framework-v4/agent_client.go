@@ -5,8 +5,13 @@ import (
 	"fmt"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"orgine.com/ai-team/power-ai-framework-v4/middleware/etcd"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xbalance"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xcache"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xhttp"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xjson"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -22,72 +27,104 @@ import (
 //				"port":"",
 //              "version":"",
 //              "code":"",
-//              "name":""
+//              "name":"",
+//              "weight":""   权重，加权轮询使用，默认1
 //			}
 // ***************************************************************************************************************
 
 type AgentClient struct {
-	etcd      *etcd_mw.Etcd                   //即用方式,无需循环etcd状态
-	instances *xcache.Cache[string, []string] // key:agent_code,value:ip:port
-	counters  *xcache.Cache[string, uint64]
+	etcd          ConfigStore                                 //即用方式,无需循环etcd状态
+	instances     *xcache.Cache[string, []*xbalance.Instance] // key:agent_code,value:实例列表
+	balancer      xbalance.Balancer                           // 负载均衡策略
+	health        *xbalance.HealthTracker                     // 被动健康检查
+	probeInterval time.Duration                               // 被摘除实例的探活间隔
+	probeClient   *xhttp.HttpClient                           // 探活使用的http客户端
+	weight        int                                         // 本实例注册的权重
+	leaseID       atomic.Int64                                // 当前注册使用的租约ID
+	stopped       atomic.Bool                                 // 是否已注销，注销后不再重新注册
+	watcher       *prefixWatcher                              // 监听 /service/instance/
 }
 
-func newAgentClient(etcd *etcd_mw.Etcd) *AgentClient {
+func newAgentClient(etcd ConfigStore, opts *Options) *AgentClient {
+	probeClient := xhttp.NewHttpClientWithConfig(&xhttp.HttpClientConfig{
+		HandshakeTimeout: 3 * time.Second,
+		ResponseTimeout:  3 * time.Second,
+	})
+	probeClient.Client.Timeout = 3 * time.Second
+
 	a := &AgentClient{
-		etcd:      etcd,
-		instances: xcache.NewCache[string, []string](),
-		counters:  xcache.NewCache[string, uint64](),
+		etcd:          etcd,
+		instances:     xcache.NewCache[string, []*xbalance.Instance](),
+		balancer:      opts.Balancer,
+		health:        xbalance.NewHealthTracker(opts.MaxInstanceFailures),
+		probeInterval: opts.ProbeInterval,
+		probeClient:   probeClient,
+		weight:        opts.InstanceWeight,
 	}
-	a.loadAll()
-	go a.watch()
+	a.watcher = newPrefixWatcher(etcd, "agent-instance", AgentInstancePrefixKey, a.handleEvent, a.resync)
+	go a.watcher.run()
+	go a.probe()
 	return a
 }
 
-func (i *AgentClient) loadAll() {
-
-	// 判断etcd是否初始化
-	if i.etcd == nil {
-		return
+// parseInstance 解析etcd中的注册信息
+func parseInstance(value []byte) (string, *xbalance.Instance, error) {
+	etcdValue := make(map[string]string)
+	if err := json.Unmarshal(value, &etcdValue); err != nil {
+		return "", nil, err
 	}
+	weight, _ := strconv.Atoi(etcdValue["weight"])
+	return etcdValue["code"], xbalance.NewInstance(etcdValue["ip"], etcdValue["port"], weight), nil
+}
 
-	// 调用etcd，通过前缀获取所有的注册实例
-	ev, err := i.etcd.GetByPrefix(AgentInstancePrefixKey)
-	// 判断etcd是否调用成功
-	if err != nil {
-		return
+// mergeInstances 用最新的实例列表替换缓存，相同地址复用已有实例，保留处理中请求数和健康状态
+func (i *AgentClient) mergeInstances(agentCode string, fresh []*xbalance.Instance) {
+	old, _ := i.instances.Get(agentCode)
+	exists := make(map[string]*xbalance.Instance, len(old))
+	for _, in := range old {
+		exists[in.Addr] = in
 	}
-
-	// 判断返回结果是否为空
-	if len(ev) == 0 {
-		return
+	merged := make([]*xbalance.Instance, 0, len(fresh))
+	for _, in := range fresh {
+		if o, ok := exists[in.Addr]; ok {
+			// 复用原实例的处理中请求数和健康状态，原实例可能正被负载均衡读取，不直接修改
+			in = o.WithWeight(in.Weight)
+		}
+		merged = append(merged, in)
 	}
+	i.instances.Set(agentCode, merged)
+}
 
-	// 对结果进行循环，如果发现是本地服务，那么优先使用，逻辑：优先调用本地智能体，如果一个都没命中，那么就取最后一个用的
-	for _, v := range ev {
-
-		etcdValue := make(map[string]string)
-		if err = json.Unmarshal([]byte(v.Value), &etcdValue); err != nil {
+// resync 使用etcd中的全部注册实例替换缓存，已下线智能体的实例列表清空
+func (i *AgentClient) resync(kvs []*etcd_mw.EtcdValue, _ int64, _ bool) {
+	grouped := make(map[string][]*xbalance.Instance)
+	for _, v := range kvs {
+		agentCode, in, err := parseInstance([]byte(v.Value))
+		if err != nil {
 			continue
 		}
-		agentCode := etcdValue["code"]
-		addrs, _ := i.instances.Get(agentCode)
-		addrs = append(addrs, fmt.Sprintf("%s:%s", etcdValue["ip"], etcdValue["port"]))
-		i.instances.Set(agentCode, addrs)
+		grouped[agentCode] = append(grouped[agentCode], in)
+	}
+	for agentCode, ins := range grouped {
+		i.mergeInstances(agentCode, ins)
+	}
+	for _, agentCode := range i.instances.Keys() {
+		if _, ok := grouped[agentCode]; !ok {
+			i.instances.Set(agentCode, nil)
+		}
 	}
-
-	return
 }
 
-func (i *AgentClient) get(agentCode string) (string, error) {
+// pick 按负载均衡策略选择一个可用实例，被摘除的实例不参与选择
+func (i *AgentClient) pick(agentCode string) (*xbalance.Instance, error) {
 
-	addr := i.next(agentCode)
-	if addr != "" {
-		return addr, nil
+	if in := i.next(agentCode); in != nil {
+		return in, nil
 	}
 
 	// 判断etcd是否初始化
 	if i.etcd == nil {
-		return "", fmt.Errorf("etcd 未初始化")
+		return nil, fmt.Errorf("etcd 未初始化")
 	}
 
 	// 获取etcd和本地缓存存储的key
@@ -96,62 +133,85 @@ func (i *AgentClient) get(agentCode string) (string, error) {
 	ev, err := i.etcd.GetByPrefix(key)
 	// 判断etcd是否调用成功
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// 判断返回结果是否为空
 	if len(ev) == 0 {
-		return "", fmt.Errorf("etcd 返回结果为空")
+		return nil, fmt.Errorf("etcd 返回结果为空")
 	}
 
-	var etcdAddrs []string
-	// 对结果进行循环，如果发现是本地服务，那么优先使用，逻辑：优先调用本地智能体，如果一个都没命中，那么就取最后一个用的
+	var fresh []*xbalance.Instance
 	for _, v := range ev {
-		etcdValue := make(map[string]string)
-		if err = json.Unmarshal([]byte(v.Value), &etcdValue); err != nil {
+		_, in, err := parseInstance([]byte(v.Value))
+		if err != nil {
 			continue
 		}
-		etcdAddrs = append(etcdAddrs, fmt.Sprintf("%s:%s", etcdValue["ip"], etcdValue["port"]))
+		fresh = append(fresh, in)
 	}
+	i.mergeInstances(agentCode, fresh)
 
-	i.instances.Set(agentCode, etcdAddrs)
-
-	addr = i.next(agentCode)
-	if addr == "" {
-		return "", fmt.Errorf("未发现可用地址")
+	in := i.next(agentCode)
+	if in == nil {
+		return nil, fmt.Errorf("未发现可用地址")
 	}
 
-	return addr, nil
+	return in, nil
 }
 
-// next 选择一个合理的服务地址,轮询方案
-func (i *AgentClient) next(agentCode string) string {
-	// 获取etcd和本地缓存存储的key
-	//key := getEtcdServiceInstancePrefixKey(agentCode)
+// next 从缓存的实例列表中按负载均衡策略选择
+func (i *AgentClient) next(agentCode string) *xbalance.Instance {
 	// 优先从缓存中获取地址列表
-	addrs, ok := i.instances.Get(agentCode)
-	if !ok || len(addrs) <= 0 {
-		return ""
+	ins, ok := i.instances.Get(agentCode)
+	if !ok || len(ins) <= 0 {
+		return nil
+	}
+	return i.balancer.Pick(agentCode, i.health.Available(ins))
+}
+
+// done 上报一次调用结果，连续失败达到阈值的实例会被摘除，等待探活恢复
+func (i *AgentClient) done(agentCode string, in *xbalance.Instance, err error) {
+	if err == nil {
+		i.health.ReportSuccess(in)
+		return
+	}
+	if i.health.ReportFailure(in) {
+		xlog.LogErrorF("10000", "agent-client", "eject", fmt.Sprintf("智能体[%s]实例[%s]连续失败%d次，已摘除", agentCode, in.Addr, in.Failures()), err)
 	}
-	// 存在地址,轮询访问
-	idx := i.getAndIncrementCounter(agentCode) % uint64(len(addrs))
-	return addrs[idx]
 }
 
-// getAndIncrementCounter 获取并递增服务的计数器（线程安全）
-func (i *AgentClient) getAndIncrementCounter(agentCode string) uint64 {
-	// 先尝试直接获取并递增
-	if count, ok := i.counters.Get(agentCode); ok {
-		// 使用原子操作确保线程安全
-		newCount := atomic.AddUint64(&count, 1)
-		// 更新缓存中的值
-		i.counters.Set(agentCode, newCount)
-		return count // 返回递增前的值作为索引
+// probe 定期对被摘除的实例调用 /health 探活，成功则恢复
+func (i *AgentClient) probe() {
+	if i.probeInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(i.probeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if i.stopped.Load() {
+			return
+		}
+		for _, agentCode := range i.instances.Keys() {
+			ins, _ := i.instances.Get(agentCode)
+			for _, in := range i.health.Ejected(ins) {
+				if i.probeOnce(agentCode, in.Addr) {
+					i.health.Recover(in)
+					xlog.LogInfoF("10000", "agent-client", "probe", fmt.Sprintf("智能体[%s]实例[%s]探活成功，已恢复", agentCode, in.Addr))
+				}
+			}
+		}
 	}
+}
 
-	// 首次访问，初始化为1（因为已经使用了一次）
-	i.counters.Set(agentCode, 1)
-	return 0 // 首次调用返回0
+func (i *AgentClient) probeOnce(agentCode, addr string) bool {
+	resp, err := i.probeClient.SendReqByRespString(&xhttp.HttpRequest{
+		RawURL: GetAgentHealthUrl(addr, agentCode),
+		Method: "GET",
+	})
+	if err != nil {
+		return false
+	}
+	return xjson.Get(resp, "code").String() == server.ResultSuccess.Code
 }
 
 func (i *AgentClient) register(ip, port, agentCode, agentName, agentVersion string) {
@@ -161,9 +221,10 @@ func (i *AgentClient) register(ip, port, agentCode, agentName, agentVersion stri
 		"version": agentVersion,
 		"code":    agentCode,
 		"name":    agentName,
+		"weight":  strconv.Itoa(i.weight),
 	}
 	b, _ := json.Marshal(&m)
-	for {
+	for !i.stopped.Load() {
 		key := GetServiceInstanceFullKey(agentCode, ip, port)
 		//  put key 并且 创建续租
 		leaseID, err := i.etcd.GrantAndSet(60, key, string(b))
@@ -180,6 +241,7 @@ func (i *AgentClient) register(ip, port, agentCode, agentName, agentVersion stri
 			continue
 		}
 
+		i.leaseID.Store(int64(leaseID))
 		xlog.LogInfoF("10000", "agent-register", "register", fmt.Sprintf("[%s]注册成功并开始自动续约", key))
 
 		//  监听续约响应
@@ -189,32 +251,59 @@ func (i *AgentClient) register(ip, port, agentCode, agentName, agentVersion stri
 				break // 退出循环，重新注册
 			}
 		}
+		if i.stopped.Load() {
+			// 主动注销，退出续约
+			xlog.LogInfoF("10000", "agent-register", "register", fmt.Sprintf("[%s]已注销，停止续约", key))
+			return
+		}
 		//  如果到这里，说明租约失效或网络异常，重新注册
 		time.Sleep(2 * time.Second)
 	}
 }
 
+// deregister 注销服务实例，撤销租约使 /service/instance/{code}/ip:port 立即删除，
+// 调用方不必等待60秒租约过期
+func (i *AgentClient) deregister() {
+	if i.stopped.Swap(true) {
+		return
+	}
+	leaseID := clientv3.LeaseID(i.leaseID.Load())
+	if leaseID == 0 || i.etcd == nil {
+		return
+	}
+	if err := i.etcd.Revoke(leaseID); err != nil {
+		xlog.LogErrorF("10000", "agent-register", "deregister", fmt.Sprintf("撤销租约[%d]失败", leaseID), err)
+		return
+	}
+	xlog.LogInfoF("10000", "agent-register", "deregister", fmt.Sprintf("撤销租约[%d]成功，服务实例已注销", leaseID))
+}
+
 func (i *AgentClient) update(value []byte) {
-	etcdValue := make(map[string]string)
-	if err := json.Unmarshal(value, &etcdValue); err != nil {
+	agentCode, in, err := parseInstance(value)
+	if err != nil {
 		return
 	}
-	v, ok := i.instances.Get(etcdValue["code"])
+	v, ok := i.instances.Get(agentCode)
 	if !ok {
 		// 不存在表示 此服务没有访问过这个服务，不进行存储
 		return
 	}
-	// update地址
-	updateAddr := fmt.Sprintf("%s:%s", etcdValue["ip"], etcdValue["port"])
 
-	for _, addr := range v {
-		if addr == updateAddr {
-			//这个地址存在则直接返回
-			return
+	fresh := make([]*xbalance.Instance, 0, len(v)+1)
+	found := false
+	for _, o := range v {
+		if o.Addr == in.Addr {
+			// 这个地址存在则更新权重
+			fresh = append(fresh, in)
+			found = true
+			continue
 		}
+		fresh = append(fresh, o)
+	}
+	if !found {
+		fresh = append(fresh, in)
 	}
-	v = append(v, updateAddr)
-	i.instances.Set(etcdValue["code"], v)
+	i.mergeInstances(agentCode, fresh)
 }
 
 func (i *AgentClient) delete(key string) {
@@ -226,29 +315,21 @@ func (i *AgentClient) delete(key string) {
 	delCode := codeAndAddr[0]
 	delAddr := codeAndAddr[1]
 
-	addrs, _ := i.instances.Get(delCode)
-	var newAddrs []string
-	for _, addr := range addrs {
-		if addr != delAddr {
-			newAddrs = append(newAddrs, addr)
+	ins, _ := i.instances.Get(delCode)
+	var newIns []*xbalance.Instance
+	for _, in := range ins {
+		if in.Addr != delAddr {
+			newIns = append(newIns, in)
 		}
 	}
-	i.instances.Set(delCode, newAddrs)
+	i.instances.Set(delCode, newIns)
 }
 
-func (i *AgentClient) watch() {
-	rch, err := i.etcd.WatchPrefixKey(AgentInstancePrefixKey)
-	if err != nil {
-		xlog.LogErrorF("10000", "agent-client", "watch", fmt.Sprintf("监听[%s]失败", AgentInstancePrefixKey), err)
-		return
-	}
-	for wresp := range rch {
-		for _, ev := range wresp.Events {
-			if ev.Type == clientv3.EventTypePut {
-				i.update(ev.Kv.Value)
-			} else if ev.Type == clientv3.EventTypeDelete {
-				i.delete(string(ev.Kv.Key))
-			}
-		}
+// handleEvent 处理监听到的实例注册和下线
+func (i *AgentClient) handleEvent(ev *clientv3.Event) {
+	if ev.Type == clientv3.EventTypePut {
+		i.update(ev.Kv.Value)
+	} else if ev.Type == clientv3.EventTypeDelete {
+		i.delete(string(ev.Kv.Key))
 	}
 }
@@ -6,7 +6,10 @@ import (
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"orgine.com/ai-team/power-ai-framework-v4/middleware/etcd"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xcache"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xconfig"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -58,9 +61,29 @@ import (
 //              "update_time":""
 //    }
 //
+//  四、配置类型
+//     智能体默认配置通过 conf_type 声明类型：string、int、float、bool、json、prompt，Schema 声明取值约束
+//     注册时校验默认值，etcd 中本智能体的配置更新时按声明校验，校验失败的更新被拒绝，继续使用原配置
+//     未声明或历史类型（text、intention 等）不校验
+//
+//  五、默认配置注册
+//     只创建etcd中不存在的配置，运维修改过的配置不会被覆盖；默认配置的 version 大于etcd中配置的 version 时覆盖
+//     WithConfigHistory 开启后配置的每次修改记录到 ai_config_history 表，可以按版本回滚
 //
 // ***************************************************************************************************************
 
+const (
+	ConfTypeString = string(xconfig.TypeString)
+	ConfTypeInt    = string(xconfig.TypeInt)
+	ConfTypeFloat  = string(xconfig.TypeFloat)
+	ConfTypeBool   = string(xconfig.TypeBool)
+	ConfTypeJSON   = string(xconfig.TypeJSON)
+	ConfTypePrompt = string(xconfig.TypePrompt)
+)
+
+// ConfigSchema 配置值约束
+type ConfigSchema = xconfig.ValueSchema
+
 type Config struct {
 	Key        string `json:"key"`
 	Value      string `json:"value"`
@@ -71,19 +94,68 @@ type Config struct {
 	ModifyFrom string `json:"modify_from"`
 	ConfType   string `json:"conf_type"`
 	UpdateTime string `json:"update_time"`
+	// Version 默认配置的版本，大于etcd中配置的版本时注册会覆盖etcd中的配置
+	Version int `json:"version,omitempty"`
+	// Schema 默认配置的取值约束，不写入etcd
+	Schema *ConfigSchema `json:"-"`
+}
+
+// validate 按 ConfType 和 Schema 校验配置值
+func (c *Config) validate(value string) error {
+	return xconfig.ValidateValue(xconfig.ValueType(c.ConfType), value, c.Schema)
+}
+
+// validateDefaultConfigs 校验智能体默认配置
+func validateDefaultConfigs(defaultConfigs map[string]*Config) error {
+	for k, v := range defaultConfigs {
+		if err := v.validate(v.Value); err != nil {
+			return fmt.Errorf("default config [%s] is invalid: %w", k, err)
+		}
+	}
+	return nil
 }
 
 type AgentConfig struct {
-	etcd            *etcd_mw.Etcd
+	etcd            ConfigStore
 	configs         *xcache.Cache[string, *Config]
 	changeCallbacks []func(key string)
+	agentCode       string
+	declared        map[string]*Config // 默认配置，按配置key声明类型和约束
+	history         func(change *configChange)
+	subMu           sync.RWMutex
+	subs            map[*configSubscription]struct{}
+	watchers        []*prefixWatcher
 }
 
-func newAgentConfig(etcd *etcd_mw.Etcd, agentCode string, defaultConfigs map[string]*Config, changeCallbacks []func(key string)) *AgentConfig {
+// configChange etcd 中配置的一次修改
+type configChange struct {
+	Key          string
+	Action       string // put/delete/rejected
+	Revision     int64
+	PrevRevision int64
+	Value        []byte
+	PrevValue    []byte
+	Remark       string
+}
+
+func newAgentConfig(etcd ConfigStore, agentCode string, defaultConfigs map[string]*Config, changeCallbacks []func(key string), history func(change *configChange)) *AgentConfig {
 	a := &AgentConfig{
 		etcd:            etcd,
 		configs:         xcache.NewCache[string, *Config](),
 		changeCallbacks: changeCallbacks,
+		agentCode:       agentCode,
+		declared:        defaultConfigs,
+		history:         history,
+		subs:            make(map[*configSubscription]struct{}),
+	}
+	// 监听 /agent/config/_general_config_/智能体编号
+	a.addWatcher("agent-config", GetAgentConfigPrefixKey(agentCode))
+	// 监听 /system/config/_internal_
+	a.addWatcher("system-config", GetSystemConfigPrefixKey())
+	// 如果智能体是意图分类智能体那么才开启监听，防止数据过多
+	if agentCode == PowerAiDecision {
+		// 监听 /agent/config/_decision_config_
+		a.addWatcher("decision-config", GetAgentDecisionPrefixKey())
 	}
 	go func() {
 		for !a.registerAgentDefaultConfig(defaultConfigs, agentCode) {
@@ -91,23 +163,15 @@ func newAgentConfig(etcd *etcd_mw.Etcd, agentCode string, defaultConfigs map[str
 		}
 		time.Sleep(5 * time.Second)
 
-		// 监听 /agent/config/_general_config_/智能体编号
-		go a.watch(GetAgentConfigPrefixKey(agentCode))
-		// 监听 /system/config/_internal_
-		go a.watch(GetSystemConfigPrefixKey())
-
-		// 如果智能体是意图分类智能体那么才开启监听，防止数据过多
-		if agentCode == PowerAiDecision {
-			// 监听 /agent/config/_decision_config_
-			go a.watch(GetAgentDecisionPrefixKey())
+		for _, w := range a.watchers {
+			go w.run()
 		}
-
 	}()
 
 	return a
 }
 
-// 注册智能体配置 无需对比etcd上面已存在配置
+// 注册智能体配置 etcd中已存在的配置只在默认配置版本更高时覆盖
 func (a *AgentConfig) registerAgentDefaultConfig(defaultConfigs map[string]*Config, agentCode string) bool {
 	if a.etcd == nil {
 		xlog.LogErrorF("10000", "agent-config", "merge", "etcd 未初始化", nil)
@@ -116,16 +180,10 @@ func (a *AgentConfig) registerAgentDefaultConfig(defaultConfigs map[string]*Conf
 	for k, v := range defaultConfigs {
 		// 组装etcd存储的key,注册到默认配置中
 		etcdKey := GetAgentConfigFullKey(v.Classify, "", agentCode, k)
-		a.configs.Set(etcdKey, v)
-		// 从etcd获取配置
-		b, err := json.Marshal(v)
-		if err != nil {
-			xlog.LogErrorF("10000", "agent-config", "register", fmt.Sprintf("将[%s]提交到etcd", etcdKey), err)
-			continue
-		}
-		err = a.etcd.Set(etcdKey, string(b))
+		c, err := a.mergeDefaultConfig(etcdKey, v)
+		a.configs.Set(etcdKey, c)
 		if err != nil {
-			xlog.LogErrorF("10000", "agent-config", "register", fmt.Sprintf("将[%s]提交到etcd", etcdKey), err)
+			xlog.LogErrorF("10000", "agent-config", "register", fmt.Sprintf("合并[%s]默认配置失败，使用默认配置", etcdKey), err)
 			continue
 		}
 		xlog.LogInfoF("10000", "agent-config", "merge", fmt.Sprintf("从etcd获取[%s]配置数据成功", etcdKey))
@@ -133,6 +191,34 @@ func (a *AgentConfig) registerAgentDefaultConfig(defaultConfigs map[string]*Conf
 	return true
 }
 
+// mergeDefaultConfig 合并默认配置和etcd中的配置，返回生效的配置，出错时返回默认配置
+func (a *AgentConfig) mergeDefaultConfig(etcdKey string, def *Config) (*Config, error) {
+	b, err := json.Marshal(def)
+	if err != nil {
+		return def, err
+	}
+	created, err := a.etcd.SetIfNotExists(etcdKey, string(b))
+	if err != nil || created {
+		return def, err
+	}
+	v, err := a.etcd.Get(etcdKey)
+	if err != nil {
+		return def, err
+	}
+	c := &Config{}
+	if err = json.Unmarshal([]byte(v.Value), c); err != nil {
+		return def, fmt.Errorf("将etcd中的配置转换结构体失败: %w", err)
+	}
+	if def.Version > c.Version {
+		xlog.LogInfoF("10000", "agent-config", "register", fmt.Sprintf("默认配置[%s]版本%d高于etcd中的版本%d，覆盖etcd中的配置", etcdKey, def.Version, c.Version))
+		return def, a.etcd.Set(etcdKey, string(b))
+	}
+	if err = def.validate(c.Value); err != nil {
+		return def, fmt.Errorf("etcd中的配置校验失败，使用默认配置: %w", err)
+	}
+	return c, nil
+}
+
 func (a *AgentConfig) getConfigFromEtcdAndCache(key string) *Config {
 
 	// 1.查询企业配置是否存在
@@ -158,40 +244,157 @@ func (a *AgentConfig) getConfigFromEtcdAndCache(key string) *Config {
 		xlog.LogErrorF("10000", "agent-config", "get", fmt.Sprintf("将etcd获取[%s]配置转换结构体", key), err)
 		return nil
 	}
+	if err = a.validate(key, c); err != nil {
+		xlog.LogErrorF("10000", "agent-config", "get", fmt.Sprintf("etcd中[%s]配置校验失败", key), err)
+		return nil
+	}
 	a.configs.Set(key, c)
 	return c
 }
 
-// 配置监听
-func (a *AgentConfig) watch(prefixKey string) {
-	rch, err := a.etcd.WatchPrefixKey(prefixKey)
-	if err != nil {
-		xlog.LogErrorF("10000", "agent-config", "watch", fmt.Sprintf("监听[%s]失败", prefixKey), err)
+func (a *AgentConfig) addWatcher(name, prefix string) {
+	a.watchers = append(a.watchers, newPrefixWatcher(a.etcd, name, prefix, a.handleEvent, func(kvs []*etcd_mw.EtcdValue, rev int64, initial bool) {
+		a.resync(prefix, kvs, rev, initial)
+	}, clientv3.WithPrevKV()))
+}
+
+// handleEvent 处理监听到的配置修改
+func (a *AgentConfig) handleEvent(ev *clientv3.Event) {
+	key := string(ev.Kv.Key)
+	if ev.Type == clientv3.EventTypePut {
+		xlog.LogInfoF("10000", "agent-config", "update", fmt.Sprintf("更新[%s],数据:%s", key, string(ev.Kv.Value)))
+		// 配置更新
+		c := &Config{}
+		err := json.Unmarshal(ev.Kv.Value, c)
+		if err != nil {
+			xlog.LogErrorF("10000", "agent-config", "update", fmt.Sprintf("将etcd获取[%s]配置转换结构体", key), err)
+			a.recordChange(eventChange(ev, ConfigActionRejected, err.Error()))
+			return
+		}
+		if err = a.validate(key, c); err != nil {
+			// 拒绝更新，继续使用原配置
+			xlog.LogErrorF("10000", "agent-config", "update", fmt.Sprintf("[%s]配置校验失败，保留原配置", key), err)
+			a.recordChange(eventChange(ev, ConfigActionRejected, err.Error()))
+			return
+		}
+		// old 使用缓存中生效的配置，etcd 中的上一个值可能是被拒绝的修改
+		old, _ := a.configs.Get(key)
+		a.configs.Set(key, c)
+		a.publish(key, old, c)
+		a.recordChange(eventChange(ev, ConfigActionPut, ""))
+	} else if ev.Type == clientv3.EventTypeDelete {
+		// 配置删除
+		xlog.LogInfoF("10000", "agent-config", "delete", fmt.Sprintf("删除[%s]", key))
+		old, _ := a.configs.Get(key)
+		a.configs.Delete(key)
+		a.publish(key, old, nil)
+		a.recordChange(eventChange(ev, ConfigActionDelete, ""))
+	}
+}
+
+// resync 使用前缀下的全部配置同步缓存，对监听断开期间的修改发出通知并记录历史
+// 断开期间被删除的配置记录为版本 rev 的删除；启动时的第一次同步只加载配置，不通知也不删除缓存（注册失败时缓存中保留默认配置）
+func (a *AgentConfig) resync(prefix string, kvs []*etcd_mw.EtcdValue, rev int64, initial bool) {
+	fresh := make(map[string]bool, len(kvs))
+	for _, kv := range kvs {
+		fresh[kv.Key] = true
+		c := parseConfig([]byte(kv.Value))
+		if c == nil {
+			xlog.LogErrorF("10000", "agent-config", "resync", fmt.Sprintf("将etcd获取[%s]配置转换结构体", kv.Key), nil)
+			continue
+		}
+		old, cached := a.configs.Get(kv.Key)
+		if cached && sameConfig(old, c) {
+			continue
+		}
+		if err := a.validate(kv.Key, c); err != nil {
+			xlog.LogErrorF("10000", "agent-config", "resync", fmt.Sprintf("[%s]配置校验失败，保留原配置", kv.Key), err)
+			continue
+		}
+		a.configs.Set(kv.Key, c)
+		if initial {
+			continue
+		}
+		xlog.LogInfoF("10000", "agent-config", "resync", fmt.Sprintf("同步[%s],数据:%s", kv.Key, kv.Value))
+		change := &configChange{Key: kv.Key, Action: ConfigActionPut, Revision: kv.Revision, Value: []byte(kv.Value)}
+		if cached {
+			change.PrevValue, _ = json.Marshal(old)
+		} else {
+			old = nil
+		}
+		a.publish(kv.Key, old, c)
+		a.recordChange(change)
+	}
+	if initial {
 		return
 	}
-	for wresp := range rch {
-		for _, ev := range wresp.Events {
-			if ev.Type == clientv3.EventTypePut {
-				key := string(ev.Kv.Key)
-				xlog.LogInfoF("10000", "agent-config", "update", fmt.Sprintf("更新[%s],数据:%s", key, string(ev.Kv.Value)))
-				// 配置更新
-				c := &Config{}
-				err = json.Unmarshal(ev.Kv.Value, c)
-				if err != nil {
-					xlog.LogErrorF("10000", "agent-config", "update", fmt.Sprintf("将etcd获取[%s]配置转换结构体", key), err)
-				} else {
-					a.configs.Set(key, c)
-				}
-			} else if ev.Type == clientv3.EventTypeDelete {
-				// 配置删除
-				key := string(ev.Kv.Key)
-				xlog.LogInfoF("10000", "agent-config", "delete", fmt.Sprintf("删除[%s]", key))
-				a.configs.Delete(key)
-			}
-			// 发出通知
-			for _, l := range a.changeCallbacks {
-				l(string(ev.Kv.Key))
-			}
+	for _, key := range a.configs.Keys() {
+		if !strings.HasPrefix(key, prefix) || fresh[key] {
+			continue
 		}
+		old, _ := a.configs.Get(key)
+		xlog.LogInfoF("10000", "agent-config", "resync", fmt.Sprintf("同步删除[%s]", key))
+		a.configs.Delete(key)
+		a.publish(key, old, nil)
+		change := &configChange{Key: key, Action: ConfigActionDelete, Revision: rev, Remark: "resync"}
+		change.PrevValue, _ = json.Marshal(old)
+		a.recordChange(change)
+	}
+}
+
+// publish 通知订阅和 WithConfigChangeCallbacks 回调
+func (a *AgentConfig) publish(key string, old, new *Config) {
+	a.notify(key, old, new)
+	for _, l := range a.changeCallbacks {
+		l(key)
+	}
+}
+
+// recordChange 异步记录本智能体配置的修改历史，系统配置和意图配置不记录
+func (a *AgentConfig) recordChange(change *configChange) {
+	if a.history == nil || !strings.HasPrefix(change.Key, GetAgentConfigPrefixKey(a.agentCode)+"/") {
+		return
+	}
+	go a.history(change)
+}
+
+// eventChange 监听事件对应的配置修改
+func eventChange(ev *clientv3.Event, action, remark string) *configChange {
+	change := &configChange{
+		Key:      string(ev.Kv.Key),
+		Action:   action,
+		Revision: ev.Kv.ModRevision,
+		Value:    ev.Kv.Value,
+		Remark:   remark,
+	}
+	if ev.PrevKv != nil {
+		change.PrevRevision = ev.PrevKv.ModRevision
+		change.PrevValue = ev.PrevKv.Value
+	}
+	return change
+}
+
+// sameConfig 两个配置写入etcd的内容是否相同
+func sameConfig(a, b *Config) bool {
+	ja, err1 := json.Marshal(a)
+	jb, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && string(ja) == string(jb)
+}
+
+// validate 校验本智能体声明过的配置，其他配置不校验
+// key: /agent/config/_general_config_/智能体编号/企业ID/配置key
+func (a *AgentConfig) validate(key string, c *Config) error {
+	rest, ok := strings.CutPrefix(key, GetAgentConfigPrefixKey(a.agentCode)+"/")
+	if !ok {
+		return nil
+	}
+	_, k, ok := strings.Cut(rest, "/")
+	if !ok {
+		return nil
+	}
+	d, ok := a.declared[k]
+	if !ok {
+		return nil
 	}
+	return d.validate(c.Value)
 }
@@ -0,0 +1,212 @@
+package powerai
+
+import (
+	"context"
+	"fmt"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/etcd"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"sync"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	etcd 前缀监听
+//	启动时全量查询前缀并从查询时的版本号开始监听，处理过的最后版本号记录在 revision
+//	监听被取消（etcd 重启、连接的节点失去 leader）或 channel 关闭时，从 revision+1 继续监听；
+//	revision 已被压缩（compaction）时重新全量查询前缀同步缓存，删除断开期间被删除的key
+//	监听状态通过 /{base}/health 返回，停机时 stop 结束监听
+//
+// ***************************************************************************************************************
+
+// 监听状态
+const (
+	WatchStateStarting     = "starting"
+	WatchStateWatching     = "watching"
+	WatchStateResyncing    = "resyncing"
+	WatchStateReconnecting = "reconnecting"
+	WatchStateStopped      = "stopped"
+)
+
+const (
+	watchMinBackoff = time.Second
+	watchMaxBackoff = 30 * time.Second
+)
+
+// WatchStatus etcd 前缀监听的状态
+type WatchStatus struct {
+	Name           string `json:"name"`
+	Prefix         string `json:"prefix"`
+	State          string `json:"state"`
+	Revision       int64  `json:"revision"` // 已处理的最后版本号
+	Restarts       int    `json:"restarts"` // 重新监听次数
+	Resyncs        int    `json:"resyncs"`  // 全量同步次数，包括启动时的同步
+	LastEventTime  string `json:"last_event_time,omitempty"`
+	LastResyncTime string `json:"last_resync_time,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+}
+
+// Healthy 是否正常监听中
+func (s *WatchStatus) Healthy() bool {
+	return s.State == WatchStateWatching
+}
+
+type prefixWatcher struct {
+	etcd     ConfigStore
+	prefix   string
+	opts     []clientv3.OpOption
+	onEvent  func(ev *clientv3.Event)
+	onResync func(kvs []*etcd_mw.EtcdValue, rev int64, initial bool)
+
+	ctx    context.Context // stop 时取消
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	status WatchStatus
+}
+
+// newPrefixWatcher 创建前缀监听，调用 run 开始监听
+// onEvent 按版本顺序处理每个事件；onResync 使用前缀下的全部key替换缓存，rev 为查询时的版本号，initial 为启动时的第一次同步
+func newPrefixWatcher(etcd ConfigStore, name, prefix string, onEvent func(ev *clientv3.Event), onResync func(kvs []*etcd_mw.EtcdValue, rev int64, initial bool), opts ...clientv3.OpOption) *prefixWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &prefixWatcher{
+		etcd:     etcd,
+		prefix:   prefix,
+		opts:     opts,
+		onEvent:  onEvent,
+		onResync: onResync,
+		status:   WatchStatus{Name: name, Prefix: prefix, State: WatchStateStarting},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// stop 结束监听，在关闭 etcd 客户端前调用，stop 之后 run 立即返回
+func (w *prefixWatcher) stop() {
+	w.cancel()
+}
+
+func (w *prefixWatcher) run() {
+	var revision int64
+	resync, initial := true, true
+	backoff := watchMinBackoff
+	for w.ctx.Err() == nil {
+		if resync {
+			w.setState(WatchStateResyncing, nil)
+			kvs, rev, err := w.etcd.ListPrefix(w.prefix)
+			if err != nil {
+				w.fail("resync", err, &backoff)
+				continue
+			}
+			w.onResync(kvs, rev, initial)
+			revision = rev
+			resync, initial = false, false
+			w.mu.Lock()
+			w.status.Resyncs++
+			w.status.Revision = rev
+			w.status.LastResyncTime = time.Now().Format(time.DateTime)
+			w.mu.Unlock()
+		}
+
+		ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(w.ctx))
+		rch, err := w.etcd.WatchPrefixKeyCtx(ctx, w.prefix, append([]clientv3.OpOption{clientv3.WithRev(revision + 1)}, w.opts...)...)
+		if err != nil {
+			cancel()
+			w.fail("watch", err, &backoff)
+			continue
+		}
+		w.setState(WatchStateWatching, nil)
+		for wresp := range rch {
+			if wresp.CompactRevision != 0 {
+				// 断开期间的修改已被压缩，只能全量同步
+				xlog.LogErrorF("10000", "etcd-watch", "compacted", fmt.Sprintf("监听[%s]的版本%d已被压缩，重新同步", w.prefix, revision+1), wresp.Err())
+				resync = true
+				break
+			}
+			if err = wresp.Err(); err != nil {
+				break
+			}
+			backoff = watchMinBackoff
+			for _, ev := range wresp.Events {
+				w.onEvent(ev)
+				revision = ev.Kv.ModRevision
+			}
+			if wresp.IsProgressNotify() && wresp.Header.Revision > revision {
+				revision = wresp.Header.Revision
+			}
+			w.mu.Lock()
+			w.status.Revision = revision
+			if len(wresp.Events) > 0 {
+				w.status.LastEventTime = time.Now().Format(time.DateTime)
+			}
+			w.mu.Unlock()
+		}
+		cancel()
+		if w.ctx.Err() != nil {
+			break
+		}
+		if err == nil && !resync {
+			err = fmt.Errorf("watch channel closed")
+		}
+		w.mu.Lock()
+		w.status.Restarts++
+		w.mu.Unlock()
+		if err != nil {
+			w.fail("watch", err, &backoff)
+		}
+	}
+	w.setState(WatchStateStopped, nil)
+}
+
+// fail 记录错误并等待 backoff 后重试，已 stop 时不记录
+func (w *prefixWatcher) fail(title string, err error, backoff *time.Duration) {
+	if w.ctx.Err() != nil {
+		return
+	}
+	xlog.LogErrorF("10000", "etcd-watch", title, fmt.Sprintf("监听[%s]中断，%v后重试", w.prefix, *backoff), err)
+	w.setState(WatchStateReconnecting, err)
+	select {
+	case <-time.After(*backoff):
+	case <-w.ctx.Done():
+	}
+	*backoff = min(*backoff*2, watchMaxBackoff)
+}
+
+func (w *prefixWatcher) setState(state string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.State = state
+	if err != nil {
+		w.status.LastError = err.Error()
+	}
+}
+
+func (w *prefixWatcher) snapshot() *WatchStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.status
+	return &s
+}
+
+// stopWatchers 结束配置和服务实例的监听
+func (a *AgentApp) stopWatchers() {
+	for _, w := range a.agentConfig.watchers {
+		w.stop()
+	}
+	if a.agentClient.watcher != nil {
+		a.agentClient.watcher.stop()
+	}
+}
+
+// WatchStatuses etcd 配置和服务实例监听的状态
+func (a *AgentApp) WatchStatuses() []*WatchStatus {
+	var statuses []*WatchStatus
+	for _, w := range a.agentConfig.watchers {
+		statuses = append(statuses, w.snapshot())
+	}
+	if a.agentClient.watcher != nil {
+		statuses = append(statuses, a.agentClient.watcher.snapshot())
+	}
+	return statuses
+}
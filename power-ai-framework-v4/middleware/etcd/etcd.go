@@ -16,8 +16,9 @@ type Config struct {
 }
 
 type EtcdValue struct {
-	Key   string
-	Value string
+	Key      string
+	Value    string
+	Revision int64 // 最后修改的版本号
 }
 
 func New(c *Config) (*Etcd, error) {
@@ -70,6 +71,7 @@ func (e *Etcd) Get(key string) (*EtcdValue, error) {
 	}
 
 	v.Value = string(value)
+	v.Revision = resp.Kvs[0].ModRevision
 	return v, nil
 }
 
@@ -98,13 +100,38 @@ func (e *Etcd) GetByPrefix(prefix string) ([]*EtcdValue, error) {
 	}
 	for _, kv := range resp.Kvs {
 		v = append(v, &EtcdValue{
-			Key:   string(kv.Key),
-			Value: string(kv.Value),
+			Key:      string(kv.Key),
+			Value:    string(kv.Value),
+			Revision: kv.ModRevision,
 		})
 	}
 	return v, nil
 }
 
+// ListPrefix 按前缀查询key和查询时的版本号，前缀下没有key时返回空列表
+func (e *Etcd) ListPrefix(prefix string) ([]*EtcdValue, int64, error) {
+	if err := e.check(); err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, fmt.Errorf("prefix '%s' invoke err: %v", prefix, err)
+	}
+	v := make([]*EtcdValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		v = append(v, &EtcdValue{
+			Key:      string(kv.Key),
+			Value:    string(kv.Value),
+			Revision: kv.ModRevision,
+		})
+	}
+	return v, resp.Header.Revision, nil
+}
+
 // Set 将值存入etcd
 func (e *Etcd) Set(key, value string) error {
 	if err := e.check(); err != nil {
@@ -121,6 +148,25 @@ func (e *Etcd) Set(key, value string) error {
 	return nil
 }
 
+// SetIfNotExists key 不存在时写入，返回是否写入
+func (e *Etcd) SetIfNotExists(key, value string) (bool, error) {
+	if err := e.check(); err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value)).
+		Commit()
+	if err != nil {
+		return false, fmt.Errorf("set key '%s' err: %v", key, err)
+	}
+	return resp.Succeeded, nil
+}
+
 func (e *Etcd) Watch(key string) (clientv3.WatchChan, error) {
 	if err := e.check(); err != nil {
 		return nil, err
@@ -129,11 +175,16 @@ func (e *Etcd) Watch(key string) (clientv3.WatchChan, error) {
 	return ch, nil
 }
 
-func (e *Etcd) WatchPrefixKey(prefix string) (clientv3.WatchChan, error) {
+func (e *Etcd) WatchPrefixKey(prefix string, opts ...clientv3.OpOption) (clientv3.WatchChan, error) {
+	return e.WatchPrefixKeyCtx(context.Background(), prefix, opts...)
+}
+
+// WatchPrefixKeyCtx 监听前缀，ctx 结束时监听取消、channel 关闭
+func (e *Etcd) WatchPrefixKeyCtx(ctx context.Context, prefix string, opts ...clientv3.OpOption) (clientv3.WatchChan, error) {
 	if err := e.check(); err != nil {
 		return nil, err
 	}
-	ch := e.client.Watch(context.Background(), prefix, clientv3.WithPrefix())
+	ch := e.client.Watch(ctx, prefix, append([]clientv3.OpOption{clientv3.WithPrefix()}, opts...)...)
 	return ch, nil
 }
 
@@ -152,6 +203,17 @@ func (e *Etcd) GrantAndSet(ttl int64, key, value string) (clientv3.LeaseID, erro
 	return leaseResp.ID, nil
 }
 
+// Revoke 撤销租约，租约下绑定的key会被立即删除
+func (e *Etcd) Revoke(leaseId clientv3.LeaseID) error {
+	if err := e.check(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := e.client.Revoke(ctx, leaseId)
+	return err
+}
+
 func (e *Etcd) KeepAliveOnce(leaseId clientv3.LeaseID) error {
 	if err := e.check(); err != nil {
 		return err
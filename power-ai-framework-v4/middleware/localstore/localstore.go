@@ -0,0 +1,294 @@
+package localstore_mw
+
+import (
+	"context"
+	"fmt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/etcd"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ***************************************************************************************************************
+//
+//	Store 进程内的键值存储，提供与 etcd_mw.Etcd 相同的方法，用于不连接 etcd 的本地运行
+//	每次修改版本号加1，不保留历史版本：从旧版本开始的监听会收到 compaction 响应，由调用方全量同步
+//	租约不过期，Revoke 或 Close 时删除租约写入的key
+//
+// ***************************************************************************************************************
+
+// watchBuffer 监听 channel 的缓冲，消费过慢时取消监听，由调用方重新同步
+const watchBuffer = 256
+
+type Store struct {
+	mu        sync.Mutex
+	kvs       map[string]*mvccpb.KeyValue
+	loaded    map[string]bool // 通过 Load 写入的key
+	revision  int64
+	leases    map[clientv3.LeaseID]*lease
+	nextLease clientv3.LeaseID
+	watchers  map[*watcher]struct{}
+	closed    bool
+}
+
+type lease struct {
+	keys []string
+	ch   chan *clientv3.LeaseKeepAliveResponse
+}
+
+type watcher struct {
+	prefix string
+	ch     chan clientv3.WatchResponse
+}
+
+func New() *Store {
+	return &Store{
+		kvs:      make(map[string]*mvccpb.KeyValue),
+		loaded:   make(map[string]bool),
+		leases:   make(map[clientv3.LeaseID]*lease),
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// Close 关闭所有监听和租约
+func (s *Store) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for w := range s.watchers {
+		close(w.ch)
+		delete(s.watchers, w)
+	}
+	for id, l := range s.leases {
+		close(l.ch)
+		delete(s.leases, id)
+	}
+}
+
+// Load 使用 kvs 替换上次 Load 写入的key：值变化的key写入，不再存在的key删除，其他方式写入的key不受影响
+func (s *Store) Load(kvs map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if cur, ok := s.kvs[k]; !ok || string(cur.Value) != kvs[k] {
+			s.put(k, kvs[k])
+		}
+	}
+	removed := make([]string, 0)
+	for k := range s.loaded {
+		if _, ok := kvs[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(removed)
+	for _, k := range removed {
+		s.delete(k)
+	}
+	s.loaded = make(map[string]bool, len(kvs))
+	for k := range kvs {
+		s.loaded[k] = true
+	}
+}
+
+// Get 根据指定KEY查询
+func (s *Store) Get(key string) (*etcd_mw.EtcdValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kv, ok := s.kvs[key]
+	if !ok {
+		return &etcd_mw.EtcdValue{Key: key}, fmt.Errorf("key '%s' value is empty ", key)
+	}
+	return toValue(kv), nil
+}
+
+// GetByPrefix 按前缀查询key
+func (s *Store) GetByPrefix(prefix string) ([]*etcd_mw.EtcdValue, error) {
+	v, _, _ := s.ListPrefix(prefix)
+	if len(v) == 0 {
+		return nil, fmt.Errorf("prefix '%s' value is empty ", prefix)
+	}
+	return v, nil
+}
+
+// ListPrefix 按前缀查询key和当前版本号，按key排序
+func (s *Store) ListPrefix(prefix string) ([]*etcd_mw.EtcdValue, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := make([]*etcd_mw.EtcdValue, 0)
+	for k, kv := range s.kvs {
+		if strings.HasPrefix(k, prefix) {
+			v = append(v, toValue(kv))
+		}
+	}
+	sort.Slice(v, func(i, j int) bool { return v[i].Key < v[j].Key })
+	return v, s.revision, nil
+}
+
+// Set 写入key
+func (s *Store) Set(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(key, value)
+	return nil
+}
+
+// SetIfNotExists key 不存在时写入，返回是否写入
+func (s *Store) SetIfNotExists(key, value string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.kvs[key]; ok {
+		return false, nil
+	}
+	s.put(key, value)
+	return true, nil
+}
+
+// Delete 删除key
+func (s *Store) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delete(key)
+}
+
+func (s *Store) Watch(key string) (clientv3.WatchChan, error) {
+	return s.WatchPrefixKey(key)
+}
+
+func (s *Store) WatchPrefixKey(prefix string, opts ...clientv3.OpOption) (clientv3.WatchChan, error) {
+	return s.WatchPrefixKeyCtx(context.Background(), prefix, opts...)
+}
+
+// WatchPrefixKeyCtx 监听前缀，支持 clientv3.WithRev；事件总是包含 PrevKv
+func (s *Store) WatchPrefixKeyCtx(ctx context.Context, prefix string, opts ...clientv3.OpOption) (clientv3.WatchChan, error) {
+	rev := clientv3.OpGet(prefix, opts...).Rev()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan clientv3.WatchResponse, watchBuffer)
+	if s.closed {
+		close(ch)
+		return ch, nil
+	}
+	if rev > 0 && rev <= s.revision {
+		// 不保留历史版本
+		ch <- clientv3.WatchResponse{CompactRevision: s.revision + 1, Canceled: true}
+		close(ch)
+		return ch, nil
+	}
+	w := &watcher{prefix: prefix, ch: ch}
+	s.watchers[w] = struct{}{}
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if _, ok := s.watchers[w]; ok {
+				delete(s.watchers, w)
+				close(w.ch)
+			}
+		}()
+	}
+	return ch, nil
+}
+
+// GrantAndSet 创建租约并写入key，租约不过期
+func (s *Store) GrantAndSet(_ int64, key, value string) (clientv3.LeaseID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, fmt.Errorf("store closed")
+	}
+	s.nextLease++
+	s.leases[s.nextLease] = &lease{keys: []string{key}, ch: make(chan *clientv3.LeaseKeepAliveResponse)}
+	s.put(key, value)
+	return s.nextLease, nil
+}
+
+// Revoke 撤销租约并删除租约写入的key
+func (s *Store) Revoke(leaseId clientv3.LeaseID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[leaseId]
+	if !ok {
+		return fmt.Errorf("lease %d not found", leaseId)
+	}
+	delete(s.leases, leaseId)
+	close(l.ch)
+	for _, k := range l.keys {
+		s.delete(k)
+	}
+	return nil
+}
+
+func (s *Store) KeepAliveOnce(leaseId clientv3.LeaseID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.leases[leaseId]; !ok {
+		return fmt.Errorf("lease %d not found", leaseId)
+	}
+	return nil
+}
+
+// KeepAlive 返回的 channel 在租约撤销或 Close 时关闭
+func (s *Store) KeepAlive(leaseId clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[leaseId]
+	if !ok {
+		return nil, fmt.Errorf("lease %d not found", leaseId)
+	}
+	return l.ch, nil
+}
+
+// put 调用方持有 s.mu
+func (s *Store) put(key, value string) {
+	s.revision++
+	prev := s.kvs[key]
+	kv := &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value), CreateRevision: s.revision, ModRevision: s.revision, Version: 1}
+	if prev != nil {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+	}
+	s.kvs[key] = kv
+	s.emit(&clientv3.Event{Type: clientv3.EventTypePut, Kv: kv, PrevKv: prev})
+}
+
+// delete 调用方持有 s.mu
+func (s *Store) delete(key string) {
+	prev, ok := s.kvs[key]
+	if !ok {
+		return
+	}
+	s.revision++
+	delete(s.kvs, key)
+	delete(s.loaded, key)
+	s.emit(&clientv3.Event{Type: clientv3.EventTypeDelete, Kv: &mvccpb.KeyValue{Key: []byte(key), ModRevision: s.revision}, PrevKv: prev})
+}
+
+// emit 调用方持有 s.mu，监听 channel 已满时取消该监听
+func (s *Store) emit(ev *clientv3.Event) {
+	for w := range s.watchers {
+		if !strings.HasPrefix(string(ev.Kv.Key), w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- clientv3.WatchResponse{Events: []*clientv3.Event{ev}}:
+		default:
+			delete(s.watchers, w)
+			close(w.ch)
+		}
+	}
+}
+
+func toValue(kv *mvccpb.KeyValue) *etcd_mw.EtcdValue {
+	return &etcd_mw.EtcdValue{Key: string(kv.Key), Value: string(kv.Value), Revision: kv.ModRevision}
+}
@@ -0,0 +1,129 @@
+package localstore_mw
+
+import (
+	"context"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"testing"
+)
+
+// drain 读取 channel 中已有的事件
+func drain(t *testing.T, ch clientv3.WatchChan) []*clientv3.Event {
+	t.Helper()
+	var events []*clientv3.Event
+	for {
+		select {
+		case resp, ok := <-ch:
+			if !ok {
+				return events
+			}
+			events = append(events, resp.Events...)
+		default:
+			return events
+		}
+	}
+}
+
+func TestLoadEmitsDiff(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.Load(map[string]string{"/a/1": "x", "/a/2": "y", "/a/3": "z"})
+	if err := s.Set("/a/manual", "m"); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := s.WatchPrefixKeyCtx(context.Background(), "/a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Load(map[string]string{"/a/1": "x", "/a/2": "y2", "/a/4": "w"})
+	events := drain(t, ch)
+	got := make(map[string]string, len(events))
+	for _, ev := range events {
+		got[string(ev.Kv.Key)] = string(ev.Kv.Value)
+		if ev.Type == clientv3.EventTypeDelete {
+			got[string(ev.Kv.Key)] = "<deleted>"
+			if ev.PrevKv == nil || string(ev.PrevKv.Value) != "z" {
+				t.Fatalf("delete event without prev value: %v", ev)
+			}
+		}
+	}
+	want := map[string]string{"/a/2": "y2", "/a/3": "<deleted>", "/a/4": "w"}
+	if len(got) != len(want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("events = %v, want %v", got, want)
+		}
+	}
+	// 其他方式写入的key不受 Load 影响
+	if v, err := s.Get("/a/manual"); err != nil || v.Value != "m" {
+		t.Fatalf("manual key = %v, %v", v, err)
+	}
+	s.Load(map[string]string{})
+	if v, _, _ := s.ListPrefix("/a/"); len(v) != 1 || v[0].Key != "/a/manual" {
+		t.Fatalf("ListPrefix after empty Load = %v", v)
+	}
+}
+
+func TestWatchWithRev(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.Load(map[string]string{"/a/1": "x"})
+	_, rev, _ := s.ListPrefix("/a/")
+
+	// 从下一个版本开始监听，只收到之后的修改
+	ch, err := s.WatchPrefixKeyCtx(context.Background(), "/a/", clientv3.WithRev(rev+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Set("/a/2", "y"); err != nil {
+		t.Fatal(err)
+	}
+	if events := drain(t, ch); len(events) != 1 || string(events[0].Kv.Key) != "/a/2" {
+		t.Fatalf("events = %v", events)
+	}
+
+	// 不保留历史版本，从已有版本开始监听返回 compaction
+	compacted, err := s.WatchPrefixKeyCtx(context.Background(), "/a/", clientv3.WithRev(rev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, ok := <-compacted
+	if !ok || resp.CompactRevision <= rev || !resp.Canceled {
+		t.Fatalf("response = %+v, want compaction", resp)
+	}
+	if _, ok = <-compacted; ok {
+		t.Fatal("compacted watch not closed")
+	}
+}
+
+func TestWatchCancelAndClose(t *testing.T) {
+	s := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := s.WatchPrefixKeyCtx(ctx, "/a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Fatal("watch not closed after cancel")
+	}
+
+	id, err := s.GrantAndSet(10, "/lease/1", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepAlive, err := s.KeepAlive(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := s.WatchPrefixKeyCtx(context.Background(), "/")
+	s.Close()
+	if _, ok := <-keepAlive; ok {
+		t.Fatal("keepalive not closed")
+	}
+	if _, ok := <-all; ok {
+		t.Fatal("watch not closed after Close")
+	}
+}
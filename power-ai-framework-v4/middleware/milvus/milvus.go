@@ -44,6 +44,16 @@ func New(c *Config) (*Milvus, error) {
 	return &Milvus{client: cli, config: c}, nil
 }
 
+// Close 关闭milvus连接
+func (m *Milvus) Close() error {
+	if m.client == nil {
+		return nil
+	}
+	err := m.client.Close()
+	m.client = nil
+	return err
+}
+
 // DynamicInsert 原子化插入函数
 //
 // 入参说明：
@@ -413,3 +423,8 @@ func (m *Milvus) CreateCollectionFromData(ctx context.Context, collectionName, p
 	//fmt.Println("Collection created, indexed, and loaded successfully.")
 	return nil
 }
+
+// HasCollection 集合是否存在
+func (m *Milvus) HasCollection(ctx context.Context, collectionName string) (bool, error) {
+	return m.client.HasCollection(ctx, collectionName)
+}
@@ -41,6 +41,11 @@ func (m *Minio) check() error {
 	return nil
 }
 
+// Close 释放minio客户端，minio基于http无长连接，置空即可
+func (m *Minio) Close() {
+	m.client = nil
+}
+
 func (m *Minio) UpLoad(bucketName, bucketFilePath, uploadFile string) error {
 	location := "us-east-1"
 
@@ -100,3 +105,16 @@ func (m *Minio) DownLoad(bucketName, bucketFilePath, savePath string) error {
 func (m *Minio) GetFileURL(bucketName, bucketFilePath string, expires time.Duration) (*url.URL, error) {
 	return m.client.PresignedGetObject(context.Background(), bucketName, bucketFilePath, 1*time.Hour, url.Values{})
 }
+
+// Remove 删除文件，文件不存在时不返回错误
+func (m *Minio) Remove(bucketName, bucketFilePath string) error {
+	return m.RemoveCtx(context.Background(), bucketName, bucketFilePath)
+}
+
+// RemoveCtx 同 Remove，ctx结束时取消请求
+func (m *Minio) RemoveCtx(ctx context.Context, bucketName, bucketFilePath string) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	return m.client.RemoveObject(ctx, bucketName, bucketFilePath, minio.RemoveObjectOptions{})
+}
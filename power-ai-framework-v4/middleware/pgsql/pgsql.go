@@ -35,6 +35,16 @@ func New(c *Config) (*PgSql, error) {
 	return &PgSql{client: client, config: c}, nil
 }
 
+// Close 关闭数据库连接池
+func (p *PgSql) Close() error {
+	if p.client == nil {
+		return nil
+	}
+	err := p.client.Close()
+	p.client = nil
+	return err
+}
+
 // Pagination 分页查询结果
 type Pagination struct {
 	CurrentPage int   `json:"current_page"`
@@ -57,22 +67,37 @@ func (p *PgSql) check() error {
 
 // QuerySingle 获取单一对象
 func (p *PgSql) QuerySingle(dest interface{}, sqlWhere string, args ...interface{}) error {
+	return p.QuerySingleCtx(context.Background(), dest, sqlWhere, args...)
+}
+
+// QuerySingleCtx 获取单一对象，ctx结束时取消查询
+func (p *PgSql) QuerySingleCtx(ctx context.Context, dest interface{}, sqlWhere string, args ...interface{}) error {
 	if err := p.check(); err != nil {
 		return err
 	}
-	return p.client.Get(dest, sqlWhere, args...)
+	return p.client.GetContext(ctx, dest, sqlWhere, args...)
 }
 
 // QueryMultiple 获取多行对象
 func (p *PgSql) QueryMultiple(dest interface{}, sqlWhere string, args ...interface{}) error {
+	return p.QueryMultipleCtx(context.Background(), dest, sqlWhere, args...)
+}
+
+// QueryMultipleCtx 获取多行对象，ctx结束时取消查询
+func (p *PgSql) QueryMultipleCtx(ctx context.Context, dest interface{}, sqlWhere string, args ...interface{}) error {
 	if err := p.check(); err != nil {
 		return err
 	}
-	return p.client.Select(dest, sqlWhere, args...)
+	return p.client.SelectContext(ctx, dest, sqlWhere, args...)
 }
 
 // QueryByPaginate 执行分页查询
 func (p *PgSql) QueryByPaginate(dest interface{}, sqlWhere string, page, pageSize int, args ...interface{}) (*Pagination, error) {
+	return p.QueryByPaginateCtx(context.Background(), dest, sqlWhere, page, pageSize, args...)
+}
+
+// QueryByPaginateCtx 执行分页查询，ctx结束时取消查询
+func (p *PgSql) QueryByPaginateCtx(ctx context.Context, dest interface{}, sqlWhere string, page, pageSize int, args ...interface{}) (*Pagination, error) {
 	if err := p.check(); err != nil {
 		return nil, err
 	}
@@ -93,7 +118,6 @@ func (p *PgSql) QueryByPaginate(dest interface{}, sqlWhere string, page, pageSiz
 	paginationArgs[len(args)] = pageSize
 	paginationArgs[len(args)+1] = (page - 1) * pageSize
 
-	ctx := context.Background()
 	// 执行数据查询
 	err := p.client.SelectContext(ctx, dest, dataQuery, paginationArgs...)
 	if err != nil {
@@ -119,21 +143,30 @@ func (p *PgSql) QueryByPaginate(dest interface{}, sqlWhere string, page, pageSiz
 
 // Exec 执行SQL语句
 func (p *PgSql) Exec(sqlWhere string, args ...interface{}) (sql.Result, error) {
+	return p.ExecCtx(context.Background(), sqlWhere, args...)
+}
+
+// ExecCtx 执行SQL语句，ctx结束时取消执行
+func (p *PgSql) ExecCtx(ctx context.Context, sqlWhere string, args ...interface{}) (sql.Result, error) {
 	if err := p.check(); err != nil {
 		return nil, err
 	}
-	return p.client.Exec(sqlWhere, args...)
+	return p.client.ExecContext(ctx, sqlWhere, args...)
 }
 
 // BatchExecTransaction 批量执行
 func (p *PgSql) BatchExecTransaction(ts []*TransactionSql) error {
+	return p.BatchExecTransactionCtx(context.Background(), ts)
+}
+
+// BatchExecTransactionCtx 批量执行，ctx结束时回滚事务
+func (p *PgSql) BatchExecTransactionCtx(ctx context.Context, ts []*TransactionSql) error {
 	if err := p.check(); err != nil {
 		return err
 	}
 	if ts == nil || len(ts) == 0 {
 		return errors.New("SQL语句列表不能为空")
 	}
-	ctx := context.Background()
 	// 开始事务
 	tx, err := p.client.BeginTxx(ctx, nil)
 	if err != nil {
@@ -1,6 +1,8 @@
 package redis_mw
 
 import (
+	"context"
+	"errors"
 	"github.com/go-redis/redis/v7"
 	"time"
 )
@@ -44,12 +46,26 @@ func (r *Redis) SetNX(key string, value any, expiration int64) (bool, error) {
 	return r.client.SetNX(key, value, exp).Result()
 }
 
+// SetCtx 同 Set，ctx结束时取消命令
+func (r *Redis) SetCtx(ctx context.Context, key string, value any, expiration int64) error {
+	exp := time.Duration(expiration) * time.Second
+	if expiration <= 0 {
+		exp = 0 // 永不过期
+	}
+	return r.client.WithContext(ctx).Set(key, value, exp).Err()
+}
+
 // Get 查询指定key的value，返回字符串结果
 // 若key不存在，返回空字符串和对应的错误（redis.Nil）
 func (r *Redis) Get(key string) (string, error) {
 	return r.client.Get(key).Result()
 }
 
+// GetCtx 同 Get，ctx结束时取消命令
+func (r *Redis) GetCtx(ctx context.Context, key string) (string, error) {
+	return r.client.WithContext(ctx).Get(key).Result()
+}
+
 // Exists 查询一个或多个key是否存在，返回存在的key数量
 func (r *Redis) Exists(keys ...string) (int64, error) {
 	return r.client.Exists(keys...).Result()
@@ -60,6 +76,45 @@ func (r *Redis) Del(keys ...string) (int64, error) {
 	return r.client.Del(keys...).Result()
 }
 
+// EvalCtx 执行lua脚本，ctx结束时取消命令
+func (r *Redis) EvalCtx(ctx context.Context, script string, keys []string, args ...any) (any, error) {
+	return r.client.WithContext(ctx).Eval(script, keys, args...).Result()
+}
+
+// ZAddCtx 写入有序集合成员，已存在时更新 score，返回新增的成员数量
+func (r *Redis) ZAddCtx(ctx context.Context, key string, score float64, member any) (int64, error) {
+	return r.client.WithContext(ctx).ZAdd(key, &redis.Z{Score: score, Member: member}).Result()
+}
+
+// ZRemCtx 删除有序集合成员，返回删除的成员数量
+func (r *Redis) ZRemCtx(ctx context.Context, key string, members ...any) (int64, error) {
+	return r.client.WithContext(ctx).ZRem(key, members...).Result()
+}
+
+// ZRangeByScoreCtx 按 score 从小到大查询 [min, max] 范围内的成员，min/max 支持 -inf、+inf，count<=0 时不限数量
+func (r *Redis) ZRangeByScoreCtx(ctx context.Context, key, min, max string, offset, count int64) ([]string, error) {
+	opt := &redis.ZRangeBy{Min: min, Max: max}
+	if count > 0 {
+		opt.Offset, opt.Count = offset, count
+	}
+	return r.client.WithContext(ctx).ZRangeByScore(key, opt).Result()
+}
+
+// HSetNXCtx 哈希字段不存在时写入，返回是否写入
+func (r *Redis) HSetNXCtx(ctx context.Context, key, field string, value any) (bool, error) {
+	return r.client.WithContext(ctx).HSetNX(key, field, value).Result()
+}
+
+// HDelCtx 删除哈希字段，返回删除的字段数量
+func (r *Redis) HDelCtx(ctx context.Context, key string, fields ...string) (int64, error) {
+	return r.client.WithContext(ctx).HDel(key, fields...).Result()
+}
+
+// IsNil 是否为key不存在的错误
+func IsNil(err error) bool {
+	return errors.Is(err, redis.Nil)
+}
+
 // Close 关闭Redis连接，释放资源
 func (r *Redis) Close() error {
 	return r.client.Close()
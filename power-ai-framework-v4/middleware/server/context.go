@@ -1,7 +1,9 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xaes"
 )
@@ -16,20 +18,57 @@ var (
 	ConversationLimit    = ErrorCode{Code: "conversation_limit", Message: "对话消息达到上限"}
 	InvokeAgentError     = ErrorCode{Code: "invoke_agent_error", Message: "调用智能体错误"}
 	InvokeServiceError   = ErrorCode{Code: "invoke_service_error", Message: "调用其他服务错误"}
+	QuotaExceeded        = ErrorCode{Code: "quota_exceeded", Message: "模型调用量超出配额"}
+	Unauthorized         = ErrorCode{Code: "unauthorized", Message: "未授权"}
 )
 
 var (
 	EventMessage       = "message"
 	EventMessageStruct = "message_struct"
 	EventMessageEnd    = "message_end"
+	EventReasoning     = "reasoning"
 	EventError         = "error"
 )
 
+type sysTrackCodeKey struct{}
+
+// WithSysTrackCode 将sys_track_code放入ctx，用于下游调用记录日志
+func WithSysTrackCode(ctx context.Context, sysTrackCode string) context.Context {
+	return context.WithValue(ctx, sysTrackCodeKey{}, sysTrackCode)
+}
+
+// SysTrackCode 从ctx中获取sys_track_code，不存在返回空字符串
+func SysTrackCode(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	stc, _ := ctx.Value(sysTrackCodeKey{}).(string)
+	return stc
+}
+
 type ErrorCode struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
 }
 
+// CodeError 携带错误码的错误，通过 fmt.Errorf("%w: ...") 补充信息后仍可用 ErrorCodeOf 取得错误码
+type CodeError struct {
+	ErrorCode
+}
+
+func (e *CodeError) Error() string {
+	return e.Message
+}
+
+// ErrorCodeOf err 中携带的错误码，没有时返回 def
+func ErrorCodeOf(err error, def ErrorCode) ErrorCode {
+	var ce *CodeError
+	if errors.As(err, &ce) {
+		return ce.ErrorCode
+	}
+	return def
+}
+
 type AgentResponse struct {
 	ConversationId string `json:"conversation_id"`
 	MessageId      string `json:"message_id"`
@@ -115,12 +154,30 @@ func (se *SSEEvent) WriteAgentResponseMessageAesEncrypt(resp *AgentResponse, con
 	return nil
 }
 
+// WriteAgentResponseReasoning 流式响应写入思考内容，模型思考策略为 separate 时使用
+func (se *SSEEvent) WriteAgentResponseReasoning(resp *AgentResponse, content string) error {
+	se.WriteString(se.eventMessageReasoning(resp, content))
+	return nil
+}
+
+// WriteAgentResponseReasoningAesEncrypt (aes加密)流式响应写入思考内容
+func (se *SSEEvent) WriteAgentResponseReasoningAesEncrypt(resp *AgentResponse, content, secretKey string) error {
+	rs, _ := xaes.EncryptCBC(se.eventMessageReasoning(resp, content), secretKey)
+	se.WriteString(rs)
+	return nil
+}
+
 // WriteAgentResponseError 流式响应错误
 func (se *SSEEvent) WriteAgentResponseError(resp *AgentResponse, code, message string) error {
 	se.WriteString(se.eventMessageError(resp, code, message))
 	return nil
 }
 
+// WriteAgentResponseErr 流式响应错误，错误码取自 err（见 ErrorCodeOf），没有时为 ServiceError
+func (se *SSEEvent) WriteAgentResponseErr(resp *AgentResponse, err error) error {
+	return se.WriteAgentResponseError(resp, ErrorCodeOf(err, ServiceError).Code, err.Error())
+}
+
 // WriteAgentResponseErrorAesEncrypt (aes加密)流式响应错误
 func (se *SSEEvent) WriteAgentResponseErrorAesEncrypt(resp *AgentResponse, code, message, secretKey string) error {
 	rs, _ := xaes.EncryptCBC(se.eventMessageError(resp, code, message), secretKey)
@@ -170,6 +227,19 @@ func (se *SSEEvent) eventMessage(resp *AgentResponse, content string) string {
 	return string(b)
 }
 
+// eventMessageReasoning 思考内容
+func (se *SSEEvent) eventMessageReasoning(resp *AgentResponse, content string) string {
+	r := &ExtendedAgentResponse{
+		Event:         EventReasoning,
+		AgentResponse: resp,
+		Data: map[string]string{
+			"content": content,
+		},
+	}
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
 // eventMessageError 流式响应错误
 func (se *SSEEvent) eventMessageError(resp *AgentResponse, code, message string) string {
 	r := &ExtendedAgentResponse{
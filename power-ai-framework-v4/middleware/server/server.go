@@ -1,33 +1,94 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"net/http"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type HttpServer struct {
 	*gin.Engine
+	srv      *http.Server
+	mu       sync.Mutex
+	inflight atomic.Int64 // 正在处理中的请求数（包含SSE流式响应）
+	draining atomic.Bool  // 是否处于停机排空阶段
 }
 
 func New() *HttpServer {
 	s := &HttpServer{
-		gin.New(),
+		Engine: gin.New(),
 	}
 
-	//日志打印中间件,跨域中间件
-	s.Use(loggerMiddleware, corsMiddleware)
+	//停机排空中间件,日志打印中间件,跨域中间件
+	s.Use(s.drainMiddleware, loggerMiddleware, corsMiddleware)
 
 	return s
 }
 
 func (s *HttpServer) RunServer(ip, port string) error {
-	return s.Engine.Run(fmt.Sprintf("%s:%s", ip, port))
+	s.mu.Lock()
+	s.srv = &http.Server{
+		Addr:    fmt.Sprintf("%s:%s", ip, port),
+		Handler: s.Engine,
+	}
+	srv := s.srv
+	s.mu.Unlock()
+
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		// 主动停机，不视为错误
+		return nil
+	}
+	return err
+}
+
+// StopServer 优雅停机
+// 1.不再接收新请求（关闭监听，已建立连接上的新请求返回503）
+// 2.等待正在处理的请求（包括SSE流式响应输出message_end）结束，最长等待到ctx超时
+func (s *HttpServer) StopServer(ctx context.Context) error {
+	s.draining.Store(true)
+
+	s.mu.Lock()
+	srv := s.srv
+	s.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+
+	xlog.LogInfoF("10000", "httpserver", "shutdown", fmt.Sprintf("开始停机，当前处理中的请求数:%d", s.inflight.Load()))
+	if err := srv.Shutdown(ctx); err != nil {
+		xlog.LogErrorF("10000", "httpserver", "shutdown", fmt.Sprintf("等待请求结束超时，仍有%d个请求未完成，强制关闭", s.inflight.Load()), err)
+		_ = srv.Close()
+		return err
+	}
+	xlog.LogInfoF("10000", "httpserver", "shutdown", "所有请求处理完成，服务已停止")
+	return nil
 }
 
-func (s *HttpServer) StopServer() {
+// InFlight 返回正在处理中的请求数
+func (s *HttpServer) InFlight() int64 {
+	return s.inflight.Load()
+}
 
+// drainMiddleware 统计处理中的请求数，停机排空阶段拒绝新请求
+func (s *HttpServer) drainMiddleware(c *gin.Context) {
+	if s.draining.Load() {
+		c.Header("Connection", "close")
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, map[string]interface{}{
+			"code":    ServiceError.Code,
+			"message": fmt.Sprintf("%s:服务正在停机", ServiceError.Message),
+		})
+		return
+	}
+	s.inflight.Add(1)
+	defer s.inflight.Add(-1)
+	c.Next()
 }
 
 func loggerMiddleware(c *gin.Context) {
@@ -40,6 +40,11 @@ func (w *Weaviate) check() error {
 	return nil
 }
 
+// Close 释放weaviate客户端，weaviate基于http无长连接，置空即可
+func (w *Weaviate) Close() {
+	w.client = nil
+}
+
 func (w *Weaviate) Insert(className string, records []map[string]string, vectors [][]float32) ([]string, error) {
 	if err := w.check(); err != nil {
 		return nil, err
@@ -0,0 +1,251 @@
+package xbalance
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ============================================================================
+// 负载均衡
+// ============================================================================
+
+const (
+	StrategyRoundRobin    = "round_robin"    // 轮询
+	StrategyWeighted      = "weighted"       // 加权轮询
+	StrategyLeastInFlight = "least_inflight" // 最少处理中请求
+	StrategyLocalFirst    = "local_first"    // 本机优先
+)
+
+// Instance 服务实例，使用 NewInstance 创建
+// 创建后字段只读，修改权重使用 WithWeight 创建副本；副本与原实例共享处理中请求数和健康状态
+type Instance struct {
+	Addr   string // ip:port
+	IP     string
+	Weight int // 权重，注册信息中的weight字段，默认1
+
+	state *instanceState
+}
+
+type instanceState struct {
+	inflight atomic.Int64 // 处理中的请求数
+	failures atomic.Int32 // 连续失败次数
+	ejected  atomic.Bool  // 是否已被摘除
+}
+
+// NewInstance 创建服务实例
+func NewInstance(ip, port string, weight int) *Instance {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &Instance{
+		Addr:   ip + ":" + port,
+		IP:     ip,
+		Weight: weight,
+		state:  &instanceState{},
+	}
+}
+
+// WithWeight 返回使用新权重的副本，与原实例共享处理中请求数和健康状态
+func (in *Instance) WithWeight(weight int) *Instance {
+	if weight <= 0 {
+		weight = 1
+	}
+	c := *in
+	c.Weight = weight
+	return &c
+}
+
+// Acquire 开始一次请求，处理中请求数+1
+func (in *Instance) Acquire() {
+	in.state.inflight.Add(1)
+}
+
+// Release 结束一次请求，处理中请求数-1
+func (in *Instance) Release() {
+	in.state.inflight.Add(-1)
+}
+
+// InFlight 处理中的请求数
+func (in *Instance) InFlight() int64 {
+	return in.state.inflight.Load()
+}
+
+// Failures 连续失败次数
+func (in *Instance) Failures() int32 {
+	return in.state.failures.Load()
+}
+
+// Ejected 是否已被摘除
+func (in *Instance) Ejected() bool {
+	return in.state.ejected.Load()
+}
+
+// Balancer 负载均衡策略
+type Balancer interface {
+	// Name 策略名称
+	Name() string
+	// Pick 从可用实例中选择一个，instances 不为空
+	Pick(service string, instances []*Instance) *Instance
+}
+
+// New 根据策略名称创建负载均衡器，未知名称返回轮询
+func New(strategy, localIP string) Balancer {
+	switch strategy {
+	case StrategyWeighted:
+		return NewWeighted()
+	case StrategyLeastInFlight:
+		return NewLeastInFlight()
+	case StrategyLocalFirst:
+		return NewLocalFirst(localIP, NewRoundRobin())
+	default:
+		return NewRoundRobin()
+	}
+}
+
+// ============================================================================
+// 轮询
+// ============================================================================
+
+type roundRobin struct {
+	counters sync.Map // map[service]*atomic.Uint64
+}
+
+// NewRoundRobin 轮询
+func NewRoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+func (b *roundRobin) Name() string {
+	return StrategyRoundRobin
+}
+
+func (b *roundRobin) Pick(service string, instances []*Instance) *Instance {
+	c, _ := b.counters.LoadOrStore(service, &atomic.Uint64{})
+	idx := (c.(*atomic.Uint64).Add(1) - 1) % uint64(len(instances))
+	return instances[idx]
+}
+
+// ============================================================================
+// 加权轮询（平滑加权，同nginx）
+// ============================================================================
+
+type weighted struct {
+	mu      sync.Mutex
+	current map[string]map[string]int // service -> addr -> current weight
+}
+
+// NewWeighted 加权轮询，权重取注册信息中的weight字段
+func NewWeighted() Balancer {
+	return &weighted{current: make(map[string]map[string]int)}
+}
+
+func (b *weighted) Name() string {
+	return StrategyWeighted
+}
+
+func (b *weighted) Pick(service string, instances []*Instance) *Instance {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cw, ok := b.current[service]
+	if !ok {
+		cw = make(map[string]int)
+		b.current[service] = cw
+	}
+	// 删除已下线或不可用实例的当前权重
+	live := make(map[string]bool, len(instances))
+	for _, in := range instances {
+		live[in.Addr] = true
+	}
+	for addr := range cw {
+		if !live[addr] {
+			delete(cw, addr)
+		}
+	}
+
+	var best *Instance
+	total := 0
+	for _, in := range instances {
+		w := in.Weight
+		if w <= 0 {
+			w = 1
+		}
+		total += w
+		cw[in.Addr] += w
+		if best == nil || cw[in.Addr] > cw[best.Addr] {
+			best = in
+		}
+	}
+	cw[best.Addr] -= total
+	return best
+}
+
+// ============================================================================
+// 最少处理中请求
+// ============================================================================
+
+type leastInFlight struct {
+	rr Balancer
+}
+
+// NewLeastInFlight 选择处理中请求数最少的实例，数量相同时轮询
+func NewLeastInFlight() Balancer {
+	return &leastInFlight{rr: NewRoundRobin()}
+}
+
+func (b *leastInFlight) Name() string {
+	return StrategyLeastInFlight
+}
+
+func (b *leastInFlight) Pick(service string, instances []*Instance) *Instance {
+	var least []*Instance
+	minN := int64(-1)
+	for _, in := range instances {
+		n := in.InFlight()
+		if minN < 0 || n < minN {
+			minN = n
+			least = least[:0]
+		}
+		if n == minN {
+			least = append(least, in)
+		}
+	}
+	if len(least) == 1 {
+		return least[0]
+	}
+	return b.rr.Pick(service, least)
+}
+
+// ============================================================================
+// 本机优先
+// ============================================================================
+
+type localFirst struct {
+	localIP string
+	next    Balancer
+}
+
+// NewLocalFirst 优先选择与本机IP相同的实例，没有则交给next在全部实例中选择
+func NewLocalFirst(localIP string, next Balancer) Balancer {
+	if next == nil {
+		next = NewRoundRobin()
+	}
+	return &localFirst{localIP: localIP, next: next}
+}
+
+func (b *localFirst) Name() string {
+	return StrategyLocalFirst
+}
+
+func (b *localFirst) Pick(service string, instances []*Instance) *Instance {
+	var local []*Instance
+	for _, in := range instances {
+		if in.IP == b.localIP {
+			local = append(local, in)
+		}
+	}
+	if len(local) > 0 {
+		return b.next.Pick(service, local)
+	}
+	return b.next.Pick(service, instances)
+}
@@ -0,0 +1,89 @@
+package xbalance
+
+import (
+	"testing"
+)
+
+func TestRoundRobin(t *testing.T) {
+	ins := []*Instance{NewInstance("10.0.0.1", "80", 1), NewInstance("10.0.0.2", "80", 1)}
+	b := NewRoundRobin()
+	if b.Pick("a", ins) != ins[0] || b.Pick("a", ins) != ins[1] || b.Pick("a", ins) != ins[0] {
+		t.Fatal("round robin order error")
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	ins := []*Instance{NewInstance("10.0.0.1", "80", 3), NewInstance("10.0.0.2", "80", 1)}
+	b := NewWeighted()
+	count := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		count[b.Pick("a", ins).Addr]++
+	}
+	if count["10.0.0.1:80"] != 6 || count["10.0.0.2:80"] != 2 {
+		t.Fatalf("weighted distribution error: %v", count)
+	}
+}
+
+func TestWeightedPrunesRemoved(t *testing.T) {
+	b := NewWeighted().(*weighted)
+	b.Pick("a", []*Instance{NewInstance("10.0.0.1", "80", 1), NewInstance("10.0.0.2", "80", 1)})
+	b.Pick("a", []*Instance{NewInstance("10.0.0.3", "80", 1)})
+	if len(b.current["a"]) != 1 {
+		t.Fatalf("removed addresses kept: %v", b.current["a"])
+	}
+}
+
+func TestWithWeight(t *testing.T) {
+	in := NewInstance("10.0.0.1", "80", 1)
+	c := in.WithWeight(5)
+	if in.Weight != 1 || c.Weight != 5 {
+		t.Fatalf("weight = %d/%d, want 1/5", in.Weight, c.Weight)
+	}
+	in.Acquire()
+	NewHealthTracker(1).ReportFailure(c)
+	if c.InFlight() != 1 || !in.Ejected() {
+		t.Fatal("copy does not share state")
+	}
+}
+
+func TestLeastInFlight(t *testing.T) {
+	ins := []*Instance{NewInstance("10.0.0.1", "80", 1), NewInstance("10.0.0.2", "80", 1)}
+	ins[0].Acquire()
+	b := NewLeastInFlight()
+	if b.Pick("a", ins) != ins[1] {
+		t.Fatal("least inflight should pick idle instance")
+	}
+}
+
+func TestLocalFirst(t *testing.T) {
+	ins := []*Instance{NewInstance("10.0.0.1", "80", 1), NewInstance("10.0.0.2", "80", 1)}
+	b := NewLocalFirst("10.0.0.2", nil)
+	for i := 0; i < 3; i++ {
+		if b.Pick("a", ins) != ins[1] {
+			t.Fatal("local first should pick local instance")
+		}
+	}
+}
+
+func TestHealthTracker(t *testing.T) {
+	ins := []*Instance{NewInstance("10.0.0.1", "80", 1), NewInstance("10.0.0.2", "80", 1)}
+	h := NewHealthTracker(2)
+	if h.ReportFailure(ins[0]) {
+		t.Fatal("should not eject before max failures")
+	}
+	if !h.ReportFailure(ins[0]) {
+		t.Fatal("should eject at max failures")
+	}
+	if av := h.Available(ins); len(av) != 1 || av[0] != ins[1] {
+		t.Fatal("ejected instance should be filtered")
+	}
+	h.ReportFailure(ins[1])
+	h.ReportFailure(ins[1])
+	if len(h.Available(ins)) != 2 {
+		t.Fatal("all ejected should fall back to all instances")
+	}
+	h.Recover(ins[0])
+	if ins[0].Ejected() || ins[0].Failures() != 0 {
+		t.Fatal("recover error")
+	}
+}
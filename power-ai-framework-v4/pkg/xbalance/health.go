@@ -0,0 +1,66 @@
+package xbalance
+
+// ============================================================================
+// 被动健康检查
+// ============================================================================
+
+// HealthTracker 根据调用结果统计实例连续失败次数，达到阈值后摘除实例
+// 被摘除的实例由调用方定期探活，探活成功后通过 Recover 恢复
+type HealthTracker struct {
+	maxFailures int32
+}
+
+// NewHealthTracker 创建健康追踪器
+// 参数:
+//   - maxFailures: 连续失败多少次后摘除实例，<=0 表示不摘除
+func NewHealthTracker(maxFailures int) *HealthTracker {
+	return &HealthTracker{maxFailures: int32(maxFailures)}
+}
+
+// ReportSuccess 调用成功，清零连续失败次数
+func (h *HealthTracker) ReportSuccess(in *Instance) {
+	in.state.failures.Store(0)
+}
+
+// ReportFailure 调用失败，连续失败次数+1，达到阈值摘除
+// 返回:
+//   - bool: 本次是否触发摘除
+func (h *HealthTracker) ReportFailure(in *Instance) bool {
+	n := in.state.failures.Add(1)
+	if h.maxFailures <= 0 || n < h.maxFailures {
+		return false
+	}
+	return in.state.ejected.CompareAndSwap(false, true)
+}
+
+// Recover 恢复被摘除的实例
+func (h *HealthTracker) Recover(in *Instance) {
+	in.state.failures.Store(0)
+	in.state.ejected.Store(false)
+}
+
+// Available 过滤出未被摘除的实例
+// 如果全部实例都被摘除，返回全部实例，避免服务完全不可用
+func (h *HealthTracker) Available(instances []*Instance) []*Instance {
+	available := make([]*Instance, 0, len(instances))
+	for _, in := range instances {
+		if !in.Ejected() {
+			available = append(available, in)
+		}
+	}
+	if len(available) == 0 {
+		return instances
+	}
+	return available
+}
+
+// Ejected 过滤出被摘除的实例
+func (h *HealthTracker) Ejected(instances []*Instance) []*Instance {
+	var ejected []*Instance
+	for _, in := range instances {
+		if in.Ejected() {
+			ejected = append(ejected, in)
+		}
+	}
+	return ejected
+}
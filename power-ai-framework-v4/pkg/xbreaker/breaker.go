@@ -0,0 +1,171 @@
+package xbreaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// 熔断器
+//   closed    正常放行，连续失败达到阈值后进入 open
+//   open      拒绝请求，经过 OpenTimeout 后进入 half_open
+//   half_open 放行最多 HalfOpenMaxCalls 个探测请求，探测成功回到 closed，失败重新进入 open
+// ============================================================================
+
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+)
+
+// ErrOpen 熔断器处于打开状态，或半开状态下探测请求已满
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Settings 熔断参数
+type Settings struct {
+	FailureThreshold int           // 连续失败多少次后熔断，<=0 表示不熔断
+	OpenTimeout      time.Duration // 熔断持续时间，到期后进入半开
+	HalfOpenMaxCalls int           // 半开状态下允许同时放行的探测请求数
+}
+
+// Snapshot 熔断器状态快照
+type Snapshot struct {
+	State            string    `json:"state"`
+	ConsecutiveFails int       `json:"consecutive_fails"`
+	OpenedAt         time.Time `json:"opened_at,omitempty"`
+	TotalRequests    int64     `json:"total_requests"`
+	TotalFailures    int64     `json:"total_failures"`
+	TotalRejected    int64     `json:"total_rejected"`
+}
+
+// Breaker 熔断器，并发安全
+type Breaker struct {
+	mu       sync.Mutex
+	settings Settings
+	state    string
+	fails    int
+	openedAt time.Time
+	probing  int
+
+	totalRequests int64
+	totalFailures int64
+	totalRejected int64
+
+	now func() time.Time
+}
+
+// New 创建熔断器
+func New(s Settings) *Breaker {
+	return &Breaker{
+		settings: normalize(s),
+		state:    StateClosed,
+		now:      time.Now,
+	}
+}
+
+func normalize(s Settings) Settings {
+	if s.OpenTimeout <= 0 {
+		s.OpenTimeout = 30 * time.Second
+	}
+	if s.HalfOpenMaxCalls <= 0 {
+		s.HalfOpenMaxCalls = 1
+	}
+	return s
+}
+
+// Update 更新熔断参数，不改变当前状态
+func (b *Breaker) Update(s Settings) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.settings = normalize(s)
+}
+
+// Allow 判断是否放行本次请求
+// 放行后调用方必须调用 Done 上报结果
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateOpen && b.now().Sub(b.openedAt) >= b.settings.OpenTimeout {
+		b.state = StateHalfOpen
+		b.probing = 0
+	}
+
+	switch b.state {
+	case StateOpen:
+		b.totalRejected++
+		return ErrOpen
+	case StateHalfOpen:
+		if b.probing >= b.settings.HalfOpenMaxCalls {
+			b.totalRejected++
+			return ErrOpen
+		}
+		b.probing++
+	}
+	b.totalRequests++
+	return nil
+}
+
+// Done 上报请求结果
+func (b *Breaker) Done(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateHalfOpen && b.probing > 0 {
+		b.probing--
+	}
+
+	if success {
+		b.fails = 0
+		if b.state == StateHalfOpen {
+			b.state = StateClosed
+		}
+		return
+	}
+
+	b.totalFailures++
+	b.fails++
+	if b.state == StateHalfOpen || (b.settings.FailureThreshold > 0 && b.fails >= b.settings.FailureThreshold) {
+		b.state = StateOpen
+		b.openedAt = b.now()
+		b.probing = 0
+	}
+}
+
+// Release 放弃本次请求的结果，不计入成功或失败，用于调用方主动取消的场景
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateHalfOpen && b.probing > 0 {
+		b.probing--
+	}
+}
+
+// State 当前状态
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateOpen && b.now().Sub(b.openedAt) >= b.settings.OpenTimeout {
+		return StateHalfOpen
+	}
+	return b.state
+}
+
+// Snapshot 获取状态快照
+func (b *Breaker) Snapshot() Snapshot {
+	state := b.State()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := Snapshot{
+		State:            state,
+		ConsecutiveFails: b.fails,
+		TotalRequests:    b.totalRequests,
+		TotalFailures:    b.totalFailures,
+		TotalRejected:    b.totalRejected,
+	}
+	if b.state != StateClosed {
+		s.OpenedAt = b.openedAt
+	}
+	return s
+}
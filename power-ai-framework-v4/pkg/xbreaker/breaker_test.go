@@ -0,0 +1,44 @@
+package xbreaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := New(Settings{FailureThreshold: 2, OpenTimeout: time.Second, HalfOpenMaxCalls: 1})
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("closed breaker should allow: %v", err)
+		}
+		b.Done(false)
+	}
+	if b.State() != StateOpen || b.Allow() != ErrOpen {
+		t.Fatal("breaker should be open after threshold")
+	}
+
+	now = now.Add(time.Second)
+	if b.State() != StateHalfOpen {
+		t.Fatal("breaker should be half open after timeout")
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatal("half open should allow one probe")
+	}
+	if b.Allow() != ErrOpen {
+		t.Fatal("half open should reject when probes are full")
+	}
+	b.Done(false)
+	if b.State() != StateOpen {
+		t.Fatal("failed probe should reopen breaker")
+	}
+
+	now = now.Add(time.Second)
+	_ = b.Allow()
+	b.Done(true)
+	if b.State() != StateClosed {
+		t.Fatal("successful probe should close breaker")
+	}
+}
@@ -0,0 +1,93 @@
+package xconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ============================================================================
+// 配置值按行比较，用于记录配置修改历史
+// ============================================================================
+
+// maxDiffCells 行数乘积超过该值时不逐行比较，直接输出全部删除和新增
+const maxDiffCells = 4_000_000
+
+// DiffLines 按行比较 old 和 new，只输出变化的行：删除的行以 "- " 开头，新增的行以 "+ " 开头，
+// 每段变化前输出 "@@ -旧行号 +新行号 @@"，内容相同返回空字符串
+func DiffLines(old, new string) string {
+	if old == new {
+		return ""
+	}
+	a, b := splitLines(old), splitLines(new)
+	// 去掉相同的开头和结尾，减少比较的行数
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	var sb strings.Builder
+	if len(a)*len(b) > maxDiffCells {
+		writeHunk(&sb, prefix, prefix, a, b)
+		return sb.String()
+	}
+
+	// lcs[i][j] 为 a[i:] 和 b[j:] 的最长公共子序列长度
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && a[i] == b[j] {
+			i++
+			j++
+			continue
+		}
+		// 收集一段连续的变化
+		si, sj := i, j
+		for i < len(a) || j < len(b) {
+			if i < len(a) && j < len(b) && a[i] == b[j] {
+				break
+			}
+			if j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]) {
+				i++
+			} else {
+				j++
+			}
+		}
+		writeHunk(&sb, prefix+si, prefix+sj, a[si:i], b[sj:j])
+	}
+	return sb.String()
+}
+
+func writeHunk(sb *strings.Builder, oldLine, newLine int, removed, added []string) {
+	sb.WriteString(fmt.Sprintf("@@ -%d +%d @@\n", oldLine+1, newLine+1))
+	for _, l := range removed {
+		sb.WriteString("- " + l + "\n")
+	}
+	for _, l := range added {
+		sb.WriteString("+ " + l + "\n")
+	}
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
@@ -0,0 +1,37 @@
+package xconfig
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	cases := []struct {
+		old, new, want string
+	}{
+		{"a\nb\nc", "a\nb\nc", ""},
+		{"a\nb\nc", "a\nB\nc", "@@ -2 +2 @@\n- b\n+ B\n"},
+		{"a\nc", "a\nb\nc", "@@ -2 +2 @@\n+ b\n"},
+		{"a\nb\nc\nd", "b\nc", "@@ -1 +1 @@\n- a\n@@ -4 +3 @@\n- d\n"},
+		{"", "x", "@@ -1 +1 @@\n+ x\n"},
+		{"3", "5", "@@ -1 +1 @@\n- 3\n+ 5\n"},
+	}
+	for _, c := range cases {
+		if got := DiffLines(c.old, c.new); got != c.want {
+			t.Fatalf("DiffLines(%q, %q) = %q, want %q", c.old, c.new, got, c.want)
+		}
+	}
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	// 超过比较上限时输出整段替换
+	var a, b []string
+	for i := 0; i < 2100; i++ {
+		a = append(a, "a")
+		b = append(b, "b")
+	}
+	got := DiffLines(strings.Join(a, "\n"), strings.Join(b, "\n"))
+	if strings.Count(got, "\n- ") != 2100 || strings.Count(got, "\n+ ") != 2100 || !strings.HasPrefix(got, "@@ -1 +1 @@\n- a") {
+		t.Fatalf("large diff has unexpected shape: %d bytes", len(got))
+	}
+}
@@ -34,6 +34,12 @@ type MemoryConfig struct {
 	// Checkpoint 配置
 	CheckpointMaxRetries int `yaml:"checkpoint_max_retries"`
 
+	// 会话锁配置，不配置使用默认值
+	SessionLockTTL         int    `yaml:"session_lock_ttl"`          // 分布式锁过期时间（毫秒），默认30000
+	SessionLockWaitTimeout int    `yaml:"session_lock_wait_timeout"` // 等待锁的最长时间（毫秒），默认10000
+	SessionLockMaxIdle     int    `yaml:"session_lock_max_idle"`     // 本地锁的最大数量，默认10000
+	SessionLockKeyPrefix   string `yaml:"session_lock_key_prefix"`   // 分布式锁的key格式，默认 short_term_memory:lock:%s
+
 	// 性能优化配置
 	EstimatedMessageChars    int `yaml:"estimated_message_chars"`
 	EstimatedWindowMessageChars int `yaml:"estimated_window_message_chars"`
@@ -0,0 +1,134 @@
+package xconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ============================================================================
+// 配置脱敏
+// 配置值为 JSON 对象或数组时，名称为密钥类（key、password、token 等）的字段替换为 RedactedValue，
+// 用于配置修改历史等需要落库或返回给调用方的场景；RestoreRedacted 使用当前配置还原被替换的字段
+// ============================================================================
+
+// RedactedValue 脱敏后的字段值
+const RedactedValue = "******"
+
+// secretNames 密钥类字段名，按 _ - . 分段后任意一段命中即为密钥
+var secretNames = map[string]bool{
+	"key": true, "apikey": true, "secret": true, "password": true, "passwd": true, "pwd": true,
+	"token": true, "ak": true, "sk": true, "credential": true, "credentials": true, "authorization": true,
+}
+
+// IsSecretName 字段名或配置key是否为密钥类，如 key、api_key、db-password；按 _ - . 分段，驼峰命名（accessToken）不拆分
+func IsSecretName(name string) bool {
+	for _, seg := range strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == '_' || r == '-' || r == '.'
+	}) {
+		if secretNames[seg] {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactJSON 替换 JSON 中密钥类字段的值，不是 JSON 对象或数组、或没有需要替换的字段时原样返回
+func RedactJSON(value string) string {
+	v, ok := parseContainer(value)
+	if !ok || !redact(v) {
+		return value
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return value
+	}
+	return string(b)
+}
+
+// RestoreRedacted 使用 current 中相同路径的值还原 redacted 中被替换的字段，数组按下标对应
+// current 中没有对应字段时返回错误
+func RestoreRedacted(redacted, current string) (string, error) {
+	if !strings.Contains(redacted, RedactedValue) {
+		return redacted, nil
+	}
+	r, ok := parseContainer(redacted)
+	if !ok {
+		return redacted, nil
+	}
+	c, _ := parseContainer(current)
+	if err := restore(r, c, "$"); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func parseContainer(value string) (interface{}, bool) {
+	s := strings.TrimSpace(value)
+	if !strings.HasPrefix(s, "{") && !strings.HasPrefix(s, "[") {
+		return nil, false
+	}
+	var v interface{}
+	if json.Unmarshal([]byte(s), &v) != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// redact 原地替换，返回是否有字段被替换
+func redact(v interface{}) bool {
+	changed := false
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if IsSecretName(k) && e != nil && e != "" {
+				t[k] = RedactedValue
+				changed = true
+				continue
+			}
+			changed = redact(e) || changed
+		}
+	case []interface{}:
+		for _, e := range t {
+			changed = redact(e) || changed
+		}
+	}
+	return changed
+}
+
+func restore(r, c interface{}, path string) error {
+	switch t := r.(type) {
+	case map[string]interface{}:
+		cm, _ := c.(map[string]interface{})
+		for k, e := range t {
+			p := path + "." + k
+			if e == RedactedValue && IsSecretName(k) {
+				cv, ok := cm[k]
+				if !ok {
+					return fmt.Errorf("%s 已脱敏，当前配置中没有该字段，无法还原", p)
+				}
+				t[k] = cv
+				continue
+			}
+			if err := restore(e, cm[k], p); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		ca, _ := c.([]interface{})
+		for i, e := range t {
+			var ce interface{}
+			if i < len(ca) {
+				ce = ca[i]
+			}
+			if err := restore(e, ce, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
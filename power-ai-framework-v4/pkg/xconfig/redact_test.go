@@ -0,0 +1,53 @@
+package xconfig
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsSecretName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"key": true, "api_key": true, "db-password": true, "llm.token": true, "SK": true,
+		"name": false, "url": false, "keyword": false, "monkey": false, "": false,
+	} {
+		if got := IsSecretName(name); got != want {
+			t.Errorf("IsSecretName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	models := `[{"name":"qwen","url":"http://x","key":"sk-1"},{"name":"ds","key":""}]`
+	got := RedactJSON(models)
+	if strings.Contains(got, "sk-1") || !strings.Contains(got, `"key":"******"`) || !strings.Contains(got, `"key":""`) {
+		t.Fatalf("RedactJSON(models) = %s", got)
+	}
+	nested := `{"db":{"host":"h","password":"p"},"api_key":{"a":1}}`
+	if got = RedactJSON(nested); got != `{"api_key":"******","db":{"host":"h","password":"******"}}` {
+		t.Fatalf("RedactJSON(nested) = %s", got)
+	}
+	// 没有密钥字段或不是JSON时原样返回，保留格式
+	for _, v := range []string{`{ "name": "a" }`, "plain key=abc", "42", ""} {
+		if got = RedactJSON(v); got != v {
+			t.Fatalf("RedactJSON(%q) = %q", v, got)
+		}
+	}
+}
+
+func TestRestoreRedacted(t *testing.T) {
+	old := `[{"name":"qwen","key":"sk-old","url":"http://old"}]`
+	cur := `[{"name":"qwen","key":"sk-cur","url":"http://new"}]`
+	got, err := RestoreRedacted(RedactJSON(old), cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != `[{"key":"sk-cur","name":"qwen","url":"http://old"}]` {
+		t.Fatalf("RestoreRedacted = %s", got)
+	}
+	if _, err = RestoreRedacted(RedactJSON(old), `[]`); err == nil || !strings.Contains(err.Error(), "$[0].key") {
+		t.Fatalf("RestoreRedacted without current field err = %v", err)
+	}
+	if got, err = RestoreRedacted(`{"a":1}`, ""); err != nil || got != `{"a":1}` {
+		t.Fatalf("RestoreRedacted unredacted = %s, %v", got, err)
+	}
+}
@@ -0,0 +1,177 @@
+package xconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xllm"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// 配置值类型校验
+// 配置中心的配置值统一是字符串，按声明的类型校验：
+//   string  任意字符串，可限定可选值
+//   int     整数，可限定取值范围
+//   float   浮点数，可限定取值范围
+//   bool    strconv.ParseBool 支持的取值
+//   json    合法 JSON，可按 JSONSchema（type/required/properties/items/additionalProperties/enum 子集）校验结构
+//   prompt  提示词模板，占位符格式 {{name}}，可限定必须包含的占位符
+// 未知类型（历史配置中的 text、intention 等）按 string 处理
+// ============================================================================
+
+// ValueType 配置值类型
+type ValueType string
+
+const (
+	TypeString ValueType = "string"
+	TypeInt    ValueType = "int"
+	TypeFloat  ValueType = "float"
+	TypeBool   ValueType = "bool"
+	TypeJSON   ValueType = "json"
+	TypePrompt ValueType = "prompt"
+)
+
+// ValueSchema 配置值约束，零值只校验类型
+type ValueSchema struct {
+	Min          *float64                 // int/float 最小值（含）
+	Max          *float64                 // int/float 最大值（含）
+	Enum         []string                 // string 可选值
+	JSON         JSONSchema               // json 结构
+	Placeholders []string                 // prompt 必须包含的占位符名称，如 history 对应 {{history}}
+	Validate     func(value string) error // 自定义校验，在类型校验通过后执行
+}
+
+// Bound 用于设置 ValueSchema.Min/Max
+func Bound(v float64) *float64 {
+	return &v
+}
+
+// ValidateValue 按类型和约束校验配置值，schema 可以为空
+func ValidateValue(typ ValueType, value string, schema *ValueSchema) error {
+	if schema == nil {
+		schema = &ValueSchema{}
+	}
+	switch typ {
+	case TypeInt:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an int", value)
+		}
+		if err = checkRange(float64(n), schema); err != nil {
+			return err
+		}
+	case TypeFloat:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("%q is not a float", value)
+		}
+		if err = checkRange(f, schema); err != nil {
+			return err
+		}
+	case TypeBool:
+		if _, err := strconv.ParseBool(strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("%q is not a bool", value)
+		}
+	case TypeJSON:
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			return fmt.Errorf("invalid json: %w", err)
+		}
+		if schema.JSON != nil {
+			if err := schema.JSON.Validate(v); err != nil {
+				return err
+			}
+		}
+	case TypePrompt:
+		if strings.TrimSpace(value) == "" {
+			return fmt.Errorf("prompt is empty")
+		}
+		have := make(map[string]bool)
+		for _, name := range PromptPlaceholders(value) {
+			have[name] = true
+		}
+		for _, name := range schema.Placeholders {
+			if !have[name] {
+				return fmt.Errorf("prompt is missing placeholder {{%s}}", name)
+			}
+		}
+	default:
+		if len(schema.Enum) > 0 && !contains(schema.Enum, value) {
+			return fmt.Errorf("%q is not one of %v", value, schema.Enum)
+		}
+	}
+	if schema.Validate != nil {
+		return schema.Validate(value)
+	}
+	return nil
+}
+
+func checkRange(f float64, schema *ValueSchema) error {
+	if schema.Min != nil && f < *schema.Min {
+		return fmt.Errorf("%v is less than %v", f, *schema.Min)
+	}
+	if schema.Max != nil && f > *schema.Max {
+		return fmt.Errorf("%v is greater than %v", f, *schema.Max)
+	}
+	return nil
+}
+
+var placeholderRe = regexp.MustCompile(`{{\s*([\w.-]+)\s*}}`)
+
+// PromptPlaceholders 提示词模板中的占位符名称，按出现顺序去重
+func PromptPlaceholders(prompt string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range placeholderRe.FindAllStringSubmatch(prompt, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// RenderPrompt 将提示词模板中的 {{name}} 替换为 vars[name]，vars 中没有的占位符保持原样
+func RenderPrompt(prompt string, vars map[string]string) string {
+	return placeholderRe.ReplaceAllStringFunc(prompt, func(s string) string {
+		name := placeholderRe.FindStringSubmatch(s)[1]
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return s
+	})
+}
+
+// JSONSchema JSON Schema 的子集，与结构化输出使用同一个校验器 xllm.Schema.Validate，
+// 可以用 ParseJSONSchema 解析 JSON Schema 文本，也可以直接使用 xllm.SchemaOf 推导的 schema
+type JSONSchema = xllm.Schema
+
+// ParseJSONSchema 解析 JSON Schema 文本
+func ParseJSONSchema(text string) (JSONSchema, error) {
+	s := JSONSchema{}
+	if err := json.Unmarshal([]byte(text), &s); err != nil {
+		return nil, fmt.Errorf("invalid json schema: %w", err)
+	}
+	return s, nil
+}
+
+// MustParseJSONSchema 解析 JSON Schema 文本，失败时 panic，用于声明默认配置
+func MustParseJSONSchema(text string) JSONSchema {
+	s, err := ParseJSONSchema(text)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package xconfig
+
+import (
+	"errors"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xllm"
+	"strings"
+	"testing"
+)
+
+func TestValidateValueScalars(t *testing.T) {
+	cases := []struct {
+		typ    ValueType
+		value  string
+		schema *ValueSchema
+		ok     bool
+	}{
+		{TypeInt, "3", nil, true},
+		{TypeInt, " 3 ", nil, true},
+		{TypeInt, "3.5", nil, false},
+		{TypeInt, "abc", nil, false},
+		{TypeInt, "0", &ValueSchema{Min: Bound(1)}, false},
+		{TypeInt, "20", &ValueSchema{Min: Bound(1), Max: Bound(10)}, false},
+		{TypeFloat, "0.75", &ValueSchema{Min: Bound(0), Max: Bound(1)}, true},
+		{TypeFloat, "NaN", nil, false},
+		{TypeBool, "false", nil, true},
+		{TypeBool, "yes", nil, false},
+		{TypeString, "b", &ValueSchema{Enum: []string{"a", "b"}}, true},
+		{TypeString, "c", &ValueSchema{Enum: []string{"a", "b"}}, false},
+		// 历史配置类型按 string 处理
+		{"text", "任意内容", nil, true},
+	}
+	for _, c := range cases {
+		err := ValidateValue(c.typ, c.value, c.schema)
+		if (err == nil) != c.ok {
+			t.Fatalf("ValidateValue(%s, %q) = %v, want ok=%v", c.typ, c.value, err, c.ok)
+		}
+	}
+}
+
+func TestValidateValueJSON(t *testing.T) {
+	schema := &ValueSchema{JSON: MustParseJSONSchema(`{
+		"type": "object",
+		"required": ["sort"],
+		"properties": {
+			"diagnose_count": {"type": "object", "additionalProperties": {"type": "integer"}},
+			"sort": {"type": "string", "enum": ["true", "false"]}
+		},
+		"additionalProperties": false
+	}`)}
+	if err := ValidateValue(TypeJSON, `{"diagnose_count": {"708": 629}, "sort": "false"}`, schema); err != nil {
+		t.Fatal(err)
+	}
+	bad := map[string]string{
+		`{"diagnose_count": {}}`:                           "缺少必填字段 $.sort",
+		`{"sort": "maybe"}`:                                "不在可选值",
+		`{"sort": "true", "diagnose_count": {"708": 1.5}}`: "$.diagnose_count.708 的类型应为 integer",
+		`{"sort": "true", "other": 1}`:                     "$.other 不是允许的字段",
+		`[1, 2]`:                                           "$ 的类型应为 object",
+		`{"sort": `:                                        "invalid json",
+	}
+	for value, want := range bad {
+		err := ValidateValue(TypeJSON, value, schema)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("ValidateValue(%s) = %v, want %q", value, err, want)
+		}
+	}
+}
+
+func TestValidateValueSchemaOf(t *testing.T) {
+	type limits struct {
+		Max   int    `json:"max"`
+		Level string `json:"level" enum:"low,high"`
+	}
+	schema := &ValueSchema{JSON: xllm.SchemaOf(limits{})}
+	if err := ValidateValue(TypeJSON, `{"max": 10, "level": "low"}`, schema); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateValue(TypeJSON, `{"max": 10, "level": "low", "min": 1}`, schema); err == nil {
+		t.Fatal("undeclared field passed")
+	}
+}
+
+func TestValidateValuePrompt(t *testing.T) {
+	schema := &ValueSchema{Placeholders: []string{"history"}}
+	if err := ValidateValue(TypePrompt, "总结以下对话：\n{{ history }}", schema); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateValue(TypePrompt, "总结以下对话", schema); err == nil {
+		t.Fatal("prompt without placeholder passed")
+	}
+	if err := ValidateValue(TypePrompt, "  ", nil); err == nil {
+		t.Fatal("empty prompt passed")
+	}
+}
+
+func TestValidateValueCustom(t *testing.T) {
+	errOdd := errors.New("odd")
+	schema := &ValueSchema{Validate: func(v string) error {
+		if v == "3" {
+			return errOdd
+		}
+		return nil
+	}}
+	if err := ValidateValue(TypeInt, "3", schema); !errors.Is(err, errOdd) {
+		t.Fatalf("custom validate = %v", err)
+	}
+	// 类型校验失败时不执行自定义校验
+	if err := ValidateValue(TypeInt, "x", schema); err == nil || errors.Is(err, errOdd) {
+		t.Fatalf("type check = %v", err)
+	}
+}
+
+func TestRenderPrompt(t *testing.T) {
+	prompt := "{{name}}你好，{{ name }}，{{unknown}}"
+	if got := PromptPlaceholders(prompt); len(got) != 2 || got[0] != "name" || got[1] != "unknown" {
+		t.Fatalf("PromptPlaceholders = %v", got)
+	}
+	if got := RenderPrompt(prompt, map[string]string{"name": "张三"}); got != "张三你好，张三，{{unknown}}" {
+		t.Fatalf("RenderPrompt = %q", got)
+	}
+}
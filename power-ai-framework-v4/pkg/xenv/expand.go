@@ -0,0 +1,38 @@
+package xenv
+
+import (
+	"os"
+	"regexp"
+)
+
+var expandPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?}`)
+
+// Expand 将字符串中的 ${VAR} 替换为环境变量的值，${VAR:-默认值} 在变量不存在或为空时使用默认值
+// 只替换一次，环境变量的值中的 ${...} 保持原样
+func Expand(s string) string {
+	return expandPattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := expandPattern.FindStringSubmatch(m)
+		if v, ok := os.LookupEnv(sub[1]); ok && v != "" {
+			return v
+		}
+		return sub[3]
+	})
+}
+
+// ExpandValues 对解析后的配置（map、切片和标量）中的字符串执行 Expand，其他标量和 map 的 key 不替换
+// map 和切片原地修改，返回替换后的值
+func ExpandValues(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return Expand(t)
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = ExpandValues(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = ExpandValues(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,43 @@
+package xenv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	t.Setenv("XENV_KEY", `a:b #"c"`)
+	t.Setenv("XENV_EMPTY", "")
+	t.Setenv("XENV_NESTED", "${XENV_KEY}")
+	cases := map[string]string{
+		"${XENV_KEY}":             `a:b #"c"`,
+		"key=${XENV_KEY}!":        `key=a:b #"c"!`,
+		"${XENV_MISSING}":         "",
+		"${XENV_MISSING:-5432}":   "5432",
+		"${XENV_EMPTY:-postgres}": "postgres",
+		"${XENV_NESTED}":          "${XENV_KEY}",
+		"$XENV_KEY":               "$XENV_KEY",
+	}
+	for in, want := range cases {
+		if got := Expand(in); got != want {
+			t.Errorf("Expand(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestExpandValues(t *testing.T) {
+	t.Setenv("XENV_KEY", "secret: x")
+	v := map[string]interface{}{
+		"${XENV_KEY}": "k",
+		"list":        []interface{}{"${XENV_KEY}", 1, true, nil},
+		"nested":      map[string]interface{}{"key": "${XENV_KEY:-none}"},
+	}
+	want := map[string]interface{}{
+		"${XENV_KEY}": "k",
+		"list":        []interface{}{"secret: x", 1, true, nil},
+		"nested":      map[string]interface{}{"key": "secret: x"},
+	}
+	if got := ExpandValues(v); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ExpandValues = %v, want %v", got, want)
+	}
+}
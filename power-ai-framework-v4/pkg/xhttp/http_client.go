@@ -104,8 +104,21 @@ func NewHttpClientWithConfig(config *HttpClientConfig) *HttpClient {
 	return client
 }
 
+// context 未指定ctx的方法使用客户端的Context
+func (client *HttpClient) context() context.Context {
+	if client.Context != nil {
+		return client.Context
+	}
+	return context.Background()
+}
+
 // SendRequest send http request.
 func (client *HttpClient) SendRequest(request *HttpRequest) (*http.Response, error) {
+	return client.SendRequestCtx(client.context(), request)
+}
+
+// SendRequestCtx send http request with ctx, the request is aborted when ctx is done.
+func (client *HttpClient) SendRequestCtx(ctx context.Context, request *HttpRequest) (*http.Response, error) {
 	err := validateRequest(request)
 	if err != nil {
 		return nil, err
@@ -113,12 +126,7 @@ func (client *HttpClient) SendRequest(request *HttpRequest) (*http.Response, err
 
 	rawUrl := request.RawURL
 
-	req, err := http.NewRequest(request.Method, rawUrl, bytes.NewBuffer(request.Body))
-
-	if client.Context != nil {
-		req, err = http.NewRequestWithContext(client.Context, request.Method, rawUrl, bytes.NewBuffer(request.Body))
-	}
-
+	req, err := http.NewRequestWithContext(ctx, request.Method, rawUrl, bytes.NewBuffer(request.Body))
 	if err != nil {
 		return nil, err
 	}
@@ -170,37 +178,33 @@ func (client *HttpClient) SendReqByRespDownload(request *HttpRequest, saveFilePa
 
 // SendReqByAsyncRespStream 异步结果返回
 func (client *HttpClient) SendReqByAsyncRespStream(request *HttpRequest, handler HttpRequestResponseFunc) {
+	client.SendReqByAsyncRespStreamCtx(client.context(), request, handler)
+}
 
-	go func() {
-		resp, err := client.SendRequest(request)
-		if err != nil {
-			handler(nil, err)
-			return
-		}
-		defer resp.Body.Close()
-		scanner := bufio.NewScanner(resp.Body)
-		scanner.Buffer(make([]byte, 4096), 1024*512)
-		for scanner.Scan() {
-
-			if !handler(scanner.Bytes(), nil) {
-				return
-			}
-			if err = scanner.Err(); err != nil {
-				handler(nil, err)
-			}
-		}
-	}()
+// SendReqByAsyncRespStreamCtx 异步结果返回，ctx结束时中断上游流
+func (client *HttpClient) SendReqByAsyncRespStreamCtx(ctx context.Context, request *HttpRequest, handler HttpRequestResponseFunc) {
+	go client.SendReqBySyncRespStreamCtx(ctx, request, handler)
 }
 
 // SendReqBySyncRespStream 同步结果返回
 func (client *HttpClient) SendReqBySyncRespStream(request *HttpRequest, handler HttpRequestResponseFunc) {
+	client.SendReqBySyncRespStreamCtx(client.context(), request, handler)
+}
 
-	resp, err := client.SendRequest(request)
+// SendReqBySyncRespStreamCtx 同步结果返回，ctx结束时中断上游流
+// 流读取中断时handler会收到错误，ctx结束时错误为 ctx.Err()
+func (client *HttpClient) SendReqBySyncRespStreamCtx(ctx context.Context, request *HttpRequest, handler HttpRequestResponseFunc) {
+
+	resp, err := client.SendRequestCtx(ctx, request)
 	if err != nil {
 		handler(nil, err)
 		return
 	}
+	ReadStream(ctx, resp, handler)
+}
 
+// ReadStream 按行读取流式响应并关闭响应体，读取中断时handler会收到错误，ctx结束时错误为 ctx.Err()
+func ReadStream(ctx context.Context, resp *http.Response, handler HttpRequestResponseFunc) {
 	defer resp.Body.Close()
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Buffer(make([]byte, 4096), 1024*512)
@@ -209,16 +213,53 @@ func (client *HttpClient) SendReqBySyncRespStream(request *HttpRequest, handler
 		if !handler(scanner.Bytes(), nil) {
 			return
 		}
-		if err = scanner.Err(); err != nil {
-			handler(nil, err)
-		}
 	}
+	if ctx.Err() != nil {
+		handler(nil, ctx.Err())
+		return
+	}
+	if err := scanner.Err(); err != nil {
+		handler(nil, err)
+	}
+}
+
+// StatusError 响应状态码异常
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("http status %d, body: %s", e.StatusCode, e.Body)
+}
+
+// CheckStatus 状态码>=400时读取响应体（最多4KB）并返回 *StatusError，不关闭响应体
+func CheckStatus(resp *http.Response) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &StatusError{StatusCode: resp.StatusCode, Body: string(b)}
+}
+
+// StatusBody 兼容状态码>=400时返回响应体的旧接口：err 为 *StatusError 时返回其响应体且不返回错误，其他情况原样返回
+func StatusBody(r string, err error) (string, error) {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Body, nil
+	}
+	return r, err
 }
 
 // SendReqByRespStruct 将结果映射成结构体
 func (client *HttpClient) SendReqByRespStruct(request *HttpRequest, target any) error {
+	return client.SendReqByRespStructCtx(client.context(), request, target)
+}
 
-	resp, err := client.SendRequest(request)
+// SendReqByRespStructCtx 将结果映射成结构体
+func (client *HttpClient) SendReqByRespStructCtx(ctx context.Context, request *HttpRequest, target any) error {
+
+	resp, err := client.SendRequestCtx(ctx, request)
 	if err != nil {
 		return err
 	}
@@ -232,8 +273,13 @@ func (client *HttpClient) SendReqByRespStruct(request *HttpRequest, target any)
 
 // SendReqByRespString 将结果映射成string
 func (client *HttpClient) SendReqByRespString(request *HttpRequest) (string, error) {
+	return client.SendReqByRespStringCtx(client.context(), request)
+}
 
-	resp, err := client.SendRequest(request)
+// SendReqByRespStringCtx 将结果映射成string
+func (client *HttpClient) SendReqByRespStringCtx(ctx context.Context, request *HttpRequest) (string, error) {
+
+	resp, err := client.SendRequestCtx(ctx, request)
 	if err != nil {
 		return "", err
 	}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xconfig"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlock"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xmemory"
+	"time"
 )
 
 // ============================================================================
@@ -40,7 +42,15 @@ func InitMemoryManager() *MemoryInitResult {
 	}
 
 	// 初始化锁管理器
-	lockManager := xlock.NewSessionLockManager()
+	lockManager := xlock.NewSessionLockManagerWithOptions(xlock.Options{
+		TTL:          time.Duration(config.SessionLockTTL) * time.Millisecond,
+		WaitTimeout:  time.Duration(config.SessionLockWaitTimeout) * time.Millisecond,
+		MaxIdleLocks: config.SessionLockMaxIdle,
+		KeyPrefix:    config.SessionLockKeyPrefix,
+		OnError: func(conversationID string, err error) {
+			xlog.LogErrorF("10000", "memory", "session-lock", fmt.Sprintf("会话[%s]分布式锁不可用,加锁失败", conversationID), err)
+		},
+	})
 
 	// 初始化消息构建器
 	messageBuilder := xmemory.NewMessageBuilder(
@@ -0,0 +1,309 @@
+package xllm
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ============================================================================
+// OpenAI 兼容的对话接口数据结构
+// ============================================================================
+
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleTool      = "tool"
+
+	FinishReasonStop      = "stop"
+	FinishReasonLength    = "length"
+	FinishReasonToolCalls = "tool_calls"
+
+	ResponseFormatText       = "text"
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+// Message 对话消息
+type Message struct {
+	Role             string     `json:"role"`
+	Content          string     `json:"content"`
+	Name             string     `json:"name,omitempty"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID       string     `json:"tool_call_id,omitempty"`
+}
+
+// SystemMessage 系统消息
+func SystemMessage(content string) Message {
+	return Message{Role: RoleSystem, Content: content}
+}
+
+// UserMessage 用户消息
+func UserMessage(content string) Message {
+	return Message{Role: RoleUser, Content: content}
+}
+
+// AssistantMessage 助手消息
+func AssistantMessage(content string) Message {
+	return Message{Role: RoleAssistant, Content: content}
+}
+
+// ToolMessage 工具执行结果消息
+func ToolMessage(toolCallID, content string) Message {
+	return Message{Role: RoleTool, ToolCallID: toolCallID, Content: content}
+}
+
+// Tool 可供模型调用的工具
+type Tool struct {
+	Type     string      `json:"type"`
+	Function FunctionDef `json:"function"`
+}
+
+// FunctionDef 工具函数定义，Parameters 为 JSON Schema
+type FunctionDef struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters,omitempty"`
+}
+
+// FunctionTool 创建函数类型的工具
+func FunctionTool(name, description string, parameters any) Tool {
+	return Tool{Type: "function", Function: FunctionDef{Name: name, Description: description, Parameters: parameters}}
+}
+
+// ToolCall 模型发起的工具调用
+// 流式响应中同一个调用会被拆成多个分片，通过 Index 关联
+type ToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
+// FunctionCall 工具调用的函数名和参数，Arguments 为 JSON 字符串
+type FunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
+// ResponseFormat 指定模型输出格式
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+// JSONSchema response_format 为 json_schema 时的结构定义
+type JSONSchema struct {
+	Name   string `json:"name"`
+	Schema any    `json:"schema"`
+	Strict bool   `json:"strict,omitempty"`
+}
+
+// StreamOptions 流式响应选项
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ChatRequest 对话请求
+// Extra 中的字段会平铺到请求体中，用于传递模型厂商的扩展参数（如 enable_thinking）
+type ChatRequest struct {
+	Model          string          `json:"model"`
+	Messages       []Message       `json:"messages"`
+	Tools          []Tool          `json:"tools,omitempty"`
+	ToolChoice     any             `json:"tool_choice,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Temperature    *float64        `json:"temperature,omitempty"`
+	TopP           *float64        `json:"top_p,omitempty"`
+	MaxTokens      int             `json:"max_tokens,omitempty"`
+	Stop           []string        `json:"stop,omitempty"`
+	Stream         bool            `json:"stream"`
+	StreamOptions  *StreamOptions  `json:"stream_options,omitempty"`
+	Extra          map[string]any  `json:"-"`
+}
+
+// NewChatRequest 创建对话请求
+func NewChatRequest(messages ...Message) *ChatRequest {
+	return &ChatRequest{Messages: messages}
+}
+
+// NewPromptRequest 创建单轮提示词请求，等价于各智能体中的 buildPromptRequest
+func NewPromptRequest(prompt string) *ChatRequest {
+	return NewChatRequest(SystemMessage("You are a helpful assistant."), UserMessage(prompt))
+}
+
+// WithTemperature 设置温度
+func (r *ChatRequest) WithTemperature(t float64) *ChatRequest {
+	r.Temperature = &t
+	return r
+}
+
+// SetExtra 设置扩展参数
+func (r *ChatRequest) SetExtra(key string, value any) *ChatRequest {
+	if r.Extra == nil {
+		r.Extra = make(map[string]any)
+	}
+	r.Extra[key] = value
+	return r
+}
+
+// Clone 复制请求，消息和扩展参数为浅拷贝，修改副本的消息列表不影响原请求
+func (r *ChatRequest) Clone() *ChatRequest {
+	c := *r
+	c.Messages = append([]Message(nil), r.Messages...)
+	if r.Extra != nil {
+		c.Extra = make(map[string]any, len(r.Extra))
+		for k, v := range r.Extra {
+			c.Extra[k] = v
+		}
+	}
+	return &c
+}
+
+type chatRequestAlias ChatRequest
+
+// MarshalJSON 将 Extra 平铺到请求体
+func (r ChatRequest) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(chatRequestAlias(r))
+	if err != nil || len(r.Extra) == 0 {
+		return b, err
+	}
+	m := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	for k, v := range r.Extra {
+		if _, ok := m[k]; ok {
+			continue
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		m[k] = raw
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON 未定义的字段保存到 Extra
+func (r *ChatRequest) UnmarshalJSON(b []byte) error {
+	var alias chatRequestAlias
+	if err := json.Unmarshal(b, &alias); err != nil {
+		return err
+	}
+	m := make(map[string]any)
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	for _, k := range knownRequestFields {
+		delete(m, k)
+	}
+	*r = ChatRequest(alias)
+	if len(m) > 0 {
+		r.Extra = m
+	}
+	return nil
+}
+
+var knownRequestFields = []string{"model", "messages", "tools", "tool_choice", "response_format",
+	"temperature", "top_p", "max_tokens", "stop", "stream", "stream_options"}
+
+// ChatRequestFromMap 将 map 形式的请求转换为 ChatRequest，兼容旧的 map[string]interface{} 调用方式
+func ChatRequestFromMap(m map[string]interface{}) (*ChatRequest, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	r := &ChatRequest{}
+	if err = json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Usage token 用量
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Choice 非流式响应的候选结果
+type Choice struct {
+	Index        int     `json:"index"`
+	Message      Message `json:"message"`
+	FinishReason string  `json:"finish_reason"`
+}
+
+// ChatResponse 非流式对话响应
+// Raw 为原始响应体
+type ChatResponse struct {
+	ID      string   `json:"id"`
+	Object  string   `json:"object"`
+	Created int64    `json:"created"`
+	Model   string   `json:"model"`
+	Choices []Choice `json:"choices"`
+	Usage   *Usage   `json:"usage,omitempty"`
+	Raw     string   `json:"-"`
+}
+
+// Message 第一个候选结果的消息，没有候选结果时返回空消息
+func (r *ChatResponse) Message() Message {
+	if r == nil || len(r.Choices) == 0 {
+		return Message{}
+	}
+	return r.Choices[0].Message
+}
+
+// Content 第一个候选结果的文本内容
+func (r *ChatResponse) Content() string {
+	return strings.TrimSpace(r.Message().Content)
+}
+
+// FinishReason 第一个候选结果的结束原因
+func (r *ChatResponse) FinishReason() string {
+	if r == nil || len(r.Choices) == 0 {
+		return ""
+	}
+	return r.Choices[0].FinishReason
+}
+
+// ChunkChoice 流式响应分片的候选结果
+type ChunkChoice struct {
+	Index        int     `json:"index"`
+	Delta        Message `json:"delta"`
+	FinishReason string  `json:"finish_reason"`
+}
+
+// ChatChunk 流式响应分片
+// Raw 为分片原始的 data 内容
+type ChatChunk struct {
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int64         `json:"created"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+	Usage   *Usage        `json:"usage,omitempty"`
+	Raw     []byte        `json:"-"`
+}
+
+// Delta 第一个候选结果的增量消息
+func (c *ChatChunk) Delta() Message {
+	if c == nil || len(c.Choices) == 0 {
+		return Message{}
+	}
+	return c.Choices[0].Delta
+}
+
+// Content 第一个候选结果的增量文本
+func (c *ChatChunk) Content() string {
+	return c.Delta().Content
+}
+
+// FinishReason 第一个候选结果的结束原因
+func (c *ChatChunk) FinishReason() string {
+	if c == nil || len(c.Choices) == 0 {
+		return ""
+	}
+	return c.Choices[0].FinishReason
+}
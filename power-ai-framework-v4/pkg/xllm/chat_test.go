@@ -0,0 +1,66 @@
+package xllm
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChatRequestExtra(t *testing.T) {
+	r, err := ChatRequestFromMap(map[string]interface{}{
+		"model": "qwen",
+		"messages": []interface{}{
+			map[string]string{"role": "user", "content": "你好"},
+		},
+		"enable_thinking": false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Model != "qwen" || len(r.Messages) != 1 || r.Messages[0].Content != "你好" {
+		t.Fatalf("unexpected request: %+v", r)
+	}
+	if v, ok := r.Extra["enable_thinking"]; !ok || v != false {
+		t.Fatalf("extra field lost: %+v", r.Extra)
+	}
+
+	b, _ := json.Marshal(r)
+	m := make(map[string]interface{})
+	_ = json.Unmarshal(b, &m)
+	if m["enable_thinking"] != false || m["model"] != "qwen" {
+		t.Fatalf("extra field not flattened: %s", string(b))
+	}
+}
+
+func TestChatStream(t *testing.T) {
+	body := strings.Join([]string{
+		`data: {"choices":[{"index":0,"delta":{"content":"<think>"}}]}`,
+		``,
+		`data: {"choices":[{"index":0,"delta":{"content":"你"}}]}`,
+		``,
+		`data: {"choices":[{"index":0,"delta":{"content":"好"},"finish_reason":"stop"}]}`,
+		``,
+		`data: {"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		``,
+		`data: [DONE]`,
+	}, "\n")
+	s := NewChatStream(io.NopCloser(strings.NewReader(body)), func(c *ChatChunk) bool {
+		return c.Content() != "<think>"
+	})
+	defer s.Close()
+
+	var n int
+	for s.Next() {
+		n++
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || s.Content() != "你好" {
+		t.Fatalf("unexpected stream result: n=%d content=%s", n, s.Content())
+	}
+	if s.Usage() == nil || s.Usage().TotalTokens != 5 {
+		t.Fatalf("usage not parsed: %+v", s.Usage())
+	}
+}
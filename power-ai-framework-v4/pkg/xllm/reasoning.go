@@ -0,0 +1,211 @@
+package xllm
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ============================================================================
+// 思考（reasoning）内容处理策略
+// ============================================================================
+
+const (
+	ReasoningStrip    = "strip"    // 去除思考内容（默认）
+	ReasoningKeep     = "keep"     // 不做任何处理，原样返回
+	ReasoningSeparate = "separate" // 思考内容从正文中分离，放到 reasoning_content 字段
+)
+
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+// ReasoningPolicy 模型的思考策略，配置在系统模型 SystemModel 的 reasoning 字段
+//
+//	{
+//	  "no_think_suffix": "/no_think",   用户消息追加的后缀，为空不追加（非Qwen模型请置空）
+//	  "enable_thinking": false,         请求体中的 enable_thinking 参数，不配置则不发送
+//	  "mode": "strip"                   strip/keep/separate
+//	}
+type ReasoningPolicy struct {
+	NoThinkSuffix  string `json:"no_think_suffix"`
+	EnableThinking *bool  `json:"enable_thinking,omitempty"`
+	Mode           string `json:"mode"`
+}
+
+// DefaultReasoningPolicy 未配置策略时使用，与历史行为一致：追加 /no_think、关闭思考、去除思考内容
+func DefaultReasoningPolicy() *ReasoningPolicy {
+	disabled := false
+	return &ReasoningPolicy{
+		NoThinkSuffix:  "/no_think",
+		EnableThinking: &disabled,
+		Mode:           ReasoningStrip,
+	}
+}
+
+// mode 未配置时为 strip
+func (p *ReasoningPolicy) mode() string {
+	if p == nil || p.Mode == "" {
+		return ReasoningStrip
+	}
+	return p.Mode
+}
+
+// ApplyRequest 按策略修改请求：用户消息追加后缀、设置 enable_thinking
+// 会修改 r，调用方应传入副本
+func (p *ReasoningPolicy) ApplyRequest(r *ChatRequest) {
+	if p == nil {
+		return
+	}
+	if p.NoThinkSuffix != "" {
+		for i := range r.Messages {
+			if r.Messages[i].Role == RoleUser && !strings.HasSuffix(r.Messages[i].Content, p.NoThinkSuffix) {
+				r.Messages[i].Content += p.NoThinkSuffix
+			}
+		}
+	}
+	if p.EnableThinking != nil {
+		r.SetExtra("enable_thinking", *p.EnableThinking)
+	}
+}
+
+// ApplyMessage 按策略处理非流式响应的消息
+func (p *ReasoningPolicy) ApplyMessage(m *Message) {
+	mode := p.mode()
+	if mode == ReasoningKeep {
+		return
+	}
+	reasoning, content := SplitThink(m.Content)
+	m.Content = strings.TrimSpace(content)
+	if mode == ReasoningSeparate {
+		m.ReasoningContent += reasoning
+	} else {
+		m.ReasoningContent = ""
+	}
+}
+
+// NewStreamFilter 创建流式响应的过滤器，每个流使用独立的过滤器
+func (p *ReasoningPolicy) NewStreamFilter() *StreamFilter {
+	return &StreamFilter{mode: p.mode()}
+}
+
+// StreamFilter 按策略处理流式响应分片
+type StreamFilter struct {
+	mode   string
+	parser ThinkParser
+}
+
+// Filter 处理分片，修改分片的 content/reasoning_content
+// 返回 false 表示分片只包含被处理掉的思考内容，应当丢弃；没有文本的分片（如只包含 role 的首个分片）总是保留
+func (f *StreamFilter) Filter(c *ChatChunk) bool {
+	if f.mode == ReasoningKeep || len(c.Choices) == 0 {
+		return true
+	}
+	d := &c.Choices[0].Delta
+	hasText := d.Content != "" || d.ReasoningContent != ""
+	reasoning, content := f.parser.Feed(d.Content)
+	if c.Choices[0].FinishReason != "" {
+		r, t := f.parser.Flush()
+		reasoning += r
+		content += t
+	}
+	d.Content = content
+	if f.mode == ReasoningSeparate {
+		d.ReasoningContent += reasoning
+	} else {
+		d.ReasoningContent = ""
+	}
+	return !hasText || d.Content != "" || d.ReasoningContent != "" || d.Role != "" || len(d.ToolCalls) > 0 ||
+		c.Choices[0].FinishReason != "" || c.Usage != nil
+}
+
+// SplitThink 将完整文本拆分为思考内容和正文
+func SplitThink(text string) (reasoning, content string) {
+	var p ThinkParser
+	reasoning, content = p.Feed(text)
+	r, t := p.Flush()
+	return reasoning + r, content + t
+}
+
+const (
+	thinkStateStart = iota // 尚未确定是否有思考内容
+	thinkStateIn           // 思考内容中
+	thinkStateAfter        // 思考结束，跳过 </think> 后的空白
+	thinkStateOut          // 正文
+)
+
+// ThinkParser 流式思考标签解析状态机
+// 只识别正文开头的 <think>...</think>，标签可以被拆分在多个分片中
+type ThinkParser struct {
+	state   int
+	pending string
+}
+
+// Feed 输入一个分片的文本，返回其中可以确定的思考内容和正文
+// 可能是标签一部分的文本会暂存，等待后续分片
+func (p *ThinkParser) Feed(s string) (reasoning, content string) {
+	text := p.pending + s
+	p.pending = ""
+	for text != "" {
+		switch p.state {
+		case thinkStateStart:
+			trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+			if strings.HasPrefix(trimmed, thinkOpenTag) {
+				text = trimmed[len(thinkOpenTag):]
+				p.state = thinkStateIn
+				continue
+			}
+			if strings.HasPrefix(thinkOpenTag, trimmed) {
+				// 空白或标签前缀，等待后续分片
+				p.pending = text
+				return
+			}
+			p.state = thinkStateOut
+		case thinkStateIn:
+			if i := strings.Index(text, thinkCloseTag); i >= 0 {
+				reasoning += text[:i]
+				text = text[i+len(thinkCloseTag):]
+				p.state = thinkStateAfter
+				continue
+			}
+			n := partialSuffix(text, thinkCloseTag)
+			reasoning += text[:len(text)-n]
+			p.pending = text[len(text)-n:]
+			return
+		case thinkStateAfter:
+			text = strings.TrimLeftFunc(text, unicode.IsSpace)
+			if text == "" {
+				return
+			}
+			p.state = thinkStateOut
+		case thinkStateOut:
+			content += text
+			return
+		}
+	}
+	return
+}
+
+// Flush 流结束时输出暂存的文本
+func (p *ThinkParser) Flush() (reasoning, content string) {
+	text := p.pending
+	p.pending = ""
+	switch p.state {
+	case thinkStateIn:
+		return text, ""
+	case thinkStateAfter:
+		return "", ""
+	default:
+		return "", text
+	}
+}
+
+// partialSuffix text 结尾与 tag 前缀重合的最大长度
+func partialSuffix(text, tag string) int {
+	for n := len(tag) - 1; n > 0; n-- {
+		if strings.HasSuffix(text, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,75 @@
+package xllm
+
+import (
+	"testing"
+)
+
+func TestSplitThink(t *testing.T) {
+	cases := []struct {
+		text, reasoning, content string
+	}{
+		{"<think>\n\n</think>\n\n你好", "\n\n", "你好"},
+		{"<think>先分析</think>结论", "先分析", "结论"},
+		{"没有思考", "", "没有思考"},
+		{"  \n正文 <think>不是开头</think>", "", "  \n正文 <think>不是开头</think>"},
+	}
+	for _, c := range cases {
+		r, content := SplitThink(c.text)
+		if r != c.reasoning || content != c.content {
+			t.Fatalf("SplitThink(%q) = %q, %q", c.text, r, content)
+		}
+	}
+}
+
+func TestThinkParserSplitTags(t *testing.T) {
+	var p ThinkParser
+	var reasoning, content string
+	for _, s := range []string{"\n<thi", "nk>思", "考</th", "ink>", "\n\n", "答", "案"} {
+		r, c := p.Feed(s)
+		reasoning += r
+		content += c
+	}
+	r, c := p.Flush()
+	reasoning += r
+	content += c
+	if reasoning != "思考" || content != "答案" {
+		t.Fatalf("reasoning=%q content=%q", reasoning, content)
+	}
+}
+
+func TestStreamFilter(t *testing.T) {
+	chunk := func(content, finish string) *ChatChunk {
+		return &ChatChunk{Choices: []ChunkChoice{{Delta: Message{Content: content}, FinishReason: finish}}}
+	}
+	f := (&ReasoningPolicy{Mode: ReasoningSeparate}).NewStreamFilter()
+	var reasoning, content string
+	for _, c := range []*ChatChunk{chunk("<think>", ""), chunk("想", ""), chunk("</think>", ""), chunk("好", ""), chunk("", "stop")} {
+		if f.Filter(c) {
+			reasoning += c.Delta().ReasoningContent
+			content += c.Content()
+		}
+	}
+	if reasoning != "想" || content != "好" {
+		t.Fatalf("reasoning=%q content=%q", reasoning, content)
+	}
+
+	strip := DefaultReasoningPolicy().NewStreamFilter()
+	if strip.Filter(chunk("<think>", "")) || strip.Filter(chunk("\n\n", "")) || strip.Filter(chunk("</think>", "")) {
+		t.Fatal("empty think chunks should be dropped")
+	}
+	if c := chunk("答", ""); !strip.Filter(c) || c.Content() != "答" {
+		t.Fatal("content chunk should be kept")
+	}
+
+	strip = DefaultReasoningPolicy().NewStreamFilter()
+	role := &ChatChunk{Choices: []ChunkChoice{{Delta: Message{Role: RoleAssistant}}}}
+	if !strip.Filter(role) {
+		t.Fatal("role-only chunk should be kept")
+	}
+	if strip.Filter(chunk("<think>", "")) {
+		t.Fatal("think chunk after role should be dropped")
+	}
+	if !strip.Filter(&ChatChunk{Choices: []ChunkChoice{{Delta: Message{Role: RoleAssistant, Content: "</think>"}}}}) {
+		t.Fatal("chunk carrying role should be kept")
+	}
+}
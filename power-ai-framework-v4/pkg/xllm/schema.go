@@ -0,0 +1,377 @@
+package xllm
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// JSON Schema 推导与校验
+// 只支持结构化输出常用的子集：type、properties、required、items、additionalProperties（布尔值或 schema）、enum、description
+// 结构化输出和配置值校验（xconfig.JSONSchema）共用该校验器
+// ============================================================================
+
+// Schema JSON Schema
+type Schema map[string]any
+
+// SchemaOf 根据 Go 类型推导 JSON Schema
+// 结构体字段使用 json 标签作为属性名，没有 omitempty 且不是指针的字段为必填，其他字段允许为 null
+// 字段标签 description 为字段说明，enum 为逗号分隔的枚举值，按字段类型转为数字、布尔值或字符串
+//
+//	type Intent struct {
+//	    Intent string `json:"intent" description:"用户意图" enum:"consult,book"`
+//	    Name   string `json:"name,omitempty" description:"医生姓名"`
+//	}
+func SchemaOf(v any) Schema {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return Schema{}
+	}
+	return schemaOfType(t, map[reflect.Type]bool{})
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func schemaOfType(t reflect.Type, visiting map[reflect.Type]bool) Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return Schema{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return Schema{"type": "array", "items": schemaOfType(t.Elem(), visiting)}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": schemaOfType(t.Elem(), visiting)}
+	case reflect.Struct:
+		if visiting[t] {
+			// 递归类型不再展开
+			return Schema{"type": "object"}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		properties := Schema{}
+		required := make([]string, 0)
+		addStructFields(t, properties, &required, visiting)
+		s := Schema{"type": "object", "properties": properties, "additionalProperties": false}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	default:
+		return Schema{}
+	}
+}
+
+func addStructFields(t reflect.Type, properties Schema, required *[]string, visiting map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addStructFields(ft, properties, required, visiting)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := schemaOfType(f.Type, visiting)
+		if d := f.Tag.Get("description"); d != "" {
+			s["description"] = d
+		}
+		if e := f.Tag.Get("enum"); e != "" {
+			s["enum"] = enumValues(f.Type, e)
+		}
+		properties[name] = s
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		} else {
+			nullable(s)
+		}
+	}
+}
+
+// nullable 非必填字段允许 null，模型对没有值的可选字段常回复 null 而不是省略
+func nullable(s Schema) {
+	typ, ok := s["type"].(string)
+	if !ok {
+		return
+	}
+	s["type"] = []string{typ, "null"}
+	if enum, ok := s["enum"].([]any); ok {
+		s["enum"] = append(enum, nil)
+	}
+}
+
+// enumValues 按字段类型转换 enum 标签中的值，无法转换的值保留为字符串
+func enumValues(t reflect.Type, tag string) []any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	parts := strings.Split(tag, ",")
+	values := make([]any, 0, len(parts))
+	for _, p := range parts {
+		var v any = p
+		var err error
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			var n int64
+			if n, err = strconv.ParseInt(strings.TrimSpace(p), 10, 64); err == nil {
+				v = n
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			var n uint64
+			if n, err = strconv.ParseUint(strings.TrimSpace(p), 10, 64); err == nil {
+				v = n
+			}
+		case reflect.Float32, reflect.Float64:
+			var n float64
+			if n, err = strconv.ParseFloat(strings.TrimSpace(p), 64); err == nil {
+				v = n
+			}
+		case reflect.Bool:
+			var b bool
+			if b, err = strconv.ParseBool(strings.TrimSpace(p)); err == nil {
+				v = b
+			}
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// String schema 的 JSON 字符串，用于拼接提示词
+func (s Schema) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// Validate 校验 JSON 解码后的值（map[string]any/[]any/string/float64/bool/nil）是否符合 schema
+func (s Schema) Validate(v any) error {
+	return validateSchema(map[string]any(s), v, "$")
+}
+
+func validateSchema(s map[string]any, v any, path string) error {
+	if types := schemaTypes(s["type"]); len(types) > 0 {
+		if err := validateType(types, v, path); err != nil {
+			return err
+		}
+	}
+	if enum := toList(s["enum"]); len(enum) > 0 {
+		found := false
+		for _, e := range enum {
+			if enumEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s 的值 %v 不在可选值 %v 中", path, v, enum)
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		for _, name := range toStrings(s["required"]) {
+			if _, ok := val[name]; !ok {
+				return fmt.Errorf("缺少必填字段 %s.%s", path, name)
+			}
+		}
+		props := toSchema(s["properties"])
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if ps, ok := props[name]; ok {
+				if err := validateSchema(toSchema(ps), val[name], path+"."+name); err != nil {
+					return err
+				}
+			} else if allowed, ok := s["additionalProperties"].(bool); ok && !allowed {
+				return fmt.Errorf("%s.%s 不是允许的字段", path, name)
+			} else if ap := toSchema(s["additionalProperties"]); ap != nil {
+				if err := validateSchema(ap, val[name], path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case []any:
+		if items := toSchema(s["items"]); items != nil {
+			for i, item := range val {
+				if err := validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// schemaTypes type 可能是字符串或字符串数组（如 ["string","null"]）
+func schemaTypes(v any) []string {
+	if typ, ok := v.(string); ok {
+		return []string{typ}
+	}
+	return toStrings(v)
+}
+
+func validateType(types []string, v any, path string) error {
+	for _, typ := range types {
+		if matchType(typ, v) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s 的类型应为 %s", path, strings.Join(types, "/"))
+}
+
+func matchType(typ string, v any) bool {
+	ok := false
+	switch typ {
+	case "object":
+		_, ok = v.(map[string]any)
+	case "array":
+		_, ok = v.([]any)
+	case "string":
+		_, ok = v.(string)
+	case "boolean":
+		_, ok = v.(bool)
+	case "number":
+		_, ok = v.(float64)
+	case "integer":
+		f, isNum := v.(float64)
+		ok = isNum && f == float64(int64(f))
+	case "null":
+		ok = v == nil
+	default:
+		ok = true
+	}
+	return ok
+}
+
+// toSchema schema 可能是 Schema 或从 JSON 解码的 map[string]any
+func toSchema(v any) map[string]any {
+	switch s := v.(type) {
+	case Schema:
+		return s
+	case map[string]any:
+		return s
+	}
+	return nil
+}
+
+// toList enum 可能是 []string、[]any 或其他切片
+func toList(v any) []any {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return nil
+	}
+	r := make([]any, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		r = append(r, rv.Index(i).Interface())
+	}
+	return r
+}
+
+// enumEqual 数字按数值比较，其他值要求类型和值都相同
+func enumEqual(e, v any) bool {
+	if ef, ok := toFloat(e); ok {
+		vf, ok := toFloat(v)
+		return ok && ef == vf
+	}
+	return reflect.DeepEqual(e, v)
+}
+
+func toFloat(v any) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+func toStrings(v any) []string {
+	switch s := v.(type) {
+	case []string:
+		return s
+	case []any:
+		r := make([]string, 0, len(s))
+		for _, item := range s {
+			r = append(r, fmt.Sprint(item))
+		}
+		return r
+	}
+	return nil
+}
+
+// ExtractJSON 从模型回复中提取 JSON 文本
+// 去除思考内容和 markdown 代码块标记，截取第一个完整的对象或数组
+func ExtractJSON(text string) string {
+	_, text = SplitThink(text)
+	text = strings.TrimSpace(text)
+	start := strings.IndexAny(text, "{[")
+	if start < 0 {
+		return text
+	}
+	depth := 0
+	inString := false
+	escaped := false
+	for i := start; i < len(text); i++ {
+		c := text[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				return text[start : i+1]
+			}
+		}
+	}
+	return text[start:]
+}
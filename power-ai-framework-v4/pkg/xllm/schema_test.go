@@ -0,0 +1,90 @@
+package xllm
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type testIntent struct {
+	Intent string   `json:"intent" description:"用户意图" enum:"consult,book"`
+	Name   string   `json:"name,omitempty"`
+	Score  float64  `json:"score"`
+	Level  int      `json:"level,omitempty" enum:"1,2,3"`
+	Tags   []string `json:"tags,omitempty"`
+	Doctor *struct {
+		Id int `json:"id"`
+	} `json:"doctor,omitempty"`
+}
+
+func TestSchemaOf(t *testing.T) {
+	s := SchemaOf(testIntent{})
+	if s["type"] != "object" {
+		t.Fatalf("unexpected type: %v", s["type"])
+	}
+	required := s["required"].([]string)
+	if len(required) != 2 || required[0] != "intent" || required[1] != "score" {
+		t.Fatalf("unexpected required: %v", required)
+	}
+	props := s["properties"].(Schema)
+	if props["intent"].(Schema)["description"] != "用户意图" {
+		t.Fatalf("description lost: %v", props["intent"])
+	}
+	if enum, _ := json.Marshal(props["level"].(Schema)["enum"]); string(enum) != "[1,2,3,null]" {
+		t.Fatalf("int enum not typed: %s", enum)
+	}
+	if typ, _ := json.Marshal(props["name"].(Schema)["type"]); string(typ) != `["string","null"]` {
+		t.Fatalf("optional field not nullable: %s", typ)
+	}
+	if props["intent"].(Schema)["type"] != "string" {
+		t.Fatalf("required field should not be nullable: %v", props["intent"])
+	}
+	if props["doctor"].(Schema)["properties"].(Schema)["id"].(Schema)["type"] != "integer" {
+		t.Fatalf("nested struct not derived: %v", props["doctor"])
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	s := SchemaOf(testIntent{})
+	cases := []struct {
+		json string
+		ok   bool
+	}{
+		{`{"intent":"consult","score":0.9}`, true},
+		{`{"intent":"consult","score":0.9,"tags":["a"],"doctor":{"id":1}}`, true},
+		{`{"intent":"consult"}`, false},
+		{`{"intent":"other","score":1}`, false},
+		{`{"intent":"book","score":1,"level":2}`, true},
+		{`{"intent":"book","score":1,"level":4}`, false},
+		{`{"intent":"book","score":1,"level":"2"}`, false},
+		{`{"intent":"book","score":"high"}`, false},
+		{`{"intent":"book","score":1,"doctor":{"id":1.5}}`, false},
+		{`{"intent":"book","score":1,"extra":true}`, false},
+		{`{"intent":"book","score":1,"name":null,"level":null,"tags":null,"doctor":null}`, true},
+		{`{"intent":null,"score":1}`, false},
+		{`{"intent":"book","score":1,"doctor":{"id":null}}`, false},
+		{`["consult"]`, false},
+	}
+	for _, c := range cases {
+		var v any
+		if err := json.Unmarshal([]byte(c.json), &v); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Validate(v); (err == nil) != c.ok {
+			t.Errorf("Validate(%s) = %v, want ok=%v", c.json, err, c.ok)
+		}
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	cases := map[string]string{
+		"{\"a\":1}":               `{"a":1}`,
+		"```json\n{\"a\":1}\n```": `{"a":1}`,
+		"<think>\n想一想{}\n</think>\n\n{\"a\":\"}\"}": `{"a":"}"}`,
+		"结果如下：[1,2] 以上":                             `[1,2]`,
+	}
+	for in, want := range cases {
+		if got := ExtractJSON(in); got != want {
+			t.Errorf("ExtractJSON(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package xllm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ============================================================================
+// 流式响应迭代器
+// ============================================================================
+
+var (
+	sseDataPrefix = []byte("data:")
+	sseDone       = []byte("[DONE]")
+)
+
+// ChatStream 流式响应迭代器，按 SSE 协议逐个解析 data 分片
+//
+// 使用方式:
+//
+//	stream, err := app.ChatStreamCtx(ctx, enterpriseId, req)
+//	if err != nil { ... }
+//	defer stream.Close()
+//	for stream.Next() {
+//	    chunk := stream.Chunk()
+//	}
+//	if err := stream.Err(); err != nil { ... }
+type ChatStream struct {
+	body      io.ReadCloser
+	scanner   *bufio.Scanner
+	filter    func(c *ChatChunk) bool
+	onUsage   func(u *Usage)
+	cur       *ChatChunk
+	usage     *Usage
+	content   bytes.Buffer
+	reasoning bytes.Buffer
+	err       error
+	done      bool
+}
+
+// NewChatStream 创建流式响应迭代器
+// filter 不为空时，每个分片先经过 filter 处理，返回 false 的分片会被跳过，如 StreamFilter.Filter
+func NewChatStream(body io.ReadCloser, filter func(c *ChatChunk) bool) *ChatStream {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 4096), 1024*512)
+	return &ChatStream{body: body, scanner: scanner, filter: filter}
+}
+
+// Next 读取下一个分片，没有更多分片或出错时返回 false
+func (s *ChatStream) Next() bool {
+	if s.done || s.err != nil {
+		return false
+	}
+	for s.scanner.Scan() {
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if !bytes.HasPrefix(line, sseDataPrefix) {
+			continue
+		}
+		data := bytes.TrimSpace(line[len(sseDataPrefix):])
+		if bytes.Equal(data, sseDone) {
+			s.done = true
+			return false
+		}
+		chunk := &ChatChunk{}
+		if err := json.Unmarshal(data, chunk); err != nil {
+			s.err = fmt.Errorf("解析流式响应分片失败: %w, data: %s", err, string(data))
+			return false
+		}
+		chunk.Raw = append([]byte(nil), data...)
+		if chunk.Usage != nil {
+			s.usage = chunk.Usage
+			if s.onUsage != nil {
+				s.onUsage(chunk.Usage)
+			}
+		}
+		if s.filter != nil && !s.filter(chunk) {
+			continue
+		}
+		s.content.WriteString(chunk.Content())
+		s.reasoning.WriteString(chunk.Delta().ReasoningContent)
+		s.cur = chunk
+		return true
+	}
+	s.err = s.scanner.Err()
+	s.done = true
+	return false
+}
+
+// OnUsage 读取到 token 用量时回调，需要请求时开启 stream_options.include_usage
+func (s *ChatStream) OnUsage(f func(u *Usage)) {
+	s.onUsage = f
+}
+
+// Chunk 当前分片
+func (s *ChatStream) Chunk() *ChatChunk {
+	return s.cur
+}
+
+// Err 迭代过程中的错误，正常结束为 nil
+func (s *ChatStream) Err() error {
+	return s.err
+}
+
+// Usage 流中返回的 token 用量，需要请求时开启 stream_options.include_usage
+func (s *ChatStream) Usage() *Usage {
+	return s.usage
+}
+
+// Content 已读取分片拼接的完整文本
+func (s *ChatStream) Content() string {
+	return s.content.String()
+}
+
+// ReasoningContent 已读取分片拼接的思考内容，思考策略为 separate 时才有值
+func (s *ChatStream) ReasoningContent() string {
+	return s.reasoning.String()
+}
+
+// Close 关闭响应体，提前结束迭代时必须调用
+func (s *ChatStream) Close() error {
+	s.done = true
+	return s.body.Close()
+}
@@ -1,43 +1,182 @@
 package xlock
 
 import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 )
 
 // ============================================================================
 // 会话级并发锁管理
+// 本地锁保证同一实例内串行，配置 Backend（Redis）后再获取分布式锁，保证多个实例之间串行
+// 每次获得分布式锁时生成递增的 fencing token，续期失败、锁已被其他实例获得后，写入方通过 token 拒绝过期持有者的写入
 // ============================================================================
 
+var (
+	// ErrLockTimeout 等待会话锁超时
+	ErrLockTimeout = errors.New("wait session lock timeout")
+	// ErrBackendUnavailable 分布式锁存储不可用，此时不持有锁
+	ErrBackendUnavailable = errors.New("session lock backend unavailable")
+)
+
+const (
+	defaultTTL           = 30 * time.Second
+	defaultWaitTimeout   = 10 * time.Second
+	defaultRetryInterval = 50 * time.Millisecond
+	defaultMaxIdleLocks  = 10000
+	defaultKeyPrefix     = "short_term_memory:lock:%s"
+	// fenceTTL token key 的过期时间，每次加锁时刷新
+	fenceTTL = 24 * time.Hour
+)
+
+// acquireScript 加锁成功返回递增的 fencing token，失败返回0
+// KEYS[1] 锁key，KEYS[2] token key，ARGV[1] 持有者标识，ARGV[2] 过期时间（毫秒），ARGV[3] 当前时间（毫秒），ARGV[4] token key 过期时间（毫秒）
+// token key 不存在时以当前时间为初值，token key 过期后生成的 token 仍大于之前的 token
+const acquireScript = `if redis.call('set', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	if redis.call('exists', KEYS[2]) == 0 then
+		redis.call('set', KEYS[2], ARGV[3])
+	end
+	local token = redis.call('incr', KEYS[2])
+	redis.call('pexpire', KEYS[2], ARGV[4])
+	return token
+end
+return 0`
+
+// releaseScript 只释放自己持有的锁
+const releaseScript = `if redis.call('get', KEYS[1]) == ARGV[1] then
+	return redis.call('del', KEYS[1])
+end
+return 0`
+
+// renewScript 只续期自己持有的锁
+const renewScript = `if redis.call('get', KEYS[1]) == ARGV[1] then
+	return redis.call('pexpire', KEYS[1], ARGV[2])
+end
+return 0`
+
+// Backend 分布式锁的存储，*redis_mw.Redis 实现了该接口
+type Backend interface {
+	EvalCtx(ctx context.Context, script string, keys []string, args ...any) (any, error)
+}
+
+// Options 会话锁配置，<=0 的值使用默认值
+type Options struct {
+	TTL           time.Duration // 分布式锁的过期时间，持有期间每 TTL/3 续期一次，默认30s
+	WaitTimeout   time.Duration // LockCtx 等待锁的最长时间，默认10s
+	RetryInterval time.Duration // 分布式锁被占用时的重试间隔，默认50ms
+	MaxIdleLocks  int           // 本地锁的最大数量，超过后淘汰最久未使用的空闲锁，默认10000
+	KeyPrefix     string        // 分布式锁的key格式，默认 short_term_memory:lock:%s
+	// OnError 分布式锁存储不可用时回调，此时 LockCtx 返回 ErrBackendUnavailable，Lock 按 RetryInterval 重试
+	OnError func(conversationID string, err error)
+}
+
 // SessionLockManager 会话锁管理器
 // 用于防止同一会话的并发写入冲突，确保数据一致性
 type SessionLockManager struct {
-	locks sync.Map // map[conversationID]*sync.Mutex
+	mu      sync.Mutex
+	locks   map[string]*list.Element // conversationID -> 元素值为 *SessionLock
+	lru     *list.List               // 最近使用的在前
+	backend func() (Backend, error)
+	opts    Options
 }
 
-// NewSessionLockManager 创建会话锁管理器
+// NewSessionLockManager 创建会话锁管理器，未调用 UseBackend 时只有本地锁
 func NewSessionLockManager() *SessionLockManager {
+	return NewSessionLockManagerWithOptions(Options{})
+}
+
+// NewSessionLockManagerWithOptions 使用指定配置创建会话锁管理器
+func NewSessionLockManagerWithOptions(opts Options) *SessionLockManager {
+	if opts.TTL <= 0 {
+		opts.TTL = defaultTTL
+	}
+	if opts.WaitTimeout <= 0 {
+		opts.WaitTimeout = defaultWaitTimeout
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = defaultRetryInterval
+	}
+	if opts.MaxIdleLocks <= 0 {
+		opts.MaxIdleLocks = defaultMaxIdleLocks
+	}
+	if opts.KeyPrefix == "" {
+		opts.KeyPrefix = defaultKeyPrefix
+	}
 	return &SessionLockManager{
-		locks: sync.Map{},
+		locks: make(map[string]*list.Element),
+		lru:   list.New(),
+		opts:  opts,
 	}
 }
 
-// GetLock 获取指定会话的锁
+// UseBackend 设置分布式锁的存储
+// backend 在每次加锁时调用，返回错误时加锁失败，可以在存储初始化前设置
+func (m *SessionLockManager) UseBackend(backend func() (Backend, error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backend = backend
+}
+
+// GetLock 获取指定会话的锁，返回的锁在调用 Lock/LockCtx 之前不会被淘汰，因此获取后必须加锁
 // 参数:
 //   - conversationID: 会话ID
 // 返回:
-//   - *sync.Mutex: 互斥锁指针
+//   - *SessionLock: 会话锁
 //
 // 使用场景:
 //   在需要修改会话状态的地方使用
 //
 // 示例:
 //   lock := lockManager.GetLock("conv_123")
-//   lock.Lock()
+//   if err := lock.LockCtx(ctx); err != nil {
+//       return err
+//   }
 //   defer lock.Unlock()
 //   // 修改会话状态...
-func (m *SessionLockManager) GetLock(conversationID string) *sync.Mutex {
-	lock, _ := m.locks.LoadOrStore(conversationID, &sync.Mutex{})
-	return lock.(*sync.Mutex)
+func (m *SessionLockManager) GetLock(conversationID string) *SessionLock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.locks[conversationID]; ok {
+		m.lru.MoveToFront(e)
+		l := e.Value.(*SessionLock)
+		l.refs++
+		l.pending++
+		return l
+	}
+	l := &SessionLock{
+		m:              m,
+		conversationID: conversationID,
+		sem:            make(chan struct{}, 1),
+		refs:           1,
+		pending:        1,
+	}
+	m.locks[conversationID] = m.lru.PushFront(l)
+	m.evict()
+	return l
+}
+
+// evict 本地锁超过上限时从最久未使用的开始淘汰空闲锁，调用方持有 m.mu
+func (m *SessionLockManager) evict() {
+	for e := m.lru.Back(); e != nil && len(m.locks) > m.opts.MaxIdleLocks; {
+		prev := e.Prev()
+		if l := e.Value.(*SessionLock); l.refs == 0 {
+			m.lru.Remove(e)
+			delete(m.locks, l.conversationID)
+		}
+		e = prev
+	}
+}
+
+// Len 本地锁的数量
+func (m *SessionLockManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.locks)
 }
 
 // LockWith 在锁保护下执行函数
@@ -49,18 +188,22 @@ func (m *SessionLockManager) GetLock(conversationID string) *sync.Mutex {
 //   简化锁的使用，避免忘记释放锁
 //
 // 示例:
-//   err := lockManager.LockWith("conv_123", func() {
+//   err := lockManager.LockWith("conv_123", func() error {
 //       // 修改会话状态...
+//       return nil
 //   })
-func (m *SessionLockManager) LockWith(conversationID string, fn func()) error) error {
+func (m *SessionLockManager) LockWith(conversationID string, fn func() error) error {
 	lock := m.GetLock(conversationID)
-	lock.Lock()
+	if err := lock.LockCtx(context.Background()); err != nil {
+		return err
+	}
 	defer lock.Unlock()
 	return fn()
 }
 
 // LockWithVal 在锁保护下执行函数并返回值
 // 参数:
+//   - m: 会话锁管理器
 //   - conversationID: 会话ID
 //   - fn: 要执行的函数
 // 返回:
@@ -70,12 +213,214 @@ func (m *SessionLockManager) LockWith(conversationID string, fn func()) error) e
 //   简化锁的使用，避免忘记释放锁，并支持返回值
 //
 // 示例:
-//   result, err := lockManager.LockWithVal("conv_123", func() (string, error) {
+//   result, err := xlock.LockWithVal(lockManager, "conv_123", func() (string, error) {
 //       return "result", nil
 //   })
-func (m *SessionLockManager) LockWithVal[T any](conversationID string, fn func() (T, error)) (T, error) {
+func LockWithVal[T any](m *SessionLockManager, conversationID string, fn func() (T, error)) (T, error) {
 	lock := m.GetLock(conversationID)
-	lock.Lock()
+	if err := lock.LockCtx(context.Background()); err != nil {
+		var zero T
+		return zero, err
+	}
 	defer lock.Unlock()
 	return fn()
 }
+
+// SessionLock 会话锁
+// 不可重入，Lock/LockCtx 成功后必须调用 Unlock
+type SessionLock struct {
+	m              *SessionLockManager
+	conversationID string
+	sem            chan struct{} // 本地锁
+	refs           int           // 已获取未加锁、等待和持有锁的数量，为0时才能被淘汰，由 m.mu 保护
+	pending        int           // GetLock 返回后还未加锁的数量，加锁时使用其计数，由 m.mu 保护
+
+	// 以下字段只在持有本地锁时访问
+	backend Backend
+	owner   string
+	token   int64
+	stop    chan struct{}
+	renewed chan struct{}
+}
+
+// Lock 加锁，阻塞直到获得锁，不受 WaitTimeout 限制
+// 分布式锁存储不可用时通过 OnError 通知，并按 RetryInterval 重试
+func (l *SessionLock) Lock() {
+	for l.lock(context.Background(), false) != nil {
+		time.Sleep(l.m.opts.RetryInterval)
+	}
+}
+
+// LockCtx 加锁，等待超过 WaitTimeout 返回 ErrLockTimeout，ctx 结束返回 ctx.Err()
+// 分布式锁存储不可用时返回 ErrBackendUnavailable，此时不持有锁
+func (l *SessionLock) LockCtx(ctx context.Context) error {
+	return l.lock(ctx, true)
+}
+
+func (l *SessionLock) lock(ctx context.Context, timeout bool) error {
+	m := l.m
+	m.mu.Lock()
+	if l.pending > 0 {
+		l.pending--
+	} else {
+		l.refs++
+	}
+	backend := m.backend
+	m.mu.Unlock()
+
+	if timeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.opts.WaitTimeout)
+		defer cancel()
+	}
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		l.release()
+		return waitErr(ctx)
+	}
+	if backend == nil {
+		return nil
+	}
+
+	b, err := backend()
+	if err != nil {
+		return l.unavailable(err)
+	}
+	owner := newOwner()
+	key := m.key(l.conversationID)
+	for {
+		r, err := b.EvalCtx(ctx, acquireScript, []string{key, m.fenceKey(l.conversationID)},
+			owner, m.opts.TTL.Milliseconds(), time.Now().UnixMilli(), fenceTTL.Milliseconds())
+		if err != nil {
+			if ctx.Err() != nil {
+				<-l.sem
+				l.release()
+				return waitErr(ctx)
+			}
+			return l.unavailable(err)
+		}
+		if token := toInt64(r); token > 0 {
+			l.backend, l.owner, l.token = b, owner, token
+			l.stop, l.renewed = make(chan struct{}), make(chan struct{})
+			go l.renew(key)
+			return nil
+		}
+		select {
+		case <-time.After(m.opts.RetryInterval):
+		case <-ctx.Done():
+			<-l.sem
+			l.release()
+			return waitErr(ctx)
+		}
+	}
+}
+
+// Unlock 解锁，先释放分布式锁再释放本地锁
+func (l *SessionLock) Unlock() {
+	if l.backend != nil {
+		close(l.stop)
+		<-l.renewed
+		key := l.m.key(l.conversationID)
+		ctx, cancel := context.WithTimeout(context.Background(), l.m.opts.WaitTimeout)
+		if _, err := l.backend.EvalCtx(ctx, releaseScript, []string{key}, l.owner); err != nil {
+			// 释放失败时等待锁过期
+			l.m.onError(l.conversationID, err)
+		}
+		cancel()
+		l.backend, l.owner, l.token = nil, "", 0
+	}
+	select {
+	case <-l.sem:
+	default:
+		panic("xlock: unlock of unlocked session lock")
+	}
+	l.release()
+}
+
+// Fence 持有分布式锁时返回 token key 和本次加锁的 fencing token，只持有本地锁时 token 为0
+// 写入受锁保护的数据时，在同一个 Redis 中原子地比较 token key 的当前值与 token，不一致说明锁已过期并被其他实例获得，应拒绝写入
+// 只能在加锁后、解锁前调用
+func (l *SessionLock) Fence() (key string, token int64) {
+	if l.token == 0 {
+		return "", 0
+	}
+	return l.m.fenceKey(l.conversationID), l.token
+}
+
+// renew 持有期间定时续期，锁已不属于自己时停止
+func (l *SessionLock) renew(key string) {
+	defer close(l.renewed)
+	ticker := time.NewTicker(l.m.opts.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), l.m.opts.TTL/3)
+			r, err := l.backend.EvalCtx(ctx, renewScript, []string{key}, l.owner, l.m.opts.TTL.Milliseconds())
+			cancel()
+			if err != nil {
+				l.m.onError(l.conversationID, err)
+				continue
+			}
+			if toInt64(r) == 0 {
+				l.m.onError(l.conversationID, fmt.Errorf("session lock %s expired before unlock", key))
+				return
+			}
+		}
+	}
+}
+
+// unavailable 分布式锁存储不可用时释放本地锁并返回错误
+func (l *SessionLock) unavailable(err error) error {
+	l.m.onError(l.conversationID, err)
+	<-l.sem
+	l.release()
+	return fmt.Errorf("%w: %s", ErrBackendUnavailable, err.Error())
+}
+
+func (l *SessionLock) release() {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+	l.refs--
+}
+
+func (m *SessionLockManager) key(conversationID string) string {
+	return fmt.Sprintf(m.opts.KeyPrefix, conversationID)
+}
+
+// fenceKey 保存会话最新 fencing token 的key
+func (m *SessionLockManager) fenceKey(conversationID string) string {
+	return m.key(conversationID) + ":fence"
+}
+
+func (m *SessionLockManager) onError(conversationID string, err error) {
+	if m.opts.OnError != nil {
+		m.opts.OnError(conversationID, err)
+	}
+}
+
+func waitErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrLockTimeout
+	}
+	return ctx.Err()
+}
+
+func newOwner() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func toInt64(v any) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	}
+	return 0
+}
@@ -0,0 +1,187 @@
+package xlock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend 模拟 Redis 执行加锁、释放和续期脚本
+type fakeBackend struct {
+	mu     sync.Mutex
+	values map[string]string
+	tokens map[string]int64
+	down   bool
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{values: map[string]string{}, tokens: map[string]int64{}}
+}
+
+func (f *fakeBackend) EvalCtx(ctx context.Context, script string, keys []string, args ...any) (any, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return nil, errors.New("connection refused")
+	}
+	owner := args[0].(string)
+	switch script {
+	case acquireScript:
+		if _, ok := f.values[keys[0]]; ok {
+			return int64(0), nil
+		}
+		f.values[keys[0]] = owner
+		f.tokens[keys[1]]++
+		return f.tokens[keys[1]], nil
+	case releaseScript:
+		if f.values[keys[0]] == owner {
+			delete(f.values, keys[0])
+			return int64(1), nil
+		}
+	case renewScript:
+		if f.values[keys[0]] == owner {
+			return int64(1), nil
+		}
+	}
+	return int64(0), nil
+}
+
+func TestDistributedLockAcrossManagers(t *testing.T) {
+	backend := newFakeBackend()
+	newManager := func() *SessionLockManager {
+		m := NewSessionLockManagerWithOptions(Options{WaitTimeout: 100 * time.Millisecond, RetryInterval: 5 * time.Millisecond})
+		m.UseBackend(func() (Backend, error) { return backend, nil })
+		return m
+	}
+	pod1, pod2 := newManager(), newManager()
+
+	l1 := pod1.GetLock("conv")
+	if err := l1.LockCtx(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	l2 := pod2.GetLock("conv")
+	if err := l2.LockCtx(context.Background()); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("LockCtx on other pod = %v, want ErrLockTimeout", err)
+	}
+	l1.Unlock()
+	if err := l2.LockCtx(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	l2.Unlock()
+	if len(backend.values) != 0 {
+		t.Fatalf("lock not released: %v", backend.values)
+	}
+}
+
+func TestFencingToken(t *testing.T) {
+	backend := newFakeBackend()
+	m := NewSessionLockManager()
+	m.UseBackend(func() (Backend, error) { return backend, nil })
+
+	var last int64
+	for i := 0; i < 2; i++ {
+		l := m.GetLock("conv")
+		if err := l.LockCtx(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		key, token := l.Fence()
+		if key != "short_term_memory:lock:conv:fence" || token <= last {
+			t.Fatalf("Fence() = %s, %d, want increasing token after %d", key, token, last)
+		}
+		last = token
+		l.Unlock()
+		if _, token = l.Fence(); token != 0 {
+			t.Fatalf("token after unlock = %d", token)
+		}
+	}
+
+	// 只有本地锁时没有 token
+	local := NewSessionLockManager().GetLock("conv")
+	local.Lock()
+	if _, token := local.Fence(); token != 0 {
+		t.Fatalf("local lock token = %d", token)
+	}
+	local.Unlock()
+}
+
+func TestBackendDownReturnsError(t *testing.T) {
+	backend := newFakeBackend()
+	backend.down = true
+	var reported error
+	m := NewSessionLockManagerWithOptions(Options{OnError: func(_ string, err error) { reported = err }})
+	m.UseBackend(func() (Backend, error) { return backend, nil })
+
+	called := false
+	err := m.LockWith("conv", func() error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("LockWith = %v, want ErrBackendUnavailable", err)
+	}
+	if called || reported == nil {
+		t.Fatalf("called = %v, reported = %v", called, reported)
+	}
+
+	// 加锁失败后不持有本地锁
+	backend.mu.Lock()
+	backend.down = false
+	backend.mu.Unlock()
+	l := m.GetLock("conv")
+	if err = l.LockCtx(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	l.Unlock()
+}
+
+func TestEvictIdleLocks(t *testing.T) {
+	m := NewSessionLockManagerWithOptions(Options{MaxIdleLocks: 2})
+	held := m.GetLock("held")
+	held.Lock()
+	for _, id := range []string{"a", "b", "c"} {
+		if err := m.LockWith(id, func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", m.Len())
+	}
+	if m.GetLock("held") != held {
+		t.Fatal("held lock evicted")
+	}
+	held.Unlock()
+}
+
+func TestEvictKeepsLocksNotYetLocked(t *testing.T) {
+	m := NewSessionLockManagerWithOptions(Options{MaxIdleLocks: 1})
+	got := m.GetLock("got")
+	for _, id := range []string{"a", "b"} {
+		if err := m.LockWith(id, func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := got.LockCtx(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	other := m.GetLock("got")
+	if other != got {
+		t.Fatal("lock returned by GetLock evicted before locking")
+	}
+	got.Unlock()
+	if err := other.LockCtx(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	other.Unlock()
+}
+
+func TestLockWithVal(t *testing.T) {
+	m := NewSessionLockManager()
+	v, err := LockWithVal(m, "conv", func() (string, error) {
+		return "ok", nil
+	})
+	if err != nil || v != "ok" {
+		t.Fatalf("LockWithVal = %q, %v", v, err)
+	}
+}
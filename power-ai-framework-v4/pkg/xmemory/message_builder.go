@@ -1,6 +1,7 @@
 package xmemory
 
 import (
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xtoken"
 	"strings"
 )
 
@@ -179,8 +180,8 @@ func (b *MessageBuilder) BuildRecentMessages(messages []AIMessage, recentTurns i
 //   - int: Token数量
 //
 // 注意事项:
-//   - 使用简化估算：字符数 / 4
-//   - 适用于中文场景
+//   - 使用 xtoken.Default 启发式估算，中文约 1.2 个字符一个 token
+//   - 需要按模型的词表计算时使用 xtoken.Get 获取分词器
 //   - 如果文本为空，返回0
 //   - 如果计算结果为0，返回1
 func EstimateTokenCount(text string) int {
@@ -189,8 +190,7 @@ func EstimateTokenCount(text string) int {
 		return 0
 	}
 
-	runeCount := len([]rune(text))
-	tokens := runeCount / 4
+	tokens := xtoken.Default.Count(text)
 	if tokens <= 0 {
 		return 1
 	}
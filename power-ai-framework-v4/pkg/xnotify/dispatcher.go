@@ -0,0 +1,149 @@
+package xnotify
+
+import (
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// 按 key 防抖、按顺序投递的修改通知
+// 同一 key 在防抖时间内的多次修改合并为一次通知：old 为第一次修改前的值，new 为最后一次修改后的值
+// 通知按各 key 第一次修改的顺序投递：某个 key 防抖结束时，比它先修改、仍在防抖中的 key 一起提前投递
+// 每个 Dispatcher 使用一个协程按顺序调用 handler，handler 不会并发执行；
+// handler panic 时调用 onPanic，不影响后续通知，也不影响其他 Dispatcher
+// ============================================================================
+
+// Handler 接收 key 的修改
+type Handler[T any] func(key string, old, new T)
+
+type change[T any] struct {
+	key      string
+	old, new T
+}
+
+type pending[T any] struct {
+	change[T]
+	timer *time.Timer
+}
+
+// Dispatcher 修改通知的投递者
+type Dispatcher[T any] struct {
+	debounce time.Duration
+	handler  Handler[T]
+	onPanic  func(key string, r interface{})
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[string]*pending[T]
+	order   []*pending[T] // 防抖中的修改，按第一次修改的顺序
+	queue   []change[T]
+	closed  bool
+	done    chan struct{}
+}
+
+// New 创建 Dispatcher，debounce<=0 时不防抖，onPanic 可以为空
+func New[T any](debounce time.Duration, handler Handler[T], onPanic func(key string, r interface{})) *Dispatcher[T] {
+	d := &Dispatcher[T]{
+		debounce: debounce,
+		handler:  handler,
+		onPanic:  onPanic,
+		pending:  make(map[string]*pending[T]),
+		done:     make(chan struct{}),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	go d.run()
+	return d
+}
+
+// Push 提交 key 的一次修改，不阻塞
+func (d *Dispatcher[T]) Push(key string, old, new T) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	if d.debounce <= 0 {
+		d.enqueue(change[T]{key: key, old: old, new: new})
+		return
+	}
+	if p, ok := d.pending[key]; ok {
+		p.new = new
+		p.timer.Reset(d.debounce)
+		return
+	}
+	p := &pending[T]{change: change[T]{key: key, old: old, new: new}}
+	p.timer = time.AfterFunc(d.debounce, func() { d.flush(p) })
+	d.pending[key] = p
+	d.order = append(d.order, p)
+}
+
+// Close 停止接收修改，丢弃防抖中的修改，已进入队列的修改投递完后返回的 channel 关闭
+func (d *Dispatcher[T]) Close() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.closed {
+		d.closed = true
+		for key, p := range d.pending {
+			p.timer.Stop()
+			delete(d.pending, key)
+		}
+		d.order = nil
+		d.cond.Broadcast()
+	}
+	return d.done
+}
+
+// flush 防抖结束，将修改和比它先修改的防抖中的修改按顺序放入投递队列
+func (d *Dispatcher[T]) flush(p *pending[T]) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// 已经投递或已关闭，Reset 后再次触发的定时器也在这里忽略
+	if d.pending[p.key] != p {
+		return
+	}
+	for len(d.order) > 0 {
+		first := d.order[0]
+		d.order[0] = nil
+		d.order = d.order[1:]
+		first.timer.Stop()
+		delete(d.pending, first.key)
+		d.enqueue(first.change)
+		if first == p {
+			return
+		}
+	}
+}
+
+// enqueue 调用方持有 d.mu
+func (d *Dispatcher[T]) enqueue(c change[T]) {
+	d.queue = append(d.queue, c)
+	d.cond.Signal()
+}
+
+func (d *Dispatcher[T]) run() {
+	defer close(d.done)
+	for {
+		d.mu.Lock()
+		for len(d.queue) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if len(d.queue) == 0 {
+			d.mu.Unlock()
+			return
+		}
+		c := d.queue[0]
+		d.queue[0] = change[T]{}
+		d.queue = d.queue[1:]
+		d.mu.Unlock()
+		d.deliver(c)
+	}
+}
+
+func (d *Dispatcher[T]) deliver(c change[T]) {
+	defer func() {
+		if r := recover(); r != nil && d.onPanic != nil {
+			d.onPanic(c.key, r)
+		}
+	}()
+	d.handler(c.key, c.old, c.new)
+}
@@ -0,0 +1,132 @@
+package xnotify
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type record struct {
+	key      string
+	old, new int
+}
+
+type recorder struct {
+	mu   sync.Mutex
+	recs []record
+}
+
+func (r *recorder) handle(key string, old, new int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recs = append(r.recs, record{key, old, new})
+}
+
+func (r *recorder) snapshot() []record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]record(nil), r.recs...)
+}
+
+func TestDispatcherOrder(t *testing.T) {
+	r := &recorder{}
+	d := New[int](0, r.handle, nil)
+	for i := 0; i < 100; i++ {
+		d.Push("k", i, i+1)
+	}
+	<-d.Close()
+	recs := r.snapshot()
+	if len(recs) != 100 {
+		t.Fatalf("delivered %d, want 100", len(recs))
+	}
+	for i, rec := range recs {
+		if rec.old != i || rec.new != i+1 {
+			t.Fatalf("recs[%d] = %+v, out of order", i, rec)
+		}
+	}
+}
+
+func TestDispatcherDebounce(t *testing.T) {
+	r := &recorder{}
+	d := New[int](30*time.Millisecond, r.handle, nil)
+	d.Push("a", 1, 2)
+	d.Push("b", 10, 11)
+	d.Push("a", 2, 3)
+	d.Push("a", 3, 4)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.snapshot()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(60 * time.Millisecond)
+	<-d.Close()
+
+	recs := r.snapshot()
+	if len(recs) != 2 || recs[0].key != "a" || recs[1].key != "b" {
+		t.Fatalf("delivered %+v, want a before b", recs)
+	}
+	got := make(map[string]record)
+	for _, rec := range recs {
+		if _, dup := got[rec.key]; dup {
+			t.Fatalf("key %s delivered twice", rec.key)
+		}
+		got[rec.key] = rec
+	}
+	if got["a"] != (record{"a", 1, 4}) || got["b"] != (record{"b", 10, 11}) {
+		t.Fatalf("delivered %+v", got)
+	}
+}
+
+func TestDispatcherFirstChangeOrder(t *testing.T) {
+	r := &recorder{}
+	d := New[int](100*time.Millisecond, r.handle, nil)
+	d.Push("a", 1, 2)
+	time.Sleep(10 * time.Millisecond)
+	d.Push("b", 10, 11)
+	// a 在 b 防抖结束前再次修改，仍按第一次修改的顺序先于 b 投递
+	time.Sleep(40 * time.Millisecond)
+	d.Push("a", 2, 3)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.snapshot()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	<-d.Close()
+	recs := r.snapshot()
+	if len(recs) != 2 || recs[0] != (record{"a", 1, 3}) || recs[1] != (record{"b", 10, 11}) {
+		t.Fatalf("delivered %+v", recs)
+	}
+}
+
+func TestDispatcherPanicIsolation(t *testing.T) {
+	var panics []string
+	r := &recorder{}
+	d := New[int](0, func(key string, old, new int) {
+		if key == "bad" {
+			panic("boom")
+		}
+		r.handle(key, old, new)
+	}, func(key string, _ interface{}) {
+		panics = append(panics, key)
+	})
+	d.Push("bad", 0, 1)
+	d.Push("good", 0, 1)
+	<-d.Close()
+	if len(panics) != 1 || panics[0] != "bad" {
+		t.Fatalf("panics = %v", panics)
+	}
+	if recs := r.snapshot(); len(recs) != 1 || recs[0].key != "good" {
+		t.Fatalf("recs = %+v", recs)
+	}
+}
+
+func TestDispatcherClose(t *testing.T) {
+	r := &recorder{}
+	d := New[int](time.Hour, r.handle, nil)
+	d.Push("a", 0, 1)
+	<-d.Close()
+	d.Push("a", 1, 2)
+	if recs := r.snapshot(); len(recs) != 0 {
+		t.Fatalf("pending change delivered after Close: %+v", recs)
+	}
+}
@@ -0,0 +1,199 @@
+package xstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// 进程内的短期记忆存储
+// 行为与 Redis 存储一致：按 key 保存 SessionValue 的 JSON，支持过期时间和按 meta.version 的比较写入
+// 用于单元测试和不需要多实例共享会话的场景，进程重启后数据丢失
+// ============================================================================
+
+// ErrNotFound key 不存在或已过期
+var ErrNotFound = errors.New("short memory not found")
+
+// purgeInterval 写入时清理过期数据的最小间隔
+const purgeInterval = time.Minute
+
+type memoryItem struct {
+	value     []byte
+	version   int64
+	expiresAt time.Time // 零值表示不过期
+}
+
+// MemoryStore 进程内的短期记忆存储，并发安全
+type MemoryStore struct {
+	mu        sync.Mutex
+	items     map[string]*memoryItem
+	lastPurge time.Time
+	now       func() time.Time
+}
+
+// NewMemoryStore 创建进程内的短期记忆存储
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items: make(map[string]*memoryItem),
+		now:   time.Now,
+	}
+}
+
+// Get 读取会话，不存在或已过期返回 ErrNotFound
+func (s *MemoryStore) Get(_ context.Context, conversationId string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.get(conversationId)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), item.value...), nil
+}
+
+// Exists 会话是否存在
+func (s *MemoryStore) Exists(_ context.Context, conversationId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.get(conversationId)
+	return ok, nil
+}
+
+// Set 写入会话，meta.version 设置为已保存的版本加1，ttl<=0 表示不过期
+func (s *MemoryStore) Set(_ context.Context, conversationId string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var current int64
+	if item, ok := s.get(conversationId); ok {
+		current = item.version
+	}
+	s.set(conversationId, withVersion(value, current+1), ttl)
+	return nil
+}
+
+// SetNX 会话不存在时写入，返回是否写入
+func (s *MemoryStore) SetNX(_ context.Context, conversationId string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.get(conversationId); ok {
+		return false, nil
+	}
+	s.set(conversationId, value, ttl)
+	return true, nil
+}
+
+// CompareAndSet 会话的 meta.version 等于 version（会话不存在时视为0）时写入，写入的 meta.version 为 version+1，返回是否写入
+func (s *MemoryStore) CompareAndSet(_ context.Context, conversationId string, value []byte, version int64, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var current int64
+	if item, ok := s.get(conversationId); ok {
+		current = item.version
+	}
+	if current != version {
+		return false, nil
+	}
+	s.set(conversationId, withVersion(value, version+1), ttl)
+	return true, nil
+}
+
+// TTL 会话剩余有效期，不过期返回 -1，不存在返回 ErrNotFound
+func (s *MemoryStore) TTL(_ context.Context, conversationId string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.get(conversationId)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if item.expiresAt.IsZero() {
+		return -1, nil
+	}
+	return item.expiresAt.Sub(s.now()), nil
+}
+
+// Delete 删除会话，不存在的会话忽略
+func (s *MemoryStore) Delete(_ context.Context, conversationIds ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range conversationIds {
+		delete(s.items, id)
+	}
+	return nil
+}
+
+// Len 未过期的会话数量
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purge()
+	return len(s.items)
+}
+
+// get 读取未过期的会话，调用方持有 s.mu
+func (s *MemoryStore) get(conversationId string) (*memoryItem, bool) {
+	item, ok := s.items[conversationId]
+	if !ok {
+		return nil, false
+	}
+	if !item.expiresAt.IsZero() && !s.now().Before(item.expiresAt) {
+		delete(s.items, conversationId)
+		return nil, false
+	}
+	return item, true
+}
+
+// set 写入会话，调用方持有 s.mu
+func (s *MemoryStore) set(conversationId string, value []byte, ttl time.Duration) {
+	item := &memoryItem{value: append([]byte(nil), value...), version: versionOf(value)}
+	if ttl > 0 {
+		item.expiresAt = s.now().Add(ttl)
+	}
+	s.items[conversationId] = item
+	if s.now().Sub(s.lastPurge) >= purgeInterval {
+		s.purge()
+	}
+}
+
+// purge 清理过期的会话，调用方持有 s.mu
+func (s *MemoryStore) purge() {
+	now := s.now()
+	for id, item := range s.items {
+		if !item.expiresAt.IsZero() && !now.Before(item.expiresAt) {
+			delete(s.items, id)
+		}
+	}
+	s.lastPurge = now
+}
+
+// versionOf 读取会话 JSON 中的 meta.version，解析失败为0
+func versionOf(value []byte) int64 {
+	var v struct {
+		Meta *struct {
+			Version int64 `json:"version"`
+		} `json:"meta"`
+	}
+	if json.Unmarshal(value, &v) != nil || v.Meta == nil {
+		return 0
+	}
+	return v.Meta.Version
+}
+
+// metaVersionPattern 会话 JSON 中 meta 对象的 version 字段
+var metaVersionPattern = regexp.MustCompile(`(?s)("meta"\s*:\s*\{.*?"version"\s*:\s*)-?\d+`)
+
+// withVersion 把会话 JSON 中的 meta.version 替换为 version，与 redis 存储的写入脚本一致，不重新编码JSON
+// 没有 meta.version 时原样返回
+func withVersion(value []byte, version int64) []byte {
+	loc := metaVersionPattern.FindSubmatchIndex(value)
+	if loc == nil {
+		return value
+	}
+	out := make([]byte, 0, len(value)+8)
+	out = append(out, value[:loc[3]]...)
+	out = strconv.AppendInt(out, version, 10)
+	return append(out, value[loc[1]:]...)
+}
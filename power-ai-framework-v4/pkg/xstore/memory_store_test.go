@@ -0,0 +1,150 @@
+package xstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestStore() (*MemoryStore, *time.Time) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewMemoryStore()
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func TestMemoryStoreGetSet(t *testing.T) {
+	s, _ := newTestStore()
+	ctx := context.Background()
+	if _, err := s.Get(ctx, "c1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get missing = %v, want ErrNotFound", err)
+	}
+	value := []byte(`{"meta":{"version":1}}`)
+	if err := s.Set(ctx, "c1", value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	value[0] = 'x'
+	got, err := s.Get(ctx, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != `{"meta":{"version":1}}` {
+		t.Fatalf("Get = %s, stored value must not alias caller's slice", got)
+	}
+	if ok, _ := s.Exists(ctx, "c1"); !ok {
+		t.Fatal("Exists = false, want true")
+	}
+	if err = s.Delete(ctx, "c1", "c2"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.Exists(ctx, "c1"); ok {
+		t.Fatal("Exists after Delete = true")
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	s, now := newTestStore()
+	ctx := context.Background()
+	_ = s.Set(ctx, "c1", []byte(`{}`), time.Minute)
+	_ = s.Set(ctx, "c2", []byte(`{}`), 0)
+
+	*now = now.Add(30 * time.Second)
+	if ttl, err := s.TTL(ctx, "c1"); err != nil || ttl != 30*time.Second {
+		t.Fatalf("TTL = %v, %v, want 30s", ttl, err)
+	}
+	if ttl, _ := s.TTL(ctx, "c2"); ttl != -1 {
+		t.Fatalf("TTL without expiry = %v, want -1", ttl)
+	}
+
+	*now = now.Add(30 * time.Second)
+	if _, err := s.Get(ctx, "c1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get expired = %v, want ErrNotFound", err)
+	}
+	if _, err := s.TTL(ctx, "c1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("TTL expired = %v, want ErrNotFound", err)
+	}
+	if n := s.Len(); n != 1 {
+		t.Fatalf("Len = %d, want 1", n)
+	}
+}
+
+func TestMemoryStoreSetNX(t *testing.T) {
+	s, now := newTestStore()
+	ctx := context.Background()
+	if ok, _ := s.SetNX(ctx, "c1", []byte(`{"a":1}`), time.Minute); !ok {
+		t.Fatal("first SetNX = false")
+	}
+	if ok, _ := s.SetNX(ctx, "c1", []byte(`{"a":2}`), time.Minute); ok {
+		t.Fatal("second SetNX = true")
+	}
+	*now = now.Add(time.Minute)
+	if ok, _ := s.SetNX(ctx, "c1", []byte(`{"a":3}`), time.Minute); !ok {
+		t.Fatal("SetNX after expiry = false")
+	}
+	got, _ := s.Get(ctx, "c1")
+	if string(got) != `{"a":3}` {
+		t.Fatalf("Get = %s", got)
+	}
+}
+
+func TestMemoryStoreCompareAndSet(t *testing.T) {
+	s, _ := newTestStore()
+	ctx := context.Background()
+
+	// 不存在时版本为0
+	if ok, _ := s.CompareAndSet(ctx, "c1", []byte(`{"meta":{"version":1}}`), 1, time.Minute); ok {
+		t.Fatal("CAS on missing key with version 1 = true")
+	}
+	if ok, _ := s.CompareAndSet(ctx, "c1", []byte(`{"meta":{"version":1}}`), 0, time.Minute); !ok {
+		t.Fatal("CAS on missing key with version 0 = false")
+	}
+	// 其他写入者已经写入版本1
+	if ok, _ := s.CompareAndSet(ctx, "c1", []byte(`{"meta":{"version":1}}`), 0, time.Minute); ok {
+		t.Fatal("CAS with stale version = true")
+	}
+	if ok, _ := s.CompareAndSet(ctx, "c1", []byte(`{"meta":{"version":2}}`), 1, time.Minute); !ok {
+		t.Fatal("CAS with current version = false")
+	}
+	got, _ := s.Get(ctx, "c1")
+	if string(got) != `{"meta":{"version":2}}` {
+		t.Fatalf("Get = %s", got)
+	}
+}
+
+func TestMemoryStoreSetBumpsVersion(t *testing.T) {
+	s, _ := newTestStore()
+	ctx := context.Background()
+
+	// 两个写入者持有同一个过期副本，写入的版本不能相同
+	stale := []byte(`{"meta":{"conversation_id":"c1","version":0},"global_state":{"version":7}}`)
+	_ = s.Set(ctx, "c1", stale, time.Minute)
+	_ = s.Set(ctx, "c1", stale, time.Minute)
+	got, _ := s.Get(ctx, "c1")
+	if string(got) != `{"meta":{"conversation_id":"c1","version":2},"global_state":{"version":7}}` {
+		t.Fatalf("Get = %s", got)
+	}
+	// 读取版本1的写入者不能覆盖版本2
+	if ok, _ := s.CompareAndSet(ctx, "c1", stale, 1, time.Minute); ok {
+		t.Fatal("CAS with version of the first blind write = true")
+	}
+	if ok, _ := s.CompareAndSet(ctx, "c1", stale, 2, time.Minute); !ok {
+		t.Fatal("CAS with current version = false")
+	}
+	if got, _ = s.Get(ctx, "c1"); versionOf(got) != 3 {
+		t.Fatalf("version after CAS = %d, want 3", versionOf(got))
+	}
+}
+
+func TestWithVersion(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{`{"meta":{"version":5}}`, `{"meta":{"version":9}}`},
+		{`{"meta": {"user_id":"a\"version\":1", "version": -1}}`, `{"meta": {"user_id":"a\"version\":1", "version": 9}}`},
+		{`{"a":1}`, `{"a":1}`},
+	}
+	for _, c := range cases {
+		if got := string(withVersion([]byte(c.in), 9)); got != c.want {
+			t.Errorf("withVersion(%s) = %s, want %s", c.in, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package xtoken
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ============================================================================
+// BPE 分词器
+// 词表为 tiktoken 格式：每行 "base64编码的token 排名"，如 Qwen 的 qwen.tiktoken
+// ============================================================================
+
+// pretokenizePattern 预分词规则，与 Qwen/cl100k 一致，RE2 不支持 \s+(?!\S)，在 pretokenize 中处理
+var pretokenizePattern = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// maxPieceRunes 预分词后单个片段的最大字符数，连续的长中文片段按该长度切分，避免合并的耗时过长
+const maxPieceRunes = 128
+
+// BPE 基于字节对合并的分词器
+type BPE struct {
+	ranks map[string]int
+}
+
+// LoadBPE 从 tiktoken 格式的词表文件加载 BPE 分词器
+func LoadBPE(path string) (*BPE, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := NewBPE(f)
+	if err != nil {
+		return nil, fmt.Errorf("加载词表[%s]失败: %w", path, err)
+	}
+	return b, nil
+}
+
+// NewBPE 从 tiktoken 格式的词表创建 BPE 分词器
+func NewBPE(r io.Reader) (*BPE, error) {
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		token, rank, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, fmt.Errorf("第%d行格式错误", line)
+		}
+		b, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("第%d行token不是合法的base64: %w", line, err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(rank))
+		if err != nil {
+			return nil, fmt.Errorf("第%d行排名不是整数: %w", line, err)
+		}
+		ranks[string(b)] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("词表为空")
+	}
+	return &BPE{ranks: ranks}, nil
+}
+
+// Count 计算 token 数量
+func (b *BPE) Count(text string) int {
+	n := 0
+	for _, piece := range pretokenize(text) {
+		for len(piece) > 0 {
+			chunk := piece
+			if utf8.RuneCountInString(piece) > maxPieceRunes {
+				i, c := 0, 0
+				for c < maxPieceRunes {
+					_, size := utf8.DecodeRuneInString(piece[i:])
+					i += size
+					c++
+				}
+				chunk = piece[:i]
+			}
+			n += b.countPiece(chunk)
+			piece = piece[len(chunk):]
+		}
+	}
+	return n
+}
+
+// countPiece 按排名从小到大合并相邻字节对，返回合并后的 token 数量
+func (b *BPE) countPiece(piece string) int {
+	if _, ok := b.ranks[piece]; ok {
+		return 1
+	}
+	// parts[i] 为第 i 个 token 的起始位置，最后一个元素为 len(piece)
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+	for len(parts) > 2 {
+		minRank, minIdx := math.MaxInt, -1
+		for i := 0; i < len(parts)-2; i++ {
+			if rank, ok := b.ranks[piece[parts[i]:parts[i+2]]]; ok && rank < minRank {
+				minRank, minIdx = rank, i
+			}
+		}
+		if minIdx < 0 {
+			break
+		}
+		parts = append(parts[:minIdx+1], parts[minIdx+2:]...)
+	}
+	return len(parts) - 1
+}
+
+// pretokenize 预分词
+// 连续多个空白字符后跟非空白字符时，最后一个空白字符归入下一个片段，等价于 \s+(?!\S)
+func pretokenize(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		loc := pretokenizePattern.FindStringIndex(text)
+		if loc == nil || loc[0] != 0 || loc[1] == 0 {
+			_, size := utf8.DecodeRuneInString(text)
+			loc = []int{0, size}
+		}
+		end := loc[1]
+		piece := text[:end]
+		if end < len(text) && utf8.RuneCountInString(piece) > 1 && isBlank(piece) {
+			_, size := utf8.DecodeLastRuneInString(piece)
+			end -= size
+		}
+		pieces = append(pieces, text[:end])
+		text = text[end:]
+	}
+	return pieces
+}
+
+// isBlank 是否只包含换行以外的空白字符
+func isBlank(s string) bool {
+	for _, r := range s {
+		if r == '\r' || r == '\n' || !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package xtoken
+
+import (
+	"math"
+	"sync"
+	"unicode"
+)
+
+// ============================================================================
+// Token 计数
+// ============================================================================
+
+// HeuristicName 启发式估算的名称，SystemModel.Tokenizer 配置为该值或不配置时使用
+const HeuristicName = "heuristic"
+
+// Tokenizer 计算文本的 token 数量
+type Tokenizer interface {
+	Count(text string) int
+}
+
+// Default 默认分词器，使用启发式估算
+var Default Tokenizer = NewHeuristic()
+
+// Heuristic 按字符类别估算 token 数量，不需要词表
+// 中日韩字符按 CJKCharsPerToken 个字符一个 token，拉丁字母按 LatinCharsPerToken 个字符一个 token，
+// 数字和标点符号每个字符一个 token，空白字符不计数
+type Heuristic struct {
+	CJKCharsPerToken   float64
+	LatinCharsPerToken float64
+}
+
+// NewHeuristic 创建启发式估算，参数按 Qwen/bge 分词器在中文医疗对话上的统计值设置
+func NewHeuristic() *Heuristic {
+	return &Heuristic{
+		CJKCharsPerToken:   1.2,
+		LatinCharsPerToken: 4,
+	}
+}
+
+// Count 估算 token 数量
+func (h *Heuristic) Count(text string) int {
+	var cjk, latin, other int
+	for _, r := range text {
+		switch {
+		case unicode.IsSpace(r):
+		case isCJK(r):
+			cjk++
+		case r < unicode.MaxASCII && unicode.IsLetter(r):
+			latin++
+		default:
+			// 数字、标点符号、其他文字和表情符号
+			other++
+		}
+	}
+	return int(math.Ceil(float64(cjk)/h.CJKCharsPerToken+float64(latin)/h.LatinCharsPerToken)) + other
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+type loaded struct {
+	t   Tokenizer
+	err error
+}
+
+var (
+	cacheMu sync.Mutex
+	cache   = make(map[string]*loaded)
+)
+
+// Get 根据名称获取分词器
+// name 为空或 HeuristicName 时返回 Default，否则作为 tiktoken 格式词表文件路径加载 BPE 分词器
+// 词表只加载一次，加载失败的结果也会缓存，修改词表文件后需要重启服务
+func Get(name string) (Tokenizer, error) {
+	if name == "" || name == HeuristicName {
+		return Default, nil
+	}
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if l, ok := cache[name]; ok {
+		return l.t, l.err
+	}
+	b, err := LoadBPE(name)
+	l := &loaded{err: err}
+	if err == nil {
+		l.t = b
+	}
+	cache[name] = l
+	return l.t, l.err
+}
@@ -0,0 +1,88 @@
+package xtoken
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeuristicCount(t *testing.T) {
+	h := NewHeuristic()
+	cases := map[string]int{
+		"":     0,
+		"   ":  0,
+		"头痛三天": 4,
+		"我头痛三天了，需要挂什么科": 11,
+		"hello world":    3,
+		"血压 140/90 mmHg": 9,
+		"a":              1,
+	}
+	for in, want := range cases {
+		if got := h.Count(in); got != want {
+			t.Errorf("Count(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestPretokenize(t *testing.T) {
+	got := pretokenize("Hello  world's 2024年\n\nok")
+	want := []string{"Hello", " ", " world", "'s", " ", "2", "0", "2", "4", "年", "\n\n", "ok"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("pretokenize = %q, want %q", got, want)
+	}
+}
+
+func writeVocab(t *testing.T, tokens ...string) string {
+	t.Helper()
+	var sb strings.Builder
+	for i, tok := range tokens {
+		fmt.Fprintf(&sb, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(tok)), i)
+	}
+	path := filepath.Join(t.TempDir(), "vocab.tiktoken")
+	if err := os.WriteFile(path, []byte(sb.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBPECount(t *testing.T) {
+	path := writeVocab(t, "a", "b", "c", "d", " ", "ab", "cd", " ab", "abcd")
+	b, err := LoadBPE(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]int{
+		"abcd":    1,
+		"abc":     2, // ab c
+		"dcba":    4,
+		"ab ab":   2, // ab, " ab"
+		"abcd ab": 2,
+	}
+	for in, want := range cases {
+		if got := b.Count(in); got != want {
+			t.Errorf("Count(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	if tk, err := Get(""); err != nil || tk != Default {
+		t.Fatalf("Get(\"\") = %v, %v", tk, err)
+	}
+	path := writeVocab(t, "a", "b", "ab")
+	first, err := Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := Get(path)
+	if first != second {
+		t.Fatal("vocab loaded twice")
+	}
+	if _, err := Get(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected error for missing vocab")
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"orgine.com/ai-team/power-ai-framework-v4/env"
-	etcd_mw "orgine.com/ai-team/power-ai-framework-v4/middleware/etcd"
 	"orgine.com/ai-team/power-ai-framework-v4/middleware/milvus"
 	minio_mw "orgine.com/ai-team/power-ai-framework-v4/middleware/minio"
 	pgsql_mw "orgine.com/ai-team/power-ai-framework-v4/middleware/pgsql"
@@ -23,7 +22,9 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 const Ver = "v1.0.27"
@@ -32,7 +33,7 @@ type AgentApp struct {
 	Manifest    *Manifest
 	HttpServer  *server.HttpServer
 	OnShutdown  func(ctx context.Context)
-	etcd        *etcd_mw.Etcd
+	etcd        ConfigStore
 	pgsql       *pgsql_mw.PgSql
 	redis       *redis_mw.Redis
 	minio       *minio_mw.Minio
@@ -40,9 +41,36 @@ type AgentApp struct {
 	milvus      *milvus_mw.Milvus
 	agentConfig *AgentConfig
 	agentClient *AgentClient
+	callGuard   *agentCallGuard
 	mu          sync.Mutex
+	// 工具调用
+	toolRegistry *toolRegistry
+	toolMaxSteps int
+	// 模型用量统计
+	usage *usageMeter
+	// 系统模型端点调用统计
+	modelStats *modelEndpointStats
+	// 自动摘要
+	autoSummary bool
+	summarizer  *memorySummarizer
+	// 跨会话语义召回
+	recall *memoryRecall
+	// 会话生命周期事件
+	sessionEvents *sessionEvents
+	// 长期记忆表是否已创建
+	patientMemoryReady atomic.Bool
+	// 用户数据删除
+	erasureAuditReady atomic.Bool
+	fileResolver      FileResolver
+	// 配置修改历史表是否已创建
+	configHistoryReady atomic.Bool
+	// 配置修改订阅的防抖时间
+	configChangeDebounce time.Duration
+	// 优雅停机等待处理中请求结束的最长时间
+	shutdownTimeout time.Duration
 	// 记忆管理相关字段
 	memoryConfig      *xconfig.MemoryConfig
+	shortMemory       ShortMemoryStore
 	sessionLockMgr    *xlock.SessionLockManager
 	sessionNormalizer *xdefense.SessionNormalizer
 	messageBuilder    *xmemory.MessageBuilder
@@ -70,6 +98,8 @@ func (a *AgentApp) Run() {
 		a.Manifest.Name,
 		a.Manifest.Version)
 
+	a.startSessionSweep()
+
 	// signal
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
@@ -77,10 +107,7 @@ func (a *AgentApp) Run() {
 		s := <-c
 		switch s {
 		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
-			a.HttpServer.StopServer()
-			if a.OnShutdown != nil {
-				a.OnShutdown(context.Background())
-			}
+			a.Shutdown()
 			return
 		case syscall.SIGHUP:
 		default:
@@ -89,20 +116,95 @@ func (a *AgentApp) Run() {
 	}
 }
 
+// Shutdown 优雅停机
+// 1.撤销etcd注册租约，调用方不再路由到本实例
+// 2.停止接收新请求，等待处理中的请求（SSE流式响应）结束，最长等待shutdownTimeout
+// 3.回调OnShutdown
+// 4.停止会话过期巡检，等待会话事件处理、自动摘要和摘要向量写入结束
+// 5.写入剩余的模型用量，取消配置修改订阅，结束配置和服务实例的监听
+// 6.关闭etcd（或本地配置文件）/redis/pgsql/milvus/weaviate/minio客户端
+func (a *AgentApp) Shutdown() {
+	xlog.LogInfoF("10000", "agent", "shutdown", fmt.Sprintf("[%s]开始优雅停机,最长等待%s", a.Manifest.Code, a.shutdownTimeout))
+	ctx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout)
+	defer cancel()
+
+	a.agentClient.deregister()
+
+	if err := a.HttpServer.StopServer(ctx); err != nil {
+		xlog.LogErrorF("10000", "agent", "shutdown", fmt.Sprintf("[%s]停止http服务异常", a.Manifest.Code), err)
+	}
+
+	if a.OnShutdown != nil {
+		a.OnShutdown(ctx)
+	}
+
+	a.stopSessionEvents(ctx)
+	a.waitSummaries(ctx)
+	a.waitRecall(ctx)
+	a.stopUsage(ctx)
+	a.agentConfig.closeSubscriptions(ctx)
+	a.stopWatchers()
+	a.closeClients()
+	xlog.LogInfoF("10000", "agent", "shutdown", fmt.Sprintf("[%s]停机完成", a.Manifest.Code))
+}
+
+// closeClients 关闭AgentApp持有的中间件客户端
+func (a *AgentApp) closeClients() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.redis != nil {
+		if err := a.redis.Close(); err != nil {
+			xlog.LogErrorF("10000", "agent", "shutdown", "关闭redis连接失败", err)
+		}
+		a.redis = nil
+	}
+	if a.pgsql != nil {
+		if err := a.pgsql.Close(); err != nil {
+			xlog.LogErrorF("10000", "agent", "shutdown", "关闭pgsql连接失败", err)
+		}
+		a.pgsql = nil
+	}
+	if a.milvus != nil {
+		if err := a.milvus.Close(); err != nil {
+			xlog.LogErrorF("10000", "agent", "shutdown", "关闭milvus连接失败", err)
+		}
+		a.milvus = nil
+	}
+	if a.weaviate != nil {
+		a.weaviate.Close()
+		a.weaviate = nil
+	}
+	if a.minio != nil {
+		a.minio.Close()
+		a.minio = nil
+	}
+	// etcd最后关闭，前面的注销依赖etcd
+	if a.etcd != nil {
+		a.etcd.Close()
+	}
+}
+
 func NewAgent(manifest string, opts ...Option) (*AgentApp, error) {
 	mf, err := initManifest(manifest)
 	if err != nil {
 		return nil, err
 	}
 	newOpts := newOptions(opts)
+	// 校验默认配置
+	if err = validateDefaultConfigs(newOpts.DefaultConfigs); err != nil {
+		return nil, err
+	}
+	if err = checkAdminAuth(newOpts); err != nil {
+		return nil, err
+	}
 	// 配置初始化环境变量
 	env.Init()
 	// 工具初始化
 	tools.Init()
-	// 初始化 etcd
-	etcd, err := initEtcd()
+	// 初始化 etcd，指定配置文件时使用本地文件
+	etcd, err := initConfigStore(newOpts)
 	if err != nil {
-		return nil, fmt.Errorf("init etcd middleware err:%s", err.Error())
+		return nil, err
 	}
 
 	// 初始化记忆管理工具类
@@ -116,13 +218,29 @@ func NewAgent(manifest string, opts ...Option) (*AgentApp, error) {
 		memoryInitResult.MessageBuilder = xmemory.NewMessageBuilder(200, 100)
 	}
 
+	callGuard := newAgentCallGuard()
 	a := &AgentApp{
 		Manifest:    mf,
 		HttpServer:  server.New(),
 		OnShutdown:  newOpts.OnShutDown,
 		etcd:        etcd,
-		agentConfig: newAgentConfig(etcd, mf.Code, newOpts.DefaultConfigs, newOpts.ConfigChangeCallbacks),
-		agentClient: newAgentClient(etcd),
+		agentClient: newAgentClient(etcd, newOpts),
+		callGuard:   callGuard,
+		// 工具调用
+		toolRegistry: newToolRegistry(),
+		toolMaxSteps: newOpts.ToolMaxSteps,
+		usage:        newUsageMeter(newOpts.UsageLogRetention),
+		modelStats:   newModelEndpointStats(),
+		autoSummary:  newOpts.AutoSummary,
+		summarizer:   newMemorySummarizer(),
+		recall:       newMemoryRecall(newOpts.MemoryRecall),
+		// 会话生命周期事件
+		sessionEvents: newSessionEvents(newOpts.SessionHooks),
+		fileResolver:  newOpts.FileResolver,
+		// 配置修改订阅
+		configChangeDebounce: newOpts.ConfigChangeDebounce,
+		// 优雅停机
+		shutdownTimeout: newOpts.ShutdownTimeout,
 		// 记忆管理相关字段
 		memoryConfig:      memoryInitResult.Config,
 		sessionLockMgr:    memoryInitResult.LockManager,
@@ -130,10 +248,43 @@ func NewAgent(manifest string, opts ...Option) (*AgentApp, error) {
 		messageBuilder:    memoryInitResult.MessageBuilder,
 	}
 
+	var history func(change *configChange)
+	if newOpts.ConfigHistory {
+		history = a.recordConfigHistory
+	}
+	a.agentConfig = newAgentConfig(etcd, mf.Code, newOpts.DefaultConfigs, append(newOpts.ConfigChangeCallbacks, callGuard.onConfigChange), history)
+
+	a.shortMemory = newOpts.ShortMemoryStore
+	if a.shortMemory == nil {
+		a.shortMemory = &redisShortMemoryStore{client: a.GetRedisClient, keyPrefix: a.memoryConfig.RedisKeyPrefix}
+	}
+	// 多实例部署时会话锁通过redis在实例之间互斥
+	if a.redisShortMemory() {
+		a.sessionLockMgr.UseBackend(a.sessionLockBackend)
+	}
+
+	for _, t := range newOpts.Tools {
+		if err = a.RegisterTool(t); err != nil {
+			return nil, fmt.Errorf("register tool err:%s", err.Error())
+		}
+	}
+
 	// 生成base_url
 	baseUrl := strings.ReplaceAll(mf.Code, "-", "/")
 	a.HttpServer.GET(fmt.Sprintf("/%s/health", baseUrl), a.health)
 	a.HttpServer.GET(fmt.Sprintf("/%s/version", baseUrl), a.version)
+	if newOpts.AdminAuth != nil {
+		a.HttpServer.GET(fmt.Sprintf("/%s/circuit_breakers", baseUrl), newOpts.AdminAuth, a.circuitBreakers)
+		a.HttpServer.GET(fmt.Sprintf("/%s/model_endpoints", baseUrl), newOpts.AdminAuth, a.modelEndpoints)
+	}
+	if newOpts.TranscriptRoutes {
+		a.HttpServer.GET(fmt.Sprintf("/%s/transcript", baseUrl), newOpts.AdminAuth, a.transcript)
+		a.HttpServer.POST(fmt.Sprintf("/%s/erase_user", baseUrl), newOpts.AdminAuth, a.eraseUser)
+	}
+	if newOpts.ConfigHistory {
+		a.HttpServer.GET(fmt.Sprintf("/%s/config_history", baseUrl), newOpts.AdminAuth, a.configHistory)
+		a.HttpServer.POST(fmt.Sprintf("/%s/config_rollback", baseUrl), newOpts.AdminAuth, a.configRollback)
+	}
 	for k, v := range newOpts.PostRouters {
 		a.HttpServer.POST(fmt.Sprintf("/%s/%s", baseUrl, k), v)
 	}
@@ -143,10 +294,22 @@ func NewAgent(manifest string, opts ...Option) (*AgentApp, error) {
 	return a, nil
 }
 
+// health 返回成功表示实例可以处理请求；etcd 监听异常时配置和实例列表可能过期，status 为 degraded，不影响实例接收请求
 func (a *AgentApp) health(c *gin.Context) {
+	status := "ok"
+	watches := a.WatchStatuses()
+	for _, w := range watches {
+		if !w.Healthy() {
+			status = "degraded"
+		}
+	}
 	c.JSON(200, map[string]interface{}{
 		"code":    server.ResultSuccess.Code,
 		"message": server.ResultSuccess.Message,
+		"data": map[string]interface{}{
+			"status":  status,
+			"watches": watches,
+		},
 	})
 }
 
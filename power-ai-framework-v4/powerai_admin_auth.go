@@ -0,0 +1,58 @@
+package powerai
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
+	"strings"
+)
+
+// ***************************************************************************************************************
+//
+//	管理路由鉴权
+//	WithTranscriptRoutes（会话导出、用户数据删除）和 WithConfigHistory（配置历史、回滚）注册的路由必须鉴权：
+//	通过 WithAdminToken 设置令牌，或通过 WithAdminAuth 设置鉴权函数（如由网关鉴权时校验网关写入的请求头），
+//	开启了这些路由但未设置鉴权时 NewAgent 返回错误
+//	诊断路由（circuit_breakers、model_endpoints）包含下游地址和调用统计，只在设置了鉴权时注册
+//
+// ***************************************************************************************************************
+
+// adminTokenHeader WithAdminToken 也接受的请求头，Authorization: Bearer {token} 之外的写法
+const adminTokenHeader = "X-Admin-Token"
+
+// WithAdminAuth 设置管理路由的鉴权函数，鉴权失败时调用 c.Abort 系列方法结束请求，成功时不需要调用 c.Next
+func WithAdminAuth(auth gin.HandlerFunc) Option {
+	return Option{
+		F: func(o *Options) {
+			o.AdminAuth = auth
+		},
+	}
+}
+
+// WithAdminToken 管理路由使用令牌鉴权，请求头 Authorization: Bearer {token} 或 X-Admin-Token: {token}
+func WithAdminToken(token string) Option {
+	return WithAdminAuth(func(c *gin.Context) {
+		got := c.GetHeader(adminTokenHeader)
+		if v, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			got = v
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, map[string]interface{}{
+				"code":           server.Unauthorized.Code,
+				"message":        server.Unauthorized.Message,
+				"sys_track_code": c.Query("sys_track_code"),
+				"data":           nil,
+			})
+		}
+	})
+}
+
+// checkAdminAuth 开启管理路由时必须设置鉴权
+func checkAdminAuth(o *Options) error {
+	if (o.TranscriptRoutes || o.ConfigHistory) && o.AdminAuth == nil {
+		return fmt.Errorf("WithTranscriptRoutes/WithConfigHistory 注册的管理路由需要通过 WithAdminToken 或 WithAdminAuth 设置鉴权")
+	}
+	return nil
+}
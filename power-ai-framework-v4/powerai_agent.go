@@ -1,60 +1,115 @@
 package powerai
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xbalance"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xconfig"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xhttp"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xjson"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
 	"orgine.com/ai-team/power-ai-framework-v4/tools"
+	"strconv"
+	"strings"
 )
 
 // SyncCallAgent 同步调用智能体
 func (a *AgentApp) SyncCallAgent(agentCode string, request *server.AgentRequest, handler xhttp.HttpRequestResponseFunc) string {
+	return a.SyncCallAgentCtx(context.Background(), agentCode, request, handler)
+}
+
+// SyncCallAgentCtx 同步调用智能体，ctx结束（如客户端断开）时中断下游流
+func (a *AgentApp) SyncCallAgentCtx(ctx context.Context, agentCode string, request *server.AgentRequest, handler xhttp.HttpRequestResponseFunc) string {
 	if agentCode == "" {
 		handler(nil, fmt.Errorf("agentCode不能为空"))
 		return ""
 	}
-	addr, err := a.agentClient.get(agentCode)
-	if err != nil {
-		handler(nil, fmt.Errorf("获取智能体[%s]实例信息失败,失败：%v", agentCode, err))
-		return ""
-	}
-	b, _ := json.Marshal(request)
-	url := GetAgentSendMsgUrl(addr, agentCode)
-	r := &xhttp.HttpRequest{
-		RawURL: url,
-		Method: "POST",
-		Body:   b,
-	}
-	tools.SendReqBySyncRespStream(r, handler)
-	return url
+	return a.streamCallAgent(ctx, agentCode, request, handler, nil)
 }
 
 // AsyncCallAgent 异步调用智能体
 func (a *AgentApp) AsyncCallAgent(agentCode string, request *server.AgentRequest, handler xhttp.HttpRequestResponseFunc) string {
+	return a.AsyncCallAgentCtx(context.Background(), agentCode, request, handler)
+}
+
+// AsyncCallAgentCtx 异步调用智能体，ctx结束（如客户端断开）时中断下游流
+func (a *AgentApp) AsyncCallAgentCtx(ctx context.Context, agentCode string, request *server.AgentRequest, handler xhttp.HttpRequestResponseFunc) string {
 	if agentCode == "" {
 		handler(nil, fmt.Errorf("agentCode不能为空"))
 		return ""
 	}
-	addr, err := a.agentClient.get(agentCode)
-	if err != nil {
-		handler(nil, fmt.Errorf("获取智能体[%s]实例信息失败,失败：%v", agentCode, err))
-		return ""
+	// 首次选中的实例地址
+	first := make(chan string, 1)
+	go a.streamCallAgent(ctx, agentCode, request, handler, first)
+	return <-first
+}
+
+// streamCallAgent 按调用策略流式调用智能体，返回最后一次请求的url
+// first 不为空时，首次选中实例或调用失败后写入url
+func (a *AgentApp) streamCallAgent(ctx context.Context, agentCode string, request *server.AgentRequest, handler xhttp.HttpRequestResponseFunc, first chan<- string) string {
+	var url string
+	notify := func() {
+		if first != nil {
+			first <- url
+			first = nil
+		}
 	}
+	defer notify()
 
 	b, _ := json.Marshal(request)
-	url := GetAgentSendMsgUrl(addr, agentCode)
-	r := &xhttp.HttpRequest{
-		RawURL: url,
-		Method: "POST",
-		Body:   b,
+	// 已经将数据或错误交给handler后不能再重试，也不能重复通知错误
+	delivered := false
+	err := a.callAgent(ctx, agentCode, request.EnterpriseId, func(ctx context.Context, in *xbalance.Instance) error {
+		url = GetAgentSendMsgUrl(in.Addr, agentCode)
+		notify()
+		resp, err := tools.StreamCommonHttpClient.SendRequestCtx(ctx, &xhttp.HttpRequest{
+			RawURL: url,
+			Method: "POST",
+			Body:   b,
+		})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("调用智能体[%s]失败,状态码：%d", agentCode, resp.StatusCode)
+		}
+		delivered = true
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 4096), 1024*512)
+		for scanner.Scan() {
+			if !handler(scanner.Bytes(), nil) {
+				return nil
+			}
+		}
+		if ctx.Err() != nil {
+			handler(nil, ctx.Err())
+			return ctx.Err()
+		}
+		if err = scanner.Err(); err != nil {
+			handler(nil, err)
+			return err
+		}
+		return nil
+	})
+	if err != nil && !delivered {
+		handler(nil, err)
 	}
-	tools.SendReqByAsyncRespStream(r, handler)
 	return url
 }
 
 // CallAgentProxy 调用智能体代理
 func (a *AgentApp) CallAgentProxy(agentCode string, request *server.AgentRequest) (string, error) {
+	return a.CallAgentProxyCtx(context.Background(), agentCode, request)
+}
+
+// CallAgentProxyCtx 调用智能体代理，ctx结束时取消请求
+func (a *AgentApp) CallAgentProxyCtx(ctx context.Context, agentCode string, request *server.AgentRequest) (string, error) {
 	if agentCode == "" {
 		return "", fmt.Errorf("agentCode不能为空")
 	}
@@ -62,19 +117,35 @@ func (a *AgentApp) CallAgentProxy(agentCode string, request *server.AgentRequest
 		return "", fmt.Errorf("methodName不能为空")
 	}
 
-	addr, err := a.agentClient.get(agentCode)
+	b, _ := json.Marshal(request)
+	var resp string
+	err := a.callAgent(ctx, agentCode, request.EnterpriseId, func(ctx context.Context, in *xbalance.Instance) error {
+		var err error
+		resp, err = sendAgentRequest(ctx, agentCode, &xhttp.HttpRequest{
+			RawURL: GetAgentProxyUrl(in.Addr, agentCode, request.MethodName),
+			Method: "POST",
+			Body:   b,
+		})
+		return err
+	})
+	return resp, err
+}
+
+// sendAgentRequest 发送请求并读取完整响应，5xx 视为调用失败
+func sendAgentRequest(ctx context.Context, agentCode string, r *xhttp.HttpRequest) (string, error) {
+	resp, err := tools.DefaultCommonHttpClient.SendRequestCtx(ctx, r)
 	if err != nil {
-		return "", fmt.Errorf("获取智能体[%s]实例信息失败,失败：%v", agentCode, err)
+		return "", err
 	}
-
-	b, _ := json.Marshal(request)
-	url := GetAgentProxyUrl(addr, agentCode, request.MethodName)
-	r := &xhttp.HttpRequest{
-		RawURL: url,
-		Method: "POST",
-		Body:   b,
+	defer resp.Body.Close()
+	rb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
 	}
-	return tools.SendReqByRespString(r)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return string(rb), fmt.Errorf("调用智能体[%s]失败,状态码：%d", agentCode, resp.StatusCode)
+	}
+	return string(rb), nil
 }
 
 type SendBoxResponse struct {
@@ -110,22 +181,27 @@ func (a *AgentApp) CallSendBox(sysTrackCode, agentCode, enterpriseId, scriptId s
 }
 
 func (a *AgentApp) CallAgentByHttp(agentCode string, request []byte) (string, string, error) {
+	return a.CallAgentByHttpCtx(context.Background(), agentCode, request)
+}
+
+// CallAgentByHttpCtx 非流式调用智能体，ctx结束时取消请求
+func (a *AgentApp) CallAgentByHttpCtx(ctx context.Context, agentCode string, request []byte) (string, string, error) {
 	if agentCode == "" {
 		return "", "", fmt.Errorf("agentCode不能为空")
 	}
-	addr, err := a.agentClient.get(agentCode)
 
-	if err != nil {
-		return "", "", fmt.Errorf("获取智能体[%s]实例信息失败,失败：%v", agentCode, err)
-	}
-
-	url := GetAgentSendMsgUrl(addr, agentCode)
-	r := &xhttp.HttpRequest{
-		RawURL: url,
-		Method: "POST",
-		Body:   request,
-	}
-	resp, err := tools.SendReqByRespString(r)
+	var resp, url string
+	enterpriseId := xjson.Get(string(request), "enterprise_id").String()
+	err := a.callAgent(ctx, agentCode, enterpriseId, func(ctx context.Context, in *xbalance.Instance) error {
+		var err error
+		url = GetAgentSendMsgUrl(in.Addr, agentCode)
+		resp, err = sendAgentRequest(ctx, agentCode, &xhttp.HttpRequest{
+			RawURL: url,
+			Method: "POST",
+			Body:   request,
+		})
+		return err
+	})
 	return resp, url, err
 }
 
@@ -180,6 +256,78 @@ func (a *AgentApp) GetConfigByAgent(key, enterpriseId, agentCode string) *Config
 	return a.agentConfig.getConfigFromEtcdAndCache(GetAgentGeneralConfigFullKey("", agentCode, key))
 }
 
+// GetAgentConfigString 获取字符串类型的智能体配置，未配置返回 def
+func (a *AgentApp) GetAgentConfigString(key, enterpriseId, def string) string {
+	c := a.GetAgentConfig(key, enterpriseId)
+	if c == nil {
+		return def
+	}
+	return c.Value
+}
+
+// GetAgentConfigInt 获取整数类型的智能体配置，未配置或不是整数返回 def
+func (a *AgentApp) GetAgentConfigInt(key, enterpriseId string, def int) int {
+	c := a.GetAgentConfig(key, enterpriseId)
+	if c == nil {
+		return def
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(c.Value))
+	if err != nil {
+		xlog.LogErrorF("10000", "agent-config", "get", fmt.Sprintf("[%s]配置不是整数，使用默认值%d", key, def), err)
+		return def
+	}
+	return v
+}
+
+// GetAgentConfigFloat 获取浮点数类型的智能体配置，未配置或不是浮点数返回 def
+func (a *AgentApp) GetAgentConfigFloat(key, enterpriseId string, def float64) float64 {
+	c := a.GetAgentConfig(key, enterpriseId)
+	if c == nil {
+		return def
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(c.Value), 64)
+	if err != nil {
+		xlog.LogErrorF("10000", "agent-config", "get", fmt.Sprintf("[%s]配置不是浮点数，使用默认值%v", key, def), err)
+		return def
+	}
+	return v
+}
+
+// GetAgentConfigBool 获取布尔类型的智能体配置，未配置或不是布尔值返回 def
+func (a *AgentApp) GetAgentConfigBool(key, enterpriseId string, def bool) bool {
+	c := a.GetAgentConfig(key, enterpriseId)
+	if c == nil {
+		return def
+	}
+	v, err := strconv.ParseBool(strings.TrimSpace(c.Value))
+	if err != nil {
+		xlog.LogErrorF("10000", "agent-config", "get", fmt.Sprintf("[%s]配置不是布尔值，使用默认值%v", key, def), err)
+		return def
+	}
+	return v
+}
+
+// GetAgentConfigJSON 将 json 类型的智能体配置解析到 v
+func (a *AgentApp) GetAgentConfigJSON(key, enterpriseId string, v interface{}) error {
+	c := a.GetAgentConfig(key, enterpriseId)
+	if c == nil {
+		return fmt.Errorf("agent config [%s] not found", key)
+	}
+	if err := json.Unmarshal([]byte(c.Value), v); err != nil {
+		return fmt.Errorf("parse agent config [%s] err: %w", key, err)
+	}
+	return nil
+}
+
+// GetAgentConfigPrompt 获取提示词模板类型的智能体配置，{{name}} 替换为 vars[name]，未配置返回空字符串
+func (a *AgentApp) GetAgentConfigPrompt(key, enterpriseId string, vars map[string]string) string {
+	c := a.GetAgentConfig(key, enterpriseId)
+	if c == nil {
+		return ""
+	}
+	return xconfig.RenderPrompt(c.Value, vars)
+}
+
 func (a *AgentApp) GetSystemConfig(key, enterpriseId string) *Config {
 	enterpriseIdKey := GetSystemConfigFullKey(enterpriseId, key)
 	c := a.agentConfig.getConfigFromEtcdAndCache(enterpriseIdKey)
@@ -237,8 +385,13 @@ type DecisionAgentResponse struct {
 
 // CallDecisionAgent 同步调用智能体
 func (a *AgentApp) CallDecisionAgent(request *server.AgentRequest) (*DecisionAgentResponse, string, error) {
+	return a.CallDecisionAgentCtx(context.Background(), request)
+}
+
+// CallDecisionAgentCtx 同步调用意图分类智能体，ctx结束时取消请求
+func (a *AgentApp) CallDecisionAgentCtx(ctx context.Context, request *server.AgentRequest) (*DecisionAgentResponse, string, error) {
 	b, _ := json.Marshal(request)
-	r, url, err := a.CallAgentByHttp(PowerAiDecision, b)
+	r, url, err := a.CallAgentByHttpCtx(ctx, PowerAiDecision, b)
 	if err != nil {
 		return nil, url, err
 	}
@@ -0,0 +1,188 @@
+package powerai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	智能体槽位（GlobalState.AgentSlots）的类型化读写
+//	SetAgentSlot 保存时记录槽位结构的版本和过期时间：
+//	AgentSlots["power-ai-agent-triage"] = {"_slot_version":2,"_slot_expires_at":1735000000,"data":{...}}
+//	GetAgentSlot 读取时版本低于注册的版本则依次调用迁移函数，已过期的槽位直接删除
+//	旧版本直接保存结构体的槽位视为版本0
+//
+// ***************************************************************************************************************
+
+const (
+	slotVersionKey   = "_slot_version"
+	slotExpiresAtKey = "_slot_expires_at"
+	slotDataKey      = "data"
+)
+
+// AgentSlotSchema 智能体槽位的结构定义
+type AgentSlotSchema struct {
+	// Version 当前结构版本，结构不兼容地修改时加1并提供迁移函数
+	Version int
+	// TTL 槽位有效期，每次 SetAgentSlot 时重新计算，0 表示不过期
+	// 适用于多轮交互中的临时状态，如等待用户选择医生
+	TTL time.Duration
+	// Migrations 版本迁移函数，key 为迁移前的版本，将 data 从版本 key 迁移到 key+1
+	Migrations map[int]func(data map[string]interface{}) error
+}
+
+var agentSlotSchemas sync.Map // agentCode -> *AgentSlotSchema
+
+// RegisterAgentSlot 注册智能体槽位的结构定义，未注册的槽位版本为0且不过期
+//
+//	powerai.RegisterAgentSlot("power-ai-agent-triage", powerai.AgentSlotSchema{
+//	    Version: 2,
+//	    TTL:     30 * time.Minute,
+//	    Migrations: map[int]func(map[string]interface{}) error{
+//	        1: func(d map[string]interface{}) error { d["symptoms"] = []interface{}{d["symptom"]}; return nil },
+//	    },
+//	})
+func RegisterAgentSlot(agentCode string, schema AgentSlotSchema) {
+	agentSlotSchemas.Store(agentCode, &schema)
+}
+
+func agentSlotSchema(agentCode string) *AgentSlotSchema {
+	if v, ok := agentSlotSchemas.Load(agentCode); ok {
+		return v.(*AgentSlotSchema)
+	}
+	return &AgentSlotSchema{}
+}
+
+// GetAgentSlot 读取智能体槽位并解析为 T，槽位不存在或已过期时返回 nil
+// 已过期的槽位会从 session 中删除，需要调用方保存会话才会持久化
+func GetAgentSlot[T any](session *SessionValue, agentCode string) (*T, error) {
+	if session == nil || session.GlobalState == nil {
+		return nil, nil
+	}
+	raw, ok := session.GlobalState.AgentSlots[agentCode]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("智能体[%s]槽位序列化失败: %w", agentCode, err)
+	}
+	var stored map[string]interface{}
+	if err = json.Unmarshal(b, &stored); err != nil {
+		return nil, fmt.Errorf("智能体[%s]槽位不是对象: %w", agentCode, err)
+	}
+
+	// 旧版本直接保存的结构体视为版本0
+	version := 0
+	data := stored
+	if v, ok := stored[slotVersionKey]; ok {
+		version = int(slotNumber(v))
+		if expiresAt := int64(slotNumber(stored[slotExpiresAtKey])); expiresAt > 0 && time.Now().Unix() >= expiresAt {
+			delete(session.GlobalState.AgentSlots, agentCode)
+			return nil, nil
+		}
+		data, _ = stored[slotDataKey].(map[string]interface{})
+		if data == nil {
+			data = make(map[string]interface{})
+		}
+	}
+
+	schema := agentSlotSchema(agentCode)
+	if version > schema.Version {
+		return nil, fmt.Errorf("智能体[%s]槽位版本[%d]高于当前版本[%d]", agentCode, version, schema.Version)
+	}
+	for ; version < schema.Version; version++ {
+		migrate, ok := schema.Migrations[version]
+		if !ok {
+			return nil, fmt.Errorf("智能体[%s]槽位缺少版本[%d]到[%d]的迁移函数", agentCode, version, version+1)
+		}
+		if err = migrate(data); err != nil {
+			return nil, fmt.Errorf("智能体[%s]槽位从版本[%d]迁移失败: %w", agentCode, version, err)
+		}
+	}
+
+	b, err = json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("智能体[%s]槽位序列化失败: %w", agentCode, err)
+	}
+	v := new(T)
+	if err = json.Unmarshal(b, v); err != nil {
+		return nil, fmt.Errorf("智能体[%s]槽位解析失败: %w", agentCode, err)
+	}
+	return v, nil
+}
+
+// SetAgentSlot 保存智能体槽位，记录当前结构版本和过期时间
+// 只修改 session，需要调用方保存会话，或使用 UpdateAgentSlot
+func SetAgentSlot[T any](session *SessionValue, agentCode string, value *T) error {
+	if session == nil {
+		return fmt.Errorf("session is nil")
+	}
+	if session.GlobalState == nil {
+		session.GlobalState = &GlobalState{}
+	}
+	if session.GlobalState.AgentSlots == nil {
+		session.GlobalState.AgentSlots = make(map[string]interface{})
+	}
+	if value == nil {
+		delete(session.GlobalState.AgentSlots, agentCode)
+		return nil
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("智能体[%s]槽位序列化失败: %w", agentCode, err)
+	}
+	var data interface{}
+	if err = json.Unmarshal(b, &data); err != nil {
+		return fmt.Errorf("智能体[%s]槽位序列化失败: %w", agentCode, err)
+	}
+	schema := agentSlotSchema(agentCode)
+	slot := map[string]interface{}{
+		slotVersionKey: schema.Version,
+		slotDataKey:    data,
+	}
+	if schema.TTL > 0 {
+		slot[slotExpiresAtKey] = time.Now().Add(schema.TTL).Unix()
+	}
+	session.GlobalState.AgentSlots[agentCode] = slot
+	return nil
+}
+
+// UpdateAgentSlot 读取-修改-保存智能体槽位，版本冲突时重新读取，槽位不存在时 fn 收到零值
+func UpdateAgentSlot[T any](a *AgentApp, conversationId, agentCode string, fn func(*T) error) error {
+	return UpdateAgentSlotCtx[T](context.Background(), a, conversationId, agentCode, fn)
+}
+
+// UpdateAgentSlotCtx 同 UpdateAgentSlot，ctx结束时停止重试
+func UpdateAgentSlotCtx[T any](ctx context.Context, a *AgentApp, conversationId, agentCode string, fn func(*T) error) error {
+	return a.UpdateShortMemoryCtx(ctx, conversationId, func(s *SessionValue) error {
+		v, err := GetAgentSlot[T](s, agentCode)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			v = new(T)
+		}
+		if err = fn(v); err != nil {
+			return err
+		}
+		return SetAgentSlot(s, agentCode, v)
+	})
+}
+
+func slotNumber(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	}
+	return 0
+}
@@ -0,0 +1,364 @@
+package powerai
+
+import (
+	"context"
+	xsql "database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"orgine.com/ai-team/power-ai-framework-v4/env"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xconfig"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	配置修改历史（WithConfigHistory 开启）
+//	监听到的本智能体配置修改（put/delete，校验失败被拒绝的修改记为 rejected）写入 ai_config_history 表，
+//	系统配置和意图配置不记录；revision 为 etcd 的修改版本号，监听断开期间被删除的配置记为重新同步时版本的 delete
+//	多实例部署时只由本智能体注册地址最小的实例记录，该实例下线到租约过期之间（最长60秒）的修改可能不被记录
+//	value/prev_value/diff 中密钥类字段（key、password、token 等，见 xconfig.IsSecretName）脱敏后写入，
+//	配置key本身为密钥类时整个配置值脱敏；回滚时脱敏的字段使用当前配置中的值，当前配置中没有该字段时不能回滚
+//	智能体未运行期间的修改不会被记录
+//	GET  /{base}/config_history?key=xxx&enterprise_id=xxx&limit=20  查询本智能体配置的修改历史
+//	POST /{base}/config_rollback  {"key":"","enterprise_id":"","revision":0,"operator":""} 将配置回滚到指定版本，
+//	回滚本身也是一次修改，会记录新的版本
+//
+// ***************************************************************************************************************
+
+// 配置修改类型
+const (
+	ConfigActionPut      = "put"
+	ConfigActionDelete   = "delete"
+	ConfigActionRejected = "rejected" // 校验失败，未生效
+)
+
+const defaultConfigHistoryLimit = 20
+
+const configHistoryTableDDL = `CREATE TABLE IF NOT EXISTS ai_config_history (
+	id            bigserial     PRIMARY KEY,
+	config_key    varchar(512)  NOT NULL,
+	revision      bigint        NOT NULL,
+	prev_revision bigint        NOT NULL DEFAULT 0,
+	action        varchar(16)   NOT NULL,
+	value         text,
+	prev_value    text,
+	diff          text,
+	modify_from   varchar(128),
+	remark        varchar(1024),
+	agent_code    varchar(128),
+	create_time   timestamp,
+	UNIQUE (config_key, revision)
+)`
+
+// ConfigRevision 配置的一个历史版本
+type ConfigRevision struct {
+	Key          string    `json:"key"`
+	Revision     int64     `json:"revision"`
+	PrevRevision int64     `json:"prev_revision"`
+	Action       string    `json:"action"`
+	Config       *Config   `json:"config,omitempty"` // 该版本的配置，删除时为空
+	Diff         string    `json:"diff,omitempty"`
+	ModifyFrom   string    `json:"modify_from,omitempty"`
+	Remark       string    `json:"remark,omitempty"`
+	CreateTime   time.Time `json:"create_time"`
+}
+
+type configHistoryRow struct {
+	ConfigKey    string          `db:"config_key"`
+	Revision     int64           `db:"revision"`
+	PrevRevision int64           `db:"prev_revision"`
+	Action       string          `db:"action"`
+	Value        xsql.NullString `db:"value"`
+	Diff         xsql.NullString `db:"diff"`
+	ModifyFrom   xsql.NullString `db:"modify_from"`
+	Remark       xsql.NullString `db:"remark"`
+	CreateTime   time.Time       `db:"create_time"`
+}
+
+// ConfigRollbackRequest 配置回滚请求
+type ConfigRollbackRequest struct {
+	Key          string `json:"key"`
+	EnterpriseID string `json:"enterprise_id"` // 为空时为默认配置
+	Revision     int64  `json:"revision"`
+	Operator     string `json:"operator"` // 写入配置的 modify_from
+}
+
+// recordConfigHistory 记录一次配置修改
+func (a *AgentApp) recordConfigHistory(change *configChange) {
+	if !a.configHistoryWriter() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.insertConfigHistory(ctx, change); err != nil {
+		xlog.LogErrorF("10000", "config-history", "record", fmt.Sprintf("记录[%s]版本%d的修改失败", change.Key, change.Revision), err)
+	}
+}
+
+func (a *AgentApp) insertConfigHistory(ctx context.Context, change *configChange) error {
+	if err := a.ensureConfigHistoryTable(ctx); err != nil {
+		return err
+	}
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return err
+	}
+	prevValue, value := redactConfig(change.Key, change.PrevValue), redactConfig(change.Key, change.Value)
+	prev, cur := parseConfig(prevValue), parseConfig(value)
+	modifyFrom := ""
+	if cur != nil {
+		modifyFrom = cur.ModifyFrom
+	} else if prev != nil {
+		modifyFrom = prev.ModifyFrom
+	}
+	_, err = client.ExecCtx(ctx, `INSERT INTO ai_config_history (config_key,revision,prev_revision,action,value,prev_value,diff,modify_from,remark,agent_code,create_time)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11) ON CONFLICT (config_key, revision) DO NOTHING`,
+		change.Key, change.Revision, change.PrevRevision, change.Action, nullString(value), nullString(prevValue),
+		configDiff(prev, cur), modifyFrom, change.Remark, a.Manifest.Code, time.Now())
+	return err
+}
+
+// configHistoryWriter 本实例是否负责记录配置历史：本智能体注册的实例中地址最小的实例记录
+// 本实例尚未出现在注册列表中时也记录，重复的记录由 (config_key, revision) 唯一约束去重
+func (a *AgentApp) configHistoryWriter() bool {
+	instances, _ := a.agentClient.instances.Get(a.Manifest.Code)
+	self := fmt.Sprintf("%s:%s", env.G.HttpServerConfig.Ip, env.G.HttpServerConfig.Port)
+	registered, writer := false, ""
+	for _, in := range instances {
+		registered = registered || in.Addr == self
+		if writer == "" || in.Addr < writer {
+			writer = in.Addr
+		}
+	}
+	return !registered || writer == self
+}
+
+// redactConfig 配置中的密钥类字段脱敏，配置key为密钥类时整个配置值脱敏；不是配置JSON时不记录值
+func redactConfig(key string, raw []byte) []byte {
+	c := parseConfig(raw)
+	if c == nil {
+		return nil
+	}
+	if xconfig.IsSecretName(path.Base(key)) {
+		if c.Value != "" {
+			c.Value = xconfig.RedactedValue
+		}
+	} else {
+		c.Value = xconfig.RedactJSON(c.Value)
+	}
+	b, _ := json.Marshal(c)
+	return b
+}
+
+// restoreRedacted 使用当前配置还原历史版本中脱敏的字段
+func (a *AgentApp) restoreRedacted(etcdKey string, c *Config) error {
+	current := ""
+	if v, err := a.etcd.Get(etcdKey); err == nil {
+		if cur := parseConfig([]byte(v.Value)); cur != nil {
+			current = cur.Value
+		}
+	}
+	if xconfig.IsSecretName(path.Base(etcdKey)) {
+		if c.Value == xconfig.RedactedValue {
+			if current == "" {
+				return fmt.Errorf("配置值已脱敏，当前没有该配置，无法还原")
+			}
+			c.Value = current
+		}
+		return nil
+	}
+	value, err := xconfig.RestoreRedacted(c.Value, current)
+	if err != nil {
+		return err
+	}
+	c.Value = value
+	return nil
+}
+
+func (a *AgentApp) ensureConfigHistoryTable(ctx context.Context) error {
+	if a.configHistoryReady.Load() {
+		return nil
+	}
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return err
+	}
+	if _, err = client.ExecCtx(ctx, configHistoryTableDDL); err != nil {
+		return fmt.Errorf("创建ai_config_history表失败: %w", err)
+	}
+	a.configHistoryReady.Store(true)
+	return nil
+}
+
+// ListAgentConfigHistory 查询智能体配置的修改历史，按版本倒序
+func (a *AgentApp) ListAgentConfigHistory(key, enterpriseId string, limit int) ([]*ConfigRevision, error) {
+	return a.ListAgentConfigHistoryCtx(context.Background(), key, enterpriseId, limit)
+}
+
+// ListAgentConfigHistoryCtx 查询智能体配置的修改历史，按版本倒序，limit<=0 时返回最近20条
+func (a *AgentApp) ListAgentConfigHistoryCtx(ctx context.Context, key, enterpriseId string, limit int) ([]*ConfigRevision, error) {
+	if key == "" {
+		return nil, fmt.Errorf("key不能为空")
+	}
+	if limit <= 0 {
+		limit = defaultConfigHistoryLimit
+	}
+	if err := a.ensureConfigHistoryTable(ctx); err != nil {
+		return nil, err
+	}
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return nil, err
+	}
+	var rows []*configHistoryRow
+	if err = client.QueryMultipleCtx(ctx, &rows, `select config_key,revision,prev_revision,action,value,diff,modify_from,remark,create_time from ai_config_history
+		where config_key = $1 ORDER BY revision DESC LIMIT $2`, GetAgentGeneralConfigFullKey(enterpriseId, a.Manifest.Code, key), limit); err != nil {
+		return nil, err
+	}
+	revisions := make([]*ConfigRevision, 0, len(rows))
+	for _, r := range rows {
+		revisions = append(revisions, r.revision())
+	}
+	return revisions, nil
+}
+
+// RollbackAgentConfig 将智能体配置回滚到指定版本
+func (a *AgentApp) RollbackAgentConfig(req *ConfigRollbackRequest) (*Config, error) {
+	return a.RollbackAgentConfigCtx(context.Background(), req)
+}
+
+// RollbackAgentConfigCtx 将智能体配置回滚到指定版本，只能回滚到 put 版本，回滚后的配置需要通过校验
+func (a *AgentApp) RollbackAgentConfigCtx(ctx context.Context, req *ConfigRollbackRequest) (*Config, error) {
+	if req.Key == "" || req.Revision <= 0 {
+		return nil, fmt.Errorf("key和revision不能为空")
+	}
+	if err := a.ensureConfigHistoryTable(ctx); err != nil {
+		return nil, err
+	}
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return nil, err
+	}
+	etcdKey := GetAgentGeneralConfigFullKey(req.EnterpriseID, a.Manifest.Code, req.Key)
+	row := &configHistoryRow{}
+	if err = client.QuerySingleCtx(ctx, row, `select config_key,revision,prev_revision,action,value,diff,modify_from,remark,create_time from ai_config_history
+		where config_key = $1 and revision = $2`, etcdKey, req.Revision); err != nil {
+		return nil, fmt.Errorf("查询[%s]版本%d失败: %w", etcdKey, req.Revision, err)
+	}
+	c := parseConfig([]byte(row.Value.String))
+	if row.Action != ConfigActionPut || c == nil {
+		return nil, fmt.Errorf("[%s]版本%d为%s，不能回滚", etcdKey, req.Revision, row.Action)
+	}
+	if err = a.restoreRedacted(etcdKey, c); err != nil {
+		return nil, fmt.Errorf("[%s]版本%d: %w", etcdKey, req.Revision, err)
+	}
+	if err = a.agentConfig.validate(etcdKey, c); err != nil {
+		return nil, fmt.Errorf("[%s]版本%d的配置校验失败: %w", etcdKey, req.Revision, err)
+	}
+	c.ModifyFrom = req.Operator
+	if c.ModifyFrom == "" {
+		c.ModifyFrom = "rollback"
+	}
+	c.UpdateTime = time.Now().Format(time.DateTime)
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	if err = a.etcd.Set(etcdKey, string(b)); err != nil {
+		return nil, err
+	}
+	xlog.LogInfoF("10000", "config-history", "rollback", fmt.Sprintf("[%s]回滚到版本%d，操作人：%s", etcdKey, req.Revision, c.ModifyFrom))
+	return c, nil
+}
+
+// configHistory GET /{base}/config_history?key=xxx&enterprise_id=xxx&limit=20
+func (a *AgentApp) configHistory(c *gin.Context) {
+	stc := c.Query("sys_track_code")
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	revisions, err := a.ListAgentConfigHistoryCtx(c.Request.Context(), c.Query("key"), c.Query("enterprise_id"), limit)
+	if err != nil {
+		xlog.LogErrorF(stc, "config-history", "list", fmt.Sprintf("查询[%s]配置历史失败", c.Query("key")), err)
+		RespJsonErr(c, err, stc, nil)
+		return
+	}
+	RespJsonSuccess(c, stc, revisions)
+}
+
+// configRollback POST /{base}/config_rollback，请求体为 ConfigRollbackRequest，返回脱敏后的配置
+func (a *AgentApp) configRollback(c *gin.Context) {
+	stc := c.Query("sys_track_code")
+	req := &ConfigRollbackRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		RespJsonError(c, server.InvalidParam.Code, err.Error(), stc, nil)
+		return
+	}
+	conf, err := a.RollbackAgentConfigCtx(c.Request.Context(), req)
+	if err != nil {
+		xlog.LogErrorF(stc, "config-history", "rollback", fmt.Sprintf("[%s]回滚到版本%d失败", req.Key, req.Revision), err)
+		RespJsonErr(c, err, stc, nil)
+		return
+	}
+	// 返回的配置同样脱敏
+	b, _ := json.Marshal(conf)
+	RespJsonSuccess(c, stc, parseConfig(redactConfig(GetAgentGeneralConfigFullKey(req.EnterpriseID, a.Manifest.Code, req.Key), b)))
+}
+
+func (r *configHistoryRow) revision() *ConfigRevision {
+	return &ConfigRevision{
+		Key:          r.ConfigKey,
+		Revision:     r.Revision,
+		PrevRevision: r.PrevRevision,
+		Action:       r.Action,
+		Config:       parseConfig([]byte(r.Value.String)),
+		Diff:         r.Diff.String,
+		ModifyFrom:   r.ModifyFrom.String,
+		Remark:       r.Remark.String,
+		CreateTime:   r.CreateTime,
+	}
+}
+
+// parseConfig 解析etcd中的配置，为空或解析失败返回 nil
+func parseConfig(b []byte) *Config {
+	if len(b) == 0 {
+		return nil
+	}
+	c := &Config{}
+	if json.Unmarshal(b, c) != nil {
+		return nil
+	}
+	return c
+}
+
+// configDiff 配置修改的内容：name/remark/conf_type 等字段的变化和 value 的逐行比较
+func configDiff(prev, cur *Config) string {
+	if prev == nil {
+		prev = &Config{}
+	}
+	if cur == nil {
+		cur = &Config{}
+	}
+	var sb strings.Builder
+	fields := []struct{ name, prev, cur string }{
+		{"name", prev.Name, cur.Name},
+		{"remark", prev.Remark, cur.Remark},
+		{"conf_type", prev.ConfType, cur.ConfType},
+		{"version", strconv.Itoa(prev.Version), strconv.Itoa(cur.Version)},
+	}
+	for _, f := range fields {
+		if f.prev != f.cur {
+			sb.WriteString(fmt.Sprintf("%s: %q -> %q\n", f.name, f.prev, f.cur))
+		}
+	}
+	sb.WriteString(xconfig.DiffLines(prev.Value, cur.Value))
+	return sb.String()
+}
+
+func nullString(b []byte) xsql.NullString {
+	return xsql.NullString{String: string(b), Valid: len(b) > 0}
+}
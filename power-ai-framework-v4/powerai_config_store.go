@@ -0,0 +1,322 @@
+package powerai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/goccy/go-yaml"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/etcd"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/localstore"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xenv"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	ConfigStore 智能体配置、系统配置和服务实例的存储，AgentConfig、AgentClient 和中间件初始化通过它读取
+//	默认使用 etcd；WithConfigFile 或环境变量 POWER_AI_CONFIG_FILE 指定配置文件时使用本地文件，不连接 etcd
+//
+//	配置文件（yaml 或 json）格式：
+//	  agent_configs:                       # 智能体通用配置：智能体编号 -> 企业ID -> 配置key -> 配置
+//	    power-ai-agent-demo:
+//	      default:
+//	        welcome: "你好"                  # 字符串作为配置值
+//	        limits: {max: 10}              # 其他值转为json作为配置值
+//	        prompt:                        # 包含 value 字段时作为完整配置
+//	          value: "..."
+//	          conf_type: prompt
+//	  decision_configs:                    # 意图配置，格式同 agent_configs
+//	  system_configs:                      # 系统配置：企业ID -> 配置key -> 配置，系统模型配置为模型列表
+//	    default:
+//	      system-llm:
+//	        - {name: qwen, url: "http://127.0.0.1:8000/v1", key: "${LLM_API_KEY}", type: llm}
+//	  services:                            # 服务实例：服务编号 -> 实例列表，包括其他智能体和中间件
+//	    power-ai-agent-other:
+//	      - {ip: 127.0.0.1, port: "40001"}
+//	    power-ai-postgres:
+//	      - {ip: 127.0.0.1, port: "5432", username: postgres, password: "${PG_PASSWORD}", database: powerai}
+//
+//	配置值中的 ${VAR} 和 ${VAR:-默认值} 在解析后替换为环境变量，只替换字符串值，不影响文件结构
+//	中间件实例配置了 ip 和 port 时使用实例中的全部字段（包括空密码），未配置的中间件使用环境变量中的地址（POWER_AI_POSTGRES_HOST 等）
+//	文件修改后自动重新加载，配置修改按 etcd 监听的方式通知；运行中写入的配置（默认配置注册、回滚）只保存在内存
+//
+// ***************************************************************************************************************
+
+// ConfigStore 配置存储，*etcd_mw.Etcd 和本地文件存储都实现该接口
+type ConfigStore interface {
+	Get(key string) (*etcd_mw.EtcdValue, error)
+	GetByPrefix(prefix string) ([]*etcd_mw.EtcdValue, error)
+	ListPrefix(prefix string) ([]*etcd_mw.EtcdValue, int64, error)
+	Set(key, value string) error
+	SetIfNotExists(key, value string) (bool, error)
+	WatchPrefixKeyCtx(ctx context.Context, prefix string, opts ...clientv3.OpOption) (clientv3.WatchChan, error)
+	GrantAndSet(ttl int64, key, value string) (clientv3.LeaseID, error)
+	KeepAlive(leaseId clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error)
+	Revoke(leaseId clientv3.LeaseID) error
+	Close()
+}
+
+var (
+	_ ConfigStore = (*etcd_mw.Etcd)(nil)
+	_ ConfigStore = (*fileConfigStore)(nil)
+)
+
+// configFileReloadInterval 检查配置文件修改的间隔
+const configFileReloadInterval = 2 * time.Second
+
+// ConfigFile 本地配置文件
+type ConfigFile struct {
+	AgentConfigs    map[string]map[string]map[string]interface{} `json:"agent_configs" yaml:"agent_configs"`
+	DecisionConfigs map[string]map[string]map[string]interface{} `json:"decision_configs" yaml:"decision_configs"`
+	SystemConfigs   map[string]map[string]interface{}            `json:"system_configs" yaml:"system_configs"`
+	Services        map[string][]map[string]interface{}          `json:"services" yaml:"services"`
+}
+
+// initConfigStore 指定配置文件时使用本地文件，否则连接 etcd
+func initConfigStore(opts *Options) (ConfigStore, error) {
+	if opts.ConfigFile == "" {
+		etcd, err := initEtcd()
+		if err != nil {
+			return nil, fmt.Errorf("init etcd middleware err:%s", err.Error())
+		}
+		return etcd, nil
+	}
+	s, err := newFileConfigStore(opts.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("init config file [%s] err:%s", opts.ConfigFile, err.Error())
+	}
+	return s, nil
+}
+
+type fileConfigStore struct {
+	*localstore_mw.Store
+	path      string
+	modTime   time.Time
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newFileConfigStore(path string) (*fileConfigStore, error) {
+	s := &fileConfigStore{Store: localstore_mw.New(), path: path, stop: make(chan struct{})}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	xlog.LogInfoF("10000", "config-file", "init", fmt.Sprintf("从配置文件[%s]加载配置，不连接etcd", path))
+	go s.reload()
+	return s, nil
+}
+
+func (s *fileConfigStore) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.Store.Close()
+	})
+}
+
+// load 读取配置文件并替换存储中文件写入的key
+func (s *fileConfigStore) load() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	kvs, err := parseConfigFile(b)
+	if err != nil {
+		return err
+	}
+	s.Load(kvs)
+	s.modTime = fi.ModTime()
+	return nil
+}
+
+// reload 文件修改后重新加载，加载失败时继续使用原配置
+func (s *fileConfigStore) reload() {
+	ticker := time.NewTicker(configFileReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(s.path)
+		if err != nil || fi.ModTime().Equal(s.modTime) {
+			continue
+		}
+		if err = s.load(); err != nil {
+			xlog.LogErrorF("10000", "config-file", "reload", fmt.Sprintf("重新加载配置文件[%s]失败，继续使用原配置", s.path), err)
+			s.modTime = fi.ModTime()
+			continue
+		}
+		xlog.LogInfoF("10000", "config-file", "reload", fmt.Sprintf("重新加载配置文件[%s]成功", s.path))
+	}
+}
+
+// expandEnv 替换配置值（字符串标量）中的 ${VAR} 和 ${VAR:-默认值}
+func (f *ConfigFile) expandEnv() {
+	for _, configs := range []map[string]map[string]map[string]interface{}{f.AgentConfigs, f.DecisionConfigs} {
+		for _, ents := range configs {
+			for _, items := range ents {
+				xenv.ExpandValues(items)
+			}
+		}
+	}
+	for _, items := range f.SystemConfigs {
+		xenv.ExpandValues(items)
+	}
+	for _, instances := range f.Services {
+		for _, ins := range instances {
+			xenv.ExpandValues(ins)
+		}
+	}
+}
+
+// parseConfigFile 解析配置文件，返回 etcd key -> value
+func parseConfigFile(b []byte) (map[string]string, error) {
+	f := &ConfigFile{}
+	if err := yaml.Unmarshal(b, f); err != nil {
+		return nil, err
+	}
+	f.expandEnv()
+	kvs := make(map[string]string)
+	agentConfigs := func(classify string, configs map[string]map[string]map[string]interface{}) error {
+		for code, ents := range configs {
+			for ent, items := range ents {
+				for k, v := range items {
+					c, err := fileConfig(k, v)
+					if err != nil {
+						return fmt.Errorf("%s/%s/%s: %w", code, ent, k, err)
+					}
+					c.AgentCode = code
+					c.Classify = classify
+					if kvs[GetAgentConfigFullKey(classify, ent, code, k)], err = marshalString(c); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+	if err := agentConfigs(GeneralConfigClassify, f.AgentConfigs); err != nil {
+		return nil, fmt.Errorf("agent_configs %w", err)
+	}
+	if err := agentConfigs(DecisionConfigClassify, f.DecisionConfigs); err != nil {
+		return nil, fmt.Errorf("decision_configs %w", err)
+	}
+	for ent, items := range f.SystemConfigs {
+		for k, v := range items {
+			c, err := fileConfig(k, v)
+			if err != nil {
+				return nil, fmt.Errorf("system_configs %s/%s: %w", ent, k, err)
+			}
+			if kvs[GetSystemConfigFullKey(ent, k)], err = marshalString(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for code, instances := range f.Services {
+		for i, ins := range instances {
+			m := make(map[string]string, len(ins)+1)
+			for k, v := range ins {
+				m[k] = scalarString(v)
+			}
+			m["code"] = code
+			ip, port := m["ip"], m["port"]
+			if ip == "" || port == "" {
+				ip, port = "file", fmt.Sprintf("%d", i)
+			}
+			var err error
+			if kvs[GetServiceInstanceFullKey(code, ip, port)], err = marshalString(m); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return kvs, nil
+}
+
+// fileConfig 包含 value 字段的对象作为完整配置，其他值作为配置值
+func fileConfig(key string, v interface{}) (*Config, error) {
+	c := &Config{}
+	if m, ok := v.(map[string]interface{}); ok {
+		if value, ok := m["value"]; ok {
+			rest := make(map[string]interface{}, len(m))
+			for k, mv := range m {
+				if k != "value" {
+					rest[k] = mv
+				}
+			}
+			b, err := json.Marshal(rest)
+			if err != nil {
+				return nil, err
+			}
+			if err = json.Unmarshal(b, c); err != nil {
+				return nil, err
+			}
+			v = value
+		}
+	}
+	value, err := configValueString(v)
+	if err != nil {
+		return nil, err
+	}
+	c.Key = key
+	c.Value = value
+	if c.ModifyFrom == "" {
+		c.ModifyFrom = "file"
+	}
+	return c, nil
+}
+
+// configValueString 字符串和数字原样作为配置值，对象和数组转为json
+func configValueString(v interface{}) (string, error) {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return marshalString(v)
+	}
+	return scalarString(v), nil
+}
+
+func scalarString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+func marshalString(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// fileServiceInstance 中间件实例是否来自本地配置文件，此时实例中的字段都覆盖环境变量中的配置，不要求密码
+func fileServiceInstance(store ConfigStore) bool {
+	_, ok := store.(*fileConfigStore)
+	return ok
+}
+
+// serviceInstances 查询中间件的服务实例
+// 使用本地配置文件且未配置该中间件时返回空列表，由调用方使用环境变量中的地址
+func serviceInstances(store ConfigStore, code string) ([]*etcd_mw.EtcdValue, error) {
+	ev, err := store.GetByPrefix(GetServiceInstancePrefixKey(code))
+	if fileServiceInstance(store) && len(ev) == 0 {
+		xlog.LogInfoF("10000", "config-file", "service", fmt.Sprintf("配置文件未配置[%s]，使用环境变量中的地址", code))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ev) == 0 {
+		return nil, fmt.Errorf("value为空")
+	}
+	return ev, nil
+}
@@ -0,0 +1,101 @@
+package powerai
+
+import (
+	"context"
+	"fmt"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xnotify"
+	"path"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	配置修改订阅
+//	OnConfigChange/OnSystemConfigChange 按 配置key + 企业ID 订阅，二者都支持 path.Match 通配符（* ? [...]），
+//	企业ID为空时订阅默认配置，为 * 时订阅所有企业；OnConfigKeyChange 按 etcd 完整key 订阅
+//	同一配置在防抖时间（WithConfigChangeDebounce，默认500ms）内的多次修改合并为一次回调，
+//	old 为第一次修改前的配置（新增时为 nil），new 为最后一次修改后的配置（删除时为 nil）
+//	每个订阅按各配置第一次修改的顺序依次回调，回调 panic 只记录日志，不影响其他订阅和后续回调
+//	校验失败被拒绝的修改不通知
+//
+// ***************************************************************************************************************
+
+const defaultConfigChangeDebounce = 500 * time.Millisecond
+
+type configSubscription struct {
+	pattern    string
+	dispatcher *xnotify.Dispatcher[*Config]
+}
+
+// OnConfigChange 订阅本智能体配置的修改，返回取消订阅的函数
+func (a *AgentApp) OnConfigChange(key, enterpriseId string, f func(old, new *Config)) (func(), error) {
+	return a.OnConfigKeyChange(GetAgentGeneralConfigFullKey(enterpriseId, a.Manifest.Code, key), f)
+}
+
+// OnSystemConfigChange 订阅系统配置的修改，返回取消订阅的函数
+func (a *AgentApp) OnSystemConfigChange(key, enterpriseId string, f func(old, new *Config)) (func(), error) {
+	return a.OnConfigKeyChange(GetSystemConfigFullKey(enterpriseId, key), f)
+}
+
+// OnConfigKeyChange 按 etcd 完整key 订阅配置的修改，只能订阅已监听的前缀：本智能体配置、系统配置、意图配置（意图分类智能体）
+func (a *AgentApp) OnConfigKeyChange(pattern string, f func(old, new *Config)) (func(), error) {
+	if f == nil {
+		return nil, fmt.Errorf("callback不能为空")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	s := &configSubscription{pattern: pattern}
+	s.dispatcher = xnotify.New[*Config](a.configChangeDebounce, func(_ string, old, new *Config) {
+		f(old, new)
+	}, func(key string, r interface{}) {
+		xlog.LogErrorF("10000", "agent-config", "subscribe", fmt.Sprintf("[%s]配置修改回调panic", key), fmt.Errorf("%v", r))
+	})
+	a.agentConfig.subscribe(s)
+	return func() { a.agentConfig.unsubscribe(s) }, nil
+}
+
+func (a *AgentConfig) subscribe(s *configSubscription) {
+	a.subMu.Lock()
+	defer a.subMu.Unlock()
+	a.subs[s] = struct{}{}
+}
+
+func (a *AgentConfig) unsubscribe(s *configSubscription) {
+	a.subMu.Lock()
+	delete(a.subs, s)
+	a.subMu.Unlock()
+	s.dispatcher.Close()
+}
+
+// notify 通知匹配的订阅，在监听协程中调用，不阻塞
+func (a *AgentConfig) notify(key string, old, new *Config) {
+	a.subMu.RLock()
+	defer a.subMu.RUnlock()
+	for s := range a.subs {
+		if ok, _ := path.Match(s.pattern, key); ok {
+			s.dispatcher.Push(key, old, new)
+		}
+	}
+}
+
+// closeSubscriptions 停机时取消全部订阅，丢弃防抖中还未回调的修改，等待执行中的回调结束
+func (a *AgentConfig) closeSubscriptions(ctx context.Context) {
+	a.subMu.Lock()
+	subs := a.subs
+	a.subs = make(map[*configSubscription]struct{})
+	a.subMu.Unlock()
+	dones := make([]<-chan struct{}, 0, len(subs))
+	for s := range subs {
+		dones = append(dones, s.dispatcher.Close())
+	}
+	for _, done := range dones {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			xlog.LogErrorF("10000", "agent-config", "shutdown", "停机时等待配置修改回调超时", ctx.Err())
+			return
+		}
+	}
+}
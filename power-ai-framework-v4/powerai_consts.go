@@ -21,6 +21,9 @@ const (
 	AgentListKey = "agent_list"
 
 	AgentDecisionIntentionKey = "intention_category"
+	AgentCallPolicyKey        = "agent-call-policy"
+	LLMTokenQuotaKey          = "llm-token-quota"
+	MemorySummaryPromptKey    = "memory-summary-prompt"
 	PowerAiDecision           = "power-ai-decision"
 	PowerAiAgentSendBox       = "power-ai-agent-sendbox"
 )
@@ -68,6 +71,10 @@ func GetAgentSendMsgUrl(addr, agentCode string) string {
 	return fmt.Sprintf("http://%s/%s/send_msg", addr, strings.ReplaceAll(agentCode, "-", "/"))
 }
 
+func GetAgentHealthUrl(addr, agentCode string) string {
+	return fmt.Sprintf("http://%s/%s/health", addr, strings.ReplaceAll(agentCode, "-", "/"))
+}
+
 func GetAgentProxyUrl(addr, agentCode, methodName string) string {
 	return fmt.Sprintf("http://%s/%s/%s", addr, strings.ReplaceAll(agentCode, "-", "/"), methodName)
 }
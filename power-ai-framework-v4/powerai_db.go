@@ -1,6 +1,7 @@
 package powerai
 
 import (
+	"context"
 	xsql "database/sql"
 	"fmt"
 	"orgine.com/ai-team/power-ai-framework-v4/middleware/pgsql"
@@ -114,6 +115,11 @@ func (a *AgentApp) GetPgSqlClient() (*pgsql_mw.PgSql, error) {
 
 // QueryConversationById 根据conversationID查询会话，返回单结果
 func (a *AgentApp) QueryConversationById(conversationID string) (*AIConversation, error) {
+	return a.QueryConversationByIdCtx(context.Background(), conversationID)
+}
+
+// QueryConversationByIdCtx 根据conversationID查询会话，ctx结束时取消查询
+func (a *AgentApp) QueryConversationByIdCtx(ctx context.Context, conversationID string) (*AIConversation, error) {
 
 	if conversationID == "" {
 		return nil, fmt.Errorf("conversationID不能为空")
@@ -126,7 +132,7 @@ func (a *AgentApp) QueryConversationById(conversationID string) (*AIConversation
 
 	sql := `select conversation_id,conversation_name,user_id,channel,channel_app,enterprise_id,create_time,update_time,extended_field from ai_conversation where conversation_id = $1`
 	r := &AIConversation{}
-	if err := client.QuerySingle(r, sql, conversationID); err != nil {
+	if err := client.QuerySingleCtx(ctx, r, sql, conversationID); err != nil {
 		return nil, err
 	}
 	return r, nil
@@ -544,45 +550,80 @@ func (a *AgentApp) QuerySystemConfigByCode(confCode string) (*AISystemConfig, er
 
 // DBQuerySingle 查询单值
 func (a *AgentApp) DBQuerySingle(dest interface{}, sqlWhere string, args ...interface{}) error {
+	return a.DBQuerySingleCtx(context.Background(), dest, sqlWhere, args...)
+}
+
+// DBQuerySingleCtx 查询单值，ctx结束时取消查询
+func (a *AgentApp) DBQuerySingleCtx(ctx context.Context, dest interface{}, sqlWhere string, args ...interface{}) error {
 	client, err := a.GetPgSqlClient()
 	if err != nil {
 		return err
 	}
-	return client.QuerySingle(dest, sqlWhere, args...)
+	err = client.QuerySingleCtx(ctx, dest, sqlWhere, args...)
+	logCanceled(ctx, "DBQuerySingle", err)
+	return err
 }
 
 // DBQueryMultiple 获取多行对象
 func (a *AgentApp) DBQueryMultiple(dest interface{}, sqlWhere string, args ...interface{}) error {
+	return a.DBQueryMultipleCtx(context.Background(), dest, sqlWhere, args...)
+}
+
+// DBQueryMultipleCtx 获取多行对象，ctx结束时取消查询
+func (a *AgentApp) DBQueryMultipleCtx(ctx context.Context, dest interface{}, sqlWhere string, args ...interface{}) error {
 	client, err := a.GetPgSqlClient()
 	if err != nil {
 		return err
 	}
-	return client.QueryMultiple(dest, sqlWhere, args...)
+	err = client.QueryMultipleCtx(ctx, dest, sqlWhere, args...)
+	logCanceled(ctx, "DBQueryMultiple", err)
+	return err
 }
 
 // DBQueryByPaginate 执行分页查询
 func (a *AgentApp) DBQueryByPaginate(dest interface{}, sqlWhere string, page, pageSize int, args ...interface{}) (*pgsql_mw.Pagination, error) {
+	return a.DBQueryByPaginateCtx(context.Background(), dest, sqlWhere, page, pageSize, args...)
+}
+
+// DBQueryByPaginateCtx 执行分页查询，ctx结束时取消查询
+func (a *AgentApp) DBQueryByPaginateCtx(ctx context.Context, dest interface{}, sqlWhere string, page, pageSize int, args ...interface{}) (*pgsql_mw.Pagination, error) {
 	client, err := a.GetPgSqlClient()
 	if err != nil {
 		return nil, err
 	}
-	return client.QueryByPaginate(dest, sqlWhere, page, pageSize, args...)
+	p, err := client.QueryByPaginateCtx(ctx, dest, sqlWhere, page, pageSize, args...)
+	logCanceled(ctx, "DBQueryByPaginate", err)
+	return p, err
 }
 
 // DBExec 执行SQL语句
 func (a *AgentApp) DBExec(sqlWhere string, args ...interface{}) (xsql.Result, error) {
+	return a.DBExecCtx(context.Background(), sqlWhere, args...)
+}
+
+// DBExecCtx 执行SQL语句，ctx结束时取消执行
+func (a *AgentApp) DBExecCtx(ctx context.Context, sqlWhere string, args ...interface{}) (xsql.Result, error) {
 	client, err := a.GetPgSqlClient()
 	if err != nil {
 		return nil, err
 	}
-	return client.Exec(sqlWhere, args...)
+	r, err := client.ExecCtx(ctx, sqlWhere, args...)
+	logCanceled(ctx, "DBExec", err)
+	return r, err
 }
 
 // DBBatchExecTransaction 批量执行
 func (a *AgentApp) DBBatchExecTransaction(ts []*pgsql_mw.TransactionSql) error {
+	return a.DBBatchExecTransactionCtx(context.Background(), ts)
+}
+
+// DBBatchExecTransactionCtx 批量执行，ctx结束时回滚事务
+func (a *AgentApp) DBBatchExecTransactionCtx(ctx context.Context, ts []*pgsql_mw.TransactionSql) error {
 	client, err := a.GetPgSqlClient()
 	if err != nil {
 		return err
 	}
-	return client.BatchExecTransaction(ts)
+	err = client.BatchExecTransactionCtx(ctx, ts)
+	logCanceled(ctx, "DBBatchExecTransaction", err)
+	return err
 }
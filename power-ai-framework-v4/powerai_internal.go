@@ -16,14 +16,11 @@ import (
 	"time"
 )
 
-func initMinio(etcd *etcd_mw.Etcd) (*minio_mw.Minio, error) {
-	ev, err := etcd.GetByPrefix(GetServiceInstancePrefixKey("power-ai-minio"))
+func initMinio(etcd ConfigStore) (*minio_mw.Minio, error) {
+	ev, err := serviceInstances(etcd, "power-ai-minio")
 	if err != nil {
 		return nil, fmt.Errorf("通过etcd获取minio服务信息,err: %v", err)
 	}
-	if len(ev) == 0 {
-		return nil, fmt.Errorf("通过etcd获取minio服务信息成功，但是value为空")
-	}
 	var ip, port, ak, sk string
 	for _, v := range ev {
 		etcdValue := make(map[string]string)
@@ -55,15 +52,12 @@ func initMinio(etcd *etcd_mw.Etcd) (*minio_mw.Minio, error) {
 	})
 }
 
-func initPgSql(etcd *etcd_mw.Etcd) (*pgsql_mw.PgSql, error) {
-	ev, err := etcd.GetByPrefix(GetServiceInstancePrefixKey("power-ai-postgres"))
+func initPgSql(etcd ConfigStore) (*pgsql_mw.PgSql, error) {
+	ev, err := serviceInstances(etcd, "power-ai-postgres")
 	if err != nil {
 		return nil, fmt.Errorf("通过etcd获取pgsql服务信息,err: %v", err)
 	}
-	if len(ev) == 0 {
-		return nil, fmt.Errorf("通过etcd获取pgsql服务信息成功，但是value为空")
-	}
-	var ip, port, password string
+	var ip, port, password, username, database string
 	for _, v := range ev {
 		etcdValue := make(map[string]string)
 		if err = json.Unmarshal([]byte(v.Value), &etcdValue); err != nil {
@@ -73,15 +67,23 @@ func initPgSql(etcd *etcd_mw.Etcd) (*pgsql_mw.PgSql, error) {
 		ip = etcdValue["ip"]
 		port = etcdValue["port"]
 		password = etcdValue["password"]
+		username = etcdValue["username"]
+		database = etcdValue["database"]
 		if ip == xenv.GetEnvOrDefault("IP_ADDR", "127.0.0.1") {
 			break
 		}
 	}
-	// 不为空，则替换掉环境变量中数据
-	if ip != "" && port != "" && password != "" {
+	// 不为空，则替换掉环境变量中数据；配置文件中的实例不要求密码
+	if ip != "" && port != "" && (password != "" || fileServiceInstance(etcd)) {
 		env.G.PgsqlConfig.Host = ip
 		env.G.PgsqlConfig.Port = port
 		env.G.PgsqlConfig.Password = password
+		if username != "" {
+			env.G.PgsqlConfig.Username = username
+		}
+		if database != "" {
+			env.G.PgsqlConfig.Database = database
+		}
 	}
 
 	return pgsql_mw.New(&pgsql_mw.Config{
@@ -93,14 +95,11 @@ func initPgSql(etcd *etcd_mw.Etcd) (*pgsql_mw.PgSql, error) {
 	})
 }
 
-func initRedis(etcd *etcd_mw.Etcd) (*redis_mw.Redis, error) {
-	ev, err := etcd.GetByPrefix(GetServiceInstancePrefixKey("power-ai-redis"))
+func initRedis(etcd ConfigStore) (*redis_mw.Redis, error) {
+	ev, err := serviceInstances(etcd, "power-ai-redis")
 	if err != nil {
 		return nil, fmt.Errorf("通过etcd获取redis服务信息,err: %v", err)
 	}
-	if len(ev) == 0 {
-		return nil, fmt.Errorf("通过etcd获取redis服务信息成功，但是value为空")
-	}
 	var ip, port, password string
 	for _, v := range ev {
 		etcdValue := make(map[string]string)
@@ -115,7 +114,8 @@ func initRedis(etcd *etcd_mw.Etcd) (*redis_mw.Redis, error) {
 			break
 		}
 	}
-	if ip != "" && port != "" && password != "" {
+	// 配置文件中的实例不要求密码
+	if ip != "" && port != "" && (password != "" || fileServiceInstance(etcd)) {
 		env.G.RedisConfig.Addr = fmt.Sprintf("%s:%s", ip, port)
 		env.G.RedisConfig.Password = password
 	}
@@ -125,14 +125,11 @@ func initRedis(etcd *etcd_mw.Etcd) (*redis_mw.Redis, error) {
 	})
 }
 
-func initWeaviate(etcd *etcd_mw.Etcd) (*weaviate_mw.Weaviate, error) {
-	ev, err := etcd.GetByPrefix(GetServiceInstancePrefixKey("power-ai-weaviate"))
+func initWeaviate(etcd ConfigStore) (*weaviate_mw.Weaviate, error) {
+	ev, err := serviceInstances(etcd, "power-ai-weaviate")
 	if err != nil {
 		return nil, fmt.Errorf("通过etcd获取weaviate服务信息,err: %v", err)
 	}
-	if len(ev) == 0 {
-		return nil, fmt.Errorf("通过etcd获取weaviate服务信息成功，但是value为空")
-	}
 	var ip, httpPort, password string
 	for _, v := range ev {
 		etcdValue := make(map[string]string)
@@ -151,7 +148,7 @@ func initWeaviate(etcd *etcd_mw.Etcd) (*weaviate_mw.Weaviate, error) {
 	}
 
 	// 不为空，则替换掉环境变量中数据
-	if ip != "" && httpPort != "" && password != "" {
+	if ip != "" && httpPort != "" && (password != "" || fileServiceInstance(etcd)) {
 		env.G.WeaviateConfig.Host = fmt.Sprintf("%s:%s", ip, httpPort)
 		env.G.WeaviateConfig.ApiKey = password
 	}
@@ -162,14 +159,11 @@ func initWeaviate(etcd *etcd_mw.Etcd) (*weaviate_mw.Weaviate, error) {
 	})
 }
 
-func initMilvus(etcd *etcd_mw.Etcd) (*milvus_mw.Milvus, error) {
-	ev, err := etcd.GetByPrefix(GetServiceInstancePrefixKey("power-ai-milvus"))
+func initMilvus(etcd ConfigStore) (*milvus_mw.Milvus, error) {
+	ev, err := serviceInstances(etcd, "power-ai-milvus")
 	if err != nil {
 		return nil, fmt.Errorf("通过etcd获取milvus服务信息,err: %v", err)
 	}
-	if len(ev) == 0 {
-		return nil, fmt.Errorf("通过etcd获取milvus服务信息成功，但是value为空")
-	}
 	var ip, port, password, username, timeout string
 	for _, v := range ev {
 		etcdValue := make(map[string]string)
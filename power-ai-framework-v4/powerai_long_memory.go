@@ -0,0 +1,308 @@
+package powerai
+
+import (
+	"context"
+	"fmt"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xdatetime"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"strings"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	长期患者记忆
+//	过敏史、慢病史、手术史、就医偏好按 企业+患者 存储在 ai_patient_memory 表，同一 事实类型+事实值 只保留一条
+//	事实类型都是多值的（如多种过敏原），不同的值同时保留；再次写入同一事实时，新的置信度不低于已有置信度
+//	（或已有记录已过期）才覆盖来源、溯源信息和过期时间
+//	FactValueNone 表示明确没有（如 无过敏史），与同类型的其他值互斥：写入时与未过期的冲突记录比较置信度，
+//	不低于冲突记录的最高置信度时删除冲突记录并写入，否则放弃写入
+//	创建会话时自动读取未过期且置信度不低于 PatientMemoryMinConfidence 的记录填充 SessionValue.UserSnapshot，
+//	同类型中置信度最高的记录为 FactValueNone 时该类型为空，否则忽略 FactValueNone
+//
+// ***************************************************************************************************************
+
+// 事实类型
+const (
+	FactTypeAllergy        = "allergy"         // 过敏史，对应 UserProfile.Allergies
+	FactTypeChronicDisease = "chronic_disease" // 慢病史，对应 UserProfile.ChronicDiseases
+	FactTypeSurgeryHistory = "surgery_history" // 手术史，对应 UserProfile.SurgeryHistory
+	FactTypePreference     = "preference"      // 就医偏好，对应 UserProfile.Preferences
+)
+
+// FactValueNone 事实值，表示明确没有该类型的事实，与同类型的其他值互斥
+const FactValueNone = "none"
+
+// PatientMemoryMinConfidence 填充用户快照时的最低置信度
+const PatientMemoryMinConfidence = 0.5
+
+const patientMemoryTableDDL = `CREATE TABLE IF NOT EXISTS ai_patient_memory (
+	enterprise_id   varchar(64)   NOT NULL,
+	patient_id      varchar(128)  NOT NULL,
+	fact_type       varchar(64)   NOT NULL,
+	fact_value      varchar(1024) NOT NULL,
+	confidence      numeric(5,4)  NOT NULL DEFAULT 0,
+	source          varchar(128),
+	conversation_id varchar(128),
+	message_id      varchar(128),
+	agent_code      varchar(128),
+	expires_at      timestamp,
+	create_time     timestamp,
+	update_time     timestamp,
+	PRIMARY KEY (enterprise_id, patient_id, fact_type, fact_value)
+)`
+
+// PatientMemory 对应 ai_patient_memory 表
+type PatientMemory struct {
+	EnterpriseID   string     `db:"enterprise_id" json:"enterprise_id"`
+	PatientID      string     `db:"patient_id" json:"patient_id"`
+	FactType       string     `db:"fact_type" json:"fact_type"`
+	FactValue      string     `db:"fact_value" json:"fact_value"`
+	Confidence     float64    `db:"confidence" json:"confidence"`
+	Source         string     `db:"source" json:"source"`
+	ConversationID string     `db:"conversation_id" json:"conversation_id"`
+	MessageID      string     `db:"message_id" json:"message_id"`
+	AgentCode      string     `db:"agent_code" json:"agent_code"`
+	ExpiresAt      *time.Time `db:"expires_at" json:"expires_at,omitempty"`
+	UpdateTime     time.Time  `db:"update_time" json:"update_time"`
+}
+
+// patientMemoryOwner 记忆归属和溯源信息
+type patientMemoryOwner struct {
+	conversationID string
+	enterpriseID   string
+	patientID      string
+	messageID      string
+	agentCode      string
+}
+
+type patientMemoryItem struct {
+	factType   string
+	value      string
+	confidence float64
+	source     string
+	expiresAt  int64
+}
+
+// upsertPatientMemorySQL 写入一条事实
+// blocked: 与新事实互斥（一方为 FactValueNone）且置信度更高的未过期记录，存在时放弃写入
+// removed: 新事实写入时删除互斥的记录
+const upsertPatientMemorySQL = `WITH blocked AS (
+	SELECT 1 FROM ai_patient_memory
+	WHERE enterprise_id = $1 AND patient_id = $2 AND fact_type = $3 AND (fact_value = $12) <> ($4 = $12)
+	AND confidence > $5 AND (expires_at IS NULL OR expires_at > now())
+), removed AS (
+	DELETE FROM ai_patient_memory
+	WHERE enterprise_id = $1 AND patient_id = $2 AND fact_type = $3 AND (fact_value = $12) <> ($4 = $12)
+	AND NOT EXISTS (SELECT 1 FROM blocked)
+)
+INSERT INTO ai_patient_memory (enterprise_id,patient_id,fact_type,fact_value,confidence,source,conversation_id,message_id,agent_code,expires_at,create_time,update_time)
+SELECT $1,$2,$3,$4,$5,$6,$7,$8,$9,$10::timestamp,$11::timestamp,$11::timestamp WHERE NOT EXISTS (SELECT 1 FROM blocked)
+ON CONFLICT (enterprise_id,patient_id,fact_type,fact_value) DO UPDATE SET
+confidence = EXCLUDED.confidence,
+source = EXCLUDED.source,
+conversation_id = EXCLUDED.conversation_id,
+message_id = EXCLUDED.message_id,
+agent_code = EXCLUDED.agent_code,
+expires_at = EXCLUDED.expires_at,
+update_time = EXCLUDED.update_time
+WHERE EXCLUDED.confidence >= ai_patient_memory.confidence
+OR (ai_patient_memory.expires_at IS NOT NULL AND ai_patient_memory.expires_at <= now())`
+
+// upsertPatientMemory 写入长期记忆，写入成功后刷新会话的用户快照
+func (a *AgentApp) upsertPatientMemory(ctx context.Context, owner *patientMemoryOwner, items []*patientMemoryItem) error {
+	if err := a.resolvePatientMemoryOwner(ctx, owner); err != nil {
+		return err
+	}
+	for _, item := range items {
+		item.factType = strings.TrimSpace(item.factType)
+		item.value = strings.TrimSpace(item.value)
+		if item.factType == "" || item.value == "" {
+			return fmt.Errorf("fact_type和fact_value不能为空")
+		}
+		if item.confidence < 0 || item.confidence > 1 {
+			return fmt.Errorf("事实[%s:%s]的置信度[%v]超出范围0-1", item.factType, item.value, item.confidence)
+		}
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return err
+	}
+	if err = a.ensurePatientMemoryTable(ctx); err != nil {
+		return err
+	}
+	now := xdatetime.GetNowDateTime()
+	for _, item := range items {
+		var expiresAt any
+		if item.expiresAt > 0 {
+			expiresAt = time.Unix(item.expiresAt, 0)
+		}
+		_, err = client.ExecCtx(ctx, upsertPatientMemorySQL,
+			owner.enterpriseID, owner.patientID, item.factType, item.value, item.confidence, item.source,
+			owner.conversationID, owner.messageID, owner.agentCode, expiresAt, now, FactValueNone)
+		if err != nil {
+			return fmt.Errorf("写入患者[%s]长期记忆[%s:%s]失败: %w", owner.patientID, item.factType, item.value, err)
+		}
+	}
+	xlog.LogInfoF(server.SysTrackCode(ctx), "long-memory", "upsert", fmt.Sprintf("企业[%s],患者[%s],会话[%s]写入长期记忆%d条", owner.enterpriseID, owner.patientID, owner.conversationID, len(items)))
+
+	a.refreshUserSnapshot(ctx, owner)
+	return nil
+}
+
+// resolvePatientMemoryOwner 企业ID、患者ID为空时根据会话记录补全
+func (a *AgentApp) resolvePatientMemoryOwner(ctx context.Context, owner *patientMemoryOwner) error {
+	if owner.agentCode == "" && a.Manifest != nil {
+		owner.agentCode = a.Manifest.Code
+	}
+	if owner.enterpriseID != "" && owner.patientID != "" {
+		return nil
+	}
+	if owner.conversationID == "" {
+		return fmt.Errorf("enterpriseID、patientID为空时conversationID不能为空")
+	}
+	conv, err := a.QueryConversationByIdCtx(ctx, owner.conversationID)
+	if err != nil {
+		return fmt.Errorf("查询会话[%s]失败: %w", owner.conversationID, err)
+	}
+	if owner.enterpriseID == "" {
+		owner.enterpriseID = conv.EnterpriseID.String
+	}
+	if owner.patientID == "" {
+		owner.patientID = conv.UserID.String
+	}
+	if owner.enterpriseID == "" || owner.patientID == "" {
+		return fmt.Errorf("会话[%s]缺少企业ID或用户ID", owner.conversationID)
+	}
+	return nil
+}
+
+func (a *AgentApp) ensurePatientMemoryTable(ctx context.Context) error {
+	if a.patientMemoryReady.Load() {
+		return nil
+	}
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return err
+	}
+	if _, err = client.ExecCtx(ctx, patientMemoryTableDDL); err != nil {
+		return fmt.Errorf("创建ai_patient_memory表失败: %w", err)
+	}
+	a.patientMemoryReady.Store(true)
+	return nil
+}
+
+// QueryPatientMemory 查询患者未过期的长期记忆，按事实类型、置信度从高到低排序
+func (a *AgentApp) QueryPatientMemory(enterpriseId, patientId string) ([]*PatientMemory, error) {
+	return a.QueryPatientMemoryCtx(context.Background(), enterpriseId, patientId)
+}
+
+// QueryPatientMemoryCtx 查询患者未过期的长期记忆，ctx结束时取消查询
+func (a *AgentApp) QueryPatientMemoryCtx(ctx context.Context, enterpriseId, patientId string) ([]*PatientMemory, error) {
+	if enterpriseId == "" || patientId == "" {
+		return nil, fmt.Errorf("enterpriseId和patientId不能为空")
+	}
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return nil, err
+	}
+	if err = a.ensurePatientMemoryTable(ctx); err != nil {
+		return nil, err
+	}
+	sql := `select enterprise_id,patient_id,fact_type,fact_value,confidence,coalesce(source,'') as source,coalesce(conversation_id,'') as conversation_id,
+		coalesce(message_id,'') as message_id,coalesce(agent_code,'') as agent_code,expires_at,update_time
+		from ai_patient_memory where enterprise_id = $1 and patient_id = $2 and (expires_at is null or expires_at > now())
+		order by fact_type,confidence desc,update_time desc`
+	var r []*PatientMemory
+	if err := client.QueryMultipleCtx(ctx, &r, sql, enterpriseId, patientId); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// hydrateUserSnapshot 使用长期记忆填充用户快照，覆盖快照中的过敏史、慢病史、手术史和就医偏好
+func (a *AgentApp) hydrateUserSnapshot(ctx context.Context, profile *UserProfile, enterpriseId, patientId string) error {
+	memories, err := a.QueryPatientMemoryCtx(ctx, enterpriseId, patientId)
+	if err != nil {
+		return err
+	}
+	profile.Allergies = nil
+	profile.ChronicDiseases = nil
+	profile.SurgeryHistory = nil
+	profile.Preferences = nil
+	for _, m := range resolvePatientMemory(memories) {
+		switch m.FactType {
+		case FactTypeAllergy:
+			profile.Allergies = append(profile.Allergies, m.FactValue)
+		case FactTypeChronicDisease:
+			profile.ChronicDiseases = append(profile.ChronicDiseases, m.FactValue)
+		case FactTypeSurgeryHistory:
+			profile.SurgeryHistory = append(profile.SurgeryHistory, m.FactValue)
+		case FactTypePreference:
+			profile.Preferences = append(profile.Preferences, m.FactValue)
+		}
+	}
+	return nil
+}
+
+// resolvePatientMemory 过滤置信度过低的记录，并处理 FactValueNone 与同类型其他值的冲突
+// memories 按事实类型、置信度从高到低排序，每个类型中第一条记录决定 FactValueNone 是否生效
+func resolvePatientMemory(memories []*PatientMemory) []*PatientMemory {
+	r := make([]*PatientMemory, 0, len(memories))
+	noneWins := make(map[string]bool)
+	for _, m := range memories {
+		if m.Confidence < PatientMemoryMinConfidence {
+			continue
+		}
+		none, seen := noneWins[m.FactType]
+		if !seen {
+			none = m.FactValue == FactValueNone
+			noneWins[m.FactType] = none
+		}
+		if none || m.FactValue == FactValueNone {
+			continue
+		}
+		r = append(r, m)
+	}
+	return r
+}
+
+// refreshUserSnapshot 写入长期记忆后刷新会话中的用户快照，会话不存在或刷新失败只记录日志
+func (a *AgentApp) refreshUserSnapshot(ctx context.Context, owner *patientMemoryOwner) {
+	if owner.conversationID == "" {
+		return
+	}
+	if _, err := a.GetShortMemoryCtx(ctx, owner.conversationID); err != nil {
+		return
+	}
+	profile := &UserProfile{}
+	err := a.hydrateUserSnapshot(ctx, profile, owner.enterpriseID, owner.patientID)
+	if err == nil {
+		err = a.UpdateShortMemoryCtx(ctx, owner.conversationID, func(s *SessionValue) error {
+			if s.UserSnapshot == nil {
+				s.UserSnapshot = &UserProfile{UserID: s.Meta.UserID}
+			}
+			s.UserSnapshot.Allergies = profile.Allergies
+			s.UserSnapshot.ChronicDiseases = profile.ChronicDiseases
+			s.UserSnapshot.SurgeryHistory = profile.SurgeryHistory
+			s.UserSnapshot.Preferences = profile.Preferences
+			return nil
+		})
+	}
+	if err != nil {
+		xlog.LogErrorF(server.SysTrackCode(ctx), "long-memory", "refresh", fmt.Sprintf("会话[%s]刷新用户快照失败", owner.conversationID), err)
+	}
+}
+
+// patientIdOf 请求对应的患者ID，inputs 中有 patient_id 时使用该值，否则为用户ID
+func patientIdOf(req *server.AgentRequest) string {
+	if v, ok := req.Inputs["patient_id"].(string); ok && v != "" {
+		return v
+	}
+	return req.UserId
+}
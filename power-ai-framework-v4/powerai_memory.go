@@ -1,11 +1,11 @@
 package powerai
 
 import (
+	"context"
 	"fmt"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xdatetime"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xjson"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
-	"orgine.com/ai-team/power-ai-framework-v4/pkg/xmemory"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xuid"
 )
 
@@ -22,7 +22,7 @@ type MemoryQueryRequest struct {
 	Query               string  // 当前用户查询（用于计算Token）
 	TokenThresholdRatio float64 // Token阈值比例（默认0.75）
 	RecentTurns         int     // 保留轮数（默认8）
-	ModelContextWindow  int     // 模型上下文窗口（默认16000）
+	ModelContextWindow  int     // 模型上下文窗口（默认取系统llm模型的 context_window，未配置为16000）
 }
 
 // MemoryContext 记忆上下文
@@ -36,6 +36,9 @@ type MemoryContext struct {
 	EstimatedTokens         int          // 预估Token数量
 	TokenRatio              float64      // Token占用比例
 	ShouldCheckpointSummary bool         // 是否需要触发摘要
+	SummaryScheduled        bool         // 是否已提交框架自动摘要（WithAutoSummary 开启时），为 true 时调用者无需再生成摘要
+	Recalled                []*RecalledMemory // 召回的该用户其他会话的摘要（WithMemoryRecall 开启时），按相似度降序
+	RecallTokens            int          // 召回摘要的Token数量，不计入 EstimatedTokens
 }
 
 // MemoryWriteRequest 记忆写入请求
@@ -65,30 +68,43 @@ type SessionFinalizeRequest struct {
 }
 
 // MedicalFact 医疗事实
-// 用于存储医疗相关的结构化信息（预留）
+// 用于存储医疗相关的结构化信息，FactType 取值见 FactTypeAllergy 等常量
 type MedicalFact struct {
 	FactType   string  // 事实类型
 	FactValue  string  // 事实值
 	Confidence float64 // 置信度（0-1）
-	Source     string  // 来源
+	Source     string  // 来源（如 "user_said", "his_record"）
+	ExpiresAt  int64   // 过期时间戳（Unix时间戳），0 表示永不过期
 }
 
 // UserPreferenceMemory 用户偏好记忆
-// 用于存储用户的偏好信息（预留）
+// 用于存储用户的偏好信息
 type UserPreferenceMemory struct {
-	Preference string // 偏好内容
-	Source     string // 来源
+	Preference string  // 偏好内容
+	Confidence float64 // 置信度（0-1），0 按 1 处理
+	Source     string  // 来源
+	ExpiresAt  int64   // 过期时间戳（Unix时间戳），0 表示永不过期
 }
 
 // FactUpsertRequest 事实插入/更新请求
+// EnterpriseID、PatientID 为空时根据会话ID查询会话记录补全
 type FactUpsertRequest struct {
-	ConversationID string        // 会话ID
+	ConversationID string         // 会话ID
+	EnterpriseID   string         // 企业ID
+	PatientID      string         // 患者ID
+	MessageID      string         // 产生事实的消息ID（溯源）
+	AgentCode      string         // 产生事实的智能体代码（溯源），为空使用当前智能体
 	Facts          []*MedicalFact // 医疗事实列表
 }
 
 // PreferenceUpsertRequest 偏好插入/更新请求
+// EnterpriseID、PatientID 为空时根据会话ID查询会话记录补全
 type PreferenceUpsertRequest struct {
-	ConversationID string                 // 会话ID
+	ConversationID string                  // 会话ID
+	EnterpriseID   string                  // 企业ID
+	PatientID      string                  // 患者ID
+	MessageID      string                  // 产生偏好的消息ID（溯源）
+	AgentCode      string                  // 产生偏好的智能体代码（溯源），为空使用当前智能体
 	Preferences    []*UserPreferenceMemory // 偏好列表
 }
 
@@ -116,6 +132,7 @@ type PreferenceUpsertRequest struct {
 //   4. 构建对话历史
 //   5. 计算Token占用率
 //   6. 判断是否需要触发摘要
+//   7. 召回该用户其他会话的摘要（WithMemoryRecall 开启时）
 //
 // 注意事项:
 //   - 如果Redis读取失败，会创建默认会话状态并继续执行
@@ -137,7 +154,12 @@ func (a *AgentApp) QueryMemoryContext(req *MemoryQueryRequest) (*MemoryContext,
 	if threshold <= 0 {
 		threshold = a.memoryConfig.TokenThresholdRatio
 	}
+	// 按系统llm模型的分词器和上下文窗口计算Token
+	tokenizer, modelContextWindow := a.systemTokenizer(req.EnterpriseID)
 	contextWindow := req.ModelContextWindow
+	if contextWindow <= 0 {
+		contextWindow = modelContextWindow
+	}
 	if contextWindow <= 0 {
 		contextWindow = a.memoryConfig.ModelContextWindow
 	}
@@ -188,8 +210,8 @@ func (a *AgentApp) QueryMemoryContext(req *MemoryQueryRequest) (*MemoryContext,
 	// ===============================
 	fullHistory := a.messageBuilder.BuildHistoryFromMessages(messages)
 
-	// 先计算fullHistory的token占用率（使用工具类）
-	estimatedTokens := xmemory.EstimateTokenCount(fullHistory + "\n" + req.Query)
+	// 先计算fullHistory的token占用率
+	estimatedTokens := tokenizer.Count(fullHistory + "\n" + req.Query)
 	tokenRatio := float64(estimatedTokens) / float64(contextWindow)
 
 	// 根据模式构建最终返回的History
@@ -204,12 +226,30 @@ func (a *AgentApp) QueryMemoryContext(req *MemoryQueryRequest) (*MemoryContext,
 	}
 
 	// 重新计算最终History的token占用率
-	estimatedTokens = xmemory.EstimateTokenCount(history + "\n" + req.Query)
+	estimatedTokens = tokenizer.Count(history + "\n" + req.Query)
 	tokenRatio = float64(estimatedTokens) / float64(contextWindow)
 
 	// 无论什么模式，只要token超过阈值就触发摘要
 	shouldCheckpoint := tokenRatio >= threshold
 
+	// 开启自动摘要时异步生成摘要，同一会话的摘要任务只有一个
+	summaryScheduled := false
+	if shouldCheckpoint && a.autoSummary {
+		a.triggerSummary(req.EnterpriseID, req.ConversationID, fullHistory, req.RecentTurns)
+		summaryScheduled = true
+	}
+
+	// 开启语义召回时召回该用户其他会话的摘要，只使用阈值内剩余的Token
+	userId := session.Meta.UserID
+	if userId == "" {
+		userId = req.PatientID
+	}
+	recalled, recallTokens, err := a.recallMemories(req.EnterpriseID, userId, req.ConversationID, req.Query, int(threshold*float64(contextWindow))-estimatedTokens)
+	if err != nil {
+		xlog.LogErrorF("MEMORY", "QueryMemoryContext", "recallMemories",
+			fmt.Sprintf("failed to recall memories for conversation %s", req.ConversationID), err)
+	}
+
 	return &MemoryContext{
 		ConversationID:          req.ConversationID,
 		Mode:                    mode,
@@ -219,6 +259,9 @@ func (a *AgentApp) QueryMemoryContext(req *MemoryQueryRequest) (*MemoryContext,
 		EstimatedTokens:         estimatedTokens,
 		TokenRatio:              tokenRatio,
 		ShouldCheckpointSummary: shouldCheckpoint,
+		SummaryScheduled:        summaryScheduled,
+		Recalled:                recalled,
+		RecallTokens:            recallTokens,
 	}, nil
 }
 
@@ -238,13 +281,12 @@ func (a *AgentApp) QueryMemoryContext(req *MemoryQueryRequest) (*MemoryContext,
 // 工作流程:
 //   1. 参数验证
 //   2. 获取会话锁（防止并发冲突）
-//   3. 获取并更新会话状态
-//   4. 保存到Redis
-//   5. 释放锁
+//   3. 获取并更新会话状态，保存到Redis
+//   4. 释放锁
 //
 // 注意事项:
-//   - 使用会话级锁防止并发写入冲突
-//   - 如果Redis读取失败，会创建默认会话状态
+//   - 使用会话级锁防止并发写入冲突，写入时校验版本，不会覆盖未加锁的智能体的修改
+//   - 如果会话不存在，会创建默认会话状态
 //   - TurnCount 会在锁保护下递增，确保计数准确
 func (a *AgentApp) WriteTurn(req *MemoryWriteRequest) (*MemoryWriteResult, error) {
 	// ===============================
@@ -279,46 +321,47 @@ func (a *AgentApp) WriteTurn(req *MemoryWriteRequest) (*MemoryWriteResult, error
 	// 2. 获取会话锁（使用工具类）
 	// ===============================
 	lock := a.sessionLockMgr.GetLock(req.ConversationID)
-	lock.Lock()
+	if err := lock.LockCtx(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to lock session: %w", err)
+	}
 	defer lock.Unlock()
 
 	// ===============================
-	// 3. 获取并更新会话状态
+	// 3. 获取并更新会话状态，保存到Redis（版本冲突时重新读取）
 	// ===============================
-	session, err := a.GetShortMemory(req.ConversationID)
-	if err != nil {
-		// 降级处理：创建默认会话状态
-		session = newDefaultSessionValue(a, req.ConversationID, req.UserID)
-	}
-
-	// 更新用户信息
-	if req.UserID != "" {
-		session.Meta.UserID = req.UserID
-		// 防御性编程：确保 UserSnapshot 不为 nil
-		if session.UserSnapshot != nil {
-			session.UserSnapshot.UserID = req.UserID
+	var session *SessionValue
+	err := a.updateShortMemory(context.Background(), req.ConversationID, lock, func() *SessionValue {
+		return newDefaultSessionValue(a, req.ConversationID, req.UserID)
+	}, func(s *SessionValue) error {
+		// 更新用户信息
+		if req.UserID != "" {
+			s.Meta.UserID = req.UserID
+			// 防御性编程：确保 UserSnapshot 不为 nil
+			if s.UserSnapshot != nil {
+				s.UserSnapshot.UserID = req.UserID
+			}
 		}
-	}
 
-	// 更新流程上下文
-	if req.AgentCode != "" {
-		session.FlowContext.CurrentAgentKey = req.AgentCode
-	}
-	if req.AgentResponse != "" {
-		session.FlowContext.LastBotMessage = req.AgentResponse
-	}
-
-	// 增加对话轮次计数
-	session.FlowContext.TurnCount++
+		// 更新流程上下文
+		if req.AgentCode != "" {
+			s.FlowContext.CurrentAgentKey = req.AgentCode
+		}
+		if req.AgentResponse != "" {
+			s.FlowContext.LastBotMessage = req.AgentResponse
+		}
 
-	// ===============================
-	// 4. 保存到Redis
-	// ===============================
-	if err := a.SetShortMemory(req.ConversationID, session); err != nil {
-		xlog.LogErrorF("MEMORY", "WriteTurn", "SetShortMemory",
+		// 增加对话轮次计数
+		s.FlowContext.TurnCount++
+		session = s
+		return nil
+	})
+	if err != nil {
+		xlog.LogErrorF("MEMORY", "WriteTurn", "UpdateShortMemory",
 			fmt.Sprintf("failed to set short memory for conversation %s: %v", req.ConversationID, err))
 		return nil, err
 	}
+	a.rearmSessionIdle(context.Background(), req.ConversationID)
+	a.emitSessionEvent(SessionTurnWritten, req.ConversationID, session)
 
 	return &MemoryWriteResult{
 		ConversationID: req.ConversationID,
@@ -340,13 +383,11 @@ func (a *AgentApp) WriteTurn(req *MemoryWriteRequest) (*MemoryWriteResult, error
 // 工作流程:
 //   1. 参数验证
 //   2. 获取会话锁（防止并发冲突）
-//   3. 获取会话状态
-//   4. 查询全部消息
-//   5. 构建"摘要+最近N轮"内容
-//   6. 插入Checkpoint消息到数据库（带重试机制）
-//   7. 更新会话状态
-//   8. 保存到Redis
-//   9. 释放锁
+//   3. 查询全部消息
+//   4. 构建"摘要+最近N轮"内容
+//   5. 插入Checkpoint消息到数据库（带重试机制）
+//   6. 更新会话状态并保存到Redis
+//   7. 释放锁
 //
 // 注意事项:
 //   - 使用会话级锁防止并发冲突
@@ -372,19 +413,13 @@ func (a *AgentApp) CheckpointShortMemory(conversationID, summary string, recentT
 	// 2. 获取会话锁（使用工具类）
 	// ===============================
 	lock := a.sessionLockMgr.GetLock(conversationID)
-	lock.Lock()
-	defer lock.Unlock()
-
-	// ===============================
-	// 3. 获取会话状态
-	// ===============================
-	session, err := a.GetShortMemory(conversationID)
-	if err != nil {
-		session = newDefaultSessionValue(a, conversationID, "")
+	if err := lock.LockCtx(context.Background()); err != nil {
+		return fmt.Errorf("failed to lock session: %w", err)
 	}
+	defer lock.Unlock()
 
 	// ===============================
-	// 4. 查询全部消息
+	// 3. 查询全部消息
 	// ===============================
 	messages, err := a.QueryMessageByConversationIDASC(conversationID)
 	if err != nil {
@@ -394,13 +429,13 @@ func (a *AgentApp) CheckpointShortMemory(conversationID, summary string, recentT
 	}
 
 	// ===============================
-	// 5. 构建"摘要+最近N轮"的内容（使用工具类）
+	// 4. 构建"摘要+最近N轮"的内容（使用工具类）
 	// ===============================
 	recentMessages := a.messageBuilder.BuildRecentMessages(messages, recentTurns)
 	summaryAndRecent := a.messageBuilder.ComposeSummaryAndRecent(summary, recentMessages)
 
 	// ===============================
-	// 6. 插入Checkpoint消息到数据库（带重试机制）
+	// 5. 插入Checkpoint消息到数据库（带重试机制）
 	// ===============================
 	// 最多重试3次，防止UUID重复
 	maxRetries := a.memoryConfig.CheckpointMaxRetries
@@ -423,7 +458,7 @@ func (a *AgentApp) CheckpointShortMemory(conversationID, summary string, recentT
 		// 插入checkpoint消息到数据库
 		sql := `INSERT INTO ai_message (message_id, conversation_id, query, answer, create_time, create_by, update_time, update_by) 
 		        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-		_, err = a.DBExec(sql, checkpointMessageID, conversationID, "[MEMORY_CHECKPOINT]", summaryAndRecent, timeNow, "system", timeNow, "system")
+		_, err = a.DBExec(sql, checkpointMessageID, conversationID, checkpointQuery, summaryAndRecent, timeNow, "system", timeNow, "system")
 
 		if err != nil {
 			// 检查是否是主键冲突（UUID重复）
@@ -442,21 +477,26 @@ func (a *AgentApp) CheckpointShortMemory(conversationID, summary string, recentT
 	}
 
 	// ===============================
-	// 7. 更新会话状态
-	// ===============================
-	session.MessageContext.Summary = summary
-	session.MessageContext.WindowMessages = a.messageBuilder.BuildRecentMessages(messages, recentTurns)
-	session.MessageContext.Mode = a.memoryConfig.MemoryModeSummaryN
-	session.MessageContext.CheckpointMessageID = xuid.UUID()
-
-	// ===============================
-	// 8. 保存到Redis
+	// 6. 更新会话状态并保存到Redis（版本冲突时重新读取）
 	// ===============================
-	if err := a.SetShortMemory(conversationID, session); err != nil {
-		xlog.LogErrorF("MEMORY", "CheckpointShortMemory", "SetShortMemory",
+	var checkpointed *SessionValue
+	err = a.updateShortMemory(context.Background(), conversationID, lock, func() *SessionValue {
+		return newDefaultSessionValue(a, conversationID, "")
+	}, func(session *SessionValue) error {
+		checkpointed = session
+		session.MessageContext.Summary = summary
+		session.MessageContext.WindowMessages = a.messageBuilder.BuildRecentMessages(messages, recentTurns)
+		session.MessageContext.Mode = a.memoryConfig.MemoryModeSummaryN
+		session.MessageContext.CheckpointMessageID = xuid.UUID()
+		return nil
+	})
+	if err != nil {
+		xlog.LogErrorF("MEMORY", "CheckpointShortMemory", "UpdateShortMemory",
 			fmt.Sprintf("failed to set short memory for conversation %s: %v", conversationID, err))
 		return err
 	}
+	a.emitSessionEvent(SessionCheckpointed, conversationID, checkpointed)
+	a.indexRecall(conversationID, summary)
 
 	return nil
 }
@@ -484,8 +524,8 @@ func (a *AgentApp) FinalizeSessionMemory(req *SessionFinalizeRequest) error {
 	return a.CheckpointShortMemory(req.ConversationID, req.Summary, req.RecentTurns)
 }
 
-// UpsertFacts 插入或更新医疗事实（预留接口）
-// 用于存储医疗相关的结构化信息
+// UpsertFacts 插入或更新医疗事实
+// 写入长期记忆（PostgreSQL），按 企业+患者+事实类型+事实值 合并
 //
 // 参数:
 //   - req: 事实插入/更新请求
@@ -493,18 +533,42 @@ func (a *AgentApp) FinalizeSessionMemory(req *SessionFinalizeRequest) error {
 //   - error: 错误信息
 //
 // 注意事项:
-//   - 当前为空实现，预留接口供后续扩展
-//   - 未来可以用于存储过敏史、病史等医疗事实
+//   - 同一事实已存在时，只有新的置信度不低于已有置信度才会覆盖来源、溯源信息和过期时间
+//   - 事实值 FactValueNone 与同类型的其他值互斥，按置信度保留一方
+//   - 写入成功后会刷新当前会话的用户快照
 func (a *AgentApp) UpsertFacts(req *FactUpsertRequest) error {
+	return a.UpsertFactsCtx(context.Background(), req)
+}
+
+// UpsertFactsCtx 插入或更新医疗事实，ctx结束时取消写入
+func (a *AgentApp) UpsertFactsCtx(ctx context.Context, req *FactUpsertRequest) error {
 	if req == nil {
 		return fmt.Errorf("fact upsert request is nil")
 	}
-	// TODO: 实现医疗事实的插入/更新逻辑
-	return nil
+	items := make([]*patientMemoryItem, 0, len(req.Facts))
+	for _, f := range req.Facts {
+		if f == nil {
+			continue
+		}
+		items = append(items, &patientMemoryItem{
+			factType:   f.FactType,
+			value:      f.FactValue,
+			confidence: f.Confidence,
+			source:     f.Source,
+			expiresAt:  f.ExpiresAt,
+		})
+	}
+	return a.upsertPatientMemory(ctx, &patientMemoryOwner{
+		conversationID: req.ConversationID,
+		enterpriseID:   req.EnterpriseID,
+		patientID:      req.PatientID,
+		messageID:      req.MessageID,
+		agentCode:      req.AgentCode,
+	}, items)
 }
 
-// UpsertPreferences 插入或更新用户偏好（预留接口）
-// 用于存储用户的偏好信息
+// UpsertPreferences 插入或更新用户偏好
+// 写入长期记忆（PostgreSQL），事实类型为 FactTypePreference
 //
 // 参数:
 //   - req: 偏好插入/更新请求
@@ -512,14 +576,40 @@ func (a *AgentApp) UpsertFacts(req *FactUpsertRequest) error {
 //   - error: 错误信息
 //
 // 注意事项:
-//   - 当前为空实现，预留接口供后续扩展
-//   - 未来可以用于存储用户的就医偏好等
+//   - 合并规则与 UpsertFacts 相同
 func (a *AgentApp) UpsertPreferences(req *PreferenceUpsertRequest) error {
+	return a.UpsertPreferencesCtx(context.Background(), req)
+}
+
+// UpsertPreferencesCtx 插入或更新用户偏好，ctx结束时取消写入
+func (a *AgentApp) UpsertPreferencesCtx(ctx context.Context, req *PreferenceUpsertRequest) error {
 	if req == nil {
 		return fmt.Errorf("preference upsert request is nil")
 	}
-	// TODO: 实现用户偏好的插入/更新逻辑
-	return nil
+	items := make([]*patientMemoryItem, 0, len(req.Preferences))
+	for _, p := range req.Preferences {
+		if p == nil {
+			continue
+		}
+		confidence := p.Confidence
+		if confidence == 0 {
+			confidence = 1
+		}
+		items = append(items, &patientMemoryItem{
+			factType:   FactTypePreference,
+			value:      p.Preference,
+			confidence: confidence,
+			source:     p.Source,
+			expiresAt:  p.ExpiresAt,
+		})
+	}
+	return a.upsertPatientMemory(ctx, &patientMemoryOwner{
+		conversationID: req.ConversationID,
+		enterpriseID:   req.EnterpriseID,
+		patientID:      req.PatientID,
+		messageID:      req.MessageID,
+		agentCode:      req.AgentCode,
+	}, items)
 }
 
 // ============================================================================
@@ -75,3 +75,16 @@ func (a *AgentApp) GetFileURL(enterpriseId, bucketName, bucketFilePath string, s
 	}
 	return client.GetFileURL(bucketName, bucketFilePath, savePath)
 }
+
+// RemoveFromMinio 删除minio上的文件
+// 参数：
+//
+//	bucketName 桶名称
+//	bucketFilePath minio上存储的路径
+func (a *AgentApp) RemoveFromMinio(enterpriseId, bucketName, bucketFilePath string) error {
+	client, err := a.GetMinioClient()
+	if err != nil {
+		return err
+	}
+	return client.Remove(bucketName, bucketFilePath)
+}
@@ -1,10 +1,15 @@
 package powerai
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xhttp"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xjson"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xllm"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xtoken"
 	"orgine.com/ai-team/power-ai-framework-v4/tools"
 )
 
@@ -23,6 +28,20 @@ type SystemModel struct {
 	Key  string `json:"key"`
 	URL  string `json:"url"`
 	Type string `json:"type"`
+	// Reasoning 思考策略，只对llm/ocr模型生效，不配置时追加 /no_think 并去除思考内容
+	Reasoning *xllm.ReasoningPolicy `json:"reasoning,omitempty"`
+	// ResponseFormat 模型支持的结构化输出方式：json_schema/json_object，不配置表示不支持，只通过提示词约束
+	ResponseFormat string `json:"response_format,omitempty"`
+	// Priority 配置多个模型时的优先级，越小越优先
+	Priority int `json:"priority,omitempty"`
+	// TimeoutMs 非流式调用的超时，超时后切换到下一个模型，不配置使用http客户端的超时
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+	// FallbackOnQuota 模型返回429（限流/额度不足）时是否切换到下一个模型
+	FallbackOnQuota bool `json:"fallback_on_quota,omitempty"`
+	// Tokenizer 计算 token 的分词器：heuristic 或 tiktoken 格式的词表文件路径，不配置使用启发式估算
+	Tokenizer string `json:"tokenizer,omitempty"`
+	// ContextWindow 模型上下文窗口（token数），记忆查询未指定窗口时使用，不配置使用记忆配置的默认值
+	ContextWindow int `json:"context_window,omitempty"`
 }
 
 // GetSystemLlmConfig 获取系统llm模型
@@ -60,101 +79,243 @@ func (a *AgentApp) GetSystemTtsConfig(enterpriseId string) (*SystemModel, error)
 	return a.getModelConfig(enterpriseId, SYSTEM_MODEL_TTS)
 }
 
-// getModelConfig 获取系统模型配置
-func (a *AgentApp) getModelConfig(enterpriseId, confCode string) (*SystemModel, error) {
-	v := a.GetSystemConfig(enterpriseId, confCode)
-	if v == nil {
-		return nil, fmt.Errorf("未查询到企业[%s],模型[%s]对应的值", enterpriseId, confCode)
+// GetSystemTokenizer 系统llm模型对应的分词器
+// 模型未配置 tokenizer、获取模型配置失败或词表加载失败时使用启发式估算
+func (a *AgentApp) GetSystemTokenizer(enterpriseId string) xtoken.Tokenizer {
+	t, _ := a.systemTokenizer(enterpriseId)
+	return t
+}
+
+// systemTokenizer 系统llm模型对应的分词器和上下文窗口，未配置上下文窗口时为0
+func (a *AgentApp) systemTokenizer(enterpriseId string) (xtoken.Tokenizer, int) {
+	c, err := a.GetSystemLlmConfig(enterpriseId)
+	if err != nil {
+		return xtoken.Default, 0
 	}
+	t, err := xtoken.Get(c.Tokenizer)
+	if err != nil {
+		xlog.LogErrorF("10000", "model", "tokenizer", fmt.Sprintf("企业[%s],模型[%s]加载分词器[%s]失败,使用启发式估算", enterpriseId, c.Name, c.Tokenizer), err)
+		return xtoken.Default, c.ContextWindow
+	}
+	return t, c.ContextWindow
+}
 
-	sm := &SystemModel{}
-	if err := json.Unmarshal([]byte(v.Value), sm); err != nil {
-		return nil, fmt.Errorf("企业[%s],模型[%s]已查到对应的值，但json转换失败:%v", enterpriseId, confCode, err)
+// getModelConfig 获取系统模型配置，配置了多个模型时返回优先级最高的
+func (a *AgentApp) getModelConfig(enterpriseId, confCode string) (*SystemModel, error) {
+	models, err := a.getModelConfigs(enterpriseId, confCode)
+	if err != nil {
+		return nil, err
 	}
-	return sm, nil
+	return models[0], nil
 }
 
 // AsyncStreamCallSystemLLM 异步流式请求大语言模型 url, key, modelName string
 func (a *AgentApp) AsyncStreamCallSystemLLM(enterpriseId string, request map[string]interface{}, handler xhttp.HttpRequestResponseFunc) {
-	c, err := a.getModelConfig(enterpriseId, SYSTEM_MODEL_LLM)
-
-	if err != nil {
-		handler(nil, err)
-		return
-	}
+	a.AsyncStreamCallSystemLLMCtx(context.Background(), enterpriseId, request, handler)
+}
 
-	tools.AsyncStreamCallSystemLLM(c.URL, c.Key, c.Name, request, handler)
+// AsyncStreamCallSystemLLMCtx 异步流式请求大语言模型，ctx结束（如客户端断开）时中断上游流
+func (a *AgentApp) AsyncStreamCallSystemLLMCtx(ctx context.Context, enterpriseId string, request map[string]interface{}, handler xhttp.HttpRequestResponseFunc) {
+	go a.SyncStreamCallSystemLLMCtx(ctx, enterpriseId, request, handler)
 }
 
 // SyncStreamCallSystemLLM 同步流式请求大语言模型 url, key, modelName string,
 func (a *AgentApp) SyncStreamCallSystemLLM(enterpriseId string, request map[string]interface{}, handler xhttp.HttpRequestResponseFunc) {
-	c, err := a.getModelConfig(enterpriseId, SYSTEM_MODEL_LLM)
+	a.SyncStreamCallSystemLLMCtx(context.Background(), enterpriseId, request, handler)
+}
 
-	if err != nil {
+// SyncStreamCallSystemLLMCtx 同步流式请求大语言模型，ctx结束（如客户端断开）时中断上游流
+// 收到第一行数据前失败时切换到下一个模型
+func (a *AgentApp) SyncStreamCallSystemLLMCtx(ctx context.Context, enterpriseId string, request map[string]interface{}, handler xhttp.HttpRequestResponseFunc) {
+	if err := a.checkQuota(ctx, enterpriseId); err != nil {
 		handler(nil, err)
 		return
 	}
-	tools.SyncStreamCallSystemLLM(c.URL, c.Key, c.Name, request, handler)
+	request, swallow := withStreamUsage(request)
+	handler = canceledHandler(ctx, "SyncStreamCallSystemLLM", handler)
+	err := a.callModel(ctx, enterpriseId, SYSTEM_MODEL_LLM, "SyncStreamCallSystemLLM", true, func(ctx context.Context, c *SystemModel) error {
+		var streamErr error
+		delivered := false
+		h := a.usageStreamHandler(ctx, enterpriseId, c.Name, swallow, handler)
+		tools.SyncStreamCallSystemLLMCtx(ctx, c.URL, c.Key, c.Name, c.Reasoning, request, func(b []byte, err error) bool {
+			if err != nil && !delivered {
+				streamErr = err
+				return false
+			}
+			delivered = true
+			return h(b, err)
+		})
+		return streamErr
+	})
+	if err != nil {
+		handler(nil, err)
+	}
 }
 
 // SyncCallSystemLLM 同步非流式请求大语言模型 url, key, modelName string,
+// 所有模型都失败且最后一个返回状态码>=400时，返回其错误响应体，不返回错误
 func (a *AgentApp) SyncCallSystemLLM(enterpriseId string, request map[string]interface{}) (string, error) {
-	c, err := a.getModelConfig(enterpriseId, SYSTEM_MODEL_LLM)
-	if err != nil {
+	return xhttp.StatusBody(a.SyncCallSystemLLMCtx(context.Background(), enterpriseId, request))
+}
+
+// SyncCallSystemLLMCtx 同步非流式请求大语言模型，ctx结束时取消请求，状态码>=400时返回 *xhttp.StatusError
+func (a *AgentApp) SyncCallSystemLLMCtx(ctx context.Context, enterpriseId string, request map[string]interface{}) (string, error) {
+	r, err := a.syncCallLLM(ctx, enterpriseId, SYSTEM_MODEL_LLM, "SyncCallSystemLLM", request)
+	logCanceled(ctx, "SyncCallSystemLLM", err)
+	return r, err
+}
+
+// syncCallLLM 非流式请求llm/ocr模型，校验配额、记录用量
+func (a *AgentApp) syncCallLLM(ctx context.Context, enterpriseId, confCode, apiName string, request map[string]interface{}) (string, error) {
+	if err := a.checkQuota(ctx, enterpriseId); err != nil {
 		return "", err
 	}
-	return tools.SyncCallSystemLLM(c.URL, c.Key, c.Name, request)
+	var r string
+	err := a.callModel(ctx, enterpriseId, confCode, apiName, false, func(ctx context.Context, c *SystemModel) error {
+		var err error
+		r, err = tools.SyncCallSystemLLMCtx(ctx, c.URL, c.Key, c.Name, c.Reasoning, request)
+		if err == nil {
+			a.recordUsage(ctx, enterpriseId, c.Name, usageFromJSON(xjson.Get(r, "usage").Raw))
+		}
+		return err
+	})
+	return r, err
+}
+
+// Chat 使用系统llm模型进行非流式对话
+func (a *AgentApp) Chat(enterpriseId string, req *xllm.ChatRequest) (*xllm.ChatResponse, error) {
+	return a.ChatCtx(context.Background(), enterpriseId, req)
+}
+
+// ChatCtx 使用系统llm模型进行非流式对话，ctx结束时取消请求
+// req 未指定 model 时使用系统配置的模型
+func (a *AgentApp) ChatCtx(ctx context.Context, enterpriseId string, req *xllm.ChatRequest) (*xllm.ChatResponse, error) {
+	if err := a.checkQuota(ctx, enterpriseId); err != nil {
+		return nil, err
+	}
+	var resp *xllm.ChatResponse
+	err := a.callModel(ctx, enterpriseId, SYSTEM_MODEL_LLM, "Chat", false, func(ctx context.Context, c *SystemModel) error {
+		var err error
+		resp, err = tools.ChatCompletionCtx(ctx, c.URL, c.Key, c.Name, c.Reasoning, req)
+		if err == nil {
+			a.recordUsage(ctx, enterpriseId, c.Name, resp.Usage)
+		}
+		return err
+	})
+	logCanceled(ctx, "Chat", err)
+	return resp, err
+}
+
+// ChatStream 使用系统llm模型进行流式对话，返回分片迭代器
+func (a *AgentApp) ChatStream(enterpriseId string, req *xllm.ChatRequest) (*xllm.ChatStream, error) {
+	return a.ChatStreamCtx(context.Background(), enterpriseId, req)
+}
+
+// ChatStreamCtx 使用系统llm模型进行流式对话，返回分片迭代器，ctx结束（如客户端断开）时中断上游流
+// 调用方必须调用 ChatStream.Close 释放连接
+func (a *AgentApp) ChatStreamCtx(ctx context.Context, enterpriseId string, req *xllm.ChatRequest) (*xllm.ChatStream, error) {
+	if err := a.checkQuota(ctx, enterpriseId); err != nil {
+		return nil, err
+	}
+	if req.StreamOptions == nil {
+		req = req.Clone()
+		req.StreamOptions = &xllm.StreamOptions{IncludeUsage: true}
+	}
+	var stream *xllm.ChatStream
+	err := a.callModel(ctx, enterpriseId, SYSTEM_MODEL_LLM, "ChatStream", true, func(ctx context.Context, c *SystemModel) error {
+		var err error
+		stream, err = tools.ChatCompletionStreamCtx(ctx, c.URL, c.Key, c.Name, c.Reasoning, req)
+		if err == nil {
+			name := c.Name
+			stream.OnUsage(func(u *xllm.Usage) {
+				a.recordUsage(ctx, enterpriseId, name, u)
+			})
+		}
+		return err
+	})
+	logCanceled(ctx, "ChatStream", err)
+	return stream, err
 }
 
 // SyncStreamCallOCRLLM 同步非流式请求大语言模型 url, key, modelName string,
+// 状态码>=400时返回错误响应体，不返回错误
 func (a *AgentApp) SyncStreamCallOCRLLM(enterpriseId string, request map[string]interface{}) (string, error) {
-	c, err := a.getModelConfig(enterpriseId, SYSTEM_MODEL_OCR)
-	if err != nil {
-		return "", err
-	}
-	return tools.SyncCallSystemLLM(c.URL, c.Key, c.Name, request)
+	return xhttp.StatusBody(a.syncCallLLM(context.Background(), enterpriseId, SYSTEM_MODEL_OCR, "SyncStreamCallOCRLLM", request))
 }
 
+// SyncCallSystemASRFromReader 语音识别，状态码>=400时返回错误响应体，不返回错误
 func (a *AgentApp) SyncCallSystemASRFromReader(enterpriseId, filename string, fileReader io.Reader) (string, error) {
+	return xhttp.StatusBody(a.SyncCallSystemASRFromReaderCtx(context.Background(), enterpriseId, filename, fileReader))
+}
+
+// SyncCallSystemASRFromReaderCtx 语音识别，ctx结束时取消请求
+// 音频流只能读取一次，不做故障切换，使用优先级最高的模型
+func (a *AgentApp) SyncCallSystemASRFromReaderCtx(ctx context.Context, enterpriseId, filename string, fileReader io.Reader) (string, error) {
 	c, err := a.getModelConfig(enterpriseId, SYSTEM_MODEL_ASR)
 	if err != nil {
 		return "", err
 	}
-	return tools.SyncCallSystemASRFromReader(c.URL, c.Key, c.Name, filename, fileReader)
+	r, err := tools.SyncCallSystemASRFromReaderCtx(ctx, c.URL, c.Key, c.Name, filename, fileReader)
+	a.modelStats.record(SYSTEM_MODEL_ASR, c, err)
+	logCanceled(ctx, "SyncCallSystemASRFromReader", err)
+	return r, err
 }
 
 // AsyncRequestCallSystemTextEmbedding 异步请求TextEmbedding模型
 func (a *AgentApp) AsyncRequestCallSystemTextEmbedding(enterpriseId string, request map[string]interface{}, handler xhttp.HttpRequestResponseFunc) {
-	c, err := a.getModelConfig(enterpriseId, SYSTEM_MODEL_TEXT_EMBEDDING)
-	if err != nil {
-		handler(nil, err)
-		return
-	}
-	tools.AsyncRequestCallSystemTextEmbedding(c.URL, c.Key, c.Name, request, handler)
+	go func() {
+		r, err := a.SyncRequestCallSystemTextEmbedding(enterpriseId, request)
+		if err != nil {
+			handler(nil, err)
+		} else {
+			handler([]byte(r), nil)
+		}
+	}()
 }
 
-// SyncRequestCallSystemTextEmbedding 同步请求TextEmbedding模型
+// SyncRequestCallSystemTextEmbedding 同步请求TextEmbedding模型，状态码>=400时返回错误响应体，不返回错误
 func (a *AgentApp) SyncRequestCallSystemTextEmbedding(enterpriseId string, request map[string]interface{}) (string, error) {
-	c, err := a.getModelConfig(enterpriseId, SYSTEM_MODEL_TEXT_EMBEDDING)
-	if err != nil {
-		return "", err
-	}
-	return tools.SyncRequestCallSystemTextEmbedding(c.URL, c.Key, c.Name, request)
+	return xhttp.StatusBody(a.SyncRequestCallSystemTextEmbeddingCtx(context.Background(), enterpriseId, request))
 }
 
-// SyncRequestCallSystemRerank 同步请求Rerank模型
+// SyncRequestCallSystemTextEmbeddingCtx 同步请求TextEmbedding模型，ctx结束时取消请求
+func (a *AgentApp) SyncRequestCallSystemTextEmbeddingCtx(ctx context.Context, enterpriseId string, request map[string]interface{}) (string, error) {
+	var r string
+	err := a.callModel(ctx, enterpriseId, SYSTEM_MODEL_TEXT_EMBEDDING, "SyncRequestCallSystemTextEmbedding", false, func(ctx context.Context, c *SystemModel) error {
+		var err error
+		r, err = tools.SyncRequestCallSystemTextEmbeddingCtx(ctx, c.URL, c.Key, c.Name, request)
+		return err
+	})
+	logCanceled(ctx, "SyncRequestCallSystemTextEmbedding", err)
+	return r, err
+}
+
+// SyncRequestCallSystemRerank 同步请求Rerank模型，状态码>=400时返回错误响应体，不返回错误
 func (a *AgentApp) SyncRequestCallSystemRerank(enterpriseId string, request map[string]interface{}) (string, error) {
-	c, err := a.getModelConfig(enterpriseId, SYSTEM_MODEL_RERANK)
-	if err != nil {
-		return "", err
-	}
-	return tools.SyncRequestCallSystemRerank(c.URL, c.Key, c.Name, request)
+	return xhttp.StatusBody(a.SyncRequestCallSystemRerankCtx(context.Background(), enterpriseId, request))
+}
+
+// SyncRequestCallSystemRerankCtx 同步请求Rerank模型，ctx结束时取消请求
+func (a *AgentApp) SyncRequestCallSystemRerankCtx(ctx context.Context, enterpriseId string, request map[string]interface{}) (string, error) {
+	var r string
+	err := a.callModel(ctx, enterpriseId, SYSTEM_MODEL_RERANK, "SyncRequestCallSystemRerank", false, func(ctx context.Context, c *SystemModel) error {
+		var err error
+		r, err = tools.SyncRequestCallSystemRerankCtx(ctx, c.URL, c.Key, c.Name, request)
+		return err
+	})
+	logCanceled(ctx, "SyncRequestCallSystemRerank", err)
+	return r, err
 }
 
 // EmbedTexts 调用 bge-m3 接口将 texts 向量化
 func (a *AgentApp) EmbedTexts(enterpriseId string, texts []string) ([][]float32, error) {
+	return a.EmbedTextsCtx(context.Background(), enterpriseId, texts)
+}
+
+// EmbedTextsCtx 调用 bge-m3 接口将 texts 向量化，ctx结束时取消请求
+func (a *AgentApp) EmbedTextsCtx(ctx context.Context, enterpriseId string, texts []string) ([][]float32, error) {
 	req := map[string]interface{}{"input": texts}
-	raw, err := a.SyncRequestCallSystemTextEmbedding(enterpriseId, req)
+	raw, err := a.SyncRequestCallSystemTextEmbeddingCtx(ctx, enterpriseId, req)
 	if err != nil {
 		return nil, fmt.Errorf("embedding 调用失败: %v", err)
 	}
@@ -176,8 +337,13 @@ func (a *AgentApp) EmbedTexts(enterpriseId string, texts []string) ([][]float32,
 
 // RerankResults 调用 bge-reranker-v2-m3 接口，对 docs 做重排序
 func (a *AgentApp) RerankResults(enterpriseId string, query string, docs []string) ([]float64, error) {
+	return a.RerankResultsCtx(context.Background(), enterpriseId, query, docs)
+}
+
+// RerankResultsCtx 调用 bge-reranker-v2-m3 接口，对 docs 做重排序，ctx结束时取消请求
+func (a *AgentApp) RerankResultsCtx(ctx context.Context, enterpriseId string, query string, docs []string) ([]float64, error) {
 	req := map[string]interface{}{"query": query, "documents": docs}
-	raw, err := a.SyncRequestCallSystemRerank(enterpriseId, req)
+	raw, err := a.SyncRequestCallSystemRerankCtx(ctx, enterpriseId, req)
 	if err != nil {
 		return nil, fmt.Errorf("重排序调用失败: %w", err)
 	}
@@ -0,0 +1,177 @@
+package powerai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xcache"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xhttp"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	系统模型故障切换
+//	系统模型配置的 value 可以是单个模型，也可以是按优先级排列的模型列表，priority 越小越优先
+//	fullKey: /system/config/_internal_/企业ID/system-llm
+//	value: [
+//	         {"name":"qwen3-32b","key":"xxx","url":"http://10.0.0.1/v1/chat/completions","priority":1,"timeout_ms":60000},
+//	         {"name":"qwen3-32b","key":"xxx","url":"http://10.0.0.2/v1/chat/completions","priority":2,"fallback_on_quota":true}
+//	]
+//	建立连接失败、超时、5xx 时切换到下一个模型，fallback_on_quota 为 true 时 429 也切换
+//	流式调用只在收到第一行数据前切换，已经输出给调用方的流不会切换
+//
+// ***************************************************************************************************************
+
+// ModelEndpointStat 模型端点的调用统计
+type ModelEndpointStat struct {
+	ConfCode     string    `json:"conf_code"`
+	Name         string    `json:"name"`
+	URL          string    `json:"url"`
+	Served       int64     `json:"served"`
+	Failed       int64     `json:"failed"`
+	LastError    string    `json:"last_error,omitempty"`
+	LastFailedAt time.Time `json:"last_failed_at,omitempty"`
+}
+
+type modelEndpointStats struct {
+	mu    sync.Mutex
+	stats *xcache.Cache[string, *ModelEndpointStat]
+}
+
+func newModelEndpointStats() *modelEndpointStats {
+	return &modelEndpointStats{stats: xcache.NewCache[string, *ModelEndpointStat]()}
+}
+
+func (s *modelEndpointStats) record(confCode string, c *SystemModel, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := confCode + "|" + c.Name + "|" + c.URL
+	st, ok := s.stats.Get(k)
+	if !ok {
+		st = &ModelEndpointStat{ConfCode: confCode, Name: c.Name, URL: c.URL}
+		s.stats.Set(k, st)
+	}
+	if err == nil {
+		st.Served++
+		return
+	}
+	st.Failed++
+	st.LastError = err.Error()
+	st.LastFailedAt = time.Now()
+}
+
+func (s *modelEndpointStats) snapshot() []ModelEndpointStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.stats.Keys()
+	sort.Strings(keys)
+	r := make([]ModelEndpointStat, 0, len(keys))
+	for _, k := range keys {
+		if st, ok := s.stats.Get(k); ok {
+			r = append(r, *st)
+		}
+	}
+	return r
+}
+
+// getModelConfigs 获取系统模型配置，按优先级排序
+func (a *AgentApp) getModelConfigs(enterpriseId, confCode string) ([]*SystemModel, error) {
+	v := a.GetSystemConfig(confCode, enterpriseId)
+	if v == nil {
+		// 兼容旧版本参数顺序颠倒时读取的key: /system/config/_internal_/模型编号/企业ID
+		v = a.GetSystemConfig(enterpriseId, confCode)
+	}
+	if v == nil {
+		return nil, fmt.Errorf("未查询到企业[%s],模型[%s]对应的值", enterpriseId, confCode)
+	}
+
+	var models []*SystemModel
+	value := strings.TrimSpace(v.Value)
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &models); err != nil {
+			return nil, fmt.Errorf("企业[%s],模型[%s]已查到对应的值，但json转换失败:%v", enterpriseId, confCode, err)
+		}
+	} else {
+		sm := &SystemModel{}
+		if err := json.Unmarshal([]byte(value), sm); err != nil {
+			return nil, fmt.Errorf("企业[%s],模型[%s]已查到对应的值，但json转换失败:%v", enterpriseId, confCode, err)
+		}
+		models = append(models, sm)
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("企业[%s],模型[%s]的模型列表为空", enterpriseId, confCode)
+	}
+	sort.SliceStable(models, func(i, j int) bool {
+		return models[i].Priority < models[j].Priority
+	})
+	return models, nil
+}
+
+// callModel 按优先级调用系统模型，fn 返回可切换的错误时调用下一个模型
+// stream 为 false 时，模型配置了 timeout_ms 则单次调用使用该超时
+func (a *AgentApp) callModel(ctx context.Context, enterpriseId, confCode, apiName string, stream bool, fn func(ctx context.Context, c *SystemModel) error) error {
+	models, err := a.getModelConfigs(enterpriseId, confCode)
+	if err != nil {
+		return err
+	}
+	for i, c := range models {
+		err = a.callModelEndpoint(ctx, c, stream, fn)
+		a.modelStats.record(confCode, c, err)
+		if err == nil {
+			xlog.LogInfoF(server.SysTrackCode(ctx), "model", apiName, fmt.Sprintf("企业[%s],模型[%s]由端点[%s,%s]处理", enterpriseId, confCode, c.Name, c.URL))
+			return nil
+		}
+		if i == len(models)-1 || ctx.Err() != nil || !shouldFailover(err, c) {
+			break
+		}
+		next := models[i+1]
+		xlog.LogErrorF(server.SysTrackCode(ctx), "model", apiName, fmt.Sprintf("企业[%s],模型[%s]端点[%s,%s]调用失败,切换到[%s,%s]",
+			enterpriseId, confCode, c.Name, c.URL, next.Name, next.URL), err)
+	}
+	return err
+}
+
+func (a *AgentApp) callModelEndpoint(ctx context.Context, c *SystemModel, stream bool, fn func(ctx context.Context, c *SystemModel) error) error {
+	if !stream && c.TimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.TimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+	return fn(ctx, c)
+}
+
+// shouldFailover 是否切换到下一个模型：建立连接失败、超时、5xx，配置 fallback_on_quota 时包括 429
+func shouldFailover(err error, c *SystemModel) bool {
+	if isConnectError(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var statusErr *xhttp.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError ||
+			(c.FallbackOnQuota && statusErr.StatusCode == http.StatusTooManyRequests)
+	}
+	return false
+}
+
+// modelEndpoints 查询系统模型端点的调用统计
+func (a *AgentApp) modelEndpoints(c *gin.Context) {
+	c.JSON(200, map[string]interface{}{
+		"code":    server.ResultSuccess.Code,
+		"message": server.ResultSuccess.Message,
+		"data":    a.modelStats.snapshot(),
+	})
+}
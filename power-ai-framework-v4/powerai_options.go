@@ -3,6 +3,9 @@ package powerai
 import (
 	"context"
 	"github.com/gin-gonic/gin"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xbalance"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xenv"
+	"time"
 )
 
 type Option struct {
@@ -16,6 +19,24 @@ type Options struct {
 	DefaultConfigs        map[string]*Config
 	ConfigChangeCallbacks []func(k string)
 	Decision              *Decision
+	ShutdownTimeout       time.Duration
+	Balancer              xbalance.Balancer
+	InstanceWeight        int
+	MaxInstanceFailures   int
+	ProbeInterval         time.Duration
+	Tools                 []*Tool
+	ToolMaxSteps          int
+	AutoSummary           bool
+	SessionHooks          *SessionHooks
+	TranscriptRoutes      bool
+	FileResolver          FileResolver
+	MemoryRecall          *MemoryRecallOptions
+	ShortMemoryStore      ShortMemoryStore
+	ConfigHistory         bool
+	ConfigChangeDebounce  time.Duration
+	ConfigFile            string
+	AdminAuth             gin.HandlerFunc
+	UsageLogRetention     time.Duration
 }
 
 func (o *Options) Apply(opts []Option) {
@@ -72,6 +93,7 @@ func WithDefaultConfigs(configs map[string]*Config) Option {
 	}
 }
 
+// WithConfigChangeCallbacks 监听的任意配置修改时回调，参数为 etcd 完整key；按配置订阅使用 AgentApp.OnConfigChange
 func WithConfigChangeCallbacks(f ...func(k string)) Option {
 	return Option{
 		F: func(o *Options) {
@@ -80,9 +102,196 @@ func WithConfigChangeCallbacks(f ...func(k string)) Option {
 	}
 }
 
+// WithShutdownTimeout 优雅停机时等待处理中请求（SSE流式响应）结束的最长时间
+// 默认读取环境变量 POWER_AI_SHUTDOWN_TIMEOUT（秒），未配置为30秒
+func WithShutdownTimeout(d time.Duration) Option {
+	return Option{
+		F: func(o *Options) {
+			if d > 0 {
+				o.ShutdownTimeout = d
+			}
+		},
+	}
+}
+
+// WithLoadBalancer 调用其他智能体时的负载均衡策略
+// 默认读取环境变量 POWER_AI_LB_STRATEGY（round_robin/weighted/least_inflight/local_first），未配置为轮询
+func WithLoadBalancer(b xbalance.Balancer) Option {
+	return Option{
+		F: func(o *Options) {
+			if b != nil {
+				o.Balancer = b
+			}
+		},
+	}
+}
+
+// WithInstanceWeight 本实例注册到etcd的权重，加权轮询时使用
+// 默认读取环境变量 POWER_AI_INSTANCE_WEIGHT，未配置为1
+func WithInstanceWeight(w int) Option {
+	return Option{
+		F: func(o *Options) {
+			if w > 0 {
+				o.InstanceWeight = w
+			}
+		},
+	}
+}
+
+// WithPassiveHealthCheck 被动健康检查
+// 实例连续失败 maxFailures 次后摘除，每隔 probeInterval 调用 /health 探活，成功后恢复
+// maxFailures<=0 表示不摘除，probeInterval<=0 表示不探活
+func WithPassiveHealthCheck(maxFailures int, probeInterval time.Duration) Option {
+	return Option{
+		F: func(o *Options) {
+			o.MaxInstanceFailures = maxFailures
+			o.ProbeInterval = probeInterval
+		},
+	}
+}
+
+// WithTools 注册可供大模型调用的工具，也可以在创建后调用 AgentApp.RegisterTool
+func WithTools(tools ...*Tool) Option {
+	return Option{
+		F: func(o *Options) {
+			o.Tools = append(o.Tools, tools...)
+		},
+	}
+}
+
+// WithToolMaxSteps 工具调用时一轮对话最多调用大模型的次数，默认5次
+func WithToolMaxSteps(n int) Option {
+	return Option{
+		F: func(o *Options) {
+			if n > 0 {
+				o.ToolMaxSteps = n
+			}
+		},
+	}
+}
+
+// WithAutoSummary 开启自动摘要：QueryMemoryContext 判断需要摘要时由框架异步生成摘要并创建 checkpoint
+func WithAutoSummary() Option {
+	return Option{
+		F: func(o *Options) {
+			o.AutoSummary = true
+		},
+	}
+}
+
+// WithSessionHooks 注册会话生命周期事件的处理函数
+func WithSessionHooks(hooks *SessionHooks) Option {
+	return Option{
+		F: func(o *Options) {
+			o.SessionHooks = hooks
+		},
+	}
+}
+
+// WithTranscriptRoutes 注册会话记录导出和用户数据删除路由
+// GET /{base}/transcript?conversation_id=xxx&format=json|markdown
+// POST /{base}/erase_user
+// 需要设置 WithAdminToken 或 WithAdminAuth
+func WithTranscriptRoutes() Option {
+	return Option{
+		F: func(o *Options) {
+			o.TranscriptRoutes = true
+		},
+	}
+}
+
+// WithConfigHistory 记录配置修改历史，并注册历史查询和回滚路由
+// GET /{base}/config_history?key=xxx&enterprise_id=xxx&limit=20
+// POST /{base}/config_rollback
+// 需要设置 WithAdminToken 或 WithAdminAuth
+func WithConfigHistory() Option {
+	return Option{
+		F: func(o *Options) {
+			o.ConfigHistory = true
+		},
+	}
+}
+
+// WithConfigChangeDebounce 设置 OnConfigChange 订阅的防抖时间，默认500ms，d<=0 时每次修改都回调
+func WithConfigChangeDebounce(d time.Duration) Option {
+	return Option{
+		F: func(o *Options) {
+			o.ConfigChangeDebounce = d
+		},
+	}
+}
+
+// WithConfigFile 从本地 yaml/json 文件加载配置和服务实例，不连接 etcd，用于本地开发和测试，文件格式见 ConfigStore
+// 默认读取环境变量 POWER_AI_CONFIG_FILE，未配置时使用 etcd
+func WithConfigFile(path string) Option {
+	return Option{
+		F: func(o *Options) {
+			o.ConfigFile = path
+		},
+	}
+}
+
+// WithFileResolver 删除用户数据时根据 file_id 解析 minio 文件，默认 file_id 为 "桶名称/路径" 格式
+func WithFileResolver(f FileResolver) Option {
+	return Option{
+		F: func(o *Options) {
+			if f != nil {
+				o.FileResolver = f
+			}
+		},
+	}
+}
+
+// WithMemoryRecall 开启跨会话语义召回：checkpoint 摘要写入 milvus，QueryMemoryContext 召回该用户其他会话的摘要
+// opts 为 nil 时使用默认配置
+func WithMemoryRecall(opts *MemoryRecallOptions) Option {
+	return Option{
+		F: func(o *Options) {
+			if opts == nil {
+				opts = &MemoryRecallOptions{}
+			}
+			o.MemoryRecall = opts
+		},
+	}
+}
+
+// WithShortMemoryStore 替换短期记忆存储，默认使用 redis
+func WithShortMemoryStore(s ShortMemoryStore) Option {
+	return Option{
+		F: func(o *Options) {
+			o.ShortMemoryStore = s
+		},
+	}
+}
+
+// WithUsageLogRetention ai_llm_usage_log 中每次调用的用量记录保留时间，过期记录每小时清理一次，d<=0 时不清理
+// 默认读取环境变量 POWER_AI_USAGE_LOG_RETENTION_DAYS（天），未配置为90天；ai_llm_usage_daily 的日汇总不清理
+func WithUsageLogRetention(d time.Duration) Option {
+	return Option{
+		F: func(o *Options) {
+			o.UsageLogRetention = d
+		},
+	}
+}
+
+// WithInMemoryShortMemory 短期记忆存储在进程内，用于单元测试，会话不在实例之间共享
+func WithInMemoryShortMemory() Option {
+	return WithShortMemoryStore(NewInMemoryShortMemoryStore())
+}
+
 func newOptions(opts []Option) *Options {
 	options := &Options{
-		PostRouters: make(map[string]gin.HandlerFunc),
+		PostRouters:          make(map[string]gin.HandlerFunc),
+		ShutdownTimeout:      time.Duration(xenv.GetEnvOrDefaultInt("POWER_AI_SHUTDOWN_TIMEOUT", 30)) * time.Second,
+		Balancer:             xbalance.New(xenv.GetEnvOrDefault("POWER_AI_LB_STRATEGY", xbalance.StrategyRoundRobin), xenv.GetEnvOrDefault("IP_ADDR", "127.0.0.1")),
+		InstanceWeight:       xenv.GetEnvOrDefaultInt("POWER_AI_INSTANCE_WEIGHT", 1),
+		MaxInstanceFailures:  3,
+		ProbeInterval:        10 * time.Second,
+		ToolMaxSteps:         5,
+		FileResolver:         defaultFileResolver,
+		ConfigChangeDebounce: defaultConfigChangeDebounce,
+		ConfigFile:           xenv.GetEnvOrDefault("POWER_AI_CONFIG_FILE", ""),
+		UsageLogRetention:    time.Duration(xenv.GetEnvOrDefaultInt("POWER_AI_USAGE_LOG_RETENTION_DAYS", 90)) * 24 * time.Hour,
 	}
 	options.Apply(opts)
 	return options
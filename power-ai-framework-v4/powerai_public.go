@@ -1,12 +1,15 @@
 package powerai
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"io/ioutil"
 	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xdatetime"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xhttp"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
 	"strings"
 )
 
@@ -55,6 +58,8 @@ func doValidateAgentRequest(c *gin.Context) (*server.AgentRequest, *server.Error
 	if req.MessageId == "" {
 		return nil, &server.ErrorCode{Code: server.ResultError.Code, Message: fmt.Sprintf("%s-{message_id}为空", server.InvalidParam.Message)}
 	}
+	// 请求上下文携带sys_track_code，客户端断开时下游调用可以记录对应的日志
+	c.Request = c.Request.WithContext(server.WithSysTrackCode(c.Request.Context(), req.SysTrackCode))
 	return req, nil
 }
 
@@ -97,6 +102,11 @@ func RespJsonError(c *gin.Context, code, msg, stc string, data interface{}) {
 	})
 }
 
+// RespJsonErr 响应错误，错误码取自 err（见 server.ErrorCodeOf），没有时为 server.ServiceError
+func RespJsonErr(c *gin.Context, err error, stc string, data interface{}) {
+	RespJsonError(c, server.ErrorCodeOf(err, server.ServiceError).Code, err.Error(), stc, data)
+}
+
 func RespJsonSuccess(c *gin.Context, stc string, data interface{}) {
 	c.JSON(200, map[string]interface{}{
 		"code":           "success",
@@ -115,3 +125,19 @@ func ParseAgentResponse(b []byte) (string, bool) {
 	}
 	return strings.TrimPrefix(s, "data:"), false
 }
+
+// logCanceled ctx已结束（客户端断开或超时）导致调用失败时，按sys_track_code记录日志
+func logCanceled(ctx context.Context, apiName string, err error) {
+	if err == nil || ctx.Err() == nil {
+		return
+	}
+	xlog.LogErrorF(server.SysTrackCode(ctx), apiName, "canceled", "请求上下文已结束，终止上游调用", ctx.Err())
+}
+
+// canceledHandler 包装流式handler，ctx结束导致流中断时记录日志
+func canceledHandler(ctx context.Context, apiName string, handler xhttp.HttpRequestResponseFunc) xhttp.HttpRequestResponseFunc {
+	return func(b []byte, err error) bool {
+		logCanceled(ctx, apiName, err)
+		return handler(b, err)
+	}
+}
@@ -0,0 +1,236 @@
+package powerai
+
+import (
+	"context"
+	"fmt"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xuid"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	跨会话语义召回（WithMemoryRecall 开启）
+//	CheckpointShortMemory/FinalizeSessionMemory 的摘要向量化后按 企业+用户 写入 milvus 集合 ai_memory_recall
+//	QueryMemoryContext 将当前问题向量化，召回该用户其他会话中最相关的 TopK 条摘要放入 MemoryContext.Recalled，
+//	召回内容只使用 token 阈值内剩余的预算，超出预算的摘要不返回
+//	向量化或 milvus 不可用时只记录日志，不影响记忆查询
+//
+// ***************************************************************************************************************
+
+const (
+	defaultRecallCollection = "ai_memory_recall"
+	defaultRecallTopK       = 3
+	defaultRecallMinScore   = 0.5
+	recallTimeout           = 5 * time.Second
+	// recallMaxRunes milvus VarChar 字段最长8192字节
+	recallMaxRunes = 2000
+)
+
+// MemoryRecallOptions 跨会话语义召回配置
+type MemoryRecallOptions struct {
+	TopK       int     // 最多召回的摘要数，默认3
+	MinScore   float32 // 最低相似度（内积），默认0.5
+	Collection string  // milvus 集合名称，默认 ai_memory_recall
+}
+
+// RecalledMemory 召回的历史会话摘要
+type RecalledMemory struct {
+	ConversationID string
+	Text           string
+	Score          float32
+	CreateTime     string
+}
+
+type memoryRecall struct {
+	enabled bool
+	opts    MemoryRecallOptions
+	ready   atomic.Bool // 集合是否已创建
+	wg      sync.WaitGroup
+}
+
+func newMemoryRecall(opts *MemoryRecallOptions) *memoryRecall {
+	r := &memoryRecall{enabled: opts != nil}
+	if opts != nil {
+		r.opts = *opts
+	}
+	if r.opts.TopK <= 0 {
+		r.opts.TopK = defaultRecallTopK
+	}
+	if r.opts.MinScore <= 0 {
+		r.opts.MinScore = defaultRecallMinScore
+	}
+	if r.opts.Collection == "" {
+		r.opts.Collection = defaultRecallCollection
+	}
+	return r
+}
+
+// indexRecall 异步将会话摘要写入召回集合
+func (a *AgentApp) indexRecall(conversationId, summary string) {
+	r := a.recall
+	summary = strings.TrimSpace(summary)
+	if !r.enabled || summary == "" {
+		return
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), summaryTimeout)
+		defer cancel()
+		if err := a.writeRecall(ctx, conversationId, summary); err != nil {
+			xlog.LogErrorF("10000", "memory-recall", "index", fmt.Sprintf("会话[%s]摘要写入召回集合失败", conversationId), err)
+		}
+	}()
+}
+
+func (a *AgentApp) writeRecall(ctx context.Context, conversationId, summary string) error {
+	conv, err := a.QueryConversationById(conversationId)
+	if err != nil {
+		return err
+	}
+	enterpriseId, userId := conv.EnterpriseID.String, conv.UserID.String
+	if enterpriseId == "" || userId == "" {
+		return fmt.Errorf("会话[%s]缺少企业ID或用户ID", conversationId)
+	}
+	if runes := []rune(summary); len(runes) > recallMaxRunes {
+		summary = string(runes[:recallMaxRunes])
+	}
+	vecs, err := a.EmbedTextsCtx(ctx, enterpriseId, []string{summary})
+	if err != nil {
+		return err
+	}
+	client, err := a.GetMilvusClient()
+	if err != nil {
+		return err
+	}
+	scalars := map[string][]string{
+		"recall_id":       {xuid.UUID()},
+		"enterprise_id":   {enterpriseId},
+		"user_id":         {userId},
+		"conversation_id": {conversationId},
+		"text":            {summary},
+		"create_time":     {time.Now().Format(time.DateTime)},
+	}
+	vectors := map[string][][]float32{"embedding": vecs}
+
+	collection := a.recall.opts.Collection
+	if !a.recall.ready.Load() {
+		exists, err := client.HasCollection(ctx, collection)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err = client.CreateCollectionFromData(ctx, collection, "recall_id", scalars, vectors); err != nil {
+				return err
+			}
+		}
+		a.recall.ready.Store(true)
+	}
+	return client.DynamicInsert(ctx, collection, scalars, vectors)
+}
+
+// recallMemories 召回用户其他会话的摘要，总 token 数不超过 budget
+func (a *AgentApp) recallMemories(enterpriseId, userId, conversationId, query string, budget int) ([]*RecalledMemory, int, error) {
+	r := a.recall
+	if !r.enabled || enterpriseId == "" || userId == "" || strings.TrimSpace(query) == "" || budget <= 0 {
+		return nil, 0, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), recallTimeout)
+	defer cancel()
+
+	client, err := a.GetMilvusClient()
+	if err != nil {
+		return nil, 0, err
+	}
+	if !r.ready.Load() {
+		exists, err := client.HasCollection(ctx, r.opts.Collection)
+		if err != nil || !exists {
+			// 还没有写入过摘要
+			return nil, 0, err
+		}
+		r.ready.Store(true)
+	}
+	vecs, err := a.EmbedTextsCtx(ctx, enterpriseId, []string{query})
+	if err != nil {
+		return nil, 0, err
+	}
+	filter := fmt.Sprintf("enterprise_id == %s && user_id == %s && conversation_id != %s",
+		milvusQuote(enterpriseId), milvusQuote(userId), milvusQuote(conversationId))
+	results, err := client.MilvusVectorSearch(ctx, r.opts.Collection, "embedding", vecs, r.opts.TopK, filter,
+		[]string{"conversation_id", "text", "create_time"})
+	if err != nil || len(results) == 0 {
+		return nil, 0, err
+	}
+
+	tokenizer := a.GetSystemTokenizer(enterpriseId)
+	var recalled []*RecalledMemory
+	used := 0
+	for _, hit := range results[0] {
+		if hit.Score < r.opts.MinScore {
+			continue
+		}
+		tokens := tokenizer.Count(hit.Data["text"])
+		if used+tokens > budget {
+			continue
+		}
+		used += tokens
+		recalled = append(recalled, &RecalledMemory{
+			ConversationID: hit.Data["conversation_id"],
+			Text:           hit.Data["text"],
+			Score:          hit.Score,
+			CreateTime:     hit.Data["create_time"],
+		})
+	}
+	return recalled, used, nil
+}
+
+// eraseRecall 删除用户在召回集合中的摘要，集合不存在时直接返回
+func (a *AgentApp) eraseRecall(ctx context.Context, enterpriseId, userId string) error {
+	client, err := a.GetMilvusClient()
+	if err != nil {
+		return err
+	}
+	collection := a.recall.opts.Collection
+	exists, err := client.HasCollection(ctx, collection)
+	if err != nil || !exists {
+		return err
+	}
+	return client.DeleteVectorsByExpression(ctx, collection,
+		fmt.Sprintf("enterprise_id == %s && user_id == %s", milvusQuote(enterpriseId), milvusQuote(userId)))
+}
+
+// waitRecall 停机时等待摘要写入结束
+func (a *AgentApp) waitRecall(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		a.recall.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		xlog.LogErrorF("10000", "memory-recall", "shutdown", "停机时等待摘要写入召回集合超时", ctx.Err())
+	}
+}
+
+// RecallText 将召回的摘要拼接为提示词片段
+func (m *MemoryContext) RecallText() string {
+	if len(m.Recalled) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("以下是该用户以往会话的摘要，仅供参考：\n")
+	for _, r := range m.Recalled {
+		sb.WriteString(fmt.Sprintf("[%s] %s\n", r.CreateTime, r.Text))
+	}
+	return sb.String()
+}
+
+func milvusQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
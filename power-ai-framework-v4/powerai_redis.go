@@ -2,6 +2,7 @@ package powerai
 
 import (
 	"orgine.com/ai-team/power-ai-framework-v4/middleware/redis"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlock"
 )
 
 func (a *AgentApp) GetRedisClient() (*redis_mw.Redis, error) {
@@ -16,3 +17,12 @@ func (a *AgentApp) GetRedisClient() (*redis_mw.Redis, error) {
 	}
 	return a.redis, nil
 }
+
+// sessionLockBackend 会话分布式锁使用的redis客户端
+func (a *AgentApp) sessionLockBackend() (xlock.Backend, error) {
+	client, err := a.GetRedisClient()
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
@@ -0,0 +1,348 @@
+package powerai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/redis"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xuid"
+	"sync"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	会话生命周期事件（WithSessionHooks 注册）
+//	created/turn_written/checkpointed 在本实例写入短期记忆后触发
+//	idle_expiring/expired 由后台巡检触发：
+//	本智能体写入过的会话记录在 redis 有序集合 short_term_memory:sessions:{智能体代码} 中，score 为下次检查的时间，
+//	会话剩余有效期不超过 IdleBefore 时触发 idle_expiring（此时仍可读取会话），会话key不存在时触发 expired
+//	idle_expiring 触发后记录在哈希 short_term_memory:sessions:{智能体代码}:idle 中，WriteTurn 写入新一轮对话前不再触发，
+//	因此处理函数写入会话（会重新设置有效期）不会使会话一直有效并反复触发
+//	每次巡检处理全部到期的会话，每批 100 个
+//	多实例部署时每个巡检周期只有抢到巡检锁的实例执行巡检，事件在智能体的实例之间只触发一次
+//
+// ***************************************************************************************************************
+
+// SessionEventType 会话事件类型
+type SessionEventType string
+
+const (
+	SessionCreated      SessionEventType = "created"       // CreateShortMemory 创建了会话
+	SessionTurnWritten  SessionEventType = "turn_written"  // WriteTurn 写入了一轮对话
+	SessionCheckpointed SessionEventType = "checkpointed"  // CheckpointShortMemory 创建了 checkpoint
+	SessionIdleExpiring SessionEventType = "idle_expiring" // 会话即将过期
+	SessionExpired      SessionEventType = "expired"       // 会话已过期
+)
+
+const (
+	sessionIndexKey        = "short_term_memory:sessions:%s"
+	sessionSweepBatch      = 100
+	defaultSessionIdle     = 5 * time.Minute
+	defaultSessionSweep    = 30 * time.Second
+	sessionEventHandlerMax = 2 * time.Minute
+)
+
+// SessionEvent 会话事件
+type SessionEvent struct {
+	Type           SessionEventType
+	ConversationID string
+	// Session 触发事件时的会话状态，expired 时为 nil
+	Session *SessionValue
+	Time    time.Time
+}
+
+// SessionHooks 会话事件处理函数，未设置的事件不处理
+// 处理函数在独立的 goroutine 中执行，ctx 最长2分钟，停机时等待执行中的处理函数结束
+type SessionHooks struct {
+	OnCreated      func(ctx context.Context, e *SessionEvent)
+	OnTurnWritten  func(ctx context.Context, e *SessionEvent)
+	OnCheckpointed func(ctx context.Context, e *SessionEvent)
+	// OnIdleExpiring 会话即将过期，可以生成最终摘要或写入长期记忆
+	// 处理函数写入会话会重新设置会话有效期，会话在之后过期时触发 OnExpired；WriteTurn 写入新一轮对话后才会再次触发
+	OnIdleExpiring func(ctx context.Context, e *SessionEvent)
+	// OnExpired 会话已过期，redis 中已没有会话状态
+	OnExpired func(ctx context.Context, e *SessionEvent)
+	// IdleBefore 会话剩余有效期不超过该值时触发 OnIdleExpiring，默认5分钟，不超过会话有效期的一半
+	IdleBefore time.Duration
+	// SweepInterval 巡检间隔，默认30秒
+	SweepInterval time.Duration
+}
+
+type sessionEvents struct {
+	hooks *SessionHooks
+	start sync.Once
+	stop  chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newSessionEvents(hooks *SessionHooks) *sessionEvents {
+	if hooks == nil {
+		hooks = &SessionHooks{}
+	}
+	if hooks.IdleBefore <= 0 {
+		hooks.IdleBefore = defaultSessionIdle
+	}
+	if hooks.SweepInterval <= 0 {
+		hooks.SweepInterval = defaultSessionSweep
+	}
+	return &sessionEvents{
+		hooks: hooks,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// sweeping 是否需要巡检会话过期
+func (e *sessionEvents) sweeping() bool {
+	return e.hooks.OnIdleExpiring != nil || e.hooks.OnExpired != nil
+}
+
+func (e *sessionEvents) handler(t SessionEventType) func(ctx context.Context, e *SessionEvent) {
+	switch t {
+	case SessionCreated:
+		return e.hooks.OnCreated
+	case SessionTurnWritten:
+		return e.hooks.OnTurnWritten
+	case SessionCheckpointed:
+		return e.hooks.OnCheckpointed
+	case SessionIdleExpiring:
+		return e.hooks.OnIdleExpiring
+	case SessionExpired:
+		return e.hooks.OnExpired
+	}
+	return nil
+}
+
+// emitSessionEvent 异步调用事件处理函数
+func (a *AgentApp) emitSessionEvent(t SessionEventType, conversationId string, session *SessionValue) {
+	e := a.sessionEvents
+	fn := e.handler(t)
+	if fn == nil {
+		return
+	}
+	event := &SessionEvent{Type: t, ConversationID: conversationId, Session: session, Time: time.Now()}
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				xlog.LogErrorF("10000", "session-event", string(t), fmt.Sprintf("会话[%s]事件处理异常", conversationId), fmt.Errorf("%v", r))
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), sessionEventHandlerMax)
+		defer cancel()
+		fn(ctx, event)
+	}()
+}
+
+// trackSession 记录本智能体写入过的会话，会话写入 redis 后调用，失败只记录日志
+func (a *AgentApp) trackSession(ctx context.Context, conversationId string) {
+	e := a.sessionEvents
+	if !e.sweeping() || !a.redisShortMemory() {
+		return
+	}
+	client, err := a.GetRedisClient()
+	if err != nil {
+		return
+	}
+	due := time.Now().Add(time.Duration(a.memoryConfig.RedisExpiration)*time.Second - a.sessionIdleBefore())
+	if _, err = client.ZAddCtx(ctx, a.sessionIndexKey(), float64(due.Unix()), conversationId); err != nil {
+		xlog.LogErrorF("10000", "session-event", "track", fmt.Sprintf("记录会话[%s]失败", conversationId), err)
+	}
+}
+
+// rearmSessionIdle 会话写入新一轮对话后可以再次触发 idle_expiring，失败只记录日志
+func (a *AgentApp) rearmSessionIdle(ctx context.Context, conversationId string) {
+	e := a.sessionEvents
+	if e.hooks.OnIdleExpiring == nil || !a.redisShortMemory() {
+		return
+	}
+	client, err := a.GetRedisClient()
+	if err != nil {
+		return
+	}
+	if _, err = client.HDelCtx(ctx, a.sessionIdleKey(), conversationId); err != nil {
+		xlog.LogErrorF("10000", "session-event", "track", fmt.Sprintf("清除会话[%s]的即将过期标记失败", conversationId), err)
+	}
+}
+
+// startSessionSweep 开始巡检会话过期，未设置 OnIdleExpiring/OnExpired 或短期记忆不在 redis 时不巡检
+func (a *AgentApp) startSessionSweep() {
+	e := a.sessionEvents
+	if !e.sweeping() || !a.redisShortMemory() {
+		return
+	}
+	e.start.Do(func() {
+		go a.sessionSweepLoop()
+	})
+}
+
+// stopSessionEvents 停止巡检并等待执行中的事件处理函数结束
+func (a *AgentApp) stopSessionEvents(ctx context.Context) {
+	e := a.sessionEvents
+	started := true
+	e.start.Do(func() {
+		started = false
+	})
+	if started {
+		close(e.stop)
+		<-e.done
+	}
+	finished := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		xlog.LogErrorF("10000", "session-event", "shutdown", "停机时等待会话事件处理超时", ctx.Err())
+	}
+}
+
+func (a *AgentApp) sessionSweepLoop() {
+	e := a.sessionEvents
+	defer close(e.done)
+	ticker := time.NewTicker(e.hooks.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.sweepSessions(); err != nil {
+				xlog.LogErrorF("10000", "session-event", "sweep", "巡检会话过期失败", err)
+			}
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// sweepSessions 分批检查全部到期的会话，触发 idle_expiring/expired
+// 巡检锁过期、停机或一批会话全部处理失败时停止，剩余的会话在下次巡检处理
+func (a *AgentApp) sweepSessions() error {
+	client, err := a.GetRedisClient()
+	if err != nil {
+		return err
+	}
+	index := a.sessionIndexKey()
+	// 巡检锁在下个巡检周期前过期，实例宕机不影响下次巡检
+	lockSeconds := int64(a.sessionEvents.hooks.SweepInterval / 2 / time.Second)
+	if lockSeconds < 1 {
+		lockSeconds = 1
+	}
+	ok, err := client.SetNX(index+":sweep", xuid.UUID(), lockSeconds)
+	if err != nil || !ok {
+		return err
+	}
+
+	ctx := context.Background()
+	deadline := time.Now().Add(time.Duration(lockSeconds) * time.Second)
+	for {
+		now := time.Now()
+		ids, err := client.ZRangeByScoreCtx(ctx, index, "-inf", fmt.Sprintf("%d", now.Unix()), 0, sessionSweepBatch)
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, conversationId := range ids {
+			if err = a.sweepSession(ctx, client, index, conversationId, now); err != nil {
+				failed++
+				xlog.LogErrorF("10000", "session-event", "sweep", fmt.Sprintf("巡检会话[%s]失败", conversationId), err)
+			}
+		}
+		if len(ids) < sessionSweepBatch || failed == len(ids) || time.Now().After(deadline) {
+			return nil
+		}
+		select {
+		case <-a.sessionEvents.stop:
+			return nil
+		default:
+		}
+	}
+}
+
+func (a *AgentApp) sweepSession(ctx context.Context, client *redis_mw.Redis, index, conversationId string, now time.Time) error {
+	var ttl int64
+	d, err := a.shortMemory.TTL(ctx, conversationId)
+	switch {
+	case errors.Is(err, ErrShortMemoryNotFound):
+		ttl = -2
+	case err != nil:
+		return err
+	case d < 0:
+		ttl = -1
+	default:
+		ttl = int64(d / time.Second)
+	}
+	idleBefore := int64(a.sessionIdleBefore() / time.Second)
+
+	reschedule := func(at int64) error {
+		_, err := client.ZAddCtx(ctx, index, float64(at), conversationId)
+		return err
+	}
+	remove := func() error {
+		if _, err := client.ZRemCtx(ctx, index, conversationId); err != nil {
+			return err
+		}
+		_, err := client.HDelCtx(ctx, a.sessionIdleKey(), conversationId)
+		return err
+	}
+
+	switch {
+	case ttl == -2:
+		// 会话已过期
+		if err = remove(); err != nil {
+			return err
+		}
+		a.emitSessionEvent(SessionExpired, conversationId, nil)
+	case ttl == -1:
+		// 会话不会过期，不再跟踪
+		return remove()
+	case ttl > idleBefore:
+		// 其他智能体延长了会话有效期
+		return reschedule(now.Unix() + ttl - idleBefore)
+	default:
+		// 到期后再检查一次
+		if err = reschedule(now.Unix() + ttl + 1); err != nil {
+			return err
+		}
+		if a.sessionEvents.hooks.OnIdleExpiring == nil {
+			return nil
+		}
+		session, err := a.GetShortMemoryCtx(ctx, conversationId)
+		if err != nil {
+			if errors.Is(err, ErrShortMemoryNotFound) {
+				return nil
+			}
+			return err
+		}
+		// 已触发过且之后没有新一轮对话
+		first, err := client.HSetNXCtx(ctx, a.sessionIdleKey(), conversationId, now.Unix())
+		if err != nil || !first {
+			return err
+		}
+		a.emitSessionEvent(SessionIdleExpiring, conversationId, session)
+	}
+	return nil
+}
+
+func (a *AgentApp) sessionIndexKey() string {
+	return fmt.Sprintf(sessionIndexKey, a.Manifest.Code)
+}
+
+// sessionIdleKey 已触发 idle_expiring 的会话
+func (a *AgentApp) sessionIdleKey() string {
+	return a.sessionIndexKey() + ":idle"
+}
+
+// sessionIdleBefore IdleBefore 不超过会话有效期的一半
+func (a *AgentApp) sessionIdleBefore() time.Duration {
+	idle := a.sessionEvents.hooks.IdleBefore
+	if half := time.Duration(a.memoryConfig.RedisExpiration) * time.Second / 2; idle > half {
+		idle = half
+	}
+	return idle
+}
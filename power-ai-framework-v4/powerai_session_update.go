@@ -0,0 +1,197 @@
+package powerai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlock"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	短期记忆的乐观并发控制
+//	SessionValue.Meta.Version 由短期记忆存储在每次写入时原子地加1，UpdateShortMemory 写入时校验已保存的版本与读取时一致，
+//	不一致说明其他智能体已经修改了会话，重新读取并再次调用修改函数，避免覆盖其他智能体的修改
+//	持有会话锁的写入（WriteTurn、CheckpointShortMemory）同时校验会话锁的 fencing token，锁已过期并被其他实例获得时
+//	拒绝写入并返回 ErrSessionLockLost，避免续期失败的持有者在其他实例修改后继续写入
+//	PatchAgentSlot/PatchSharedEntity 只修改一个槽位或共享实体
+//
+// ***************************************************************************************************************
+
+// ErrSessionConflict 多次重试后仍然与其他写入冲突
+var ErrSessionConflict = errors.New("short memory version conflict")
+
+// ErrSessionLockLost 写入时会话锁已过期并被其他实例获得
+var ErrSessionLockLost = errors.New("session lock lost before write")
+
+// sessionUpdateMaxRetries UpdateShortMemory 版本冲突时最多重试的次数
+const sessionUpdateMaxRetries = 5
+
+// UpdateShortMemory 读取-修改-写入短期记忆
+// fn 修改会话，返回错误时不写入；写入时其他智能体已修改会话，则重新读取并再次调用 fn，fn 可能被调用多次
+// 会话不存在或已过期时返回的错误满足 errors.Is(err, ErrShortMemoryNotFound)，不创建会话，创建会话使用 InitShortMemory
+//
+//	err := app.UpdateShortMemory(req.ConversationId, func(s *powerai.SessionValue) error {
+//	    s.GlobalState.CurrentIntent = "book_ticket"
+//	    return nil
+//	})
+func (a *AgentApp) UpdateShortMemory(conversationId string, fn func(*SessionValue) error) error {
+	return a.UpdateShortMemoryCtx(context.Background(), conversationId, fn)
+}
+
+// UpdateShortMemoryCtx 同 UpdateShortMemory，ctx结束时停止重试
+func (a *AgentApp) UpdateShortMemoryCtx(ctx context.Context, conversationId string, fn func(*SessionValue) error) error {
+	return a.updateShortMemory(ctx, conversationId, nil, nil, fn)
+}
+
+// updateShortMemory 同 UpdateShortMemoryCtx，create 不为 nil 时会话不存在则使用 create 返回的会话状态
+// lock 为调用方持有的会话锁，不为 nil 时写入校验锁的 fencing token
+func (a *AgentApp) updateShortMemory(ctx context.Context, conversationId string, lock *xlock.SessionLock, create func() *SessionValue, fn func(*SessionValue) error) error {
+	if conversationId == "" {
+		return fmt.Errorf("conversation_id is empty")
+	}
+	for attempt := 1; ; attempt++ {
+		session, err := a.GetShortMemoryCtx(ctx, conversationId)
+		if err != nil {
+			if !errors.Is(err, ErrShortMemoryNotFound) || create == nil {
+				return err
+			}
+			session = a.normalizeSession(create())
+		}
+		version := session.Meta.Version
+		if err = fn(session); err != nil {
+			return err
+		}
+
+		ok, err := a.compareAndSetShortMemory(ctx, conversationId, session, version, lock)
+		if err != nil {
+			logCanceled(ctx, "UpdateShortMemory", err)
+			return err
+		}
+		if ok {
+			a.trackSession(ctx, conversationId)
+			return nil
+		}
+		if attempt >= sessionUpdateMaxRetries {
+			return fmt.Errorf("%w: conversation %s, %d attempts", ErrSessionConflict, conversationId, attempt)
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// compareAndSetShortMemory 已保存会话的版本仍为 version 时写入，存储把写入的版本设置为 version+1
+// lock 持有分布式锁时（redis 存储）同时校验 fencing token
+func (a *AgentApp) compareAndSetShortMemory(ctx context.Context, conversationId string, session *SessionValue, version int64, lock *xlock.SessionLock) (bool, error) {
+	session = a.normalizeSession(session)
+	session.Meta.ConversationID = conversationId
+	session.Meta.UpdatedAt = time.Now().Unix()
+
+	b, err := json.Marshal(session)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal session: %w", err)
+	}
+	var ok bool
+	if store, isRedis := a.shortMemory.(*redisShortMemoryStore); isRedis && lock != nil {
+		fenceKey, token := lock.Fence()
+		ok, err = store.compareAndSet(ctx, conversationId, b, version, a.shortMemoryTTL(), fenceKey, token)
+	} else {
+		ok, err = a.shortMemory.CompareAndSet(ctx, conversationId, b, version, a.shortMemoryTTL())
+	}
+	if ok {
+		session.Meta.Version = version + 1
+	}
+	return ok, err
+}
+
+// normalizeSession 补全会话中为 nil 的部分，保证返回的会话所有嵌套指针都不为 nil
+func (a *AgentApp) normalizeSession(session *SessionValue) *SessionValue {
+	if session == nil {
+		session = &SessionValue{}
+	}
+	if session.Meta == nil {
+		session.Meta = &MetaInfo{}
+	}
+	session.Meta.UserID = a.sessionNormalizer.NormalizeString(session.Meta.UserID, "")
+	session.Meta.UpdatedAt = a.sessionNormalizer.NormalizeTimestamp(session.Meta.UpdatedAt)
+	if session.FlowContext == nil {
+		session.FlowContext = &FlowContext{}
+	}
+	session.FlowContext.TurnCount = a.sessionNormalizer.NormalizeInt(session.FlowContext.TurnCount, 0)
+	if session.MessageContext == nil {
+		session.MessageContext = &MessageContext{}
+	}
+	session.MessageContext.Mode = a.sessionNormalizer.NormalizeString(session.MessageContext.Mode, a.memoryConfig.MemoryModeFullHistory)
+	if session.GlobalState == nil {
+		session.GlobalState = &GlobalState{}
+	}
+	if session.UserSnapshot == nil {
+		session.UserSnapshot = &UserProfile{UserID: session.Meta.UserID}
+	}
+	return session
+}
+
+// PatchAgentSlot 只更新指定智能体的槽位，value 为 nil 时删除槽位
+func (a *AgentApp) PatchAgentSlot(conversationId, agentCode string, value interface{}) error {
+	if agentCode == "" {
+		return fmt.Errorf("agent_code is empty")
+	}
+	return a.UpdateShortMemory(conversationId, func(s *SessionValue) error {
+		if s.GlobalState == nil {
+			s.GlobalState = &GlobalState{}
+		}
+		if value == nil {
+			delete(s.GlobalState.AgentSlots, agentCode)
+			return nil
+		}
+		if s.GlobalState.AgentSlots == nil {
+			s.GlobalState.AgentSlots = make(map[string]interface{})
+		}
+		s.GlobalState.AgentSlots[agentCode] = value
+		return nil
+	})
+}
+
+// PatchSharedEntity 只更新一个共享实体，name 为 SharedEntities 的 json 字段名，如 target_doctor
+// Shared 和 Entities 同时更新
+func (a *AgentApp) PatchSharedEntity(conversationId, name, value string) error {
+	if _, ok := sharedEntityField(&SharedEntities{}, name); !ok {
+		return fmt.Errorf("unknown shared entity: %s", name)
+	}
+	return a.UpdateShortMemory(conversationId, func(s *SessionValue) error {
+		if s.GlobalState == nil {
+			s.GlobalState = &GlobalState{}
+		}
+		if s.GlobalState.Shared == nil {
+			s.GlobalState.Shared = &SharedEntities{}
+		}
+		field, _ := sharedEntityField(s.GlobalState.Shared, name)
+		*field = value
+		if s.GlobalState.Entities != nil && s.GlobalState.Entities != s.GlobalState.Shared {
+			field, _ = sharedEntityField(s.GlobalState.Entities, name)
+			*field = value
+		}
+		return nil
+	})
+}
+
+func sharedEntityField(e *SharedEntities, name string) (*string, bool) {
+	switch name {
+	case "symptom_summary":
+		return &e.SymptomSummary, true
+	case "disease":
+		return &e.Disease, true
+	case "target_dept":
+		return &e.TargetDept, true
+	case "target_doctor":
+		return &e.TargetDoctor, true
+	case "intent_tag":
+		return &e.IntentTag, true
+	}
+	return nil, false
+}
@@ -1,9 +1,11 @@
 package powerai
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
 	"time"
 )
 
@@ -15,7 +17,7 @@ import (
 // 存储会话的完整状态信息，包括元数据、流程上下文、消息上下文、全局状态和用户快照
 //
 // 序列化格式: JSON
-// 存储位置: Redis
+// 存储位置: Redis（默认，可通过 WithShortMemoryStore 替换）
 // Key格式: short_term_memory:session:{conversation_id}
 // 过期时间: 30分钟（1800秒）
 type SessionValue struct {
@@ -32,6 +34,7 @@ type MetaInfo struct {
 	ConversationID string `json:"conversation_id"` // 会话唯一标识
 	UserID         string `json:"user_id"`         // 用户ID
 	UpdatedAt      int64  `json:"updated_at"`      // 最后更新时间戳（Unix时间戳）
+	Version        int64  `json:"version"`         // 版本号，存储在每次写入时加1，UpdateShortMemory 用于检测并发修改
 }
 
 // FlowContext 流程上下文
@@ -108,6 +111,7 @@ type PendingAction struct {
 	ToolName   string                 `json:"tool_name"`   // 工具名称（如 "create_payment_order"）
 	ToolParams map[string]interface{} `json:"tool_params"` // 工具参数（如 {"amount": 100, "bill_id": "123"}）
 	Reason     string                 `json:"reason"`     // 挂起原因（如 "waiting_for_user_confirmation"）
+	ToolCallID string                 `json:"tool_call_id,omitempty"` // 大模型发起工具调用的ID，确认后回传工具结果时使用
 }
 
 // UserProfile 用户快照
@@ -200,7 +204,7 @@ func newDefaultSessionValue(a *AgentApp, conversationID, userID string) *Session
 }
 
 // CreateShortMemory 创建短期记忆
-// 在对话开始时调用，为会话初始化 Redis 存储
+// 在对话开始时调用，为会话初始化短期记忆存储
 //
 // 参数:
 //   - req: Agent 请求信息
@@ -213,20 +217,16 @@ func newDefaultSessionValue(a *AgentApp, conversationID, userID string) *Session
 //
 // 注意事项:
 //   - 如果会话已存在，则不重复创建
-//   - 使用 Redis 的 EXISTS 命令检查是否已存在
+//   - 先检查会话是否存在，写入时只在会话不存在时写入，并发创建不会互相覆盖
 func (a *AgentApp) CreateShortMemory(req *server.AgentRequest) error {
-	// 获取 Redis 客户端
-	client, err := a.GetRedisClient()
-	if err != nil {
-		return fmt.Errorf("failed to get redis client: %w", err)
-	}
-
-	// 生成 Redis Key
-	key := fmt.Sprintf(a.memoryConfig.RedisKeyPrefix, req.ConversationId)
+	ctx := context.Background()
 
 	// 检查会话是否已存在
-	count, _ := client.Exists(key)
-	if count > 0 {
+	exists, err := a.shortMemory.Exists(ctx, req.ConversationId)
+	if err != nil {
+		return err
+	}
+	if exists {
 		// 会话已存在，无需重复创建
 		return nil
 	}
@@ -234,18 +234,31 @@ func (a *AgentApp) CreateShortMemory(req *server.AgentRequest) error {
 	// 创建新的会话状态
 	session := newDefaultSessionValue(a, req.ConversationId, req.UserId)
 
+	// 从长期记忆填充用户快照，失败不影响会话创建
+	if patientId := patientIdOf(req); req.EnterpriseId != "" && patientId != "" {
+		if err := a.hydrateUserSnapshot(ctx, session.UserSnapshot, req.EnterpriseId, patientId); err != nil {
+			xlog.LogErrorF(req.SysTrackCode, "long-memory", "hydrate", fmt.Sprintf("会话[%s]读取患者[%s]长期记忆失败", req.ConversationId, patientId), err)
+		}
+	}
+
 	// 序列化为 JSON
 	b, err := json.Marshal(session)
 	if err != nil {
 		return fmt.Errorf("failed to marshal session: %w", err)
 	}
 
-	// 存储到 Redis
-	return client.Set(key, string(b), a.memoryConfig.RedisExpiration)
+	// 存储，其他请求已经创建会话时不覆盖
+	created, err := a.shortMemory.SetNX(ctx, req.ConversationId, b, a.shortMemoryTTL())
+	if err != nil || !created {
+		return err
+	}
+	a.trackSession(ctx, req.ConversationId)
+	a.emitSessionEvent(SessionCreated, req.ConversationId, session)
+	return nil
 }
 
 // GetShortMemory 获取短期记忆
-// 从 Redis 读取会话状态
+// 从短期记忆存储读取会话状态，会话不存在时返回的错误满足 errors.Is(err, ErrShortMemoryNotFound)
 //
 // 参数:
 //   - conversationId: 会话ID
@@ -261,35 +274,32 @@ func (a *AgentApp) CreateShortMemory(req *server.AgentRequest) error {
 //   - 返回的会话状态已经过规范化处理
 //   - 所有嵌套指针都保证不为 nil
 func (a *AgentApp) GetShortMemory(conversationId string) (*SessionValue, error) {
-	// 获取 Redis 客户端
-	client, err := a.GetRedisClient()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get redis client: %w", err)
-	}
-
-	// 生成 Redis Key
-	key := fmt.Sprintf(a.memoryConfig.RedisKeyPrefix, conversationId)
+	return a.GetShortMemoryCtx(context.Background(), conversationId)
+}
 
-	// 从 Redis 读取
-	s, err := client.Get(key)
+// GetShortMemoryCtx 获取短期记忆，ctx结束时取消读取
+func (a *AgentApp) GetShortMemoryCtx(ctx context.Context, conversationId string) (*SessionValue, error) {
+	// 读取会话
+	b, err := a.shortMemory.Get(ctx, conversationId)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get session from redis: %w", err)
+		logCanceled(ctx, "GetShortMemory", err)
+		return nil, fmt.Errorf("failed to get session: %w", err)
 	}
 
 	// 反序列化 JSON
 	session := &SessionValue{}
-	err = json.Unmarshal([]byte(s), session)
+	err = json.Unmarshal(b, session)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal session: %w", err)
 	}
 
 	// 规范化会话状态（使用工具类）
-	normalizedSession := a.sessionNormalizer.Normalize(session)
+	normalizedSession := a.normalizeSession(session)
 	return normalizedSession, nil
 }
 
 // SetShortMemory 设置短期记忆
-// 将会话状态保存到 Redis
+// 将会话状态保存到短期记忆存储
 //
 // 参数:
 //   - conversationId: 会话ID
@@ -304,22 +314,19 @@ func (a *AgentApp) GetShortMemory(conversationId string) (*SessionValue, error)
 //
 // 注意事项:
 //   - 会话状态会先进行规范化处理
-//   - 自动更新 UpdatedAt 时间戳
+//   - 自动更新 UpdatedAt 时间戳，版本号由存储在写入时加1，忽略 session 中的版本号
 //   - 自动刷新过期时间
+//   - 直接覆盖整个会话，会丢失读取后其他智能体的修改，修改部分字段时使用 UpdateShortMemory
 func (a *AgentApp) SetShortMemory(conversationId string, session *SessionValue) error {
-	// 获取 Redis 客户端
-	client, err := a.GetRedisClient()
-	if err != nil {
-		return fmt.Errorf("failed to get redis client: %w", err)
-	}
-
-	// 生成 Redis Key
-	key := fmt.Sprintf(a.memoryConfig.RedisKeyPrefix, conversationId)
+	return a.SetShortMemoryCtx(context.Background(), conversationId, session)
+}
 
+// SetShortMemoryCtx 设置短期记忆，ctx结束时取消写入
+func (a *AgentApp) SetShortMemoryCtx(ctx context.Context, conversationId string, session *SessionValue) error {
 	// 规范化会话状态（使用工具类）
-	session = a.sessionNormalizer.Normalize(session)
+	session = a.normalizeSession(session)
 
-	// 更新元信息
+	// 更新元信息，版本号由存储在写入时加1
 	session.Meta.ConversationID = conversationId
 	session.Meta.UpdatedAt = time.Now().Unix()
 
@@ -329,6 +336,11 @@ func (a *AgentApp) SetShortMemory(conversationId string, session *SessionValue)
 		return fmt.Errorf("failed to marshal session: %w", err)
 	}
 
-	// 存储到 Redis
-	return client.Set(key, string(b), a.memoryConfig.RedisExpiration)
+	// 存储
+	err = a.shortMemory.Set(ctx, conversationId, b, a.shortMemoryTTL())
+	logCanceled(ctx, "SetShortMemory", err)
+	if err == nil {
+		a.trackSession(ctx, conversationId)
+	}
+	return err
 }
@@ -0,0 +1,196 @@
+package powerai
+
+import (
+	"context"
+	"fmt"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/redis"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xstore"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	短期记忆存储
+//	默认使用 redis，key 格式为 MemoryConfig.RedisKeyPrefix
+//	WithInMemoryShortMemory 使用进程内存储，单元测试中不需要 redis；会话只在本实例可见，
+//	此时会话锁只有本地锁，会话过期事件（idle_expiring/expired）不触发
+//
+// ***************************************************************************************************************
+
+// ErrShortMemoryNotFound 会话不存在或已过期
+var ErrShortMemoryNotFound = xstore.ErrNotFound
+
+// ShortMemoryStore 短期记忆存储，value 为 SessionValue 的 JSON
+type ShortMemoryStore interface {
+	// Get 读取会话，不存在返回 ErrShortMemoryNotFound
+	Get(ctx context.Context, conversationId string) ([]byte, error)
+	// Exists 会话是否存在
+	Exists(ctx context.Context, conversationId string) (bool, error)
+	// Set 写入会话，meta.version 由存储设置为已保存的版本加1（不存在时为1），ttl<=0 表示不过期
+	Set(ctx context.Context, conversationId string, value []byte, ttl time.Duration) error
+	// SetNX 会话不存在时写入，返回是否写入
+	SetNX(ctx context.Context, conversationId string, value []byte, ttl time.Duration) (bool, error)
+	// CompareAndSet 已保存会话的 meta.version 等于 version（会话不存在时视为0）时写入，返回是否写入
+	// 写入的 meta.version 由存储设置为 version+1
+	CompareAndSet(ctx context.Context, conversationId string, value []byte, version int64, ttl time.Duration) (bool, error)
+	// TTL 会话剩余有效期，不过期返回 -1，不存在返回 ErrShortMemoryNotFound
+	TTL(ctx context.Context, conversationId string) (time.Duration, error)
+	// Delete 删除会话
+	Delete(ctx context.Context, conversationIds ...string) error
+}
+
+// NewInMemoryShortMemoryStore 创建进程内的短期记忆存储
+func NewInMemoryShortMemoryStore() ShortMemoryStore {
+	return xstore.NewMemoryStore()
+}
+
+// writeSessionScript 写入会话，meta.version 设置为已保存的版本加1，返回写入的版本，版本不一致时返回0
+// KEYS[1] 会话key，ARGV[1] 会话JSON，ARGV[2] 读取时的版本（-1 表示不比较），ARGV[3] 过期时间（秒）
+// 可选 KEYS[2] 会话锁的 token key，ARGV[4] 持有会话锁的 fencing token，token key 的当前值不等于 ARGV[4] 时返回-1
+// 只替换 ARGV[1] 中 meta 对象的 version，不重新编码JSON（cjson 会把空数组编码为对象）
+const writeSessionScript = `if #KEYS > 1 and redis.call('get', KEYS[2]) ~= ARGV[4] then
+	return -1
+end
+local cur = redis.call('get', KEYS[1])
+local version = 0
+if cur then
+	local ok, s = pcall(cjson.decode, cur)
+	if ok and type(s) == 'table' and type(s['meta']) == 'table' and tonumber(s['meta']['version']) then
+		version = tonumber(s['meta']['version'])
+	end
+end
+local expected = tonumber(ARGV[2])
+if expected >= 0 and version ~= expected then
+	return 0
+end
+local value = string.gsub(ARGV[1], '("meta"%s*:%s*{.-"version"%s*:%s*)%-?%d+', '%1' .. string.format('%d', version + 1), 1)
+if tonumber(ARGV[3]) > 0 then
+	redis.call('set', KEYS[1], value, 'EX', ARGV[3])
+else
+	redis.call('set', KEYS[1], value)
+end
+return version + 1`
+
+// redisShortMemoryStore 使用 redis 的短期记忆存储
+type redisShortMemoryStore struct {
+	client    func() (*redis_mw.Redis, error)
+	keyPrefix string
+}
+
+func (s *redisShortMemoryStore) key(conversationId string) string {
+	return fmt.Sprintf(s.keyPrefix, conversationId)
+}
+
+func (s *redisShortMemoryStore) Get(ctx context.Context, conversationId string) ([]byte, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get redis client: %w", err)
+	}
+	v, err := client.GetCtx(ctx, s.key(conversationId))
+	if err != nil {
+		if redis_mw.IsNil(err) {
+			return nil, fmt.Errorf("%w: %w", ErrShortMemoryNotFound, err)
+		}
+		return nil, err
+	}
+	return []byte(v), nil
+}
+
+func (s *redisShortMemoryStore) Exists(_ context.Context, conversationId string) (bool, error) {
+	client, err := s.client()
+	if err != nil {
+		return false, fmt.Errorf("failed to get redis client: %w", err)
+	}
+	n, err := client.Exists(s.key(conversationId))
+	return n > 0, err
+}
+
+func (s *redisShortMemoryStore) Set(ctx context.Context, conversationId string, value []byte, ttl time.Duration) error {
+	client, err := s.client()
+	if err != nil {
+		return fmt.Errorf("failed to get redis client: %w", err)
+	}
+	_, err = client.EvalCtx(ctx, writeSessionScript, []string{s.key(conversationId)}, string(value), -1, int64(ttl/time.Second))
+	return err
+}
+
+func (s *redisShortMemoryStore) SetNX(_ context.Context, conversationId string, value []byte, ttl time.Duration) (bool, error) {
+	client, err := s.client()
+	if err != nil {
+		return false, fmt.Errorf("failed to get redis client: %w", err)
+	}
+	return client.SetNX(s.key(conversationId), string(value), int64(ttl/time.Second))
+}
+
+func (s *redisShortMemoryStore) CompareAndSet(ctx context.Context, conversationId string, value []byte, version int64, ttl time.Duration) (bool, error) {
+	return s.compareAndSet(ctx, conversationId, value, version, ttl, "", 0)
+}
+
+// compareAndSet 同 CompareAndSet，token>0 时会话锁的 fencing token 已变化（锁已过期并被其他实例获得）则不写入，返回 ErrSessionLockLost
+func (s *redisShortMemoryStore) compareAndSet(ctx context.Context, conversationId string, value []byte, version int64, ttl time.Duration, fenceKey string, token int64) (bool, error) {
+	client, err := s.client()
+	if err != nil {
+		return false, fmt.Errorf("failed to get redis client: %w", err)
+	}
+	keys := []string{s.key(conversationId)}
+	args := []any{string(value), version, int64(ttl / time.Second)}
+	if token > 0 {
+		keys = append(keys, fenceKey)
+		args = append(args, token)
+	}
+	r, err := client.EvalCtx(ctx, writeSessionScript, keys, args...)
+	if err != nil {
+		return false, err
+	}
+	n, _ := r.(int64)
+	if n < 0 {
+		return false, fmt.Errorf("%w: conversation %s, token %d", ErrSessionLockLost, conversationId, token)
+	}
+	return n > 0, nil
+}
+
+func (s *redisShortMemoryStore) TTL(ctx context.Context, conversationId string) (time.Duration, error) {
+	client, err := s.client()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get redis client: %w", err)
+	}
+	r, err := client.EvalCtx(ctx, `return redis.call('ttl', KEYS[1])`, []string{s.key(conversationId)})
+	if err != nil {
+		return 0, err
+	}
+	switch ttl, _ := r.(int64); ttl {
+	case -2:
+		return 0, ErrShortMemoryNotFound
+	case -1:
+		return -1, nil
+	default:
+		return time.Duration(ttl) * time.Second, nil
+	}
+}
+
+func (s *redisShortMemoryStore) Delete(_ context.Context, conversationIds ...string) error {
+	if len(conversationIds) == 0 {
+		return nil
+	}
+	client, err := s.client()
+	if err != nil {
+		return fmt.Errorf("failed to get redis client: %w", err)
+	}
+	keys := make([]string, len(conversationIds))
+	for i, id := range conversationIds {
+		keys[i] = s.key(id)
+	}
+	_, err = client.Del(keys...)
+	return err
+}
+
+// redisShortMemory 短期记忆是否存储在 redis，会话过期事件和分布式会话锁依赖 redis
+func (a *AgentApp) redisShortMemory() bool {
+	_, ok := a.shortMemory.(*redisShortMemoryStore)
+	return ok
+}
+
+// shortMemoryTTL 短期记忆的过期时间
+func (a *AgentApp) shortMemoryTTL() time.Duration {
+	return time.Duration(a.memoryConfig.RedisExpiration) * time.Second
+}
@@ -0,0 +1,148 @@
+package powerai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xllm"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"reflect"
+	"regexp"
+)
+
+// ***************************************************************************************************************
+//
+//	结构化输出：要求大模型按 T 推导出的 JSON Schema 输出，解析为 T
+//	模型配置了 response_format 时通过请求参数约束输出，否则只在提示词中给出 schema
+//	输出不合法时把错误反馈给模型重新生成，最多 StructuredMaxRepairs 次，仍失败返回 *StructuredOutputError
+//
+// ***************************************************************************************************************
+
+// StructuredMaxRepairs 输出不合法时最多让模型修正的次数
+const StructuredMaxRepairs = 1
+
+// StructuredValidator T 实现该接口时，schema 校验通过后还会调用 Validate 做业务校验
+type StructuredValidator interface {
+	Validate() error
+}
+
+// StructuredOutputError 模型输出无法解析为目标结构
+type StructuredOutputError struct {
+	Raw      string // 最后一次模型输出
+	Attempts int    // 调用模型的次数
+	Err      error  // 最后一次的解析或校验错误
+}
+
+func (e *StructuredOutputError) Error() string {
+	return fmt.Sprintf("大模型结构化输出不合法,尝试%d次,err: %v, raw: %s", e.Attempts, e.Err, e.Raw)
+}
+
+func (e *StructuredOutputError) Unwrap() error {
+	return e.Err
+}
+
+// CallLLMForStruct 调用系统llm模型，将回复解析为 T
+func CallLLMForStruct[T any](a *AgentApp, enterpriseId string, req *xllm.ChatRequest) (*T, error) {
+	return CallLLMForStructCtx[T](context.Background(), a, enterpriseId, req)
+}
+
+// CallLLMForStructCtx 调用系统llm模型，将回复解析为 T，ctx结束时取消请求
+// req 不会被修改，提示词中无需再描述输出格式
+//
+//	type Intent struct {
+//	    Intent string `json:"intent" description:"用户意图" enum:"consult,book"`
+//	    Name   string `json:"name,omitempty" description:"医生姓名"`
+//	}
+//	intent, err := powerai.CallLLMForStructCtx[Intent](ctx, app, req.EnterpriseId, xllm.NewPromptRequest(prompt))
+func CallLLMForStructCtx[T any](ctx context.Context, a *AgentApp, enterpriseId string, req *xllm.ChatRequest) (*T, error) {
+	c, err := a.GetSystemLlmConfig(enterpriseId)
+	if err != nil {
+		return nil, err
+	}
+
+	var zero T
+	schema := xllm.SchemaOf(zero)
+	r := req.Clone()
+	switch c.ResponseFormat {
+	case xllm.ResponseFormatJSONSchema:
+		r.ResponseFormat = &xllm.ResponseFormat{
+			Type:       xllm.ResponseFormatJSONSchema,
+			JSONSchema: &xllm.JSONSchema{Name: schemaName(reflect.TypeOf(zero)), Schema: schema},
+		}
+	case xllm.ResponseFormatJSONObject:
+		r.ResponseFormat = &xllm.ResponseFormat{Type: xllm.ResponseFormatJSONObject}
+	}
+	r.Messages = withSchemaInstruction(r.Messages,
+		fmt.Sprintf("请只输出符合以下 JSON Schema 的 JSON，不要输出其他内容：\n%s", schema))
+
+	var raw string
+	for attempt := 1; ; attempt++ {
+		resp, err := a.ChatCtx(ctx, enterpriseId, r)
+		if err != nil {
+			return nil, err
+		}
+		raw = resp.Content()
+		v, err := parseStruct[T](raw, schema)
+		if err == nil {
+			return v, nil
+		}
+		if attempt > StructuredMaxRepairs {
+			return nil, &StructuredOutputError{Raw: raw, Attempts: attempt, Err: err}
+		}
+		xlog.LogInfoF(server.SysTrackCode(ctx), "structured", "repair", fmt.Sprintf("大模型输出不合法,第%d次修正,原因：%v", attempt, err))
+		r.Messages = append(r.Messages,
+			xllm.AssistantMessage(raw),
+			xllm.UserMessage(fmt.Sprintf("上面的输出不合法：%v。请修正后重新输出，只输出 JSON。", err)),
+		)
+	}
+}
+
+// withSchemaInstruction 把输出格式说明合并到开头的系统消息，没有系统消息时在最前面插入
+// 部分模型的对话模板（如 ChatML）只接受第一条消息为系统消息
+func withSchemaInstruction(messages []xllm.Message, instruction string) []xllm.Message {
+	if len(messages) > 0 && messages[0].Role == xllm.RoleSystem {
+		messages[0].Content = messages[0].Content + "\n\n" + instruction
+		return messages
+	}
+	return append([]xllm.Message{xllm.SystemMessage(instruction)}, messages...)
+}
+
+// parseStruct 提取、校验并解析模型输出
+func parseStruct[T any](raw string, schema xllm.Schema) (*T, error) {
+	text := xllm.ExtractJSON(raw)
+	var generic any
+	if err := json.Unmarshal([]byte(text), &generic); err != nil {
+		return nil, fmt.Errorf("不是合法的JSON: %w", err)
+	}
+	if err := schema.Validate(generic); err != nil {
+		return nil, err
+	}
+	v := new(T)
+	if err := json.Unmarshal([]byte(text), v); err != nil {
+		return nil, fmt.Errorf("解析JSON失败: %w", err)
+	}
+	if validator, ok := any(v).(StructuredValidator); ok {
+		if err := validator.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+var schemaNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// schemaName response_format 中的 schema 名称，只能包含字母、数字、下划线和中划线
+func schemaName(t reflect.Type) string {
+	if t == nil {
+		return "result"
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	name := schemaNameInvalid.ReplaceAllString(t.Name(), "_")
+	if name == "" {
+		return "result"
+	}
+	return name
+}
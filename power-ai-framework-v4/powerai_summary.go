@@ -0,0 +1,157 @@
+package powerai
+
+import (
+	"context"
+	"fmt"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xllm"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xuid"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	自动摘要（WithAutoSummary 开启）
+//	QueryMemoryContext 判断需要摘要时，异步调用系统llm模型对 FullHistory 生成摘要并调用 CheckpointShortMemory
+//	同一会话同时只有一个摘要任务，摘要期间再次触发直接忽略；短期记忆在 redis 时通过
+//	short_term_memory:summary:{会话ID}（有效期为 summaryTimeout）在智能体的实例之间去重
+//	提示词配置: /agent/config/_general_config_/智能体代码/企业ID/memory-summary-prompt
+//	value 中的 {{history}} 替换为对话历史，不包含占位符时对话历史追加在提示词之后，未配置使用 defaultSummaryPrompt
+//
+// ***************************************************************************************************************
+
+// summaryHistoryPlaceholder 摘要提示词中对话历史的占位符
+const summaryHistoryPlaceholder = "{{history}}"
+
+// summaryTimeout 单次摘要的最长时间
+const summaryTimeout = 2 * time.Minute
+
+// summaryRunningKey 多实例之间的摘要任务去重
+const summaryRunningKey = "short_term_memory:summary:%s"
+
+// releaseSummaryScript 只删除自己写入的去重key
+const releaseSummaryScript = `if redis.call('get', KEYS[1]) == ARGV[1] then
+	return redis.call('del', KEYS[1])
+end
+return 0`
+
+const defaultSummaryPrompt = `请将以下医疗对话压缩成短期记忆摘要，要求：
+1) 保留核心症状、持续时间、就诊目标、关键医生/科室信息；
+2) 保留过敏史/慢病/禁忌等安全信息；
+3) 只输出摘要正文，不输出JSON。
+
+对话：
+{{history}}`
+
+type memorySummarizer struct {
+	running sync.Map // conversationID -> struct{}
+	wg      sync.WaitGroup
+}
+
+func newMemorySummarizer() *memorySummarizer {
+	return &memorySummarizer{}
+}
+
+// triggerSummary 提交会话的摘要任务，会话已有摘要任务在执行时不重复提交
+func (a *AgentApp) triggerSummary(enterpriseId, conversationID, history string, recentTurns int) {
+	s := a.summarizer
+	if _, loaded := s.running.LoadOrStore(conversationID, struct{}{}); loaded {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.running.Delete(conversationID)
+		defer func() {
+			if r := recover(); r != nil {
+				xlog.LogErrorF("10000", "memory", "auto-summary", fmt.Sprintf("会话[%s]自动摘要异常", conversationID), fmt.Errorf("%v", r))
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), summaryTimeout)
+		defer cancel()
+		release, ok := a.acquireSummary(conversationID)
+		if !ok {
+			return
+		}
+		defer release()
+		if err := a.summarize(ctx, enterpriseId, conversationID, history, recentTurns); err != nil {
+			xlog.LogErrorF("10000", "memory", "auto-summary", fmt.Sprintf("会话[%s]自动摘要失败", conversationID), err)
+		}
+	}()
+}
+
+// acquireSummary 短期记忆在 redis 时抢占会话的摘要任务，其他实例正在摘要或 redis 不可用时返回 false
+func (a *AgentApp) acquireSummary(conversationID string) (func(), bool) {
+	if !a.redisShortMemory() {
+		return func() {}, true
+	}
+	client, err := a.GetRedisClient()
+	if err != nil {
+		xlog.LogErrorF("10000", "memory", "auto-summary", fmt.Sprintf("会话[%s]获取redis客户端失败,跳过自动摘要", conversationID), err)
+		return nil, false
+	}
+	key, owner := fmt.Sprintf(summaryRunningKey, conversationID), xuid.UUID()
+	ok, err := client.SetNX(key, owner, int64(summaryTimeout/time.Second))
+	if err != nil {
+		xlog.LogErrorF("10000", "memory", "auto-summary", fmt.Sprintf("会话[%s]摘要任务去重失败,跳过自动摘要", conversationID), err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	return func() {
+		if _, err := client.EvalCtx(context.Background(), releaseSummaryScript, []string{key}, owner); err != nil {
+			xlog.LogErrorF("10000", "memory", "auto-summary", fmt.Sprintf("会话[%s]释放摘要任务失败,等待过期", conversationID), err)
+		}
+	}, true
+}
+
+// summarize 生成摘要并创建 checkpoint，CheckpointShortMemory 内部持有会话锁
+func (a *AgentApp) summarize(ctx context.Context, enterpriseId, conversationID, history string, recentTurns int) error {
+	history = strings.TrimSpace(history)
+	if history == "" {
+		return nil
+	}
+	resp, err := a.ChatCtx(ctx, enterpriseId, xllm.NewPromptRequest(a.summaryPrompt(enterpriseId, history)))
+	if err != nil {
+		return err
+	}
+	_, summary := xllm.SplitThink(resp.Content())
+	summary = strings.TrimSpace(summary)
+	if summary == "" {
+		return fmt.Errorf("大模型返回的摘要为空")
+	}
+	if err = a.CheckpointShortMemory(conversationID, summary, recentTurns); err != nil {
+		return err
+	}
+	xlog.LogInfoF("10000", "memory", "auto-summary", fmt.Sprintf("会话[%s]自动摘要完成,摘要长度%d", conversationID, len([]rune(summary))))
+	return nil
+}
+
+// summaryPrompt 读取摘要提示词并填入对话历史
+func (a *AgentApp) summaryPrompt(enterpriseId, history string) string {
+	prompt := defaultSummaryPrompt
+	if c := a.GetAgentConfig(MemorySummaryPromptKey, enterpriseId); c != nil && strings.TrimSpace(c.Value) != "" {
+		prompt = c.Value
+	}
+	if strings.Contains(prompt, summaryHistoryPlaceholder) {
+		return strings.ReplaceAll(prompt, summaryHistoryPlaceholder, history)
+	}
+	return prompt + "\n\n" + history
+}
+
+// waitSummaries 停机时等待执行中的摘要任务结束
+func (a *AgentApp) waitSummaries(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		a.summarizer.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		xlog.LogErrorF("10000", "memory", "auto-summary", "停机时等待自动摘要超时", ctx.Err())
+	}
+}
@@ -0,0 +1,448 @@
+package powerai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xllm"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// ***************************************************************************************************************
+//
+//	工具调用（function calling）
+//	智能体注册工具后，RunToolsCtx 将工具作为 OpenAI tools 传给大模型，执行模型返回的工具调用并把结果回传给模型，
+//	直到模型给出最终回复或达到最大步数
+//	工具执行方式：本地函数、调用其他智能体（CallAgentProxy）、sendbox 执行lua脚本
+//	需要用户确认的工具不会立即执行，而是挂起到短期记忆的 GlobalState.PendingAction，
+//	用户在下一轮确认后执行，拒绝或转而提出其他问题时取消
+//	模型一次返回多个工具调用且其中有需要确认的工具时，整批都不执行，模型在确认后重新调用其他工具
+//
+// ***************************************************************************************************************
+
+const (
+	// PendingReasonConfirm 挂起原因：等待用户确认
+	PendingReasonConfirm = "waiting_for_user_confirmation"
+
+	ConfirmUnknown  = 0 // 无法判断用户是否确认
+	ConfirmAccepted = 1 // 用户确认
+	ConfirmRejected = 2 // 用户拒绝
+)
+
+// ToolHandler 本地工具函数
+// args 为模型生成的参数，返回值作为工具结果回传给模型
+type ToolHandler func(ctx context.Context, req *server.AgentRequest, args map[string]interface{}) (string, error)
+
+// Tool 可供大模型调用的工具
+// Handler、AgentCode、ScriptId 三者只能设置一个，分别对应本地函数、调用其他智能体、sendbox 执行lua脚本
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  any // 参数的 JSON Schema，为空表示没有参数
+
+	Handler    ToolHandler
+	AgentCode  string // 目标智能体编号，参数作为 AgentRequest.Inputs 传递
+	MethodName string // 目标智能体的方法名
+	ScriptId   string // sendbox 脚本ID，参数作为脚本的 params 传递
+
+	Confirm        bool                                     // 执行前是否需要用户确认
+	ConfirmMessage func(args map[string]interface{}) string // 需要确认时回复用户的提示，为空使用默认提示
+}
+
+// NewLocalTool 本地函数工具
+func NewLocalTool(name, description string, parameters any, handler ToolHandler) *Tool {
+	return &Tool{Name: name, Description: description, Parameters: parameters, Handler: handler}
+}
+
+// NewAgentTool 调用其他智能体的工具
+func NewAgentTool(name, description string, parameters any, agentCode, methodName string) *Tool {
+	return &Tool{Name: name, Description: description, Parameters: parameters, AgentCode: agentCode, MethodName: methodName}
+}
+
+// NewSendBoxTool sendbox 执行lua脚本的工具
+func NewSendBoxTool(name, description string, parameters any, scriptId string) *Tool {
+	return &Tool{Name: name, Description: description, Parameters: parameters, ScriptId: scriptId}
+}
+
+// WithConfirm 设置工具执行前需要用户确认，message 为空使用默认提示
+func (t *Tool) WithConfirm(message func(args map[string]interface{}) string) *Tool {
+	t.Confirm = true
+	t.ConfirmMessage = message
+	return t
+}
+
+func (t *Tool) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("工具名称不能为空")
+	}
+	n := 0
+	if t.Handler != nil {
+		n++
+	}
+	if t.AgentCode != "" {
+		n++
+	}
+	if t.ScriptId != "" {
+		n++
+	}
+	if n != 1 {
+		return fmt.Errorf("工具[%s]的 Handler、AgentCode、ScriptId 必须且只能设置一个", t.Name)
+	}
+	if t.AgentCode != "" && t.MethodName == "" {
+		return fmt.Errorf("工具[%s]的 MethodName 不能为空", t.Name)
+	}
+	return nil
+}
+
+func (t *Tool) definition() xllm.Tool {
+	params := t.Parameters
+	if params == nil {
+		params = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+	}
+	return xllm.FunctionTool(t.Name, t.Description, params)
+}
+
+func (t *Tool) confirmMessage(args map[string]interface{}) string {
+	if t.ConfirmMessage != nil {
+		return t.ConfirmMessage(args)
+	}
+	return fmt.Sprintf("即将执行[%s]，请确认是否继续？", t.Name)
+}
+
+type toolRegistry struct {
+	mu    sync.RWMutex
+	tools map[string]*Tool
+}
+
+func newToolRegistry() *toolRegistry {
+	return &toolRegistry{tools: make(map[string]*Tool)}
+}
+
+func (r *toolRegistry) register(t *Tool) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tools[t.Name] = t
+	return nil
+}
+
+func (r *toolRegistry) get(name string) (*Tool, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.tools[name]
+	return t, ok
+}
+
+// definitions 所有工具的定义，按名称排序保证请求稳定
+func (r *toolRegistry) definitions() []xllm.Tool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.tools))
+	for name := range r.tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	defs := make([]xllm.Tool, 0, len(names))
+	for _, name := range names {
+		defs = append(defs, r.tools[name].definition())
+	}
+	return defs
+}
+
+// RegisterTool 注册工具，同名工具会被覆盖
+func (a *AgentApp) RegisterTool(t *Tool) error {
+	return a.toolRegistry.register(t)
+}
+
+// ToolResult RunToolsCtx 的执行结果
+type ToolResult struct {
+	Content  string         // 回复用户的内容，挂起时为确认提示
+	Messages []xllm.Message // 本轮新增的消息，包括工具调用、工具结果和最终回复
+	Pending  *PendingAction // 不为空表示有工具挂起等待用户确认
+	Steps    int            // 调用大模型的次数
+}
+
+// RunTools 使用已注册的工具进行对话
+func (a *AgentApp) RunTools(req *server.AgentRequest, chat *xllm.ChatRequest) (*ToolResult, error) {
+	return a.RunToolsCtx(context.Background(), req, chat)
+}
+
+// RunToolsCtx 使用已注册的工具进行对话，ctx结束时取消请求
+// chat 为本轮的对话请求（系统提示词、历史消息和用户消息），不会被修改
+// req.ConversationId 不为空时，会从短期记忆中恢复挂起的工具：用户确认则执行，否则取消
+func (a *AgentApp) RunToolsCtx(ctx context.Context, req *server.AgentRequest, chat *xllm.ChatRequest) (*ToolResult, error) {
+	r := chat.Clone()
+	result := &ToolResult{}
+
+	var session *SessionValue
+	if req.ConversationId != "" {
+		s, err := a.GetShortMemoryCtx(ctx, req.ConversationId)
+		if err != nil {
+			xlog.LogErrorF(req.SysTrackCode, "tool", "session", "获取短期记忆失败,无法处理挂起的工具", err)
+		} else {
+			session = s
+		}
+	}
+	if session != nil && session.GlobalState.PendingAction != nil {
+		msgs, err := a.resumePendingAction(ctx, req, session)
+		if err != nil {
+			return nil, err
+		}
+		r.Messages = append(r.Messages, msgs...)
+		result.Messages = append(result.Messages, msgs...)
+	}
+
+	maxSteps := a.toolMaxSteps
+	for step := 1; ; step++ {
+		r.Tools = a.toolRegistry.definitions()
+		if step >= maxSteps {
+			// 达到最大步数，要求模型直接回复
+			r.ToolChoice = "none"
+		}
+		resp, err := a.ChatCtx(ctx, req.EnterpriseId, r)
+		result.Steps = step
+		if err != nil {
+			return nil, err
+		}
+		msg := resp.Message()
+		msg.Role = xllm.RoleAssistant
+		r.Messages = append(r.Messages, msg)
+		result.Messages = append(result.Messages, msg)
+		if len(msg.ToolCalls) == 0 || step >= maxSteps {
+			result.Content = strings.TrimSpace(msg.Content)
+			return result, nil
+		}
+
+		// 同一批工具调用中有需要确认的工具时，整批都不执行，每个调用都回传结果，保证对话记录完整
+		if pending := a.pendingToolCall(msg.ToolCalls); pending != nil {
+			for _, call := range msg.ToolCalls {
+				content := fmt.Sprintf("未执行：需要用户先确认工具[%s]的调用", pending.ToolName)
+				if call.ID == pending.ToolCallID {
+					content = "等待用户确认"
+				}
+				result.Messages = append(result.Messages, xllm.ToolMessage(call.ID, content))
+			}
+			t, _ := a.toolRegistry.get(pending.ToolName)
+			result.Pending = pending
+			result.Content = t.confirmMessage(pending.ToolParams)
+			result.Messages = append(result.Messages, xllm.AssistantMessage(result.Content))
+			a.savePendingAction(ctx, req, session, result.Pending)
+			return result, nil
+		}
+		for _, call := range msg.ToolCalls {
+			t, args, err := a.parseToolCall(call)
+			var content string
+			if err == nil {
+				content, err = a.executeTool(ctx, req, t, args)
+			}
+			if err != nil {
+				xlog.LogErrorF(req.SysTrackCode, "tool", "execute", fmt.Sprintf("执行工具[%s]失败", call.Function.Name), err)
+				content = fmt.Sprintf("工具执行失败: %v", err)
+			}
+			toolMsg := xllm.ToolMessage(call.ID, content)
+			r.Messages = append(r.Messages, toolMsg)
+			result.Messages = append(result.Messages, toolMsg)
+		}
+	}
+}
+
+// pendingToolCall 一批工具调用中第一个需要用户确认的调用，没有时返回 nil
+func (a *AgentApp) pendingToolCall(calls []xllm.ToolCall) *PendingAction {
+	for _, call := range calls {
+		if t, args, err := a.parseToolCall(call); err == nil && t.Confirm {
+			return &PendingAction{
+				ToolName:   t.Name,
+				ToolParams: args,
+				Reason:     PendingReasonConfirm,
+				ToolCallID: call.ID,
+			}
+		}
+	}
+	return nil
+}
+
+// resumePendingAction 处理上一轮挂起的工具，返回需要追加到对话中的工具调用和结果消息
+func (a *AgentApp) resumePendingAction(ctx context.Context, req *server.AgentRequest, session *SessionValue) ([]xllm.Message, error) {
+	pending := session.GlobalState.PendingAction
+	if pending.Reason != PendingReasonConfirm {
+		return nil, nil
+	}
+	t, ok := a.toolRegistry.get(pending.ToolName)
+	if !ok {
+		return nil, nil
+	}
+
+	// 无论结果如何，挂起的工具只处理一次
+	session.GlobalState.PendingAction = nil
+	err := a.UpdateShortMemoryCtx(ctx, req.ConversationId, func(s *SessionValue) error {
+		s.GlobalState.PendingAction = nil
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("清除挂起的工具失败: %w", err)
+	}
+
+	var content string
+	switch ParseConfirmation(req.Query) {
+	case ConfirmAccepted:
+		xlog.LogInfoF(req.SysTrackCode, "tool", "confirm", fmt.Sprintf("用户确认执行工具[%s]", t.Name))
+		r, err := a.executeTool(ctx, req, t, pending.ToolParams)
+		if err != nil {
+			xlog.LogErrorF(req.SysTrackCode, "tool", "execute", fmt.Sprintf("执行工具[%s]失败", t.Name), err)
+			r = fmt.Sprintf("工具执行失败: %v", err)
+		}
+		content = r
+	case ConfirmRejected:
+		xlog.LogInfoF(req.SysTrackCode, "tool", "confirm", fmt.Sprintf("用户拒绝执行工具[%s]", t.Name))
+		content = "用户拒绝执行该操作，操作已取消"
+	default:
+		// 用户没有明确答复，视为放弃该操作，按新的问题处理
+		xlog.LogInfoF(req.SysTrackCode, "tool", "confirm", fmt.Sprintf("用户未确认,取消工具[%s]", t.Name))
+		return nil, nil
+	}
+
+	// 挂起时原调用已回传“等待用户确认”，确认后的执行使用新的调用ID
+	callID := "confirmed_" + pending.ToolCallID
+	if pending.ToolCallID == "" {
+		callID = "pending_" + t.Name
+	}
+	b, _ := json.Marshal(pending.ToolParams)
+	return []xllm.Message{
+		{
+			Role: xllm.RoleAssistant,
+			ToolCalls: []xllm.ToolCall{{
+				ID:       callID,
+				Type:     "function",
+				Function: xllm.FunctionCall{Name: t.Name, Arguments: string(b)},
+			}},
+		},
+		xllm.ToolMessage(callID, content),
+	}, nil
+}
+
+// savePendingAction 挂起工具到短期记忆，没有会话时只通过返回值告知调用方
+func (a *AgentApp) savePendingAction(ctx context.Context, req *server.AgentRequest, session *SessionValue, pending *PendingAction) {
+	if session == nil {
+		xlog.LogInfoF(req.SysTrackCode, "tool", "pending", fmt.Sprintf("没有短期记忆,工具[%s]的挂起状态未保存", pending.ToolName))
+		return
+	}
+	session.GlobalState.PendingAction = pending
+	err := a.UpdateShortMemoryCtx(ctx, req.ConversationId, func(s *SessionValue) error {
+		s.GlobalState.PendingAction = pending
+		return nil
+	})
+	if err != nil {
+		xlog.LogErrorF(req.SysTrackCode, "tool", "pending", fmt.Sprintf("保存挂起的工具[%s]失败", pending.ToolName), err)
+	}
+}
+
+// parseToolCall 查找工具并解析参数
+func (a *AgentApp) parseToolCall(call xllm.ToolCall) (*Tool, map[string]interface{}, error) {
+	t, ok := a.toolRegistry.get(call.Function.Name)
+	if !ok {
+		return nil, nil, fmt.Errorf("工具[%s]不存在", call.Function.Name)
+	}
+	args := make(map[string]interface{})
+	if s := strings.TrimSpace(call.Function.Arguments); s != "" {
+		if err := json.Unmarshal([]byte(s), &args); err != nil {
+			return nil, nil, fmt.Errorf("工具[%s]的参数不是合法的JSON: %w", t.Name, err)
+		}
+	}
+	return t, args, nil
+}
+
+// executeTool 执行工具，本地函数发生 panic 时转换为错误
+func (a *AgentApp) executeTool(ctx context.Context, req *server.AgentRequest, t *Tool, args map[string]interface{}) (content string, err error) {
+	switch {
+	case t.Handler != nil:
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("工具[%s]执行异常: %v", t.Name, r)
+			}
+		}()
+		return t.Handler(ctx, req, args)
+	case t.AgentCode != "":
+		r := *req
+		r.MethodName = t.MethodName
+		r.Inputs = args
+		return a.CallAgentProxyCtx(ctx, t.AgentCode, &r)
+	default:
+		sbr, _, err := a.CallSendBox(req.SysTrackCode, a.Manifest.Code, req.EnterpriseId, t.ScriptId, args)
+		if err != nil {
+			return "", err
+		}
+		if sbr.Code != server.ResultSuccess.Code {
+			return "", fmt.Errorf("sendbox执行脚本[%s]失败,code: %s,message: %s", t.ScriptId, sbr.Code, sbr.Message)
+		}
+		return sbr.Data, nil
+	}
+}
+
+var (
+	confirmAcceptedWords = toWordSet("确认", "确定", "是的", "是", "好的", "好", "可以", "同意", "没问题", "行", "嗯", "对", "执行", "继续", "确认执行", "yes", "y", "ok", "okay", "sure")
+	confirmRejectedWords = toWordSet("不", "否", "取消", "算了", "不用", "不要", "拒绝", "不行", "不可以", "不同意", "不确认", "不是", "不对", "不好", "别", "no", "n", "nope", "cancel")
+)
+
+// confirmParticles 答复末尾的语气词，匹配时忽略
+const confirmParticles = "吧啊呀呢哦了的嘛"
+
+func toWordSet(words ...string) map[string]bool {
+	m := make(map[string]bool, len(words))
+	for _, w := range words {
+		m[w] = true
+	}
+	return m
+}
+
+// ParseConfirmation 判断用户对挂起操作的答复
+// 答复按标点和空格分段，每一段都必须是完整的确认词（可以带语气词，如“好吧”“嗯嗯”）才视为确认，
+// 任意一段是拒绝词视为拒绝；“是什么意思”等较长或包含其他内容的输入视为用户提出了新的问题
+func ParseConfirmation(query string) int {
+	q := strings.ToLower(strings.TrimSpace(query))
+	if q == "" || len([]rune(q)) > 10 {
+		return ConfirmUnknown
+	}
+	tokens := strings.FieldsFunc(q, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r) || r == '~'
+	})
+	if len(tokens) == 0 {
+		return ConfirmUnknown
+	}
+	accepted := true
+	for _, t := range tokens {
+		if matchConfirmWord(t, confirmRejectedWords) {
+			return ConfirmRejected
+		}
+		accepted = accepted && matchConfirmWord(t, confirmAcceptedWords)
+	}
+	if accepted {
+		return ConfirmAccepted
+	}
+	return ConfirmUnknown
+}
+
+// matchConfirmWord 整段匹配，忽略末尾的语气词和重复的单字（嗯嗯、好好）
+func matchConfirmWord(token string, words map[string]bool) bool {
+	if words[token] {
+		return true
+	}
+	rs := []rune(token)
+	for n := len(rs) - 1; n > 0 && strings.ContainsRune(confirmParticles, rs[n]); n-- {
+		if words[string(rs[:n])] {
+			return true
+		}
+	}
+	for _, r := range rs[1:] {
+		if r != rs[0] {
+			return false
+		}
+	}
+	return len(rs) > 1 && words[string(rs[0])]
+}
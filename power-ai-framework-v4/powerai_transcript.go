@@ -0,0 +1,445 @@
+package powerai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/pgsql"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xdatetime"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xuid"
+	"strings"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	会话记录导出与用户数据删除
+//	ExportTranscript 导出会话的全部消息（包括 checkpoint、inputs 和 extended_field 中的结构化数据），支持 JSON 和 Markdown
+//	EraseUserData 删除用户在企业下的全部数据：ai_conversation/ai_message/ai_message_file、短期记忆、长期记忆、
+//	消息引用的 minio 文件、召回集合中的摘要（WithMemoryRecall 开启时），并在 ai_erasure_audit 表记录删除操作
+//	WithTranscriptRoutes 注册 GET /{base}/transcript 和 POST /{base}/erase_user
+//
+// ***************************************************************************************************************
+
+// checkpointQuery CheckpointShortMemory 写入的 checkpoint 消息的 query
+const checkpointQuery = "[MEMORY_CHECKPOINT]"
+
+// 导出格式
+const (
+	TranscriptFormatJSON     = "json"
+	TranscriptFormatMarkdown = "markdown"
+)
+
+// 删除审计记录的状态
+const (
+	ErasureStatusDBErased  = "db_erased" // 数据库已删除，正在删除缓存和文件
+	ErasureStatusCompleted = "completed" // 全部删除
+	ErasureStatusPartial   = "partial"   // 部分短期记忆、文件或召回摘要删除失败，见 failed_items
+)
+
+const erasureAuditTableDDL = `CREATE TABLE IF NOT EXISTS ai_erasure_audit (
+	audit_id           varchar(64)  PRIMARY KEY,
+	enterprise_id      varchar(64)  NOT NULL,
+	user_id            varchar(128) NOT NULL,
+	patient_id         varchar(128),
+	operator           varchar(128),
+	reason             varchar(1024),
+	conversation_count integer      NOT NULL DEFAULT 0,
+	message_count      integer      NOT NULL DEFAULT 0,
+	fact_count         integer      NOT NULL DEFAULT 0,
+	file_count         integer      NOT NULL DEFAULT 0,
+	failed_items       text,
+	status             varchar(32)  NOT NULL,
+	agent_code         varchar(128),
+	create_time        timestamp,
+	update_time        timestamp
+)`
+
+// FileResolver 根据 file_id 解析 minio 上的桶和路径，ok 为 false 表示文件不在 minio 上
+type FileResolver func(ctx context.Context, enterpriseId, fileId string) (bucketName, bucketFilePath string, ok bool, err error)
+
+// defaultFileResolver file_id 为 "桶名称/路径" 格式时解析为 minio 文件
+func defaultFileResolver(_ context.Context, _, fileId string) (string, string, bool, error) {
+	bucket, path, found := strings.Cut(strings.TrimPrefix(fileId, "/"), "/")
+	if !found || bucket == "" || path == "" {
+		return "", "", false, nil
+	}
+	return bucket, path, true, nil
+}
+
+// Transcript 会话记录
+type Transcript struct {
+	ConversationID   string               `json:"conversation_id"`
+	ConversationName string               `json:"conversation_name"`
+	UserID           string               `json:"user_id"`
+	EnterpriseID     string               `json:"enterprise_id"`
+	Channel          string               `json:"channel"`
+	ChannelApp       string               `json:"channel_app"`
+	CreateTime       time.Time            `json:"create_time"`
+	ExportTime       time.Time            `json:"export_time"`
+	Messages         []*TranscriptMessage `json:"messages"`
+}
+
+// TranscriptMessage 会话记录中的一条消息，按时间升序
+type TranscriptMessage struct {
+	MessageID  string   `json:"message_id"`
+	Query      string   `json:"query"`
+	Answer     string   `json:"answer"`
+	AgentCode  string   `json:"agent_code,omitempty"`
+	Rating     string   `json:"rating,omitempty"`
+	Errors     string   `json:"errors,omitempty"`
+	FileIDs    []string `json:"file_ids,omitempty"`
+	Checkpoint bool     `json:"checkpoint"` // 记忆摘要，不是用户发送的消息
+	// Inputs/ExtendedField 为 JSON 时原样输出，否则输出为字符串
+	Inputs        json.RawMessage `json:"inputs,omitempty"`
+	ExtendedField json.RawMessage `json:"extended_field,omitempty"`
+	CreateTime    time.Time       `json:"create_time"`
+}
+
+// EraseUserRequest 用户数据删除请求
+type EraseUserRequest struct {
+	EnterpriseID string `json:"enterprise_id"`
+	UserID       string `json:"user_id"`
+	PatientID    string `json:"patient_id"` // 长期记忆的患者ID，为空时与 UserID 相同
+	Operator     string `json:"operator"`   // 操作人，写入审计记录
+	Reason       string `json:"reason"`     // 删除原因，写入审计记录
+}
+
+// EraseUserResult 用户数据删除结果
+type EraseUserResult struct {
+	AuditID       string   `json:"audit_id"`
+	Status        string   `json:"status"`
+	Conversations int      `json:"conversations"`
+	Messages      int      `json:"messages"`
+	Facts         int      `json:"facts"`
+	Files         int      `json:"files"`
+	FailedItems   []string `json:"failed_items,omitempty"` // 删除失败的短期记忆、文件和召回摘要
+}
+
+// ExportTranscript 导出会话记录
+func (a *AgentApp) ExportTranscript(conversationId string) (*Transcript, error) {
+	return a.ExportTranscriptCtx(context.Background(), conversationId)
+}
+
+// ExportTranscriptCtx 导出会话记录，ctx结束时取消查询
+func (a *AgentApp) ExportTranscriptCtx(ctx context.Context, conversationId string) (*Transcript, error) {
+	if conversationId == "" {
+		return nil, fmt.Errorf("conversationID不能为空")
+	}
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return nil, err
+	}
+	conv := &AIConversation{}
+	if err = client.QuerySingleCtx(ctx, conv, `select conversation_id,conversation_name,user_id,channel,channel_app,enterprise_id,create_time,update_time,extended_field from ai_conversation where conversation_id = $1`, conversationId); err != nil {
+		return nil, err
+	}
+	var messages []*AIMessage
+	if err = client.QueryMultipleCtx(ctx, &messages, `select message_id,conversation_id,query,answer,rating,inputs,errors,agent_code,file_id,create_time, update_time,extended_field from ai_message where conversation_id = $1 ORDER BY create_time ASC`, conversationId); err != nil {
+		return nil, err
+	}
+	var files []struct {
+		MessageID string `db:"message_id"`
+		FileID    string `db:"file_id"`
+	}
+	if err = client.QueryMultipleCtx(ctx, &files, `select message_id,file_id from ai_message_file where conversation_id = $1 ORDER BY create_time ASC`, conversationId); err != nil {
+		return nil, err
+	}
+	messageFiles := make(map[string][]string)
+	for _, f := range files {
+		messageFiles[f.MessageID] = append(messageFiles[f.MessageID], f.FileID)
+	}
+
+	t := &Transcript{
+		ConversationID:   conversationId,
+		ConversationName: conv.ConversationName.String,
+		UserID:           conv.UserID.String,
+		EnterpriseID:     conv.EnterpriseID.String,
+		Channel:          conv.Channel.String,
+		ChannelApp:       conv.ChannelApp.String,
+		CreateTime:       conv.CreateTime,
+		ExportTime:       time.Now(),
+		Messages:         make([]*TranscriptMessage, 0, len(messages)),
+	}
+	for _, m := range messages {
+		tm := &TranscriptMessage{
+			MessageID:     m.MessageID.String,
+			Query:         m.GetQuery(),
+			Answer:        m.GetAnswer(),
+			AgentCode:     m.AgentCode.String,
+			Rating:        m.Rating.String,
+			Errors:        m.Errors.String,
+			Checkpoint:    m.GetQuery() == checkpointQuery,
+			Inputs:        rawJSON(m.Inputs.String),
+			ExtendedField: rawJSON(m.ExtendedField.String),
+			CreateTime:    m.CreateTime,
+		}
+		if m.FileID.String != "" {
+			tm.FileIDs = append(tm.FileIDs, m.FileID.String)
+		}
+		tm.FileIDs = appendMissing(tm.FileIDs, messageFiles[tm.MessageID]...)
+		t.Messages = append(t.Messages, tm)
+	}
+	return t, nil
+}
+
+// Markdown 将会话记录转换为 Markdown
+func (t *Transcript) Markdown() string {
+	var sb strings.Builder
+	name := t.ConversationName
+	if name == "" {
+		name = t.ConversationID
+	}
+	sb.WriteString(fmt.Sprintf("# 会话记录：%s\n\n", name))
+	sb.WriteString(fmt.Sprintf("- 会话ID：%s\n", t.ConversationID))
+	sb.WriteString(fmt.Sprintf("- 用户ID：%s\n", t.UserID))
+	sb.WriteString(fmt.Sprintf("- 企业ID：%s\n", t.EnterpriseID))
+	if t.Channel != "" {
+		sb.WriteString(fmt.Sprintf("- 渠道：%s/%s\n", t.Channel, t.ChannelApp))
+	}
+	sb.WriteString(fmt.Sprintf("- 创建时间：%s\n", t.CreateTime.Format(time.DateTime)))
+	sb.WriteString(fmt.Sprintf("- 导出时间：%s\n", t.ExportTime.Format(time.DateTime)))
+
+	for _, m := range t.Messages {
+		if m.Checkpoint {
+			sb.WriteString(fmt.Sprintf("\n## %s 记忆摘要\n\n", m.CreateTime.Format(time.DateTime)))
+			for _, line := range strings.Split(m.Answer, "\n") {
+				sb.WriteString("> " + line + "\n")
+			}
+			continue
+		}
+		title := m.CreateTime.Format(time.DateTime)
+		if m.AgentCode != "" {
+			title += " · " + m.AgentCode
+		}
+		sb.WriteString(fmt.Sprintf("\n## %s\n\n", title))
+		sb.WriteString(fmt.Sprintf("**用户**：%s\n\n", m.Query))
+		if m.Answer != "" {
+			sb.WriteString(fmt.Sprintf("**助手**：%s\n\n", m.Answer))
+		}
+		if m.Errors != "" {
+			sb.WriteString(fmt.Sprintf("**错误**：%s\n\n", m.Errors))
+		}
+		if len(m.FileIDs) > 0 {
+			sb.WriteString(fmt.Sprintf("**附件**：%s\n\n", strings.Join(m.FileIDs, ", ")))
+		}
+		writeMarkdownJSON(&sb, "输入参数", m.Inputs)
+		writeMarkdownJSON(&sb, "结构化数据", m.ExtendedField)
+	}
+	return sb.String()
+}
+
+func writeMarkdownJSON(sb *strings.Builder, title string, raw json.RawMessage) {
+	if len(raw) == 0 {
+		return
+	}
+	b, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		b = raw
+	}
+	sb.WriteString(fmt.Sprintf("**%s**：\n\n```json\n%s\n```\n\n", title, b))
+}
+
+// EraseUserData 删除用户在企业下的全部数据
+// 数据库中的会话、消息、消息文件、长期记忆和审计记录在一个事务中写入，之后删除短期记忆和 minio 文件，
+// 短期记忆或文件删除失败时审计记录状态为 partial，可以根据 failed_items 重新处理
+func (a *AgentApp) EraseUserData(req *EraseUserRequest) (*EraseUserResult, error) {
+	return a.EraseUserDataCtx(context.Background(), req)
+}
+
+// EraseUserDataCtx 删除用户在企业下的全部数据，ctx结束时取消
+func (a *AgentApp) EraseUserDataCtx(ctx context.Context, req *EraseUserRequest) (*EraseUserResult, error) {
+	if req == nil || req.EnterpriseID == "" || req.UserID == "" {
+		return nil, fmt.Errorf("enterprise_id和user_id不能为空")
+	}
+	patientId := req.PatientID
+	if patientId == "" {
+		patientId = req.UserID
+	}
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return nil, err
+	}
+	if err = a.ensureErasureAuditTable(ctx); err != nil {
+		return nil, err
+	}
+	if err = a.ensurePatientMemoryTable(ctx); err != nil {
+		return nil, err
+	}
+
+	// 1.统计要删除的数据
+	var conversationIds []string
+	if err = client.QueryMultipleCtx(ctx, &conversationIds, `select conversation_id from ai_conversation where enterprise_id = $1 and user_id = $2`, req.EnterpriseID, req.UserID); err != nil {
+		return nil, err
+	}
+	result := &EraseUserResult{AuditID: xuid.UUID(), Conversations: len(conversationIds)}
+	var fileIds []string
+	for _, id := range conversationIds {
+		var count int
+		if err = client.QuerySingleCtx(ctx, &count, `select count(*) from ai_message where conversation_id = $1`, id); err != nil {
+			return nil, err
+		}
+		result.Messages += count
+		var ids []string
+		if err = client.QueryMultipleCtx(ctx, &ids, `select file_id from ai_message where conversation_id = $1 and file_id is not null and file_id <> ''
+			union select file_id from ai_message_file where conversation_id = $1 and file_id is not null and file_id <> ''`, id); err != nil {
+			return nil, err
+		}
+		fileIds = appendMissing(fileIds, ids...)
+	}
+	if err = client.QuerySingleCtx(ctx, &result.Facts, `select count(*) from ai_patient_memory where enterprise_id = $1 and patient_id = $2`, req.EnterpriseID, patientId); err != nil {
+		return nil, err
+	}
+	result.Files = len(fileIds)
+
+	// 2.删除数据库中的数据并写入审计记录
+	now := xdatetime.GetNowDateTime()
+	sqls := []*pgsql_mw.TransactionSql{{
+		SqlStatement: `INSERT INTO ai_erasure_audit (audit_id,enterprise_id,user_id,patient_id,operator,reason,conversation_count,message_count,fact_count,file_count,status,agent_code,create_time,update_time)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$13)`,
+		Args: []any{result.AuditID, req.EnterpriseID, req.UserID, patientId, req.Operator, req.Reason,
+			result.Conversations, result.Messages, result.Facts, result.Files, ErasureStatusDBErased, a.Manifest.Code, now},
+	}, {
+		SqlStatement: `DELETE FROM ai_patient_memory WHERE enterprise_id = $1 AND patient_id = $2`,
+		Args:         []any{req.EnterpriseID, patientId},
+	}}
+	for _, id := range conversationIds {
+		sqls = append(sqls,
+			&pgsql_mw.TransactionSql{SqlStatement: `DELETE FROM ai_message_file WHERE conversation_id = $1`, Args: []any{id}},
+			&pgsql_mw.TransactionSql{SqlStatement: `DELETE FROM ai_message WHERE conversation_id = $1`, Args: []any{id}},
+			&pgsql_mw.TransactionSql{SqlStatement: `DELETE FROM ai_conversation WHERE conversation_id = $1`, Args: []any{id}},
+		)
+	}
+	if err = client.BatchExecTransactionCtx(ctx, sqls); err != nil {
+		return nil, fmt.Errorf("删除企业[%s]用户[%s]的数据失败: %w", req.EnterpriseID, req.UserID, err)
+	}
+
+	// 3.删除短期记忆、文件和召回摘要
+	for _, id := range conversationIds {
+		if err = a.shortMemory.Delete(ctx, id); err != nil {
+			xlog.LogErrorF("10000", "erasure", "short-memory", fmt.Sprintf("删除会话[%s]的短期记忆失败", id), err)
+			result.FailedItems = append(result.FailedItems, "short_memory:"+id)
+		}
+	}
+	for _, fileId := range fileIds {
+		if err = a.removeFile(ctx, req.EnterpriseID, fileId); err != nil {
+			xlog.LogErrorF("10000", "erasure", "file", fmt.Sprintf("删除文件[%s]失败", fileId), err)
+			result.FailedItems = append(result.FailedItems, "file:"+fileId)
+		}
+	}
+
+	if a.recall.enabled {
+		if err = a.eraseRecall(ctx, req.EnterpriseID, req.UserID); err != nil {
+			xlog.LogErrorF("10000", "erasure", "recall", fmt.Sprintf("删除用户[%s]的召回摘要失败", req.UserID), err)
+			result.FailedItems = append(result.FailedItems, "memory_recall:"+req.UserID)
+		}
+	}
+
+	// 4.更新审计记录
+	result.Status = ErasureStatusCompleted
+	if len(result.FailedItems) > 0 {
+		result.Status = ErasureStatusPartial
+	}
+	failed, _ := json.Marshal(result.FailedItems)
+	if _, err = client.ExecCtx(ctx, `UPDATE ai_erasure_audit SET status = $1, failed_items = $2, update_time = $3 WHERE audit_id = $4`,
+		result.Status, string(failed), xdatetime.GetNowDateTime(), result.AuditID); err != nil {
+		xlog.LogErrorF("10000", "erasure", "audit", fmt.Sprintf("更新删除审计记录[%s]失败", result.AuditID), err)
+	}
+	xlog.LogInfoF("10000", "erasure", "user", fmt.Sprintf("企业[%s],用户[%s],操作人[%s]删除数据,会话%d个,消息%d条,长期记忆%d条,文件%d个,状态[%s],审计ID[%s]",
+		req.EnterpriseID, req.UserID, req.Operator, result.Conversations, result.Messages, result.Facts, result.Files, result.Status, result.AuditID))
+	return result, nil
+}
+
+// removeFile 删除 file_id 引用的 minio 文件，不在 minio 上的文件忽略
+func (a *AgentApp) removeFile(ctx context.Context, enterpriseId, fileId string) error {
+	bucket, path, ok, err := a.fileResolver(ctx, enterpriseId, fileId)
+	if err != nil || !ok {
+		return err
+	}
+	client, err := a.GetMinioClient()
+	if err != nil {
+		return err
+	}
+	return client.RemoveCtx(ctx, bucket, path)
+}
+
+func (a *AgentApp) ensureErasureAuditTable(ctx context.Context) error {
+	if a.erasureAuditReady.Load() {
+		return nil
+	}
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return err
+	}
+	if _, err = client.ExecCtx(ctx, erasureAuditTableDDL); err != nil {
+		return fmt.Errorf("创建ai_erasure_audit表失败: %w", err)
+	}
+	a.erasureAuditReady.Store(true)
+	return nil
+}
+
+// transcript GET /{base}/transcript?conversation_id=xxx&format=json|markdown
+func (a *AgentApp) transcript(c *gin.Context) {
+	stc := c.Query("sys_track_code")
+	t, err := a.ExportTranscriptCtx(c.Request.Context(), c.Query("conversation_id"))
+	if err != nil {
+		xlog.LogErrorF(stc, "transcript", "export", fmt.Sprintf("导出会话[%s]失败", c.Query("conversation_id")), err)
+		RespJsonErr(c, err, stc, nil)
+		return
+	}
+	if c.Query("format") == TranscriptFormatMarkdown {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.md"`, t.ConversationID))
+		c.Data(200, "text/markdown; charset=utf-8", []byte(t.Markdown()))
+		return
+	}
+	RespJsonSuccess(c, stc, t)
+}
+
+// eraseUser POST /{base}/erase_user，请求体为 EraseUserRequest
+func (a *AgentApp) eraseUser(c *gin.Context) {
+	stc := c.Query("sys_track_code")
+	req := &EraseUserRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		RespJsonError(c, server.InvalidParam.Code, err.Error(), stc, nil)
+		return
+	}
+	r, err := a.EraseUserDataCtx(c.Request.Context(), req)
+	if err != nil {
+		xlog.LogErrorF(stc, "erasure", "user", fmt.Sprintf("删除企业[%s]用户[%s]的数据失败", req.EnterpriseID, req.UserID), err)
+		RespJsonErr(c, err, stc, nil)
+		return
+	}
+	RespJsonSuccess(c, stc, r)
+}
+
+// rawJSON 合法的 JSON 原样返回，否则返回 JSON 字符串，空字符串返回 nil
+func rawJSON(s string) json.RawMessage {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	if json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	b, _ := json.Marshal(s)
+	return b
+}
+
+func appendMissing(dst []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, d := range dst {
+			if d == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst = append(dst, v)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,495 @@
+package powerai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"orgine.com/ai-team/power-ai-framework-v4/middleware/server"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xdatetime"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xhttp"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xjson"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xllm"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xlog"
+	"sync"
+	"time"
+)
+
+// ***************************************************************************************************************
+//
+//	大模型 token 用量统计与企业配额
+//	每次调用系统llm模型后记录 prompt/completion tokens，按 日期+企业+智能体+模型 汇总，定时写入 ai_llm_usage_daily 表；
+//	每次调用的用量和 sys_track_code 同时写入 ai_llm_usage_log 表，用于按请求追溯，超过 WithUsageLogRetention（默认90天）的记录定时删除
+//	流式调用自动开启 stream_options.include_usage
+//	配额配置: /system/config/_internal_/企业ID/llm-token-quota
+//	value: {"daily_tokens":1000000,"monthly_tokens":30000000}  0 或不配置表示不限制
+//	超出配额时调用直接返回 ErrQuotaExceeded，错误码为 server.QuotaExceeded，RespJsonErr/WriteAgentResponseErr 响应时使用该错误码
+//
+// ***************************************************************************************************************
+
+// ErrQuotaExceeded 企业的模型调用量超出配额，server.ErrorCodeOf 返回 server.QuotaExceeded
+var ErrQuotaExceeded error = &server.CodeError{ErrorCode: server.QuotaExceeded}
+
+const (
+	usageFlushInterval  = 30 * time.Second // 用量写入数据库的间隔
+	usageReloadInterval = 30 * time.Second // 企业已用量从数据库重新加载的间隔，多实例部署时各实例的用量在此间隔内汇总
+	usageLogMaxPending  = 10000            // 写入失败时保留的调用记录上限，超过后丢弃最早的记录
+	usageLogCleanup     = time.Hour        // 清理过期调用记录的间隔
+	usageLogCleanupSize = 5000             // 每批删除的过期调用记录数
+)
+
+const usageTableDDL = `CREATE TABLE IF NOT EXISTS ai_llm_usage_daily (
+	stat_date         date         NOT NULL,
+	enterprise_id     varchar(64)  NOT NULL,
+	agent_code        varchar(128) NOT NULL,
+	model_name        varchar(128) NOT NULL,
+	request_count     bigint       NOT NULL DEFAULT 0,
+	prompt_tokens     bigint       NOT NULL DEFAULT 0,
+	completion_tokens bigint       NOT NULL DEFAULT 0,
+	total_tokens      bigint       NOT NULL DEFAULT 0,
+	create_time       timestamp,
+	update_time       timestamp,
+	PRIMARY KEY (stat_date, enterprise_id, agent_code, model_name)
+)`
+
+const usageLogTableDDL = `CREATE TABLE IF NOT EXISTS ai_llm_usage_log (
+	id                bigserial    PRIMARY KEY,
+	sys_track_code    varchar(128) NOT NULL DEFAULT '',
+	enterprise_id     varchar(64)  NOT NULL,
+	agent_code        varchar(128) NOT NULL,
+	model_name        varchar(128) NOT NULL,
+	prompt_tokens     bigint       NOT NULL DEFAULT 0,
+	completion_tokens bigint       NOT NULL DEFAULT 0,
+	total_tokens      bigint       NOT NULL DEFAULT 0,
+	create_time       timestamp
+)`
+
+var usageLogIndexDDL = []string{
+	`CREATE INDEX IF NOT EXISTS idx_ai_llm_usage_log_track_code ON ai_llm_usage_log (sys_track_code)`,
+	`CREATE INDEX IF NOT EXISTS idx_ai_llm_usage_log_create_time ON ai_llm_usage_log (create_time)`,
+}
+
+// TokenQuota 企业的 token 配额
+type TokenQuota struct {
+	DailyTokens   int64 `json:"daily_tokens"`
+	MonthlyTokens int64 `json:"monthly_tokens"`
+}
+
+// LLMUsageDaily 对应 ai_llm_usage_daily 表
+type LLMUsageDaily struct {
+	StatDate         time.Time `db:"stat_date" json:"stat_date"`
+	EnterpriseID     string    `db:"enterprise_id" json:"enterprise_id"`
+	AgentCode        string    `db:"agent_code" json:"agent_code"`
+	ModelName        string    `db:"model_name" json:"model_name"`
+	RequestCount     int64     `db:"request_count" json:"request_count"`
+	PromptTokens     int64     `db:"prompt_tokens" json:"prompt_tokens"`
+	CompletionTokens int64     `db:"completion_tokens" json:"completion_tokens"`
+	TotalTokens      int64     `db:"total_tokens" json:"total_tokens"`
+}
+
+type usageKey struct {
+	date         string
+	enterpriseId string
+	modelName    string
+}
+
+// usageLog 一次调用的用量，对应 ai_llm_usage_log 表
+type usageLog struct {
+	sysTrackCode string
+	enterpriseId string
+	modelName    string
+	prompt       int64
+	completion   int64
+	total        int64
+	createTime   string
+}
+
+type usageAgg struct {
+	requests   int64
+	prompt     int64
+	completion int64
+	total      int64
+}
+
+// usedTokens 企业已用量，数据库中的值加上本实例尚未写入的值
+type usedTokens struct {
+	date     string
+	day      int64
+	month    int64
+	loadedAt time.Time
+}
+
+type usageMeter struct {
+	mu            sync.Mutex
+	pending       map[usageKey]*usageAgg
+	logs          []*usageLog
+	used          map[string]*usedTokens
+	tableReady    bool
+	logTableReady bool
+	logRetention  time.Duration // <=0 时不清理调用记录
+	cleanedAt     time.Time
+	start         sync.Once
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+func newUsageMeter(logRetention time.Duration) *usageMeter {
+	return &usageMeter{
+		pending:      make(map[usageKey]*usageAgg),
+		used:         make(map[string]*usedTokens),
+		logRetention: logRetention,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// recordUsage 记录一次模型调用的用量
+func (a *AgentApp) recordUsage(ctx context.Context, enterpriseId, modelName string, u *xllm.Usage) {
+	if u == nil {
+		return
+	}
+	total := int64(u.TotalTokens)
+	if total == 0 {
+		total = int64(u.PromptTokens + u.CompletionTokens)
+	}
+	xlog.LogInfoF(server.SysTrackCode(ctx), "llm-usage", "record", fmt.Sprintf("企业[%s],智能体[%s],模型[%s],prompt_tokens:%d,completion_tokens:%d,total_tokens:%d",
+		enterpriseId, a.Manifest.Code, modelName, u.PromptTokens, u.CompletionTokens, total))
+
+	m := a.usage
+	m.start.Do(func() {
+		go a.flushUsageLoop()
+	})
+	date := time.Now().Format(time.DateOnly)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := usageKey{date: date, enterpriseId: enterpriseId, modelName: modelName}
+	agg, ok := m.pending[k]
+	if !ok {
+		agg = &usageAgg{}
+		m.pending[k] = agg
+	}
+	m.logs = append(m.logs, &usageLog{
+		sysTrackCode: server.SysTrackCode(ctx),
+		enterpriseId: enterpriseId,
+		modelName:    modelName,
+		prompt:       int64(u.PromptTokens),
+		completion:   int64(u.CompletionTokens),
+		total:        total,
+		createTime:   xdatetime.GetNowDateTime(),
+	})
+	agg.requests++
+	agg.prompt += int64(u.PromptTokens)
+	agg.completion += int64(u.CompletionTokens)
+	agg.total += total
+	if used, ok := m.used[enterpriseId]; ok && used.date == date {
+		used.day += total
+		used.month += total
+	}
+}
+
+// checkQuota 校验企业是否超出配额，未配置配额时直接通过
+// 查询已用量失败时不拦截调用
+func (a *AgentApp) checkQuota(ctx context.Context, enterpriseId string) error {
+	c := a.GetSystemConfig(LLMTokenQuotaKey, enterpriseId)
+	if c == nil || c.Value == "" {
+		return nil
+	}
+	quota := &TokenQuota{}
+	if err := json.Unmarshal([]byte(c.Value), quota); err != nil {
+		xlog.LogErrorF(server.SysTrackCode(ctx), "llm-usage", "quota", fmt.Sprintf("解析[%s]配置失败", LLMTokenQuotaKey), err)
+		return nil
+	}
+	if quota.DailyTokens <= 0 && quota.MonthlyTokens <= 0 {
+		return nil
+	}
+	used, err := a.enterpriseUsage(ctx, enterpriseId)
+	if err != nil {
+		xlog.LogErrorF(server.SysTrackCode(ctx), "llm-usage", "quota", fmt.Sprintf("查询企业[%s]模型用量失败", enterpriseId), err)
+		return nil
+	}
+	if quota.DailyTokens > 0 && used.day >= quota.DailyTokens {
+		return fmt.Errorf("%w: 企业[%s]今日已使用%d tokens,日配额%d", ErrQuotaExceeded, enterpriseId, used.day, quota.DailyTokens)
+	}
+	if quota.MonthlyTokens > 0 && used.month >= quota.MonthlyTokens {
+		return fmt.Errorf("%w: 企业[%s]本月已使用%d tokens,月配额%d", ErrQuotaExceeded, enterpriseId, used.month, quota.MonthlyTokens)
+	}
+	return nil
+}
+
+// enterpriseUsage 企业今日和本月的已用量，超过 usageReloadInterval 从数据库重新加载
+func (a *AgentApp) enterpriseUsage(ctx context.Context, enterpriseId string) (usedTokens, error) {
+	m := a.usage
+	now := time.Now()
+	date := now.Format(time.DateOnly)
+	m.mu.Lock()
+	used, ok := m.used[enterpriseId]
+	if ok && used.date == date && now.Sub(used.loadedAt) < usageReloadInterval {
+		u := *used
+		m.mu.Unlock()
+		return u, nil
+	}
+	m.mu.Unlock()
+
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return usedTokens{}, err
+	}
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).Format(time.DateOnly)
+	var r struct {
+		Day   int64 `db:"day"`
+		Month int64 `db:"month"`
+	}
+	err = client.QuerySingleCtx(ctx, &r, `select coalesce(sum(case when stat_date = $1 then total_tokens end),0) as day,coalesce(sum(total_tokens),0) as month
+		from ai_llm_usage_daily where enterprise_id = $2 and stat_date >= $3`, date, enterpriseId, monthStart)
+	if err != nil {
+		return usedTokens{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	used = &usedTokens{date: date, day: r.Day, month: r.Month, loadedAt: now}
+	// 加上本实例尚未写入数据库的用量
+	for k, agg := range m.pending {
+		if k.enterpriseId != enterpriseId || k.date < monthStart {
+			continue
+		}
+		if k.date == date {
+			used.day += agg.total
+		}
+		used.month += agg.total
+	}
+	m.used[enterpriseId] = used
+	return *used, nil
+}
+
+// flushUsageLoop 定时将用量写入数据库，停机时写入剩余用量
+func (a *AgentApp) flushUsageLoop() {
+	m := a.usage
+	defer close(m.done)
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flushUsage(context.Background())
+			a.cleanupUsageLogs(context.Background())
+		case <-m.stop:
+			a.flushUsage(context.Background())
+			return
+		}
+	}
+}
+
+// stopUsage 停止定时写入并写入剩余用量，未记录过用量时直接返回
+func (a *AgentApp) stopUsage(ctx context.Context) {
+	m := a.usage
+	started := true
+	m.start.Do(func() {
+		started = false
+	})
+	if !started {
+		return
+	}
+	close(m.stop)
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		xlog.LogErrorF("10000", "llm-usage", "flush", "停机时写入模型用量超时", ctx.Err())
+	}
+}
+
+// flushUsage 将汇总的用量写入数据库，失败的记录合并回去等待下次写入
+func (a *AgentApp) flushUsage(ctx context.Context) {
+	m := a.usage
+	m.mu.Lock()
+	pending, logs := m.pending, m.logs
+	m.pending, m.logs = make(map[usageKey]*usageAgg), nil
+	m.mu.Unlock()
+	if len(pending) == 0 && len(logs) == 0 {
+		return
+	}
+
+	logs, err := a.writeUsageLogs(ctx, logs)
+	if err != nil {
+		xlog.LogErrorF("10000", "llm-usage", "flush", fmt.Sprintf("写入模型调用记录失败,共%d条,等待下次写入", len(logs)), err)
+		m.mu.Lock()
+		m.logs = append(logs, m.logs...)
+		if n := len(m.logs) - usageLogMaxPending; n > 0 {
+			xlog.LogErrorF("10000", "llm-usage", "flush", fmt.Sprintf("待写入的模型调用记录超过%d条,丢弃最早的%d条", usageLogMaxPending, n), err)
+			m.logs = m.logs[n:]
+		}
+		m.mu.Unlock()
+	}
+
+	if len(pending) == 0 {
+		return
+	}
+	err = a.writeUsage(ctx, pending)
+	if err == nil {
+		return
+	}
+	xlog.LogErrorF("10000", "llm-usage", "flush", fmt.Sprintf("写入模型用量失败,共%d条,等待下次写入", len(pending)), err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, agg := range pending {
+		if cur, ok := m.pending[k]; ok {
+			cur.requests += agg.requests
+			cur.prompt += agg.prompt
+			cur.completion += agg.completion
+			cur.total += agg.total
+		} else {
+			m.pending[k] = agg
+		}
+	}
+}
+
+func (a *AgentApp) writeUsage(ctx context.Context, pending map[usageKey]*usageAgg) error {
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return err
+	}
+	if !a.usage.tableReady {
+		if _, err = client.ExecCtx(ctx, usageTableDDL); err != nil {
+			return fmt.Errorf("创建ai_llm_usage_daily表失败: %w", err)
+		}
+		a.usage.tableReady = true
+	}
+	now := xdatetime.GetNowDateTime()
+	for k, agg := range pending {
+		_, err = client.ExecCtx(ctx, `INSERT INTO ai_llm_usage_daily (stat_date,enterprise_id,agent_code,model_name,request_count,prompt_tokens,completion_tokens,total_tokens,create_time,update_time)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$9)
+			ON CONFLICT (stat_date,enterprise_id,agent_code,model_name) DO UPDATE SET
+			request_count = ai_llm_usage_daily.request_count + EXCLUDED.request_count,
+			prompt_tokens = ai_llm_usage_daily.prompt_tokens + EXCLUDED.prompt_tokens,
+			completion_tokens = ai_llm_usage_daily.completion_tokens + EXCLUDED.completion_tokens,
+			total_tokens = ai_llm_usage_daily.total_tokens + EXCLUDED.total_tokens,
+			update_time = EXCLUDED.update_time`,
+			k.date, k.enterpriseId, a.Manifest.Code, k.modelName, agg.requests, agg.prompt, agg.completion, agg.total, now)
+		if err != nil {
+			return err
+		}
+		delete(pending, k)
+	}
+	return nil
+}
+
+// writeUsageLogs 写入每次调用的用量，返回未写入的记录
+func (a *AgentApp) writeUsageLogs(ctx context.Context, logs []*usageLog) ([]*usageLog, error) {
+	if len(logs) == 0 {
+		return nil, nil
+	}
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return logs, err
+	}
+	if !a.usage.logTableReady {
+		for _, ddl := range append([]string{usageLogTableDDL}, usageLogIndexDDL...) {
+			if _, err = client.ExecCtx(ctx, ddl); err != nil {
+				return logs, fmt.Errorf("创建ai_llm_usage_log表失败: %w", err)
+			}
+		}
+		a.usage.logTableReady = true
+	}
+	for i, l := range logs {
+		_, err = client.ExecCtx(ctx, `INSERT INTO ai_llm_usage_log (sys_track_code,enterprise_id,agent_code,model_name,prompt_tokens,completion_tokens,total_tokens,create_time)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8)`,
+			l.sysTrackCode, l.enterpriseId, a.Manifest.Code, l.modelName, l.prompt, l.completion, l.total, l.createTime)
+		if err != nil {
+			return logs[i:], err
+		}
+	}
+	return nil, nil
+}
+
+// cleanupUsageLogs 每隔 usageLogCleanup 分批删除超过保留时间的调用记录，多实例同时清理不影响结果
+func (a *AgentApp) cleanupUsageLogs(ctx context.Context) {
+	m := a.usage
+	if m.logRetention <= 0 || !m.logTableReady || time.Since(m.cleanedAt) < usageLogCleanup {
+		return
+	}
+	m.cleanedAt = time.Now()
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return
+	}
+	before := time.Now().Add(-m.logRetention)
+	var deleted int64
+	for {
+		r, err := client.ExecCtx(ctx, `DELETE FROM ai_llm_usage_log WHERE id IN
+			(SELECT id FROM ai_llm_usage_log WHERE create_time < $1 LIMIT $2)`, before, usageLogCleanupSize)
+		if err != nil {
+			xlog.LogErrorF("10000", "llm-usage", "cleanup", "清理过期的模型调用记录失败", err)
+			return
+		}
+		n, _ := r.RowsAffected()
+		deleted += n
+		if n < usageLogCleanupSize {
+			break
+		}
+	}
+	if deleted > 0 {
+		xlog.LogInfoF("10000", "llm-usage", "cleanup", fmt.Sprintf("清理%s之前的模型调用记录%d条", before.Format(time.DateTime), deleted))
+	}
+}
+
+// QueryLLMUsage 查询企业的模型用量，startDate/endDate 格式 2006-01-02，包含边界
+func (a *AgentApp) QueryLLMUsage(enterpriseId, startDate, endDate string) ([]*LLMUsageDaily, error) {
+	if enterpriseId == "" {
+		return nil, fmt.Errorf("enterpriseId不能为空")
+	}
+	client, err := a.GetPgSqlClient()
+	if err != nil {
+		return nil, err
+	}
+	sql := `select stat_date,enterprise_id,agent_code,model_name,request_count,prompt_tokens,completion_tokens,total_tokens
+		from ai_llm_usage_daily where enterprise_id = $1 and stat_date >= $2 and stat_date <= $3 order by stat_date,agent_code,model_name`
+	var r []*LLMUsageDaily
+	if err := client.QueryMultiple(&r, sql, enterpriseId, startDate, endDate); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// withStreamUsage 流式请求开启 stream_options.include_usage，返回请求的副本，不修改调用方的请求
+// 调用方未自行开启时返回 true，此时只包含用量的分片不会传给调用方
+func withStreamUsage(request map[string]interface{}) (map[string]interface{}, bool) {
+	if _, ok := request["stream_options"]; ok {
+		return request, false
+	}
+	r := make(map[string]interface{}, len(request)+1)
+	for k, v := range request {
+		r[k] = v
+	}
+	r["stream_options"] = map[string]interface{}{"include_usage": true}
+	return r, true
+}
+
+// usageStreamHandler 从流式响应中读取用量并记录
+func (a *AgentApp) usageStreamHandler(ctx context.Context, enterpriseId, modelName string, swallow bool, handler xhttp.HttpRequestResponseFunc) xhttp.HttpRequestResponseFunc {
+	return func(line []byte, err error) bool {
+		if err != nil || !bytes.Contains(line, []byte(`"usage"`)) {
+			return handler(line, err)
+		}
+		data := bytes.TrimSpace(line)
+		data = bytes.TrimSpace(bytes.TrimPrefix(data, []byte("data:")))
+		if u := usageFromJSON(xjson.GetBytes(data, "usage").Raw); u != nil {
+			a.recordUsage(ctx, enterpriseId, modelName, u)
+			if swallow && !xjson.GetBytes(data, "choices.0").Exists() {
+				return true
+			}
+		}
+		return handler(line, err)
+	}
+}
+
+// usageFromJSON 解析响应中的 usage，没有用量时返回 nil
+func usageFromJSON(raw string) *xllm.Usage {
+	if raw == "" || raw == "null" {
+		return nil
+	}
+	u := &xllm.Usage{}
+	if err := json.Unmarshal([]byte(raw), u); err != nil || (u.TotalTokens == 0 && u.PromptTokens == 0 && u.CompletionTokens == 0) {
+		return nil
+	}
+	return u
+}
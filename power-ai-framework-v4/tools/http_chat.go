@@ -0,0 +1,75 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xhttp"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xllm"
+)
+
+// ChatCompletionCtx 同步非流式对话，ctx结束时取消请求
+// req 不会被修改，未指定 model 时使用 modelName；policy 为空时使用 xllm.DefaultReasoningPolicy
+func ChatCompletionCtx(ctx context.Context, url, key, modelName string, policy *xllm.ReasoningPolicy, req *xllm.ChatRequest) (*xllm.ChatResponse, error) {
+	raw, err := chatCompletion(ctx, url, key, modelName, reasoningPolicy(policy), req)
+	if err != nil {
+		return nil, err
+	}
+	resp := &xllm.ChatResponse{}
+	if err = json.Unmarshal([]byte(raw), resp); err != nil {
+		return nil, fmt.Errorf("解析大模型响应失败: %w, resp: %s", err, raw)
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("大模型响应中没有结果, resp: %s", raw)
+	}
+	resp.Raw = raw
+	return resp, nil
+}
+
+// ChatCompletionStreamCtx 流式对话，返回分片迭代器，ctx结束时中断上游流
+// 调用方必须调用 ChatStream.Close 释放连接
+func ChatCompletionStreamCtx(ctx context.Context, url, key, modelName string, policy *xllm.ReasoningPolicy, req *xllm.ChatRequest) (*xllm.ChatStream, error) {
+	policy = reasoningPolicy(policy)
+	r := prepareChatRequest(req, modelName, policy)
+	r.Stream = true
+
+	resp, err := StreamCommonHttpClient.SendRequestCtx(ctx, chatHttpRequest(url, key, r))
+	if err != nil {
+		return nil, err
+	}
+	if err = xhttp.CheckStatus(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return xllm.NewChatStream(resp.Body, policy.NewStreamFilter().Filter), nil
+}
+
+// chatCompletion 发送非流式对话请求，返回按思考策略处理后的原始响应
+func chatCompletion(ctx context.Context, url, key, modelName string, policy *xllm.ReasoningPolicy, req *xllm.ChatRequest) (string, error) {
+	r := prepareChatRequest(req, modelName, policy)
+	r.Stream = false
+	return syncRequest(ctx, policy, chatHttpRequest(url, key, r))
+}
+
+// prepareChatRequest 复制请求，填充模型名称，按思考策略修改请求
+func prepareChatRequest(req *xllm.ChatRequest, modelName string, policy *xllm.ReasoningPolicy) *xllm.ChatRequest {
+	r := req.Clone()
+	if r.Model == "" {
+		r.Model = modelName
+	}
+	policy.ApplyRequest(r)
+	return r
+}
+
+func chatHttpRequest(url, key string, r *xllm.ChatRequest) *xhttp.HttpRequest {
+	body, _ := json.Marshal(r)
+	return &xhttp.HttpRequest{
+		RawURL: url,
+		Method: "POST",
+		Body:   body,
+		Headers: map[string][]string{
+			"Content-Type":  {"application/json"},
+			"Authorization": {fmt.Sprintf("Bearer %s", key)},
+		},
+	}
+}
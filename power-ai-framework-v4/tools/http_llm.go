@@ -2,57 +2,71 @@ package tools
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xhttp"
 	"orgine.com/ai-team/power-ai-framework-v4/pkg/xjson"
-	"regexp"
+	"orgine.com/ai-team/power-ai-framework-v4/pkg/xllm"
 	"strings"
-	"sync/atomic"
 )
 
 // AsyncStreamCallSystemLLM 异步流式请求大语言模型
 func AsyncStreamCallSystemLLM(url, key, modelName string, request map[string]interface{}, handler xhttp.HttpRequestResponseFunc) {
+	AsyncStreamCallSystemLLMCtx(context.Background(), url, key, modelName, nil, request, handler)
+}
+
+// AsyncStreamCallSystemLLMCtx 异步流式请求大语言模型，ctx结束时中断上游流
+// policy 为模型的思考策略，为空时使用 xllm.DefaultReasoningPolicy
+func AsyncStreamCallSystemLLMCtx(ctx context.Context, url, key, modelName string, policy *xllm.ReasoningPolicy, request map[string]interface{}, handler xhttp.HttpRequestResponseFunc) {
+	policy = reasoningPolicy(policy)
 	request["model"] = modelName
 	request["stream"] = true
-	r := noThinkLLMReq(url, key, request)
-	asyncStream(r, handler)
+	r := reasoningLLMReq(url, key, policy, request)
+	asyncStream(ctx, r, reasoningStreamHandler(policy, handler))
 }
 
 // SyncStreamCallSystemLLM 同步流式请求大语言模型
 func SyncStreamCallSystemLLM(url, key, modelName string, request map[string]interface{}, handler xhttp.HttpRequestResponseFunc) {
+	SyncStreamCallSystemLLMCtx(context.Background(), url, key, modelName, nil, request, handler)
+}
+
+// SyncStreamCallSystemLLMCtx 同步流式请求大语言模型，ctx结束时中断上游流
+// policy 为模型的思考策略，为空时使用 xllm.DefaultReasoningPolicy
+func SyncStreamCallSystemLLMCtx(ctx context.Context, url, key, modelName string, policy *xllm.ReasoningPolicy, request map[string]interface{}, handler xhttp.HttpRequestResponseFunc) {
+	policy = reasoningPolicy(policy)
 	request["model"] = modelName
 	request["stream"] = true
-	r := noThinkLLMReq(url, key, request)
-	syncStream(r, handler)
+	r := reasoningLLMReq(url, key, policy, request)
+	syncStream(ctx, r, reasoningStreamHandler(policy, handler))
 }
 
-// SyncCallSystemLLM 同步非流式请求大语言模型
+// SyncCallSystemLLM 同步非流式请求大语言模型，状态码>=400时返回上游的错误响应体，不返回错误
 func SyncCallSystemLLM(url, key, modelName string, request map[string]interface{}) (string, error) {
+	return xhttp.StatusBody(SyncCallSystemLLMCtx(context.Background(), url, key, modelName, nil, request))
+}
+
+// SyncCallSystemLLMCtx 同步非流式请求大语言模型，ctx结束时取消请求，状态码>=400时返回 *xhttp.StatusError
+// 兼容 map 形式的请求，内部转换为 xllm.ChatRequest，返回原始响应
+// 新代码建议使用 ChatCompletionCtx
+func SyncCallSystemLLMCtx(ctx context.Context, url, key, modelName string, policy *xllm.ReasoningPolicy, request map[string]interface{}) (string, error) {
+	policy = reasoningPolicy(policy)
 	request["model"] = modelName
-	request["stream"] = false
-	request["enable_thinking"] = false
-	r := noThinkLLMReq(url, key, request)
-	return syncRequest(r)
+	req, err := xllm.ChatRequestFromMap(request)
+	if err != nil {
+		// 无法转换的请求（如多模态消息的content为数组）按原样发送
+		request["stream"] = false
+		return syncRequest(ctx, policy, reasoningLLMReq(url, key, policy, request))
+	}
+	return chatCompletion(ctx, url, key, modelName, policy, req)
 }
 
 // AsyncRequestCallSystemTextEmbedding 异步请求TextEmbedding模型
 func AsyncRequestCallSystemTextEmbedding(url, key, modelName string, request map[string]interface{}, handler xhttp.HttpRequestResponseFunc) {
 	go func() {
-		request["model"] = modelName
-		body, _ := json.Marshal(request)
-		r := &xhttp.HttpRequest{
-			RawURL: url,
-			Method: "POST",
-			Body:   body,
-			Headers: map[string][]string{
-				"Content-Type":  {"application/json"},
-				"Authorization": {fmt.Sprintf("Bearer %s", key)},
-			},
-		}
-		rtn, err := syncRequest(r)
+		rtn, err := SyncRequestCallSystemTextEmbedding(url, key, modelName, request)
 		if err != nil {
 			handler(nil, err)
 		} else {
@@ -61,27 +75,32 @@ func AsyncRequestCallSystemTextEmbedding(url, key, modelName string, request map
 	}()
 }
 
-// SyncRequestCallSystemTextEmbedding 同步请求TextEmbedding模型
+// SyncRequestCallSystemTextEmbedding 同步请求TextEmbedding模型，状态码>=400时返回上游的错误响应体，不返回错误
 func SyncRequestCallSystemTextEmbedding(url, key, modelName string, request map[string]interface{}) (string, error) {
+	return xhttp.StatusBody(SyncRequestCallSystemTextEmbeddingCtx(context.Background(), url, key, modelName, request))
+}
+
+// SyncRequestCallSystemTextEmbeddingCtx 同步请求TextEmbedding模型，ctx结束时取消请求，状态码>=400时返回 *xhttp.StatusError
+func SyncRequestCallSystemTextEmbeddingCtx(ctx context.Context, url, key, modelName string, request map[string]interface{}) (string, error) {
 	request["model"] = modelName
-	body, _ := json.Marshal(request)
-	r := &xhttp.HttpRequest{
-		RawURL: url,
-		Method: "POST",
-		Body:   body,
-		Headers: map[string][]string{
-			"Content-Type":  {"application/json"},
-			"Authorization": {fmt.Sprintf("Bearer %s", key)},
-		},
-	}
-	return syncRequest(r)
+	return sendModelRequest(ctx, modelReq(url, key, request))
 }
 
-// SyncRequestCallSystemRerank 同步请求Rerank模型
+// SyncRequestCallSystemRerank 同步请求Rerank模型，状态码>=400时返回上游的错误响应体，不返回错误
 func SyncRequestCallSystemRerank(url, key, modelName string, request map[string]interface{}) (string, error) {
+	return xhttp.StatusBody(SyncRequestCallSystemRerankCtx(context.Background(), url, key, modelName, request))
+}
+
+// SyncRequestCallSystemRerankCtx 同步请求Rerank模型，ctx结束时取消请求，状态码>=400时返回 *xhttp.StatusError
+func SyncRequestCallSystemRerankCtx(ctx context.Context, url, key, modelName string, request map[string]interface{}) (string, error) {
 	request["model"] = modelName
+	return sendModelRequest(ctx, modelReq(url, key, request))
+}
+
+// modelReq 组装模型请求
+func modelReq(url, key string, request map[string]interface{}) *xhttp.HttpRequest {
 	body, _ := json.Marshal(request)
-	r := &xhttp.HttpRequest{
+	return &xhttp.HttpRequest{
 		RawURL: url,
 		Method: "POST",
 		Body:   body,
@@ -90,13 +109,12 @@ func SyncRequestCallSystemRerank(url, key, modelName string, request map[string]
 			"Authorization": {fmt.Sprintf("Bearer %s", key)},
 		},
 	}
-	return syncRequest(r)
 }
 
 // EmbedTexts 调用 bge-m3 接口将 texts 向量化
 func EmbedTexts(url, key, modelName string, texts []string) ([][]float32, error) {
 	req := map[string]interface{}{"input": texts}
-	raw, err := SyncRequestCallSystemTextEmbedding(url, key, modelName, req)
+	raw, err := SyncRequestCallSystemTextEmbeddingCtx(context.Background(), url, key, modelName, req)
 	if err != nil {
 		return nil, fmt.Errorf("embedding 调用失败: %v", err)
 	}
@@ -119,7 +137,7 @@ func EmbedTexts(url, key, modelName string, texts []string) ([][]float32, error)
 // RerankResults 调用 bge-reranker-v2-m3 接口，对 docs 做重排序
 func RerankResults(url, key, modelName string, query string, docs []string) ([]float64, error) {
 	req := map[string]interface{}{"query": query, "documents": docs}
-	raw, err := SyncRequestCallSystemRerank(url, key, modelName, req)
+	raw, err := SyncRequestCallSystemRerankCtx(context.Background(), url, key, modelName, req)
 	if err != nil {
 		return nil, fmt.Errorf("重排序调用失败: %w", err)
 	}
@@ -139,104 +157,143 @@ func RerankResults(url, key, modelName string, query string, docs []string) ([]f
 	return scores, nil
 }
 
-func noThinkLLMReq(url, key string, request map[string]interface{}) *xhttp.HttpRequest {
-	if request["messages"] != nil {
-		messages := request["messages"].([]interface{})
+// reasoningPolicy 未配置思考策略时使用默认策略
+func reasoningPolicy(policy *xllm.ReasoningPolicy) *xllm.ReasoningPolicy {
+	if policy == nil {
+		return xllm.DefaultReasoningPolicy()
+	}
+	return policy
+}
+
+// reasoningLLMReq 按思考策略组装请求：用户消息追加后缀、设置 enable_thinking
+func reasoningLLMReq(url, key string, policy *xllm.ReasoningPolicy, request map[string]interface{}) *xhttp.HttpRequest {
+	if request["messages"] != nil && policy.NoThinkSuffix != "" {
+		messages, _ := request["messages"].([]interface{})
 		for i := range messages {
 
 			switch msg := messages[i].(type) {
 			case map[string]interface{}:
 				if msg["role"] == "user" {
-					if content, ok := msg["content"].(string); ok {
-						msg["content"] = content + "/no_think"
+					if content, ok := msg["content"].(string); ok && !strings.HasSuffix(content, policy.NoThinkSuffix) {
+						msg["content"] = content + policy.NoThinkSuffix
 					}
 				}
 			case map[string]string:
-				if msg["role"] == "user" {
-					msg["content"] = msg["content"] + "/no_think"
+				if msg["role"] == "user" && !strings.HasSuffix(msg["content"], policy.NoThinkSuffix) {
+					msg["content"] = msg["content"] + policy.NoThinkSuffix
 				}
 			}
 		}
 	}
-	body, _ := json.Marshal(request)
-	r := &xhttp.HttpRequest{
-		RawURL: url,
-		Method: "POST",
-		Body:   body,
-		Headers: map[string][]string{
-			"Content-Type":  {"application/json"},
-			"Authorization": {fmt.Sprintf("Bearer %s", key)},
-		},
+	if policy.EnableThinking != nil {
+		request["enable_thinking"] = *policy.EnableThinking
 	}
-	return r
+	return modelReq(url, key, request)
 }
 
-// asyncStream 异步流式请求
-func asyncStream(request *xhttp.HttpRequest, handler xhttp.HttpRequestResponseFunc) {
-	var index atomic.Int64
-	StreamCommonHttpClient.SendReqByAsyncRespStream(request, func(bytes []byte, err error) bool {
-		index.Add(1)
-		// 如果错误，之直接返回
-		if err != nil {
-			return handler(bytes, err)
+// reasoningStreamHandler 按思考策略处理流式响应的每一行
+// 思考标签可能被拆分在多个分片中，由 xllm.StreamFilter 状态机识别；只包含被处理掉的思考内容的分片直接跳过，只有 role 等没有文本的分片原样输出
+func reasoningStreamHandler(policy *xllm.ReasoningPolicy, handler xhttp.HttpRequestResponseFunc) xhttp.HttpRequestResponseFunc {
+	if policy.Mode == xllm.ReasoningKeep {
+		return handler
+	}
+	filter := policy.NewStreamFilter()
+	return func(line []byte, err error) bool {
+		// 如果错误或bytes为空，则直接返回
+		if err != nil || line == nil {
+			return handler(line, err)
 		}
-		// 如果bytes为空，则直接返回
-		if bytes == nil {
-			return handler(bytes, err)
+		data := strings.TrimSpace(string(line))
+		if !strings.HasPrefix(data, "data:") {
+			return handler(line, nil)
 		}
-		if index.Load() <= 4 {
-			content := xjson.Get(string(bytes), "choices.0.delta.content")
-			if content.String() == "<think>" || content.String() == "\n\n" || content.String() == "</think>" {
-				//直接跳过
-				return true
-			} else {
-				return handler(bytes, nil)
-			}
+		data = strings.TrimSpace(strings.TrimPrefix(data, "data:"))
+		chunk := &xllm.ChatChunk{}
+		if data == "[DONE]" || json.Unmarshal([]byte(data), chunk) != nil || len(chunk.Choices) == 0 {
+			return handler(line, nil)
 		}
-		return handler(bytes, nil)
-	})
-}
-
-// syncStream 同步流式请求
-func syncStream(request *xhttp.HttpRequest, handler xhttp.HttpRequestResponseFunc) {
-	var index atomic.Int64
-	StreamCommonHttpClient.SendReqBySyncRespStream(request, func(bytes []byte, err error) bool {
-		index.Add(1)
-		// 如果错误，之直接返回
+		if !filter.Filter(chunk) {
+			return true
+		}
+		delta := chunk.Delta()
+		newData, err := xjson.Set(data, "choices.0.delta.content", delta.Content)
 		if err != nil {
-			return handler(bytes, err)
+			return handler(line, nil)
 		}
-		// 如果bytes为空，则直接返回
-		if bytes == nil {
-			return handler(bytes, err)
+		if delta.ReasoningContent != "" {
+			newData, err = xjson.Set(newData, "choices.0.delta.reasoning_content", delta.ReasoningContent)
+		} else {
+			newData, err = xjson.Delete(newData, "choices.0.delta.reasoning_content")
 		}
-		if index.Load() <= 4 {
-			content := xjson.Get(string(bytes), "choices.0.delta.content")
-			if content.String() == "<think>" || content.String() == "\n\n" || content.String() == "</think>" {
-				return true
-			} else {
-				return handler(bytes, nil)
-			}
+		if err != nil {
+			return handler(line, nil)
 		}
+		return handler([]byte("data: "+newData), nil)
+	}
+}
+
+// asyncStream 异步流式请求
+func asyncStream(ctx context.Context, request *xhttp.HttpRequest, handler xhttp.HttpRequestResponseFunc) {
+	go syncStream(ctx, request, handler)
+}
+
+// syncStream 同步流式请求，状态码>=400时handler收到 *xhttp.StatusError
+func syncStream(ctx context.Context, request *xhttp.HttpRequest, handler xhttp.HttpRequestResponseFunc) {
+	resp, err := StreamCommonHttpClient.SendRequestCtx(ctx, request)
+	if err != nil {
+		handler(nil, err)
+		return
+	}
+	if err = xhttp.CheckStatus(resp); err != nil {
+		resp.Body.Close()
+		handler(nil, err)
+		return
+	}
+	xhttp.ReadStream(ctx, resp, handler)
+}
 
-		return handler(bytes, err)
-	})
+// sendModelRequest 发送请求并读取完整响应，状态码>=400时返回 *xhttp.StatusError
+func sendModelRequest(ctx context.Context, r *xhttp.HttpRequest) (string, error) {
+	resp, err := StreamCommonHttpClient.SendRequestCtx(ctx, r)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err = xhttp.CheckStatus(resp); err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
 }
 
-// syncRequest 同步请求
-func syncRequest(r *xhttp.HttpRequest) (string, error) {
+// syncRequest 同步请求，按思考策略处理响应中的消息
+func syncRequest(ctx context.Context, policy *xllm.ReasoningPolicy, r *xhttp.HttpRequest) (string, error) {
 
-	resp, err := StreamCommonHttpClient.SendReqByRespString(r)
+	resp, err := sendModelRequest(ctx, r)
 	// 如果错误，则直接返回
 	if err != nil {
 		return "", err
 	}
+	if policy.Mode == xllm.ReasoningKeep {
+		return resp, nil
+	}
 
-	content := xjson.Get(resp, "choices.0.message.content")
-	contentStr := strings.TrimSpace(content.String())
-	newContent := regexp.MustCompile(`(?s)<think>.*?</think>\s*`).ReplaceAllString(contentStr, "")
-	newContent = regexp.MustCompile("<think>\n").ReplaceAllString(newContent, "")
-	newResp, err := xjson.Set(resp, "choices.0.message.content", newContent)
+	msg := &xllm.Message{
+		Content:          xjson.Get(resp, "choices.0.message.content").String(),
+		ReasoningContent: xjson.Get(resp, "choices.0.message.reasoning_content").String(),
+	}
+	policy.ApplyMessage(msg)
+	newResp, err := xjson.Set(resp, "choices.0.message.content", msg.Content)
+	if err == nil {
+		if msg.ReasoningContent != "" {
+			newResp, err = xjson.Set(newResp, "choices.0.message.reasoning_content", msg.ReasoningContent)
+		} else {
+			newResp, err = xjson.Delete(newResp, "choices.0.message.reasoning_content")
+		}
+	}
 	// 如果重置失败，则返回原始内容
 	if err != nil {
 		return resp, nil
@@ -245,12 +302,18 @@ func syncRequest(r *xhttp.HttpRequest) (string, error) {
 		return newResp, nil
 	}
 }
+// SyncCallSystemASRFromReader 语音识别，状态码>=400时返回上游的错误响应体，不返回错误
 func SyncCallSystemASRFromReader(url, key, modelName, filename string, fileReader io.Reader) (string, error) {
+	return xhttp.StatusBody(SyncCallSystemASRFromReaderCtx(context.Background(), url, key, modelName, filename, fileReader))
+}
+
+// SyncCallSystemASRFromReaderCtx 语音识别，ctx结束时取消请求，状态码>=400时返回 *xhttp.StatusError
+func SyncCallSystemASRFromReaderCtx(ctx context.Context, url, key, modelName, filename string, fileReader io.Reader) (string, error) {
 	r, err := buildASRReqFromReader(url, key, modelName, filename, fileReader)
 	if err != nil {
 		return "", err
 	}
-	return StreamCommonHttpClient.SendReqByRespString(r)
+	return sendModelRequest(ctx, r)
 }
 
 func buildASRReqFromReader(url, key, modelName, filename string, fileReader io.Reader) (*xhttp.HttpRequest, error) {